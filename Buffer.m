@@ -1,3 +1,5 @@
+//go:build darwin
+
 #import "BufferCache.h"
 #import "Error.h"
 #import "Metal.h"
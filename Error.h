@@ -10,6 +10,13 @@ enum MetalErrorCode {
   MetalErrorNone = 0,
   MetalErrorInvalidFunctionId = 1,
   MetalErrorInvalidBufferId = 2,
+  MetalErrorInvalidLibraryId = 3,
+  MetalErrorCompile = 4,
+  // The command buffer errors are classified on the Go side from the
+  // MTLCommandBufferError code, which the run functions report as is.
+  MetalErrorGPUTimeout = 5,
+  MetalErrorGPUPageFault = 6,
+  MetalErrorGPUOutOfMemory = 7,
 };
 
 // logError writes a heap-allocated copy of message to *target (for display).
@@ -1,3 +1,5 @@
+//go:build darwin
+
 #import "Error.h"
 #include <string.h>
 
@@ -1,3 +1,5 @@
+//go:build darwin
+
 // The process in this file largely follows the structure detailed in
 // https://developer.apple.com/documentation/metal/performing_calculations_on_a_gpu.
 
@@ -6,6 +8,7 @@
 #import "FunctionCache.h"
 #import "Metal.h"
 #import "MetalInternal.h"
+#include "_cgo_export.h"
 #include <limits.h>
 #include <string.h>
 #import <Metal/Metal.h>
@@ -17,6 +20,7 @@
 @interface MetalFunction : NSObject
 @property (nonatomic, strong) id<MTLFunction> mtlFunction;
 @property (nonatomic, strong) id<MTLComputePipelineState> pipeline;
+@property (nonatomic, strong) MTLComputePipelineReflection *reflection;
 @end
 
 @implementation MetalFunction
@@ -33,6 +37,11 @@ static id<MTLCommandQueue> commandQueue = nil;
 // dispatchThreadgroups:threadsPerThreadgroup: path. Determined once at init.
 static _Bool supportsNonUniformThreadgroups = false;
 
+// The alignment, in bytes, that the device requires for the offset of a buffer
+// bound to a constant argument: 4 on Apple GPUs, including Apple silicon Macs,
+// and 256 on the Mac2 family. Determined once at init.
+static int constantBufferOffsetAlignment = 256;
+
 // Initialize the function cache and shared command queue. This should be called
 // only once. Returns false if the command queue could not be created.
 _Bool function_cache_init(void) {
@@ -46,18 +55,27 @@ _Bool function_cache_init(void) {
   supportsNonUniformThreadgroups =
       [device supportsFamily:MTLGPUFamilyApple4] ||
       [device supportsFamily:MTLGPUFamilyMac2];
+  constantBufferOffsetAlignment =
+      [device supportsFamily:MTLGPUFamilyApple1] ? 4 : 256;
 
   commandQueue = [device newCommandQueue];
   return commandQueue != nil;
 }
 
 // Set up a new pipeline for executing the specified function in the provided
-// MTL code on the default GPU. This returns an Id that must be used to run the
-// function. This should be called only once for every function. If any error is
-// encountered initializing the metal function, this returns 0 and sets an error
-// message in error.
+// MTL code on the default GPU, compiled with options (NULL for the defaults).
+// This returns an Id that must be used to run the function. This should be
+// called only once for every function. If the compiler reports anything, even
+// just warnings, its output is copied into log. If any error is encountered
+// initializing the metal function, this returns 0 and sets an error message in
+// error, and if the code does not compile it sets errorCode to
+// MetalErrorCompile. archiveIn and archiveOut are the paths of binary archives
+// to load the pipeline from and to store it in, as function_cache_new
+// describes.
 int function_new(const char *metalCode, const char *funcName,
-                 const char **error) {
+                 const CompileOptions *options, const char *archiveIn,
+                 const char *archiveOut, int *archiveStatus, const char **log,
+                 const char **error, int *errorCode) {
   // Wrap the body so the autoreleased ObjC temporaries created here (NSStrings,
   // the MTLLibrary, boxed NSNumber keys, etc.) are released when this returns.
   // A Go goroutine calling in through cgo has no ambient autorelease pool to
@@ -72,14 +90,6 @@ int function_new(const char *metalCode, const char *funcName,
       return 0;
     }
 
-    // Set up a new function object to hold the various resources for the
-    // pipeline.
-    MetalFunction *function = [[MetalFunction alloc] init];
-    if (function == nil) {
-      logError(error, @"failed to initialize function");
-      return 0;
-    }
-
     // Create a new library of metal code, which will be used to get a
     // reference to the function we want to run on the GPU. Normally, we
     // would use newDefaultLibrary here to automatically create a library from
@@ -89,37 +99,305 @@ int function_new(const char *metalCode, const char *funcName,
     NSError *libraryError = nil;
     id<MTLLibrary> library =
         [metal_device() newLibraryWithSource:[NSString stringWithUTF8String:metalCode]
-                                     options:nil
+                                     options:compile_options_new(options)
                                        error:&libraryError];
+    if (libraryError != nil) {
+      logError(log, libraryError.localizedDescription);
+    }
     if (library == nil) {
       logError(error, [NSString stringWithFormat:@"failed to create library: %@",
                                                  libraryError]);
+      setErrorCode(errorCode, MetalErrorCompile);
+      return 0;
+    }
+
+    return function_cache_new(library, funcName, options, archiveIn, archiveOut,
+                              archiveStatus, error);
+  }
+}
+
+// Convert options into the options Metal compiles source with. This returns
+// nil, which compiles with Metal's defaults, if options is NULL. Go has already
+// checked the options, so every value is one that Metal knows.
+MTLCompileOptions *compile_options_new(const CompileOptions *options) {
+  if (options == NULL) {
+    return nil;
+  }
+
+  MTLCompileOptions *compileOptions = [[MTLCompileOptions alloc] init];
+  if (options->languageVersion != 0) {
+    compileOptions.languageVersion = (MTLLanguageVersion)options->languageVersion;
+  }
+
+  if (options->mathMode != CompileMathModeDefault) {
+    if (@available(macOS 15.0, iOS 18.0, *)) {
+      switch (options->mathMode) {
+      case CompileMathModeSafe:
+        compileOptions.mathMode = MTLMathModeSafe;
+        break;
+      case CompileMathModeRelaxed:
+        compileOptions.mathMode = MTLMathModeRelaxed;
+        break;
+      default:
+        compileOptions.mathMode = MTLMathModeFast;
+        break;
+      }
+    } else {
+      // Older systems only have a switch for fast math, so relaxed math is
+      // compiled as safe.
+      compileOptions.fastMathEnabled = options->mathMode == CompileMathModeFast;
+    }
+  }
+
+  if (options->preserveInvariance) {
+    if (@available(macOS 11.0, iOS 14.0, *)) {
+      compileOptions.preserveInvariance = YES;
+    }
+  }
+
+  if (options->numMacros > 0) {
+    NSMutableDictionary<NSString *, NSObject *> *macros =
+        [NSMutableDictionary dictionaryWithCapacity:options->numMacros];
+    for (int i = 0; i < options->numMacros; i++) {
+      macros[[NSString stringWithUTF8String:options->macroNames[i]]] =
+          [NSString stringWithUTF8String:options->macroValues[i]];
+    }
+    compileOptions.preprocessorMacros = macros;
+  }
+
+  return compileOptions;
+}
+
+// Convert the function constants in options into the values Metal specializes
+// functions with. This returns nil if there are none, so that functions are set
+// up without specializing them. Go has already checked each constant's type.
+static MTLFunctionConstantValues *constant_values_new(const CompileOptions *options) {
+  if (options == NULL || options->numConstants == 0) {
+    return nil;
+  }
+
+  MTLFunctionConstantValues *values = [[MTLFunctionConstantValues alloc] init];
+  for (int i = 0; i < options->numConstants; i++) {
+    const FunctionConstantValue *constant = &options->constants[i];
+
+    // Metal copies each value, so it can be read from these locals.
+    unsigned char byte = (unsigned char)constant->bits;
+    unsigned short halfWord = (unsigned short)constant->bits;
+    unsigned int word = constant->bits;
+    const void *value = &word;
+    MTLDataType type = MTLDataTypeInt;
+    switch (constant->type) {
+    case FunctionConstantBool:
+      value = &byte;
+      type = MTLDataTypeBool;
+      break;
+    case FunctionConstantUInt:
+      type = MTLDataTypeUInt;
+      break;
+    case FunctionConstantFloat:
+      type = MTLDataTypeFloat;
+      break;
+    case FunctionConstantHalf:
+      value = &halfWord;
+      type = MTLDataTypeHalf;
+      break;
+    case FunctionConstantShort:
+      value = &halfWord;
+      type = MTLDataTypeShort;
+      break;
+    case FunctionConstantUShort:
+      value = &halfWord;
+      type = MTLDataTypeUShort;
+      break;
+    default:
+      break;
+    }
+
+    if (constant->name != NULL) {
+      [values setConstantValue:value
+                          type:type
+                      withName:[NSString stringWithUTF8String:constant->name]];
+    } else {
+      [values setConstantValue:value type:type atIndex:constant->index];
+    }
+  }
+
+  return values;
+}
+
+// Create the pipeline for mtlFunction from the binary archive at path, without
+// compiling it. This returns nil if path is NULL, if the archive cannot be
+// read, or if it does not hold the pipeline for this device, as when it is
+// corrupt or was compiled by an older system.
+static id<MTLComputePipelineState>
+pipeline_from_archive(id<MTLFunction> mtlFunction, const char *path,
+                      MTLPipelineOption options,
+                      MTLComputePipelineReflection **reflection) {
+  if (path == NULL) {
+    return nil;
+  }
+
+  if (@available(macOS 11.0, iOS 14.0, *)) {
+    MTLBinaryArchiveDescriptor *archiveDescriptor =
+        [[MTLBinaryArchiveDescriptor alloc] init];
+    archiveDescriptor.url =
+        [NSURL fileURLWithPath:[NSString stringWithUTF8String:path]];
+    id<MTLBinaryArchive> archive =
+        [metal_device() newBinaryArchiveWithDescriptor:archiveDescriptor
+                                                 error:nil];
+    if (archive == nil) {
+      return nil;
+    }
+
+    MTLComputePipelineDescriptor *descriptor =
+        [[MTLComputePipelineDescriptor alloc] init];
+    descriptor.computeFunction = mtlFunction;
+    descriptor.binaryArchives = @[ archive ];
+    return [metal_device()
+        newComputePipelineStateWithDescriptor:descriptor
+                                      options:options |
+                                              MTLPipelineOptionFailOnBinaryArchiveMiss
+                                   reflection:reflection
+                                        error:nil];
+  }
+
+  return nil;
+}
+
+// Compile the pipeline that descriptor describes into a new binary archive and
+// write it to path. On success the archive is added to descriptor's binary
+// archives, so that the pipeline created from descriptor afterward is taken
+// from the archive instead of being compiled a second time. This returns false
+// if path is NULL or the archive cannot be written.
+static _Bool pipeline_to_archive(MTLComputePipelineDescriptor *descriptor,
+                                 const char *path) {
+  if (path == NULL) {
+    return false;
+  }
+
+  if (@available(macOS 11.0, iOS 14.0, *)) {
+    MTLBinaryArchiveDescriptor *archiveDescriptor =
+        [[MTLBinaryArchiveDescriptor alloc] init];
+    id<MTLBinaryArchive> archive =
+        [metal_device() newBinaryArchiveWithDescriptor:archiveDescriptor
+                                                 error:nil];
+    if (archive == nil) {
+      return false;
+    }
+
+    if (![archive addComputePipelineFunctionsWithDescriptor:descriptor
+                                                      error:nil]) {
+      return false;
+    }
+    if (![archive
+            serializeToURL:[NSURL fileURLWithPath:[NSString stringWithUTF8String:path]]
+                     error:nil]) {
+      return false;
+    }
+    descriptor.binaryArchives = @[ archive ];
+    return true;
+  }
+
+  return false;
+}
+
+// Set up a new pipeline for executing the specified function in library,
+// specialized with the function constants in options (NULL for none), and
+// store it in the function cache. This returns the function's Id, or 0 with an
+// error message in error. function_new and library_function share it, so a
+// function behaves the same whichever way its library was created.
+//
+// If archiveIn is not NULL, the pipeline is loaded from the binary archive at
+// that path if it can be. Otherwise it is compiled and, if archiveOut is not
+// NULL, stored in a new binary archive at that path. archiveStatus is set to
+// the PipelineArchiveStatus that says which happened.
+int function_cache_new(id<MTLLibrary> library, const char *funcName,
+                       const CompileOptions *options, const char *archiveIn,
+                       const char *archiveOut, int *archiveStatus,
+                       const char **error) {
+  // Wrap the body for the same reason as function_new: library_function calls
+  // in here directly from cgo.
+  @autoreleasepool {
+    if (funcName == NULL || strlen(funcName) == 0) {
+      logError(error, @"missing function name");
       return 0;
     }
 
-    // Get a reference to the function in the code that's now in the new library.
+    // Set up a new function object to hold the various resources for the
+    // pipeline.
+    MetalFunction *function = [[MetalFunction alloc] init];
+    if (function == nil) {
+      logError(error, @"failed to initialize function");
+      return 0;
+    }
+
+    // Get a reference to the function in the library.
     // (Note that this is not executable yet. We need a pipeline in order to run
     // this function.)
-    function.mtlFunction =
-        [library newFunctionWithName:[NSString stringWithUTF8String:funcName]];
+    // A function with function constants is specialized with their values
+    // here, which is when the compiler removes the code they disable.
+    NSString *name = [NSString stringWithUTF8String:funcName];
+    MTLFunctionConstantValues *constantValues = constant_values_new(options);
+    NSError *functionError = nil;
+    if (constantValues == nil) {
+      function.mtlFunction = [library newFunctionWithName:name];
+    } else {
+      function.mtlFunction = [library newFunctionWithName:name
+                                           constantValues:constantValues
+                                                    error:&functionError];
+    }
     if (function.mtlFunction == nil) {
-      logError(error, [NSString stringWithFormat:@"failed to find function '%s'",
-                                                 funcName]);
+      if (functionError != nil &&
+          functionError.code != MTLLibraryErrorFunctionNotFound) {
+        logError(error, [NSString stringWithFormat:@"failed to specialize function '%s': %@",
+                                                   funcName,
+                                                   functionError.localizedDescription]);
+      } else {
+        logError(error, [NSString stringWithFormat:@"failed to find function '%s'",
+                                                   funcName]);
+      }
       return 0;
     }
 
     // Convert the function object we just created into a pipeline so we can
     // run the function. A pipeline contains the actual instructions/steps
     // that the GPU uses to execute the code.
+    // The pipeline's reflection data is kept so function_arguments can
+    // describe the function's arguments later.
     NSError *pipelineError = nil;
-    function.pipeline =
-        [metal_device() newComputePipelineStateWithFunction:function.mtlFunction
-                                                      error:&pipelineError];
+    MTLComputePipelineReflection *reflection = nil;
+    MTLPipelineOption pipelineOptions =
+        MTLPipelineOptionArgumentInfo | MTLPipelineOptionBufferTypeInfo;
+    int status = PipelineArchiveNone;
+    function.pipeline = pipeline_from_archive(function.mtlFunction, archiveIn,
+                                              pipelineOptions, &reflection);
+    if (function.pipeline != nil) {
+      status = PipelineArchiveLoaded;
+    } else {
+      // The pipeline is compiled once: into the new archive if there is one,
+      // from which it is then created, and otherwise when it is created.
+      MTLComputePipelineDescriptor *descriptor =
+          [[MTLComputePipelineDescriptor alloc] init];
+      descriptor.computeFunction = function.mtlFunction;
+      _Bool stored = pipeline_to_archive(descriptor, archiveOut);
+      function.pipeline =
+          [metal_device() newComputePipelineStateWithDescriptor:descriptor
+                                                        options:pipelineOptions
+                                                     reflection:&reflection
+                                                          error:&pipelineError];
+      if (function.pipeline != nil && stored) {
+        status = PipelineArchiveStored;
+      }
+    }
+    if (archiveStatus != NULL) {
+      *archiveStatus = status;
+    }
     if (function.pipeline == nil) {
       logError(error, [NSString stringWithFormat:@"failed to create pipeline: %@",
                                                  pipelineError]);
       return 0;
     }
+    function.reflection = reflection;
 
     // Store the function in the cache under the next available ID.
     int functionId = 0;
@@ -137,11 +415,75 @@ int function_new(const char *metalCode, const char *funcName,
   }
 }
 
+// Write value to *target, unless target is NULL, so that a caller that does not
+// care about an out-param can pass NULL for it.
+static void set_int(int *target, int value) {
+  if (target != NULL) {
+    *target = value;
+  }
+}
+
+// Create a command buffer for a batch of dispatches. Where it is supported, the
+// command buffer records the state of each of its encoders if it fails, so that
+// command_buffer_failure can tell which dispatch faulted.
+static id<MTLCommandBuffer> new_batch_command_buffer(void) {
+  if (@available(macOS 11.0, iOS 14.0, *)) {
+    MTLCommandBufferDescriptor *descriptor =
+        [[MTLCommandBufferDescriptor alloc] init];
+    descriptor.errorOptions =
+        MTLCommandBufferErrorOptionEncoderExecutionStatus;
+    return [commandQueue commandBufferWithDescriptor:descriptor];
+  }
+
+  return [commandQueue commandBuffer];
+}
+
+// Describe the failure of commandBuffer, which has finished running. If it
+// completed successfully this returns nil. Otherwise it returns a message for
+// the failure, sets commandBufferError to its MTLCommandBufferError code (which
+// the Go side classifies), and sets failedDispatch to the index of the dispatch
+// whose encoder faulted, or -1 if that is not known. The index is read from the
+// encoder labels that encode_batch_into sets.
+static NSString *command_buffer_failure(id<MTLCommandBuffer> commandBuffer,
+                                        int *failedDispatch,
+                                        int *commandBufferError) {
+  if (commandBuffer.status != MTLCommandBufferStatusError) {
+    return nil;
+  }
+
+  NSError *err = commandBuffer.error;
+  if ([err.domain isEqualToString:MTLCommandBufferErrorDomain]) {
+    set_int(commandBufferError, (int)err.code);
+  }
+
+  set_int(failedDispatch, -1);
+  if (@available(macOS 11.0, iOS 14.0, *)) {
+    NSArray<id<MTLCommandBufferEncoderInfo>> *infos =
+        err.userInfo[MTLCommandBufferEncoderInfoErrorKey];
+    for (id<MTLCommandBufferEncoderInfo> info in infos) {
+      if (info.errorState == MTLCommandEncoderErrorStateFaulted &&
+          info.label != nil) {
+        set_int(failedDispatch, info.label.intValue);
+        break;
+      }
+    }
+  }
+
+  NSString *reason = err.localizedDescription ?: @"unknown error";
+  return [NSString stringWithFormat:@"command buffer failed: %@", reason];
+}
+
 // Encode a single compute dispatch into encoder: look up the function, set its
-// pipeline, bind the scalar inputs and buffers as arguments, and dispatch the
-// grid. Returns false and sets error/errorCode on failure. The caller owns the
-// encoder and is responsible for endEncoding in all cases; on the failure paths
-// here the encoder has not been ended yet, so the caller must end it.
+// pipeline, bind the scalar inputs and buffers as arguments, set the lengths of
+// its threadgroup memory, and dispatch the grid in threadgroups of the given
+// size, which the Go side has already chosen and checked against the
+// pipeline's limits. inputs holds the bytes of every input back to back; input
+// i is inputSizes[i] bytes long. Returns false and sets error/errorCode on
+// failure, and if a buffer could not be bound, sets failedArgument to its index
+// in the argument table.
+// The caller owns the encoder and is responsible for endEncoding in all cases;
+// on the failure paths here the encoder has not been ended yet, so the caller
+// must end it.
 //
 // This is the shared core of function_run, function_run_batch, and
 // function_run_async — the three differ only in how they manage the command
@@ -149,9 +491,15 @@ int function_new(const char *metalCode, const char *funcName,
 static _Bool encode_dispatch(id<MTLComputeCommandEncoder> encoder,
                              int functionId, unsigned int width,
                              unsigned int height, unsigned int depth,
-                             float *inputs, int numInputs, int *bufferIds,
-                             int numBufferIds, const char **error,
-                             int *errorCode) {
+                             unsigned int threadgroupWidth,
+                             unsigned int threadgroupHeight,
+                             unsigned int threadgroupDepth,
+                             unsigned char *inputs, int *inputSizes,
+                             int numInputs, int *bufferIds,
+                             unsigned long *bufferOffsets, int numBufferIds,
+                             unsigned long *threadgroupMemory,
+                             int numThreadgroupMemory, const char **error,
+                             int *errorCode, int *failedArgument) {
   // Fetch the function from the cache.
   [functionLock lock];
   MetalFunction *function = functionCache[@(functionId)];
@@ -169,12 +517,13 @@ static _Bool encode_dispatch(id<MTLComputeCommandEncoder> encoder,
   // Set the arguments that will be passed to the function. The indexes for the
   // arguments here need to match their order in the function declaration. We'll
   // start with the arguments that are static values, and then we'll add the
-  // buffers. We currently support using only the entire buffer without any
-  // offsets, which could be used to, say, use one part of a buffer for one
-  // function argument and the other part for a different argument.
+  // buffers. Each buffer is bound at its offset in bufferOffsets, so one part
+  // of a buffer can be used for one function argument and another part for a
+  // different argument. A NULL bufferOffsets binds every buffer from its start.
   int index = 0;
   for (int i = 0; i < numInputs; i++) {
-    [encoder setBytes:&inputs[i] length:sizeof(float) atIndex:index++];
+    [encoder setBytes:inputs length:inputSizes[i] atIndex:index++];
+    inputs += inputSizes[i];
   }
   for (int i = 0; i < numBufferIds; i++) {
     // Retrieve the buffer for this Id from the buffer cache.
@@ -184,44 +533,32 @@ static _Bool encode_dispatch(id<MTLComputeCommandEncoder> encoder,
                [NSString stringWithFormat:@"failed to retrieve buffer %d/%d: invalid buffer id: %d",
                                           i + 1, numBufferIds, bufferIds[i]]);
       setErrorCode(errorCode, MetalErrorInvalidBufferId);
+      set_int(failedArgument, index);
       return false;
     }
 
-    [encoder setBuffer:buffer offset:0 atIndex:index++];
+    NSUInteger offset = bufferOffsets != NULL ? bufferOffsets[i] : 0;
+    [encoder setBuffer:buffer offset:offset atIndex:index++];
+  }
+
+  // Threadgroup memory has its own argument table, so threadgroupMemory[i] is
+  // the length for [[threadgroup(i)]]. The Go side has already rounded every
+  // length up to a multiple of 16 bytes and checked the total against the
+  // device's limit. A length of 0 leaves its index unset.
+  for (int i = 0; i < numThreadgroupMemory; i++) {
+    if (threadgroupMemory[i] > 0) {
+      [encoder setThreadgroupMemoryLength:threadgroupMemory[i] atIndex:i];
+    }
   }
 
   // Specify how many threads we need to perform all the calculations (one
   // thread per calculation).
   MTLSize gridSize = MTLSizeMake(width, height, depth);
 
-  // Figure out how many threads will be grouped together into each threadgroup.
-  // There are two variables that are important here:
-  //
-  //     pipeline.threadExecutionWidth:
-  //         Maximum number of threads that the GPU can execute at one time in
-  //         parallel (aka thread warp size, aka SIMD group size)
-  //     pipeline.maxTotalThreadsPerThreadgroup:
-  //         Maximum number of threads that can be bundled together into a
-  //         threadgroup
-  //
-  // We're going to divide the threads conceptually into two dimensions and then
-  // place them into a 3-dimensional grid with no height. The first dimension
-  // will be the number of threads that can run at one time (the thread warp
-  // size). The second dimension will be the maximum number of parallel thread
-  // bundles.
-  //
-  // For more details on threads, grids, and threadgroup sizes, see
-  // https://developer.apple.com/documentation/metal/compute_passes/calculating_threadgroup_and_grid_sizes.
-  NSUInteger w = function.pipeline.threadExecutionWidth;
-  // maxTotalThreadsPerThreadgroup is per-pipeline and can be smaller than the
-  // device's threadExecutionWidth for kernels with high register pressure,
-  // which would make this division zero. A threadgroup with a zero dimension
-  // is invalid and faults at dispatch, so clamp the height to at least one.
-  NSUInteger h = function.pipeline.maxTotalThreadsPerThreadgroup / w;
-  if (h == 0) {
-    h = 1;
-  }
-  MTLSize threadgroupSize = MTLSizeMake(w, h, 1);
+  // The threadgroup size is chosen in Go (see metal.threadgroupSize), which
+  // reads the pipeline's limits through function_limits.
+  MTLSize threadgroupSize =
+      MTLSizeMake(threadgroupWidth, threadgroupHeight, threadgroupDepth);
 
   // Dispatch the work. dispatchThreads:threadsPerThreadgroup: lets Metal size
   // the grid exactly (one thread per element, no over-dispatch) but requires
@@ -248,11 +585,17 @@ static _Bool encode_dispatch(id<MTLComputeCommandEncoder> encoder,
 // safe for concurrent use: each call creates its own command buffer and encoder,
 // and the command queue serializes GPU execution automatically. If any error is
 // encountered running the metal function, this returns false and sets an error
-// message in error.
+// message in error; if the command buffer failed on the GPU, its
+// MTLCommandBufferError code is also set in commandBufferError.
 _Bool function_run(int functionId, unsigned int width, unsigned int height,
-                   unsigned int depth, float *inputs, int numInputs,
-                   int *bufferIds, int numBufferIds, const char **error,
-                   int *errorCode) {
+                   unsigned int depth, unsigned int threadgroupWidth,
+                   unsigned int threadgroupHeight,
+                   unsigned int threadgroupDepth, unsigned char *inputs,
+                   int *inputSizes, int numInputs, int *bufferIds,
+                   unsigned long *bufferOffsets, int numBufferIds,
+                   unsigned long *threadgroupMemory, int numThreadgroupMemory,
+                   const char **error, int *errorCode,
+                   int *commandBufferError) {
   // Wrap the body so the autoreleased ObjC temporaries created here (the command
   // buffer, encoder, boxed NSNumber keys, any error NSStrings) are released when
   // this returns. A Go goroutine calling in through cgo has no ambient
@@ -278,8 +621,11 @@ _Bool function_run(int functionId, unsigned int width, unsigned int height,
       return false;
     }
 
-    if (!encode_dispatch(encoder, functionId, width, height, depth, inputs,
-                         numInputs, bufferIds, numBufferIds, error, errorCode)) {
+    if (!encode_dispatch(encoder, functionId, width, height, depth,
+                         threadgroupWidth, threadgroupHeight, threadgroupDepth,
+                         inputs, inputSizes, numInputs, bufferIds,
+                         bufferOffsets, numBufferIds, threadgroupMemory,
+                         numThreadgroupMemory, error, errorCode, NULL)) {
       // Metal requires endEncoding before the encoder is released, even on the
       // error path.
       [encoder endEncoding];
@@ -295,6 +641,13 @@ _Bool function_run(int functionId, unsigned int width, unsigned int height,
     [commandBuffer commit];
     [commandBuffer waitUntilCompleted];
 
+    NSString *failure =
+        command_buffer_failure(commandBuffer, NULL, commandBufferError);
+    if (failure != nil) {
+      logError(error, failure);
+      return false;
+    }
+
     return true;
   }
 }
@@ -302,27 +655,46 @@ _Bool function_run(int functionId, unsigned int width, unsigned int height,
 // Encode numDispatches dispatches into commandBuffer, one compute encoder each,
 // reading dispatch i's parameters from element i of the parallel arrays. Returns
 // false and sets error/errorCode if any dispatch fails to encode (the caller
-// then discards commandBuffer without committing). This is the shared core of the
-// sync and async batch entry points; they differ only in whether they wait after
-// committing.
+// then discards commandBuffer without committing), with the index of that
+// dispatch in failedDispatch and the argument as for encode_dispatch. This is
+// the shared core of the sync and async batch entry points; they differ only in
+// whether they wait after committing.
 static _Bool encode_batch_into(id<MTLCommandBuffer> commandBuffer,
                                int numDispatches, int *functionIds,
                                unsigned int *widths, unsigned int *heights,
-                               unsigned int *depths, float **inputs,
+                               unsigned int *depths,
+                               unsigned int *threadgroupWidths,
+                               unsigned int *threadgroupHeights,
+                               unsigned int *threadgroupDepths,
+                               unsigned char **inputs, int **inputSizes,
                                int *numInputs, int **bufferIds,
-                               int *numBufferIds, const char **error,
-                               int *errorCode) {
+                               unsigned long **bufferOffsets,
+                               int *numBufferIds,
+                               unsigned long **threadgroupMemory,
+                               int *numThreadgroupMemory, const char **error,
+                               int *errorCode, int *failedDispatch,
+                               int *failedArgument) {
   for (int i = 0; i < numDispatches; i++) {
     id<MTLComputeCommandEncoder> encoder = [commandBuffer computeCommandEncoder];
     if (encoder == nil) {
       logError(error, @"failed to set up compute encoder");
+      set_int(failedDispatch, i);
       return false;
     }
 
+    // Label the encoder with the index of its dispatch, so that
+    // command_buffer_failure can tell which dispatch faulted.
+    encoder.label = [NSString stringWithFormat:@"%d", i];
+
     if (!encode_dispatch(encoder, functionIds[i], widths[i], heights[i],
-                         depths[i], inputs[i], numInputs[i], bufferIds[i],
-                         numBufferIds[i], error, errorCode)) {
+                         depths[i], threadgroupWidths[i],
+                         threadgroupHeights[i], threadgroupDepths[i],
+                         inputs[i], inputSizes[i], numInputs[i], bufferIds[i],
+                         bufferOffsets[i], numBufferIds[i],
+                         threadgroupMemory[i], numThreadgroupMemory[i], error,
+                         errorCode, failedArgument)) {
       [encoder endEncoding];
+      set_int(failedDispatch, i);
       return false;
     }
 
@@ -337,82 +709,140 @@ static _Bool encode_batch_into(id<MTLCommandBuffer> commandBuffer,
 // parallel arrays. Batching amortizes command-buffer setup and the single GPU
 // synchronization across all dispatches, which Apple recommends over many
 // one-shot command buffers. If any dispatch fails to encode, nothing is
-// committed and this returns false with the error describing which one failed.
+// committed and this returns false with the error describing which one failed,
+// and its index in failedDispatch. If the command buffer fails on the GPU, this
+// returns false with the failure as command_buffer_failure describes it.
 _Bool function_run_batch(int numDispatches, int *functionIds,
                          unsigned int *widths, unsigned int *heights,
-                         unsigned int *depths, float **inputs, int *numInputs,
-                         int **bufferIds, int *numBufferIds,
-                         const char **error, int *errorCode) {
+                         unsigned int *depths, unsigned int *threadgroupWidths,
+                         unsigned int *threadgroupHeights,
+                         unsigned int *threadgroupDepths, unsigned char **inputs,
+                         int **inputSizes, int *numInputs, int **bufferIds,
+                         unsigned long **bufferOffsets, int *numBufferIds,
+                         unsigned long **threadgroupMemory,
+                         int *numThreadgroupMemory, const char **error,
+                         int *errorCode, int *failedDispatch,
+                         int *failedArgument, int *commandBufferError) {
   @autoreleasepool {
-    id<MTLCommandBuffer> commandBuffer = [commandQueue commandBuffer];
+    id<MTLCommandBuffer> commandBuffer = new_batch_command_buffer();
     if (commandBuffer == nil) {
       logError(error, @"failed to set up command buffer");
       return false;
     }
 
     if (!encode_batch_into(commandBuffer, numDispatches, functionIds, widths,
-                           heights, depths, inputs, numInputs, bufferIds,
-                           numBufferIds, error, errorCode)) {
+                           heights, depths, threadgroupWidths,
+                           threadgroupHeights, threadgroupDepths, inputs,
+                           inputSizes, numInputs, bufferIds, bufferOffsets,
+                           numBufferIds, threadgroupMemory,
+                           numThreadgroupMemory, error, errorCode,
+                           failedDispatch, failedArgument)) {
       return false;
     }
 
     [commandBuffer commit];
     [commandBuffer waitUntilCompleted];
 
+    NSString *failure = command_buffer_failure(commandBuffer, failedDispatch,
+                                               commandBufferError);
+    if (failure != nil) {
+      logError(error, failure);
+      return false;
+    }
+
     return true;
   }
 }
 
+// Report the progress of commandBuffer, which must not have been committed yet,
+// to the Go completion identified by callback: runScheduled once the GPU has
+// scheduled it, and runCompleted once it has finished, with a strdup'd error
+// message (which the Go side frees) if it finished in an error state, and the
+// failed dispatch and command buffer error from command_buffer_failure. Metal
+// keeps the command buffer alive until its completed handlers have run and
+// releases it afterward, so nothing else needs to hold it while it is in
+// flight.
+static void add_completion_handlers(id<MTLCommandBuffer> commandBuffer,
+                                    uintptr_t callback) {
+  [commandBuffer addScheduledHandler:^(id<MTLCommandBuffer> buffer) {
+    runScheduled(callback);
+  }];
+  [commandBuffer addCompletedHandler:^(id<MTLCommandBuffer> buffer) {
+    @autoreleasepool {
+      char *error = NULL;
+      int failedDispatch = -1;
+      int commandBufferError = 0;
+      NSString *failure =
+          command_buffer_failure(buffer, &failedDispatch, &commandBufferError);
+      if (failure != nil) {
+        error = strdup(failure.UTF8String);
+      }
+      runCompleted(callback, error, failedDispatch, commandBufferError);
+    }
+  }];
+}
+
 // Encode and commit a batch of dispatches (like function_run_batch) without
-// waiting. On success *handle receives a retained reference to the in-flight
-// command buffer for the whole batch, which the caller must later pass to
-// function_wait exactly once. Because all dispatches share one command buffer, a
-// single wait covers the entire batch. Returns false and sets error/errorCode
-// (leaving *handle NULL) if any dispatch fails to encode; nothing is committed.
+// waiting. On success the command buffer for the whole batch reports its
+// progress to the Go completion identified by callback (see
+// add_completion_handlers), so a single completion covers the entire batch.
+// Returns false and sets error/errorCode if any dispatch fails to encode;
+// nothing is committed and callback is never reported to.
 _Bool function_run_batch_async(int numDispatches, int *functionIds,
                                unsigned int *widths, unsigned int *heights,
-                               unsigned int *depths, float **inputs,
+                               unsigned int *depths,
+                               unsigned int *threadgroupWidths,
+                               unsigned int *threadgroupHeights,
+                               unsigned int *threadgroupDepths,
+                               unsigned char **inputs, int **inputSizes,
                                int *numInputs, int **bufferIds,
-                               int *numBufferIds, void **handle,
-                               const char **error, int *errorCode) {
+                               unsigned long **bufferOffsets,
+                               int *numBufferIds,
+                               unsigned long **threadgroupMemory,
+                               int *numThreadgroupMemory, uintptr_t callback,
+                               const char **error, int *errorCode,
+                               int *failedDispatch, int *failedArgument) {
   @autoreleasepool {
-    *handle = NULL;
-
-    id<MTLCommandBuffer> commandBuffer = [commandQueue commandBuffer];
+    id<MTLCommandBuffer> commandBuffer = new_batch_command_buffer();
     if (commandBuffer == nil) {
       logError(error, @"failed to set up command buffer");
       return false;
     }
 
     if (!encode_batch_into(commandBuffer, numDispatches, functionIds, widths,
-                           heights, depths, inputs, numInputs, bufferIds,
-                           numBufferIds, error, errorCode)) {
+                           heights, depths, threadgroupWidths,
+                           threadgroupHeights, threadgroupDepths, inputs,
+                           inputSizes, numInputs, bufferIds, bufferOffsets,
+                           numBufferIds, threadgroupMemory,
+                           numThreadgroupMemory, error, errorCode,
+                           failedDispatch, failedArgument)) {
       return false;
     }
 
+    add_completion_handlers(commandBuffer, callback);
     [commandBuffer commit];
 
-    // Hand the command buffer to the caller as an opaque handle; function_wait
-    // balances this +1 retain with __bridge_transfer.
-    *handle = (__bridge_retained void *)commandBuffer;
-
     return true;
   }
 }
 
 // Encode and commit a single dispatch without waiting for it to finish. On
-// success *handle receives a retained reference to the in-flight command buffer
-// that the caller must later pass to function_wait (which releases it). The
-// caller keeps the CPU free to encode more work while the GPU runs. Returns
-// false and sets error/errorCode (and leaves *handle NULL) if encoding fails;
-// in that case nothing was committed and there is nothing to wait on.
+// success the command buffer reports its progress to the Go completion
+// identified by callback (see add_completion_handlers), and the caller keeps
+// the CPU free to encode more work while the GPU runs. Returns false and sets
+// error/errorCode if encoding fails; in that case nothing was committed and
+// callback is never reported to.
 _Bool function_run_async(int functionId, unsigned int width,
-                         unsigned int height, unsigned int depth, float *inputs,
-                         int numInputs, int *bufferIds, int numBufferIds,
-                         void **handle, const char **error, int *errorCode) {
+                         unsigned int height, unsigned int depth,
+                         unsigned int threadgroupWidth,
+                         unsigned int threadgroupHeight,
+                         unsigned int threadgroupDepth, unsigned char *inputs,
+                         int *inputSizes, int numInputs, int *bufferIds,
+                         unsigned long *bufferOffsets, int numBufferIds,
+                         unsigned long *threadgroupMemory,
+                         int numThreadgroupMemory, uintptr_t callback,
+                         const char **error, int *errorCode) {
   @autoreleasepool {
-    *handle = NULL;
-
     id<MTLCommandBuffer> commandBuffer = [commandQueue commandBuffer];
     if (commandBuffer == nil) {
       logError(error, @"failed to set up command buffer");
@@ -425,47 +855,19 @@ _Bool function_run_async(int functionId, unsigned int width,
       return false;
     }
 
-    if (!encode_dispatch(encoder, functionId, width, height, depth, inputs,
-                         numInputs, bufferIds, numBufferIds, error, errorCode)) {
+    if (!encode_dispatch(encoder, functionId, width, height, depth,
+                         threadgroupWidth, threadgroupHeight, threadgroupDepth,
+                         inputs, inputSizes, numInputs, bufferIds,
+                         bufferOffsets, numBufferIds, threadgroupMemory,
+                         numThreadgroupMemory, error, errorCode, NULL)) {
       [encoder endEncoding];
       return false;
     }
 
     [encoder endEncoding];
+    add_completion_handlers(commandBuffer, callback);
     [commandBuffer commit];
 
-    // Hand the command buffer to the caller as an opaque handle. __bridge_retained
-    // transfers a +1 retain to the raw pointer so the command buffer outlives this
-    // autorelease pool; function_wait balances it with __bridge_transfer.
-    *handle = (__bridge_retained void *)commandBuffer;
-
-    return true;
-  }
-}
-
-// Wait for an async dispatch (started by function_run_async or
-// function_run_batch_async) to finish and release its command buffer. handle
-// must be a non-NULL handle returned by one of those and must be waited on
-// exactly once. A single wait covers the whole command buffer, so it completes
-// an entire async batch. After this call the handle is invalid. Returns false
-// and sets an error if the command buffer finished in an error state.
-_Bool function_wait(void *handle, const char **error) {
-  @autoreleasepool {
-    // __bridge_transfer takes back ownership of the +1 retain that the async
-    // entry point put on the raw pointer, so the command buffer is released when
-    // commandBuffer goes out of scope at the end of this pool.
-    id<MTLCommandBuffer> commandBuffer =
-        (__bridge_transfer id<MTLCommandBuffer>)handle;
-
-    [commandBuffer waitUntilCompleted];
-
-    if (commandBuffer.status == MTLCommandBufferStatusError) {
-      NSString *reason = commandBuffer.error.localizedDescription;
-      logError(error, [NSString stringWithFormat:@"command buffer failed: %@",
-                                                 reason ?: @"unknown error"]);
-      return false;
-    }
-
     return true;
   }
 }
@@ -498,6 +900,172 @@ const char *function_name(int functionId) {
   }
 }
 
+// Get the threadgroup limits of the compiled pipeline for the metal function
+// with the provided function Id: the SIMD group width, the most threads that
+// one threadgroup may have, the most threadgroup memory that the device allows,
+// how much of it the pipeline declares statically, and the alignment that the
+// device requires for the offset of a constant buffer. Returns false if the
+// function Id is invalid.
+_Bool function_limits(int functionId, int *threadExecutionWidth,
+                      int *maxTotalThreadsPerThreadgroup,
+                      int *maxThreadgroupMemoryLength,
+                      int *staticThreadgroupMemoryLength,
+                      int *constantOffsetAlignment) {
+  @autoreleasepool {
+    [functionLock lock];
+    MetalFunction *function = functionCache[@(functionId)];
+    [functionLock unlock];
+
+    if (function == nil) {
+      return false;
+    }
+
+    *threadExecutionWidth = (int)function.pipeline.threadExecutionWidth;
+    *maxTotalThreadsPerThreadgroup =
+        (int)function.pipeline.maxTotalThreadsPerThreadgroup;
+    *maxThreadgroupMemoryLength = (int)metal_device().maxThreadgroupMemoryLength;
+    *staticThreadgroupMemoryLength =
+        (int)function.pipeline.staticThreadgroupMemoryLength;
+    *constantOffsetAlignment = constantBufferOffsetAlignment;
+
+    return true;
+  }
+}
+
+// Return the MSL name of a buffer's element type, or nil if it is not a scalar
+// or vector type.
+static NSString *data_type_name(MTLDataType dataType) {
+  switch (dataType) {
+  case MTLDataTypeFloat: return @"float";
+  case MTLDataTypeFloat2: return @"float2";
+  case MTLDataTypeFloat3: return @"float3";
+  case MTLDataTypeFloat4: return @"float4";
+  case MTLDataTypeHalf: return @"half";
+  case MTLDataTypeHalf2: return @"half2";
+  case MTLDataTypeHalf3: return @"half3";
+  case MTLDataTypeHalf4: return @"half4";
+  case MTLDataTypeInt: return @"int";
+  case MTLDataTypeInt2: return @"int2";
+  case MTLDataTypeInt3: return @"int3";
+  case MTLDataTypeInt4: return @"int4";
+  case MTLDataTypeUInt: return @"uint";
+  case MTLDataTypeUInt2: return @"uint2";
+  case MTLDataTypeUInt3: return @"uint3";
+  case MTLDataTypeUInt4: return @"uint4";
+  case MTLDataTypeShort: return @"short";
+  case MTLDataTypeShort2: return @"short2";
+  case MTLDataTypeShort3: return @"short3";
+  case MTLDataTypeShort4: return @"short4";
+  case MTLDataTypeUShort: return @"ushort";
+  case MTLDataTypeUShort2: return @"ushort2";
+  case MTLDataTypeUShort3: return @"ushort3";
+  case MTLDataTypeUShort4: return @"ushort4";
+  case MTLDataTypeChar: return @"char";
+  case MTLDataTypeChar2: return @"char2";
+  case MTLDataTypeChar3: return @"char3";
+  case MTLDataTypeChar4: return @"char4";
+  case MTLDataTypeUChar: return @"uchar";
+  case MTLDataTypeUChar2: return @"uchar2";
+  case MTLDataTypeUChar3: return @"uchar3";
+  case MTLDataTypeUChar4: return @"uchar4";
+  case MTLDataTypeBool: return @"bool";
+  case MTLDataTypeBool2: return @"bool2";
+  case MTLDataTypeBool3: return @"bool3";
+  case MTLDataTypeBool4: return @"bool4";
+  case MTLDataTypeLong: return @"long";
+  case MTLDataTypeLong2: return @"long2";
+  case MTLDataTypeLong3: return @"long3";
+  case MTLDataTypeLong4: return @"long4";
+  case MTLDataTypeULong: return @"ulong";
+  case MTLDataTypeULong2: return @"ulong2";
+  case MTLDataTypeULong3: return @"ulong3";
+  case MTLDataTypeULong4: return @"ulong4";
+  default: return nil;
+  }
+}
+
+// Describe the arguments of the given function from its pipeline's reflection
+// data. Only the arguments bound to memory (buffers and threadgroup memory)
+// appear in the reflection. On success this returns the number of arguments
+// and points *arguments at a malloc'd array of them, which the caller must
+// release with function_arguments_free. Reflection requires macOS 13; on older
+// systems this succeeds with no arguments. If any error is encountered, this
+// returns -1 and sets an error message in error.
+int function_arguments(int functionId, FunctionArgument **arguments,
+                       const char **error, int *errorCode) {
+  // Wrap the body so the boxed NSNumber key and the autoreleased reflection
+  // objects are released when this returns; the cgo caller has no ambient pool
+  // to drain them.
+  @autoreleasepool {
+    *arguments = NULL;
+
+    [functionLock lock];
+    MetalFunction *function = functionCache[@(functionId)];
+    [functionLock unlock];
+
+    if (function == nil) {
+      logError(error, [NSString stringWithFormat:@"invalid function id: %d", functionId]);
+      setErrorCode(errorCode, MetalErrorInvalidFunctionId);
+      return -1;
+    }
+
+    if (@available(macOS 13.0, iOS 16.0, *)) {
+      NSArray<id<MTLBinding>> *bindings = function.reflection.bindings;
+      if (bindings.count == 0) {
+        return 0;
+      }
+
+      FunctionArgument *args = calloc(bindings.count, sizeof(FunctionArgument));
+      if (args == NULL) {
+        logError(error, @"failed to allocate arguments");
+        return -1;
+      }
+
+      int numArguments = 0;
+      for (id<MTLBinding> binding in bindings) {
+        FunctionArgument *arg = &args[numArguments];
+        switch (binding.type) {
+        case MTLBindingTypeBuffer: {
+          id<MTLBufferBinding> buffer = (id<MTLBufferBinding>)binding;
+          arg->kind = FunctionArgumentBuffer;
+          NSString *typeName = data_type_name(buffer.bufferDataType);
+          arg->typeName = strdup(typeName ? [typeName UTF8String] : "");
+          break;
+        }
+        case MTLBindingTypeThreadgroupMemory:
+          arg->kind = FunctionArgumentThreadgroupMemory;
+          arg->typeName = strdup("");
+          break;
+        default:
+          // Textures, samplers, and the rest are not described.
+          continue;
+        }
+        arg->index = (int)binding.index;
+        arg->name = strdup([binding.name UTF8String]);
+        arg->readOnly = binding.access == MTLBindingAccessReadOnly;
+        numArguments++;
+      }
+
+      *arguments = args;
+      return numArguments;
+    }
+
+    return 0;
+  }
+}
+
+// Release the arguments returned by function_arguments.
+void function_arguments_free(FunctionArgument *arguments, int numArguments) {
+  if (arguments == NULL) {
+    return;
+  }
+  for (int i = 0; i < numArguments; i++) {
+    free(arguments[i].name);
+    free(arguments[i].typeName);
+  }
+  free(arguments);
+}
+
 // Release the compiled pipeline for the given function Id. After this call the
 // Id is invalid. Returns false and sets an error if the Id is not found.
 _Bool function_close(int functionId, const char **error, int *errorCode) {
@@ -3,6 +3,13 @@
 
 #import <Metal/Metal.h>
 
+#import "Metal.h"
+
 _Bool function_cache_init(void);
+MTLCompileOptions *compile_options_new(const CompileOptions *options);
+int function_cache_new(id<MTLLibrary> library, const char *funcName,
+                       const CompileOptions *options, const char *archiveIn,
+                       const char *archiveOut, int *archiveStatus,
+                       const char **error);
 
 #endif
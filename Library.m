@@ -0,0 +1,182 @@
+//go:build darwin
+
+#import "Error.h"
+#import "FunctionCache.h"
+#import "LibraryCache.h"
+#import "Metal.h"
+#import "MetalInternal.h"
+#include <limits.h>
+#include <string.h>
+#import <Metal/Metal.h>
+
+static NSMutableDictionary *libraryCache = nil;
+static int nextLibraryId = 1;
+static NSLock *libraryLock = nil;
+
+// Initialize the library cache. This should be called only once.
+void library_cache_init(void) {
+  libraryCache = [[NSMutableDictionary alloc] init];
+  libraryLock = [[NSLock alloc] init];
+}
+
+// Store a library in the cache and write the names of its kernel functions to
+// names, which is heap-allocated along with the strings in it and must be freed
+// with library_names_free. Returns the library's Id, or 0 on error.
+static int library_cache_store(id<MTLLibrary> library, char ***names,
+                               int *numNames, const char **error) {
+  NSMutableArray<NSString *> *kernels = [NSMutableArray array];
+  for (NSString *name in library.functionNames) {
+    id<MTLFunction> function = [library newFunctionWithName:name];
+    if (function.functionType == MTLFunctionTypeKernel) {
+      [kernels addObject:name];
+    }
+  }
+
+  int libraryId = 0;
+  [libraryLock lock];
+  if (nextLibraryId == INT_MAX) {
+    [libraryLock unlock];
+    logError(error, @"library id space exhausted");
+    return 0;
+  }
+  libraryId = nextLibraryId++;
+  libraryCache[@(libraryId)] = library;
+  [libraryLock unlock];
+
+  *numNames = (int)kernels.count;
+  *names = calloc(kernels.count, sizeof(char *));
+  for (NSUInteger i = 0; i < kernels.count; i++) {
+    (*names)[i] = strdup([kernels[i] UTF8String]);
+  }
+
+  return libraryId;
+}
+
+// Compile every function in the provided MTL code into a new library on the
+// default GPU, compiled with options as for function_new. This returns an Id
+// that is used to set up functions from the library, and the names of its
+// kernel functions, as for library_cache_store. The compiler's output is copied
+// into log as function_new does. If the code does not compile, this returns 0,
+// sets an error message in error, and sets errorCode to MetalErrorCompile.
+int library_new_with_source(const char *metalCode,
+                            const CompileOptions *options, char ***names,
+                            int *numNames, const char **log,
+                            const char **error, int *errorCode) {
+  // Wrap the body so the autoreleased ObjC temporaries created here are
+  // released when this returns; the cgo caller has no ambient pool to drain
+  // them.
+  @autoreleasepool {
+    if (metalCode == NULL || strlen(metalCode) == 0) {
+      logError(error, @"missing metal code");
+      return 0;
+    }
+
+    NSError *libraryError = nil;
+    id<MTLLibrary> library =
+        [metal_device() newLibraryWithSource:[NSString stringWithUTF8String:metalCode]
+                                     options:compile_options_new(options)
+                                       error:&libraryError];
+    if (libraryError != nil) {
+      logError(log, libraryError.localizedDescription);
+    }
+    if (library == nil) {
+      logError(error, [NSString stringWithFormat:@"failed to create library: %@",
+                                                 libraryError]);
+      setErrorCode(errorCode, MetalErrorCompile);
+      return 0;
+    }
+
+    return library_cache_store(library, names, numNames, error);
+  }
+}
+
+// Load the compiled metallib file in data. This returns an Id that is used to
+// set up functions from the library, and the names of its kernel functions, as
+// for library_cache_store. If the library cannot be loaded, this returns 0 and
+// sets an error message in error.
+int library_new_with_data(const void *data, size_t length, char ***names,
+                          int *numNames, const char **error) {
+  // Wrap the body so the autoreleased ObjC temporaries created here are
+  // released when this returns; the cgo caller has no ambient pool to drain
+  // them.
+  @autoreleasepool {
+    if (data == NULL || length == 0) {
+      logError(error, @"missing library data");
+      return 0;
+    }
+
+    // The default destructor makes dispatch_data_create copy the bytes, so the
+    // Go memory behind data need not outlive this call.
+    dispatch_data_t libraryData =
+        dispatch_data_create(data, length, NULL, DISPATCH_DATA_DESTRUCTOR_DEFAULT);
+
+    NSError *libraryError = nil;
+    id<MTLLibrary> library = [metal_device() newLibraryWithData:libraryData
+                                                          error:&libraryError];
+    if (library == nil) {
+      logError(error, [NSString stringWithFormat:@"failed to create library: %@",
+                                                 libraryError]);
+      return 0;
+    }
+
+    return library_cache_store(library, names, numNames, error);
+  }
+}
+
+// Free the names returned by library_new_with_source and library_new_with_data.
+void library_names_free(char **names, int numNames) {
+  if (names == NULL) {
+    return;
+  }
+  for (int i = 0; i < numNames; i++) {
+    free(names[i]);
+  }
+  free(names);
+}
+
+// Set up a new pipeline for executing the specified function in the library
+// with the given Id, specialized with the function constants in options (NULL
+// for none). This returns the function's Id, as function_new does. If any
+// error is encountered, this returns 0 and sets an error message in error and
+// a category in errorCode.
+int library_function(int libraryId, const char *funcName,
+                     const CompileOptions *options, const char **error,
+                     int *errorCode) {
+  // Wrap the body so the boxed NSNumber key is released when this returns; the
+  // cgo caller has no ambient pool to drain it.
+  @autoreleasepool {
+    [libraryLock lock];
+    id<MTLLibrary> library = libraryCache[@(libraryId)];
+    [libraryLock unlock];
+
+    if (library == nil) {
+      logError(error, [NSString stringWithFormat:@"invalid library id: %d", libraryId]);
+      setErrorCode(errorCode, MetalErrorInvalidLibraryId);
+      return 0;
+    }
+
+    return function_cache_new(library, funcName, options, NULL, NULL, NULL,
+                              error);
+  }
+}
+
+// Release the library with the given Id. Functions set up from it hold their
+// own pipelines, so they stay valid.
+_Bool library_close(int libraryId, const char **error, int *errorCode) {
+  // Wrap the body so the boxed NSNumber keys and any error NSString are released
+  // when this returns; the cgo caller has no ambient pool to drain them.
+  @autoreleasepool {
+    [libraryLock lock];
+    id<MTLLibrary> library = libraryCache[@(libraryId)];
+    if (library == nil) {
+      [libraryLock unlock];
+      logError(error, [NSString stringWithFormat:@"invalid library id: %d", libraryId]);
+      setErrorCode(errorCode, MetalErrorInvalidLibraryId);
+      return false;
+    }
+    [libraryCache removeObjectForKey:@(libraryId)];
+    [libraryLock unlock];
+
+    return true;
+  }
+}
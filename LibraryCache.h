@@ -0,0 +1,8 @@
+#ifndef HEADER_LIBRARY_CACHE
+#define HEADER_LIBRARY_CACHE
+
+#import <Metal/Metal.h>
+
+void library_cache_init(void);
+
+#endif
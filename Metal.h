@@ -1,44 +1,165 @@
 #ifndef HEADER_METAL
 #define HEADER_METAL
 
+#include <stdint.h>
 #include <stdlib.h>
 
 // Functions that must be called once for every application
 _Bool metal_init(void);
 
+// Functions for querying the device
+char *metal_device_identity(void);
+
+// The floating-point optimizations the compiler may make, in the order of
+// metal.MathMode.
+enum CompileMathMode {
+  CompileMathModeDefault = 0,
+  CompileMathModeSafe = 1,
+  CompileMathModeRelaxed = 2,
+  CompileMathModeFast = 3,
+};
+
+// The types a function constant can have.
+enum FunctionConstantType {
+  FunctionConstantBool = 0,
+  FunctionConstantInt = 1,
+  FunctionConstantUInt = 2,
+  FunctionConstantFloat = 3,
+  FunctionConstantHalf = 4,
+  FunctionConstantShort = 5,
+  FunctionConstantUShort = 6,
+};
+
+// The value of one function constant, which is set by name, or by index if
+// name is NULL. bits holds the value's encoding in its low bytes.
+typedef struct {
+  const char *name;
+  int index;
+  int type;
+  unsigned int bits;
+} FunctionConstantValue;
+
+// The options that metal code is compiled with. languageVersion is an
+// MTLLanguageVersion, or 0 for the default. macroNames and macroValues hold
+// numMacros preprocessor macros, and constants holds the numConstants function
+// constants that functions are specialized with.
+typedef struct {
+  unsigned long languageVersion;
+  int mathMode;
+  _Bool preserveInvariance;
+  const char **macroNames;
+  const char **macroValues;
+  int numMacros;
+  const FunctionConstantValue *constants;
+  int numConstants;
+} CompileOptions;
+
+// What function_new did with the binary archives it was given, in the order of
+// metal.archiveStatus.
+enum PipelineArchiveStatus {
+  PipelineArchiveNone = 0,
+  PipelineArchiveLoaded = 1,
+  PipelineArchiveStored = 2,
+};
+
 // Functions that must be called once for every metal function
 int function_new(const char *metalCode, const char *funcName,
-                 const char **error);
+                 const CompileOptions *options, const char *archiveIn,
+                 const char *archiveOut, int *archiveStatus, const char **log,
+                 const char **error, int *errorCode);
 _Bool function_run(int functionId, unsigned int width, unsigned int height,
-                   unsigned int depth, float *inputs, int numInputs,
-                   int *bufferIds, int numBufferIds, const char **error,
-                   int *errorCode);
+                   unsigned int depth, unsigned int threadgroupWidth,
+                   unsigned int threadgroupHeight,
+                   unsigned int threadgroupDepth, unsigned char *inputs,
+                   int *inputSizes, int numInputs, int *bufferIds,
+                   unsigned long *bufferOffsets, int numBufferIds,
+                   unsigned long *threadgroupMemory, int numThreadgroupMemory,
+                   const char **error, int *errorCode,
+                   int *commandBufferError);
 _Bool function_run_batch(int numDispatches, int *functionIds,
                          unsigned int *widths, unsigned int *heights,
-                         unsigned int *depths, float **inputs, int *numInputs,
-                         int **bufferIds, int *numBufferIds,
-                         const char **error, int *errorCode);
+                         unsigned int *depths, unsigned int *threadgroupWidths,
+                         unsigned int *threadgroupHeights,
+                         unsigned int *threadgroupDepths, unsigned char **inputs,
+                         int **inputSizes, int *numInputs, int **bufferIds,
+                         unsigned long **bufferOffsets, int *numBufferIds,
+                         unsigned long **threadgroupMemory,
+                         int *numThreadgroupMemory, const char **error,
+                         int *errorCode, int *failedDispatch,
+                         int *failedArgument, int *commandBufferError);
 _Bool function_run_async(int functionId, unsigned int width,
-                         unsigned int height, unsigned int depth, float *inputs,
-                         int numInputs, int *bufferIds, int numBufferIds,
-                         void **handle, const char **error, int *errorCode);
+                         unsigned int height, unsigned int depth,
+                         unsigned int threadgroupWidth,
+                         unsigned int threadgroupHeight,
+                         unsigned int threadgroupDepth, unsigned char *inputs,
+                         int *inputSizes, int numInputs, int *bufferIds,
+                         unsigned long *bufferOffsets, int numBufferIds,
+                         unsigned long *threadgroupMemory,
+                         int numThreadgroupMemory, uintptr_t callback,
+                         const char **error, int *errorCode);
 _Bool function_run_batch_async(int numDispatches, int *functionIds,
                                unsigned int *widths, unsigned int *heights,
-                               unsigned int *depths, float **inputs,
+                               unsigned int *depths,
+                               unsigned int *threadgroupWidths,
+                               unsigned int *threadgroupHeights,
+                               unsigned int *threadgroupDepths,
+                               unsigned char **inputs, int **inputSizes,
                                int *numInputs, int **bufferIds,
-                               int *numBufferIds, void **handle,
-                               const char **error, int *errorCode);
-_Bool function_wait(void *handle, const char **error);
+                               unsigned long **bufferOffsets,
+                               int *numBufferIds,
+                               unsigned long **threadgroupMemory,
+                               int *numThreadgroupMemory, uintptr_t callback,
+                               const char **error, int *errorCode,
+                               int *failedDispatch, int *failedArgument);
 
 // Functions for querying data on a metal function
 const char *function_name(int functionId);
+_Bool function_limits(int functionId, int *threadExecutionWidth,
+                      int *maxTotalThreadsPerThreadgroup,
+                      int *maxThreadgroupMemoryLength,
+                      int *staticThreadgroupMemoryLength,
+                      int *constantOffsetAlignment);
+
+// The kind of memory a FunctionArgument is bound to.
+enum FunctionArgumentKind {
+  FunctionArgumentBuffer = 0,
+  FunctionArgumentThreadgroupMemory = 1,
+};
+
+// One argument of a metal function, as reported by its pipeline's reflection.
+// name and typeName are heap-allocated; typeName is empty if the element type
+// is not a scalar or vector type.
+typedef struct {
+  int index;
+  char *name;
+  char *typeName;
+  int kind;
+  _Bool readOnly;
+} FunctionArgument;
+
+int function_arguments(int functionId, FunctionArgument **arguments,
+                       const char **error, int *errorCode);
+void function_arguments_free(FunctionArgument *arguments, int numArguments);
 
 // Functions that must be called once for every buffer used as an argument to
 // a metal function
 int buffer_new(size_t size, void **contents, const char **error);
 _Bool buffer_close(int bufferId, const char **error, int *errorCode);
 
+// Functions for libraries, which functions can be set up from
+int library_new_with_source(const char *metalCode,
+                            const CompileOptions *options, char ***names,
+                            int *numNames, const char **log,
+                            const char **error, int *errorCode);
+int library_new_with_data(const void *data, size_t length, char ***names,
+                          int *numNames, const char **error);
+void library_names_free(char **names, int numNames);
+int library_function(int libraryId, const char *funcName,
+                     const CompileOptions *options, const char **error,
+                     int *errorCode);
+
 // Functions for closing metal resources
 _Bool function_close(int functionId, const char **error, int *errorCode);
+_Bool library_close(int libraryId, const char **error, int *errorCode);
 
 #endif
\ No newline at end of file
@@ -1,7 +1,11 @@
+//go:build darwin
+
 #import "BufferCache.h"
 #import "FunctionCache.h"
+#import "LibraryCache.h"
 #import "Metal.h"
 #import "MetalInternal.h"
+#include <string.h>
 #import <Metal/Metal.h>
 
 // This package relies on ARC to manage the lifetimes of its Metal objects
@@ -34,11 +38,24 @@ _Bool metal_init(void) {
       return false;
     }
     buffer_cache_init();
+    library_cache_init();
 
     return true;
   }
 }
 
+// Describe the device and the system it runs on, which together decide whether
+// a compiled pipeline can be reused. The result is heap-allocated; the caller
+// must free it.
+char *metal_device_identity(void) {
+  @autoreleasepool {
+    NSString *identity = [NSString
+        stringWithFormat:@"%@; %@", device.name,
+                         [[NSProcessInfo processInfo] operatingSystemVersionString]];
+    return strdup(identity.UTF8String);
+  }
+}
+
 // metal_device returns the shared MTLDevice initialized by metal_init.
 id<MTLDevice> metal_device(void) {
   return device;
@@ -0,0 +1,288 @@
+package metal
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/green-aloe/metal/internal/msl"
+)
+
+// ----------------------------------------------------------------------------
+// Function arguments
+// ----------------------------------------------------------------------------
+
+// An AddressSpace is the memory region that a kernel argument lives in.
+type AddressSpace int
+
+const (
+	// AddressSpaceThread is the private memory of one thread. Arguments that are passed by value,
+	// such as thread positions, are in this address space.
+	AddressSpaceThread AddressSpace = iota
+	// AddressSpaceDevice is buffer memory that the kernel can read and write.
+	AddressSpaceDevice
+	// AddressSpaceConstant is read-only buffer memory.
+	AddressSpaceConstant
+	// AddressSpaceThreadgroup is memory shared by the threads of one threadgroup.
+	AddressSpaceThreadgroup
+)
+
+// String returns the name of the address space as it is written in MSL.
+func (a AddressSpace) String() string {
+	switch a {
+	case AddressSpaceThread:
+		return "thread"
+	case AddressSpaceDevice:
+		return "device"
+	case AddressSpaceConstant:
+		return "constant"
+	case AddressSpaceThreadgroup:
+		return "threadgroup"
+	default:
+		return fmt.Sprintf("AddressSpace(%d)", int(a))
+	}
+}
+
+// An Argument describes one parameter of a metal function.
+type Argument struct {
+	// Index is the argument's index in the argument table it is bound from: its buffer index for a
+	// device or constant pointer or reference, its threadgroup memory index for a threadgroup
+	// pointer, and its texture or sampler index for a texture or sampler. It is -1 for an argument
+	// that is not bound by the caller, such as a thread position.
+	Index int
+	// Name is the parameter's name.
+	Name string
+	// Type is the element type: the type that the argument points to or references, or the type of
+	// an argument passed by value, such as "float" or "uint2".
+	Type string
+	// AddressSpace is the address space of the argument's memory.
+	AddressSpace AddressSpace
+	// Pointer reports whether the argument is a pointer or a reference, and so is bound to memory
+	// rather than passed by value.
+	Pointer bool
+	// Const reports whether the memory of a pointer or reference is declared const, as in device
+	// const float *, so the kernel only reads it. It is only set from the source.
+	Const bool
+	// Attribute is the parameter's attribute without the brackets, such as "buffer(1)" or
+	// "thread_position_in_grid", or "" if it has none. Several attributes are separated by commas.
+	Attribute string
+}
+
+// parseArguments describes the parameters of the kernel called funcName by parsing its signature in
+// source.
+func parseArguments(source, funcName string) ([]Argument, error) {
+	sigs, err := msl.ParseSignatures(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse function signature: %w", err)
+	}
+
+	for _, sig := range sigs {
+		if sig.Name != funcName {
+			continue
+		}
+
+		args := make([]Argument, len(sig.Params))
+		for i, param := range sig.Params {
+			attrs := make([]string, len(param.Attributes))
+			for j, attr := range param.Attributes {
+				attrs[j] = attr.String()
+			}
+
+			args[i] = Argument{
+				Index:        param.Index,
+				Name:         param.Name,
+				Type:         param.TypeName,
+				AddressSpace: addressSpace(param.Type.Space),
+				Pointer:      param.Type.Pointer,
+				Const:        param.Type.Pointer && param.Type.Const,
+				Attribute:    strings.Join(attrs, ", "),
+			}
+		}
+		return args, nil
+	}
+
+	return nil, fmt.Errorf("failed to find function '%s'", funcName)
+}
+
+// addressSpace converts an interpreter address space to the package's.
+func addressSpace(space msl.AddressSpace) AddressSpace {
+	switch space {
+	case msl.Device:
+		return AddressSpaceDevice
+	case msl.Constant:
+		return AddressSpaceConstant
+	case msl.Threadgroup:
+		return AddressSpaceThreadgroup
+	default:
+		return AddressSpaceThread
+	}
+}
+
+// mergeArguments combines the arguments parsed from a function's source with the ones its backend
+// reflected from the compiled pipeline. Reflection is authoritative for what it reports, namely the
+// index and element type of each bound argument, while only the source has the address spaces and
+// attributes, and the arguments that are not bound at all. An argument is matched by name, since
+// reflection reports arguments by table rather than in declaration order.
+func mergeArguments(parsed, reflected []Argument) []Argument {
+	byName := make(map[string]Argument, len(reflected))
+	for _, arg := range reflected {
+		byName[arg.Name] = arg
+	}
+
+	merged := make([]Argument, len(parsed))
+	for i, arg := range parsed {
+		if r, ok := byName[arg.Name]; ok {
+			arg.Index = r.Index
+			if r.Type != "" {
+				arg.Type = r.Type
+			}
+		}
+		merged[i] = arg
+	}
+
+	return merged
+}
+
+// ----------------------------------------------------------------------------
+// Argument validation
+// ----------------------------------------------------------------------------
+
+// An ArgumentError reports an input or buffer that does not match the kernel's signature. Run and
+// the other dispatch methods return one, before anything is dispatched, when
+// RunParameters.Validate is set. Use errors.As to retrieve it.
+type ArgumentError struct {
+	// Index is the buffer index that the argument is bound at. Inputs are bound first, from index
+	// 0, followed by the buffers.
+	Index int
+	// Name is the name of the kernel parameter at Index, or "" if the kernel has none there.
+	Name string
+	// Msg describes the mismatch.
+	Msg string
+}
+
+func (e *ArgumentError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("invalid argument at buffer index %d: %s", e.Index, e.Msg)
+	}
+	return fmt.Sprintf("invalid argument '%s' at buffer index %d: %s", e.Name, e.Index, e.Msg)
+}
+
+// A boundArgument is one input or buffer of a dispatch, in the order it is bound: the Go element
+// type of its data and its total size.
+type boundArgument struct {
+	input    bool
+	elem     msl.Scalar
+	numBytes int
+	// structType is the Go type of a struct input, whose elem is msl.Void.
+	structType string
+	// offset is the byte offset of a buffer range in its buffer.
+	offset int
+}
+
+// validateArguments checks the inputs and buffers of a dispatch, in binding order, against the
+// kernel arguments args. Every buffer argument of the kernel must be bound; nothing may be bound
+// where the kernel has no buffer argument; inputs must be bound to arguments that the kernel only
+// reads, constant or device const; and each argument's data must have the element type the kernel
+// expects and hold a whole number of its elements. The offset of a buffer range must be aligned for
+// the element type and, for a constant argument, to constantAlign bytes, which is the backend's
+// pipelineLimits.constantOffsetAlignment and has no effect if it is 0 or 1. An element type that is
+// not a scalar or vector, such as a struct, is not checked.
+func validateArguments(args []Argument, bound []boundArgument, constantAlign int) error {
+	byIndex := make(map[int]Argument)
+	for _, arg := range args {
+		if arg.Pointer && arg.Index >= 0 && (arg.AddressSpace == AddressSpaceDevice || arg.AddressSpace == AddressSpaceConstant) {
+			byIndex[arg.Index] = arg
+		}
+	}
+
+	for i, b := range bound {
+		arg, ok := byIndex[i]
+		if !ok {
+			return &ArgumentError{Index: i, Msg: "the kernel has no buffer argument at this index"}
+		}
+		// setBytes:length:atIndex: binds an input to any argument the kernel only reads.
+		if b.input && arg.AddressSpace != AddressSpaceConstant && !(arg.AddressSpace == AddressSpaceDevice && arg.Const) {
+			return &ArgumentError{Index: i, Name: arg.Name, Msg: fmt.Sprintf("an input cannot be bound to a %s argument", arg.AddressSpace)}
+		}
+		if arg.AddressSpace == AddressSpaceConstant && constantAlign > 1 && b.offset%constantAlign != 0 {
+			return &ArgumentError{Index: i, Name: arg.Name, Msg: fmt.Sprintf("offset %d of a constant buffer is not a multiple of %d bytes", b.offset, constantAlign)}
+		}
+
+		typ, ok := msl.LookupType(arg.Type)
+		if !ok {
+			continue
+		}
+		if !compatibleElement(typ.Scalar, b.elem) {
+			what, held := "buffer holds", goTypeName(b.elem)
+			if b.input {
+				what = "input is"
+			}
+			if b.structType != "" {
+				held = b.structType
+			}
+			return &ArgumentError{Index: i, Name: arg.Name, Msg: fmt.Sprintf("%s %s, but the kernel expects %s", what, held, typ)}
+		}
+		if b.numBytes%typ.Size() != 0 {
+			return &ArgumentError{Index: i, Name: arg.Name, Msg: fmt.Sprintf("%d bytes is not a whole number of %s elements (%d bytes each)", b.numBytes, typ, typ.Size())}
+		}
+		if b.offset%typ.Align() != 0 {
+			return &ArgumentError{Index: i, Name: arg.Name, Msg: fmt.Sprintf("offset %d is not aligned for %s (%d bytes)", b.offset, typ, typ.Align())}
+		}
+	}
+
+	// Report the lowest unbound index, so the error points at the first missing argument.
+	missing := -1
+	for index := range byIndex {
+		if index >= len(bound) && (missing < 0 || index < missing) {
+			missing = index
+		}
+	}
+	if missing >= 0 {
+		return &ArgumentError{Index: missing, Name: byIndex[missing].Name, Msg: fmt.Sprintf("missing argument; only %d inputs and buffers were supplied", len(bound))}
+	}
+
+	return nil
+}
+
+// compatibleElement reports whether data whose Go element type is elem can be bound to a kernel
+// argument whose element scalar is want. Go has no 16-bit float, so half data is held in uint16s,
+// and bool data in uint8s.
+func compatibleElement(want, elem msl.Scalar) bool {
+	switch {
+	case want == elem:
+		return true
+	case want == msl.Half:
+		return elem == msl.UShort
+	case want == msl.Bool:
+		return elem == msl.UChar
+	default:
+		return false
+	}
+}
+
+// goTypeName returns the name of the Go type that holds elements of the scalar s.
+func goTypeName(s msl.Scalar) string {
+	switch s {
+	case msl.Char:
+		return "int8"
+	case msl.UChar:
+		return "uint8"
+	case msl.Short:
+		return "int16"
+	case msl.UShort:
+		return "uint16"
+	case msl.Int:
+		return "int32"
+	case msl.UInt:
+		return "uint32"
+	case msl.Float:
+		return "float32"
+	default:
+		return s.String()
+	}
+}
+
+// elementScalar returns the scalar held by a buffer's data, a slice of a BufferType.
+func elementScalar(data any) msl.Scalar {
+	return kindScalar(reflect.TypeOf(data).Elem().Kind())
+}
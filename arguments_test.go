@@ -0,0 +1,281 @@
+package metal
+
+import (
+	"testing"
+
+	"github.com/green-aloe/metal/internal/msl"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_AddressSpace_String(t *testing.T) {
+	require.Equal(t, "thread", AddressSpaceThread.String())
+	require.Equal(t, "device", AddressSpaceDevice.String())
+	require.Equal(t, "constant", AddressSpaceConstant.String())
+	require.Equal(t, "threadgroup", AddressSpaceThreadgroup.String())
+	require.Equal(t, "AddressSpace(9)", AddressSpace(9).String())
+}
+
+// Test_parseArguments tests that a kernel's arguments are described from its signature.
+func Test_parseArguments(t *testing.T) {
+	type subtest struct {
+		name     string
+		source   string
+		funcName string
+		args     []Argument
+		err      string
+	}
+
+	subtests := []subtest{
+		{
+			name:     "sine",
+			source:   sourceSine,
+			funcName: "sine",
+			args: []Argument{
+				{Index: 0, Name: "mult", Type: "float", AddressSpace: AddressSpaceConstant, Pointer: true},
+				{Index: 1, Name: "input", Type: "float", AddressSpace: AddressSpaceConstant, Pointer: true},
+				{Index: 2, Name: "result", Type: "float", AddressSpace: AddressSpaceDevice, Pointer: true},
+				{Index: -1, Name: "pos", Type: "uint", Attribute: "thread_position_in_grid"},
+			},
+		},
+		{
+			name: "attributes",
+			source: `
+struct Params { float2 scale; };
+kernel void k(constant Params &params [[buffer(3)]],
+              device atomic_uint *counter,
+              threadgroup half4 *scratch [[threadgroup(1)]],
+              uint2 pos [[thread_position_in_grid]], uint i [[thread_index_in_threadgroup]]) {}`,
+			funcName: "k",
+			args: []Argument{
+				{Index: 3, Name: "params", Type: "Params", AddressSpace: AddressSpaceConstant, Pointer: true, Attribute: "buffer(3)"},
+				{Index: 4, Name: "counter", Type: "atomic_uint", AddressSpace: AddressSpaceDevice, Pointer: true},
+				{Index: 1, Name: "scratch", Type: "half4", AddressSpace: AddressSpaceThreadgroup, Pointer: true, Attribute: "threadgroup(1)"},
+				{Index: -1, Name: "pos", Type: "uint2", Attribute: "thread_position_in_grid"},
+				{Index: -1, Name: "i", Type: "uint", Attribute: "thread_index_in_threadgroup"},
+			},
+		},
+		{
+			name: "const",
+			source: `
+kernel void k(device const float *input, const device float2 &scale, device float *const result,
+              const uint n [[thread_position_in_grid]]) {}`,
+			funcName: "k",
+			args: []Argument{
+				{Index: 0, Name: "input", Type: "float", AddressSpace: AddressSpaceDevice, Pointer: true, Const: true},
+				{Index: 1, Name: "scale", Type: "float2", AddressSpace: AddressSpaceDevice, Pointer: true, Const: true},
+				{Index: 2, Name: "result", Type: "float", AddressSpace: AddressSpaceDevice, Pointer: true},
+				{Index: -1, Name: "n", Type: "uint", Attribute: "thread_position_in_grid"},
+			},
+		},
+		{
+			name:     "no arguments",
+			source:   "kernel void k() {}",
+			funcName: "k",
+			args:     []Argument{},
+		},
+		{
+			name:     "missing function",
+			source:   sourceSine,
+			funcName: "cosine",
+			err:      "failed to find function 'cosine'",
+		},
+		{
+			name:     "invalid signature",
+			source:   "kernel void k(device float *a",
+			funcName: "k",
+			err:      "failed to parse function signature: 1:30: expected ')', found end of file",
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			args, err := parseArguments(subtest.source, subtest.funcName)
+			if subtest.err != "" {
+				require.EqualError(t, err, subtest.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, subtest.args, args)
+		})
+	}
+}
+
+// Test_mergeArguments tests that reflected arguments override the index and element type of the
+// parsed ones they match, and leave the rest alone.
+func Test_mergeArguments(t *testing.T) {
+	parsed := []Argument{
+		{Index: 0, Name: "params", Type: "Params", AddressSpace: AddressSpaceConstant, Pointer: true},
+		{Index: 1, Name: "input", Type: "real", AddressSpace: AddressSpaceDevice, Pointer: true},
+		{Index: -1, Name: "pos", Type: "uint", Attribute: "thread_position_in_grid"},
+	}
+	reflected := []Argument{
+		{Index: 2, Name: "input", Type: "float", AddressSpace: AddressSpaceConstant, Pointer: true},
+		{Index: 0, Name: "params", AddressSpace: AddressSpaceConstant, Pointer: true},
+	}
+
+	require.Equal(t, []Argument{
+		{Index: 0, Name: "params", Type: "Params", AddressSpace: AddressSpaceConstant, Pointer: true},
+		{Index: 2, Name: "input", Type: "float", AddressSpace: AddressSpaceDevice, Pointer: true},
+		{Index: -1, Name: "pos", Type: "uint", Attribute: "thread_position_in_grid"},
+	}, mergeArguments(parsed, reflected))
+
+	require.Equal(t, parsed, mergeArguments(parsed, nil))
+}
+
+// Test_validateArguments tests that the inputs and buffers of a dispatch are checked against the
+// kernel's arguments.
+func Test_validateArguments(t *testing.T) {
+	sine := []Argument{
+		{Index: 0, Name: "mult", Type: "float", AddressSpace: AddressSpaceConstant, Pointer: true},
+		{Index: 1, Name: "input", Type: "float", AddressSpace: AddressSpaceConstant, Pointer: true},
+		{Index: 2, Name: "result", Type: "float", AddressSpace: AddressSpaceDevice, Pointer: true},
+		{Index: -1, Name: "pos", Type: "uint", Attribute: "thread_position_in_grid"},
+	}
+	input := boundArgument{input: true, elem: msl.Float, numBytes: 4}
+	floats := boundArgument{elem: msl.Float, numBytes: 40}
+
+	type subtest struct {
+		name          string
+		args          []Argument
+		bound         []boundArgument
+		constantAlign int
+		err           string
+	}
+
+	subtests := []subtest{
+		{name: "valid", args: sine, bound: []boundArgument{input, floats, floats}},
+		{name: "buffers only", args: sine, bound: []boundArgument{floats, floats, floats}},
+		{
+			name:  "too few",
+			args:  sine,
+			bound: []boundArgument{input, floats},
+			err:   "invalid argument 'result' at buffer index 2: missing argument; only 2 inputs and buffers were supplied",
+		},
+		{
+			name:  "too many",
+			args:  sine,
+			bound: []boundArgument{input, floats, floats, floats},
+			err:   "invalid argument at buffer index 3: the kernel has no buffer argument at this index",
+		},
+		{
+			name:  "input to device",
+			args:  sine,
+			bound: []boundArgument{input, input, input},
+			err:   "invalid argument 'result' at buffer index 2: an input cannot be bound to a device argument",
+		},
+		{
+			name: "input to device const",
+			args: []Argument{
+				{Index: 0, Name: "count", Type: "float", AddressSpace: AddressSpaceDevice, Pointer: true, Const: true},
+				{Index: 1, Name: "result", Type: "float", AddressSpace: AddressSpaceDevice, Pointer: true},
+			},
+			bound: []boundArgument{input, floats},
+		},
+		{
+			name:  "element type",
+			args:  sine,
+			bound: []boundArgument{input, floats, {elem: msl.Short, numBytes: 20}},
+			err:   "invalid argument 'result' at buffer index 2: buffer holds int16, but the kernel expects float",
+		},
+		{
+			name:  "input type",
+			args:  []Argument{{Index: 0, Name: "count", Type: "uint", AddressSpace: AddressSpaceConstant, Pointer: true}},
+			bound: []boundArgument{input},
+			err:   "invalid argument 'count' at buffer index 0: input is float32, but the kernel expects uint",
+		},
+		{
+			name:  "element size",
+			args:  []Argument{{Index: 0, Name: "points", Type: "float4", AddressSpace: AddressSpaceDevice, Pointer: true}},
+			bound: []boundArgument{{elem: msl.Float, numBytes: 24}},
+			err:   "invalid argument 'points' at buffer index 0: 24 bytes is not a whole number of float4 elements (16 bytes each)",
+		},
+		{
+			name:  "vector",
+			args:  []Argument{{Index: 0, Name: "points", Type: "float4", AddressSpace: AddressSpaceDevice, Pointer: true}},
+			bound: []boundArgument{{elem: msl.Float, numBytes: 32}},
+		},
+		{
+			name:  "half",
+			args:  []Argument{{Index: 0, Name: "values", Type: "half", AddressSpace: AddressSpaceDevice, Pointer: true}},
+			bound: []boundArgument{{elem: msl.UShort, numBytes: 8}},
+		},
+		{
+			name:  "struct",
+			args:  []Argument{{Index: 0, Name: "params", Type: "Params", AddressSpace: AddressSpaceConstant, Pointer: true}},
+			bound: []boundArgument{{elem: msl.UChar, numBytes: 7}},
+		},
+		{
+			name:  "range offset",
+			args:  []Argument{{Index: 0, Name: "points", Type: "float4", AddressSpace: AddressSpaceDevice, Pointer: true}},
+			bound: []boundArgument{{elem: msl.Float, numBytes: 32, offset: 8}},
+			err:   "invalid argument 'points' at buffer index 0: offset 8 is not aligned for float4 (16 bytes)",
+		},
+		{
+			name:          "constant range offset",
+			args:          sine,
+			bound:         []boundArgument{input, {elem: msl.Float, numBytes: 40, offset: 64}, floats},
+			constantAlign: 256,
+			err:           "invalid argument 'input' at buffer index 1: offset 64 of a constant buffer is not a multiple of 256 bytes",
+		},
+		{
+			name:          "aligned range offsets",
+			args:          sine,
+			bound:         []boundArgument{input, {elem: msl.Float, numBytes: 40, offset: 512}, {elem: msl.Float, numBytes: 40, offset: 4}},
+			constantAlign: 256,
+		},
+		{
+			name:          "constant range offset on an Apple GPU",
+			args:          sine,
+			bound:         []boundArgument{input, {elem: msl.Float, numBytes: 40, offset: 64}, floats},
+			constantAlign: 4,
+		},
+		{
+			name:          "unaligned constant range offset on an Apple GPU",
+			args:          []Argument{{Index: 0, Name: "bytes", Type: "uchar", AddressSpace: AddressSpaceConstant, Pointer: true}},
+			bound:         []boundArgument{{elem: msl.UChar, numBytes: 8, offset: 2}},
+			constantAlign: 4,
+			err:           "invalid argument 'bytes' at buffer index 0: offset 2 of a constant buffer is not a multiple of 4 bytes",
+		},
+		{
+			name:  "constant range offset without an alignment",
+			args:  []Argument{{Index: 0, Name: "bytes", Type: "uchar", AddressSpace: AddressSpaceConstant, Pointer: true}},
+			bound: []boundArgument{{elem: msl.UChar, numBytes: 8, offset: 2}},
+		},
+		{
+			name: "explicit indexes",
+			args: []Argument{
+				{Index: 1, Name: "b", Type: "int", AddressSpace: AddressSpaceDevice, Pointer: true},
+				{Index: 0, Name: "a", Type: "int", AddressSpace: AddressSpaceDevice, Pointer: true},
+				{Index: 0, Name: "scratch", Type: "int", AddressSpace: AddressSpaceThreadgroup, Pointer: true},
+			},
+			bound: []boundArgument{{elem: msl.Int, numBytes: 4}, {elem: msl.Int, numBytes: 4}},
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			err := validateArguments(subtest.args, subtest.bound, subtest.constantAlign)
+			if subtest.err == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			var argErr *ArgumentError
+			require.ErrorAs(t, err, &argErr)
+			require.EqualError(t, err, subtest.err)
+		})
+	}
+}
+
+func Test_elementScalar(t *testing.T) {
+	type celsius float32
+
+	require.Equal(t, msl.Float, elementScalar([]float32{}))
+	require.Equal(t, msl.Float, elementScalar([]celsius{}))
+	require.Equal(t, msl.Char, elementScalar([]int8{}))
+	require.Equal(t, msl.UChar, elementScalar([]uint8{}))
+	require.Equal(t, msl.Short, elementScalar([]int16{}))
+	require.Equal(t, msl.UShort, elementScalar([]uint16{}))
+	require.Equal(t, msl.Int, elementScalar([]int32{}))
+	require.Equal(t, msl.UInt, elementScalar([]uint32{}))
+}
@@ -0,0 +1,146 @@
+package metal
+
+import (
+	"unsafe"
+)
+
+// ----------------------------------------------------------------------------
+// Execution backend
+// ----------------------------------------------------------------------------
+
+// A backend is the execution layer behind the public API. The exported functions and methods in
+// this package validate their arguments in Go and then hand off to a backend, which owns the actual
+// resources (compiled pipelines, buffer memory, in-flight command buffers). The Objective-C Metal
+// implementation is one backend (darwin only); platforms without Metal get a backend that reports
+// ErrMetalUnavailable from every call.
+//
+// Ids handed out by a backend are only meaningful to that same backend. Every method must be safe
+// for concurrent use, matching the concurrency guarantees of the public API.
+type backend interface {
+	// available returns nil if the backend can run computations, or the error every other call
+	// would fail with if it cannot.
+	available() error
+
+	// newFunction compiles funcName from source with opts, which are nil for the defaults, and
+	// returns its id, which is always positive on success, and the warnings and notes that the
+	// compiler reported. If the source does not compile, the error wraps a *CompileError.
+	newFunction(source, funcName string, opts *CompileOptions) (int32, []Diagnostic, error)
+	// functionName returns the name of the function with the given id, or the empty string if the
+	// id is unknown.
+	functionName(id int32) string
+	// closeFunction releases the function with the given id.
+	closeFunction(id int32) error
+	// limits returns the threadgroup limits of the compiled pipeline for the function with the given
+	// id, or false if the id is unknown.
+	limits(id int32) (pipelineLimits, bool)
+	// arguments returns the arguments of the function with the given id as the backend's compiled
+	// pipeline reports them, which covers only the arguments bound to memory, or nil if the backend
+	// has no such reflection data.
+	arguments(id int32) ([]Argument, error)
+
+	// newLibrary compiles every function in source into a library with opts, as newFunction does.
+	// It returns the library's id, which is always positive on success, the names of the kernel
+	// functions in it, and the warnings and notes that the compiler reported.
+	newLibrary(source string, opts *CompileOptions) (int32, []string, []Diagnostic, error)
+	// loadLibrary loads the compiled metallib file in data, as newLibrary does from source.
+	loadLibrary(data []byte) (int32, []string, error)
+	// libraryFunction sets up the function called funcName from the library with the given id, as
+	// newFunction does from source, and returns its id. opts are the options the library was
+	// compiled with, whose constants specialize the function; they are nil for a loaded library.
+	libraryFunction(libraryId int32, funcName string, opts *CompileOptions) (int32, error)
+	// closeLibrary releases the library with the given id. Functions set up from it stay valid.
+	closeLibrary(id int32) error
+
+	// newBuffer allocates numBytes of memory that is shared between the CPU and the backend's
+	// device. It returns the buffer's id, which is always positive on success, and a pointer to the
+	// start of its contents.
+	newBuffer(numBytes int) (int32, unsafe.Pointer, error)
+	// closeBuffer releases the buffer with the given id.
+	closeBuffer(id int32) error
+
+	// run executes one dispatch and blocks until it finishes.
+	run(d dispatch) error
+	// runBatch executes every dispatch as a single unit of work and blocks until all of them
+	// finish. ds is never empty.
+	runBatch(ds []dispatch) error
+	// runAsync starts one dispatch and returns without waiting for it to finish, reporting its
+	// progress to c. If it returns an error, nothing was started and c is never told anything.
+	runAsync(d dispatch, c completion) error
+	// runBatchAsync starts every dispatch as a single unit of work and returns without waiting for
+	// them to finish, reporting their progress to c like runAsync. ds is never empty.
+	runBatchAsync(ds []dispatch, c completion) error
+}
+
+// A completion is told about the progress of the work that runAsync or runBatchAsync started; a
+// RunHandle is one. running is called once the device takes the work on, by backends that can
+// tell, which for Metal is when the command buffer is scheduled on the device. finish is called
+// exactly once, with the work's result, after it finishes and the backend has released whatever it
+// held for it. Either may be called before runAsync returns.
+type completion interface {
+	running()
+	finish(err error)
+}
+
+// A dispatch is one validated unit of work for a backend: a function, the grid to run it over, and
+// the arguments to bind. It is built from RunParameters by RunParameters.dispatch, so by the time a
+// backend sees it every grid dimension has already been checked and clamped. threadgroup is the size
+// of each threadgroup, which Function.dispatch chooses within the function's limits, so every
+// dimension of it is positive, and threadgroupMemory holds the length of each threadgroup memory
+// argument, already rounded and checked, or nil if there are none. structs holds the packed bytes
+// of each struct input, which are bound after inputs and before the buffers. spans is nil when
+// every buffer is bound whole; otherwise it holds one span per buffer Id, and a zero span also
+// binds the whole buffer.
+type dispatch struct {
+	functionId        int32
+	width             uint32
+	height            uint32
+	depth             uint32
+	threadgroup       Grid
+	threadgroupMemory []int
+	inputs            []Scalar
+	structs           [][]byte
+	bufferIds         []BufferId
+	spans             []bufferSpan
+}
+
+// span returns the span of the ith buffer of d, which is the zero span if the buffer is bound
+// whole.
+func (d dispatch) span(i int) bufferSpan {
+	if d.spans == nil {
+		return bufferSpan{}
+	}
+	return d.spans[i]
+}
+
+// bufferArgument returns the buffer index that the ith buffer of d is bound at, which follows its
+// inputs and struct inputs.
+func (d dispatch) bufferArgument(i int) int {
+	return len(d.inputs) + len(d.structs) + i
+}
+
+// defaultBackend is the platform backend: Metal on darwin with cgo, and a backend that is never
+// available everywhere else. It is set exactly once by the platform-specific init (before any other
+// goroutine can run) and only read afterward, so it needs no synchronization.
+var defaultBackend backend
+
+// functionBackend returns the backend that NewFunction builds new functions on: the CPU backend if
+// it is forced by CPUOptions.Force or if the platform backend is unavailable, and the platform
+// backend otherwise.
+func functionBackend() backend {
+	if currentCPUOptions().Force || defaultBackend.available() != nil {
+		return cpu
+	}
+	return defaultBackend
+}
+
+// bufferBackend returns the backend that owns buffer memory: the platform backend if it is
+// available, and the CPU backend otherwise. Unlike functionBackend this never changes during the
+// life of the process, so every buffer is closed by the backend that created it. The CPU backend
+// reads buffers through the buffer registry rather than through the backend that allocated them,
+// so CPU functions can use buffers from either.
+func bufferBackend() backend {
+	if defaultBackend.available() == nil {
+		return defaultBackend
+	}
+	return cpu
+}
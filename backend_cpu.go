@@ -0,0 +1,654 @@
+package metal
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/green-aloe/metal/internal/msl"
+)
+
+// cpu is the CPU backend. It runs functions whose kernels were registered with RegisterCPUKernel,
+// interprets the metal source of any other function, and allocates buffer memory from the Go heap
+// when Metal is unavailable.
+var cpu = &cpuBackend{
+	functions: make(map[int32]cpuFunction),
+	libraries: make(map[int32]cpuLibrary),
+	memory:    make(map[int32][]uint64),
+}
+
+// cpuBackend runs kernels on goroutines with the same dispatch semantics as the Metal backend. Its
+// function and buffer ids come from their own counters, just as the Objective-C caches keep their
+// own.
+type cpuBackend struct {
+	mu             sync.Mutex
+	functions      map[int32]cpuFunction
+	nextFunctionId int32
+	libraries      map[int32]cpuLibrary
+	nextLibraryId  int32
+	memory         map[int32][]uint64
+	nextBufferId   int32
+}
+
+// A cpuFunction is a kernel bound to the name it was created under: either a registered Go kernel
+// or, if none was registered, the interpreted MSL kernel.
+type cpuFunction struct {
+	name        string
+	kernel      CPUKernel
+	interpreted *msl.Kernel
+}
+
+// A cpuLibrary is the names of a library's kernels and, for a library built from source, the parsed
+// program that kernels without a registered Go implementation are interpreted from, or the error
+// that parsing it gave. A library loaded from a metallib has neither, since the CPU backend cannot
+// run its compiled code: only registered kernels can be set up from it.
+type cpuLibrary struct {
+	names   []string
+	program *msl.Program
+	err     error
+}
+
+func (b *cpuBackend) available() error {
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Functions
+// ----------------------------------------------------------------------------
+
+func (b *cpuBackend) newFunction(source, funcName string, opts *CompileOptions) (int32, []Diagnostic, error) {
+	if funcName == "" {
+		return 0, nil, newError("missing function name", "unable to set up metal function", errCodeNone)
+	}
+
+	function := cpuFunction{name: funcName, kernel: lookupCPUKernel(funcName)}
+	if function.kernel == nil {
+		kernel, err := interpret(source, funcName, opts)
+		if err != nil {
+			return 0, nil, unavailable(err)
+		}
+		function.interpreted = kernel
+	}
+
+	// The interpreter reports no warnings.
+	id, err := b.storeFunction(function)
+	return id, nil, err
+}
+
+// storeFunction stores function under the next function id and returns the id.
+func (b *cpuBackend) storeFunction(function cpuFunction) (int32, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.nextFunctionId == math.MaxInt32 {
+		return 0, newError("function id space exhausted", "unable to set up metal function", errCodeNone)
+	}
+	b.nextFunctionId++
+	b.functions[b.nextFunctionId] = function
+
+	return b.nextFunctionId, nil
+}
+
+// unavailable marks err with ErrMetalUnavailable if the CPU backend is only in use because Metal is
+// missing, so that callers testing for ErrMetalUnavailable still see it.
+func unavailable(err error) error {
+	if defaultBackend.available() != nil {
+		return sentinelError{err: err, sentinel: ErrMetalUnavailable}
+	}
+	return err
+}
+
+// interpret preprocesses source with opts, parses it, and compiles its kernel called funcName,
+// reporting problems the way the Metal compiler's are reported.
+func interpret(source, funcName string, opts *CompileOptions) (*msl.Kernel, error) {
+	if source == "" {
+		return nil, newError("missing metal code", "unable to set up metal function", errCodeNone)
+	}
+
+	source, err := opts.preprocess(source)
+	if err != nil {
+		return nil, interpreterError(err, "unable to set up metal function")
+	}
+
+	program, err := msl.ParseSpecialized(source, opts.constantValues())
+	if err != nil {
+		return nil, interpreterError(err, "unable to set up metal function")
+	}
+
+	return compileKernel(program, funcName)
+}
+
+// compileKernel compiles the kernel called funcName in program, as interpret does.
+func compileKernel(program *msl.Program, funcName string) (*msl.Kernel, error) {
+	if !slices.Contains(program.Kernels(), funcName) {
+		return nil, newError(fmt.Sprintf("failed to find function '%s'", funcName), "unable to set up metal function", errCodeNone)
+	}
+
+	kernel, err := program.Kernel(funcName)
+	if err != nil {
+		return nil, newError(fmt.Sprintf("failed to create pipeline: %s", err), "unable to set up metal function", errCodeNone)
+	}
+
+	return kernel, nil
+}
+
+func (b *cpuBackend) functionName(id int32) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.functions[id].name
+}
+
+func (b *cpuBackend) closeFunction(id int32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.functions[id]; !ok {
+		return newError(fmt.Sprintf("invalid function id: %d", id), "unable to close metal function", errCodeInvalidFunctionId)
+	}
+	delete(b.functions, id)
+
+	return nil
+}
+
+// limits reports the limits set by CPUOptions, which every CPU function shares.
+func (b *cpuBackend) limits(id int32) (pipelineLimits, bool) {
+	if _, ok := b.lookupFunction(id); !ok {
+		return pipelineLimits{}, false
+	}
+
+	return currentCPUOptions().limits(), true
+}
+
+func (b *cpuBackend) arguments(id int32) ([]Argument, error) {
+	if _, ok := b.lookupFunction(id); !ok {
+		return nil, newError(fmt.Sprintf("invalid function id: %d", id), "unable to get metal function arguments", errCodeInvalidFunctionId)
+	}
+
+	// The CPU backend has no compiled pipeline to reflect on, so Function.Arguments describes its
+	// functions from their source alone.
+	return nil, nil
+}
+
+// lookupFunction returns the function with the given id, or false if there is none.
+func (b *cpuBackend) lookupFunction(id int32) (cpuFunction, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	function, ok := b.functions[id]
+	return function, ok
+}
+
+// ----------------------------------------------------------------------------
+// Libraries
+// ----------------------------------------------------------------------------
+
+func (b *cpuBackend) newLibrary(source string, opts *CompileOptions) (int32, []string, []Diagnostic, error) {
+	if source == "" {
+		return 0, nil, nil, newError("missing metal code", "unable to create metal library", errCodeNone)
+	}
+
+	source, err := opts.preprocess(source)
+	if err != nil {
+		return 0, nil, nil, unavailable(interpreterError(err, "unable to create metal library"))
+	}
+
+	// The kernels are listed from their declarations alone, so a library can be created even from
+	// source that the interpreter cannot run, for kernels that are registered.
+	sigs, err := msl.ParseSignatures(source)
+	if err != nil {
+		return 0, nil, nil, unavailable(interpreterError(err, "unable to create metal library"))
+	}
+	library := cpuLibrary{names: make([]string, len(sigs))}
+	for i, sig := range sigs {
+		library.names[i] = sig.Name
+	}
+
+	library.program, err = msl.ParseSpecialized(source, opts.constantValues())
+	if err != nil {
+		library.err = interpreterError(err, "unable to set up metal function")
+	}
+
+	// The interpreter reports no warnings.
+	id, names, err := b.storeLibrary(library, "unable to create metal library")
+	return id, names, nil, err
+}
+
+func (b *cpuBackend) loadLibrary(data []byte) (int32, []string, error) {
+	info, err := ReadLibraryInfo(data)
+	if err != nil {
+		return 0, nil, newError(fmt.Sprintf("failed to create library: %s", err), "unable to load metal library", errCodeNone)
+	}
+
+	return b.storeLibrary(cpuLibrary{names: info.kernels()}, "unable to load metal library")
+}
+
+// storeLibrary stores library under the next library id and returns the id and the names of the
+// library's kernels. wrap prefixes the error if there are no ids left.
+func (b *cpuBackend) storeLibrary(library cpuLibrary, wrap string) (int32, []string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.nextLibraryId == math.MaxInt32 {
+		return 0, nil, newError("library id space exhausted", wrap, errCodeNone)
+	}
+	b.nextLibraryId++
+	b.libraries[b.nextLibraryId] = library
+
+	return b.nextLibraryId, slices.Clone(library.names), nil
+}
+
+// libraryFunction ignores opts: the library's program was specialized with them when it was parsed.
+func (b *cpuBackend) libraryFunction(libraryId int32, funcName string, _ *CompileOptions) (int32, error) {
+	if funcName == "" {
+		return 0, newError("missing function name", "unable to set up metal function", errCodeNone)
+	}
+
+	b.mu.Lock()
+	library, ok := b.libraries[libraryId]
+	b.mu.Unlock()
+	if !ok {
+		return 0, newError(fmt.Sprintf("invalid library id: %d", libraryId), "unable to set up metal function", errCodeInvalidLibraryId)
+	}
+
+	if !slices.Contains(library.names, funcName) {
+		return 0, newError(fmt.Sprintf("failed to find function '%s'", funcName), "unable to set up metal function", errCodeNone)
+	}
+	function := cpuFunction{name: funcName, kernel: lookupCPUKernel(funcName)}
+	if function.kernel == nil {
+		switch {
+		case library.err != nil:
+			return 0, unavailable(library.err)
+		case library.program == nil:
+			return 0, unavailable(newError(fmt.Sprintf("no CPU kernel is registered for '%s'", funcName), "unable to set up metal function", errCodeNone))
+		}
+
+		kernel, err := compileKernel(library.program, funcName)
+		if err != nil {
+			return 0, unavailable(err)
+		}
+		function.interpreted = kernel
+	}
+
+	return b.storeFunction(function)
+}
+
+func (b *cpuBackend) closeLibrary(id int32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.libraries[id]; !ok {
+		return newError(fmt.Sprintf("invalid library id: %d", id), "unable to close metal library", errCodeInvalidLibraryId)
+	}
+	delete(b.libraries, id)
+
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Buffers
+// ----------------------------------------------------------------------------
+
+func (b *cpuBackend) newBuffer(numBytes int) (int32, unsafe.Pointer, error) {
+	// Allocate in 8-byte words so the contents are aligned for every BufferType (and for any wider
+	// element a kernel might read through the same memory).
+	memory := make([]uint64, (numBytes+7)/8)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.nextBufferId == math.MaxInt32 {
+		return 0, nil, newError("buffer id space exhausted", "unable to create buffer", errCodeNone)
+	}
+	b.nextBufferId++
+	b.memory[b.nextBufferId] = memory
+
+	return b.nextBufferId, unsafe.Pointer(&memory[0]), nil
+}
+
+func (b *cpuBackend) closeBuffer(id int32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.memory[id]; !ok {
+		return newError(fmt.Sprintf("invalid buffer id: %d", id), "unable to free buffer", errCodeInvalidBufferId)
+	}
+	delete(b.memory, id)
+
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Dispatch: synchronous, batched, and asynchronous
+// ----------------------------------------------------------------------------
+
+func (b *cpuBackend) run(d dispatch) error {
+	job, err := b.prepare(d)
+	if err != nil {
+		return newError(err.msg, "unable to run metal function", err.code)
+	}
+
+	if err := job.execute(currentCPUOptions()); err != nil {
+		return newError(err.Error(), "unable to run metal function", errCodeNone)
+	}
+
+	return nil
+}
+
+func (b *cpuBackend) runBatch(ds []dispatch) error {
+	jobs, index, err := b.prepareBatch(ds)
+	if err != nil {
+		return batchFailure(b, ds, index, err.argument, err.msg, "unable to run metal function batch",
+			err.code)
+	}
+
+	if index, err := executeBatch(jobs, currentCPUOptions()); err != nil {
+		return batchFailure(b, ds, index, -1, err.Error(), "unable to run metal function batch",
+			errCodeNone)
+	}
+
+	return nil
+}
+
+func (b *cpuBackend) runAsync(d dispatch, c completion) error {
+	job, err := b.prepare(d)
+	if err != nil {
+		return newError(err.msg, "unable to run metal function asynchronously", err.code)
+	}
+
+	b.startJobs([]cpuJob{job}, nil, c)
+	return nil
+}
+
+func (b *cpuBackend) runBatchAsync(ds []dispatch, c completion) error {
+	jobs, index, err := b.prepareBatch(ds)
+	if err != nil {
+		return batchFailure(b, ds, index, err.argument, err.msg,
+			"unable to run metal function batch asynchronously", err.code)
+	}
+
+	b.startJobs(jobs, ds, c)
+	return nil
+}
+
+// startJobs runs jobs in order on a new goroutine and reports their progress to c. ds is the batch
+// that the jobs were prepared from, or nil for a single dispatch.
+func (b *cpuBackend) startJobs(jobs []cpuJob, ds []dispatch, c completion) {
+	opts := currentCPUOptions()
+
+	go func() {
+		c.running()
+
+		var err error
+		if index, jobErr := executeBatch(jobs, opts); jobErr != nil {
+			if ds == nil {
+				err = newError(jobErr.Error(), "unable to wait for metal function", errCodeNone)
+			} else {
+				err = batchFailure(b, ds, index, -1, jobErr.Error(), "unable to wait for metal function",
+					errCodeNone)
+			}
+		}
+		c.finish(err)
+	}()
+}
+
+// ----------------------------------------------------------------------------
+// Internal dispatch helpers
+// ----------------------------------------------------------------------------
+
+// A cpuJob is a dispatch whose function and buffers have been resolved, ready to execute. An
+// interpreted function has its arguments already bound in invocation.
+type cpuJob struct {
+	function    cpuFunction
+	grid        Grid
+	threadgroup Grid
+	inputs      []float32
+	bufs        []any
+	invocation  *msl.Invocation
+}
+
+// cpuEncodeError is a failure to resolve a dispatch, reported the same way the Objective-C layer
+// reports a failure to encode one: a message plus an error code, and the buffer index of the
+// argument that failed to bind, or -1 if the failure is not of one argument.
+type cpuEncodeError struct {
+	msg      string
+	code     int
+	argument int
+}
+
+// prepare resolves the function and buffers for d, the CPU counterpart of encoding a dispatch. The
+// inputs are copied so that, as on the GPU, they need not outlive the call that started the
+// dispatch.
+func (b *cpuBackend) prepare(d dispatch) (cpuJob, *cpuEncodeError) {
+	function, ok := b.lookupFunction(d.functionId)
+	if !ok {
+		return cpuJob{}, &cpuEncodeError{
+			msg:      fmt.Sprintf("failed to retrieve function: invalid function id: %d", d.functionId),
+			code:     errCodeInvalidFunctionId,
+			argument: -1,
+		}
+	}
+
+	bufs := make([]any, len(d.bufferIds))
+	entries := make([]bufferEntry, len(d.bufferIds))
+	for i, id := range d.bufferIds {
+		entry, ok := lookupBuffer(id)
+		if !ok {
+			return cpuJob{}, &cpuEncodeError{
+				msg:      fmt.Sprintf("failed to retrieve buffer %d/%d: invalid buffer id: %d", i+1, len(d.bufferIds), id),
+				code:     errCodeInvalidBufferId,
+				argument: d.bufferArgument(i),
+			}
+		}
+		entry = entry.slice(d.span(i))
+		bufs[i] = entry.data
+		entries[i] = entry
+	}
+
+	// The interpreter does not parse struct declarations and a CPUKernel has no way to receive one,
+	// so struct inputs are left to Metal.
+	if len(d.structs) > 0 {
+		return cpuJob{}, &cpuEncodeError{
+			msg:      "failed to bind arguments: struct inputs are not supported by the CPU backend",
+			code:     errCodeNone,
+			argument: -1,
+		}
+	}
+
+	job := cpuJob{
+		function:    function,
+		grid:        Grid{X: int(d.width), Y: int(d.height), Z: int(d.depth)},
+		threadgroup: d.threadgroup,
+		inputs:      make([]float32, len(d.inputs)),
+		bufs:        bufs,
+	}
+	for i, input := range d.inputs {
+		job.inputs[i] = input.float32()
+	}
+
+	if function.interpreted != nil {
+		// Bind the arguments at the same indexes that encode_dispatch uses: each input as its own
+		// constant with the width of its type, followed by the buffers.
+		args := make([][]byte, 0, len(d.inputs)+len(entries))
+		for _, input := range d.inputs {
+			args = append(args, input.bytes())
+		}
+		for _, entry := range entries {
+			args = append(args, entry.bytes())
+		}
+
+		invocation, err := function.interpreted.Bind(args)
+		if err != nil {
+			return cpuJob{}, &cpuEncodeError{
+				msg:      fmt.Sprintf("failed to bind arguments: %s", err),
+				code:     errCodeNone,
+				argument: -1,
+			}
+		}
+		job.invocation = invocation
+	}
+
+	return job, nil
+}
+
+// prepareBatch resolves every dispatch in ds, failing on the first one that cannot be resolved so
+// that, as with a command buffer, nothing runs unless everything does. On failure it also returns
+// the index of that dispatch.
+func (b *cpuBackend) prepareBatch(ds []dispatch) ([]cpuJob, int, *cpuEncodeError) {
+	jobs := make([]cpuJob, len(ds))
+	for i, d := range ds {
+		job, err := b.prepare(d)
+		if err != nil {
+			return nil, i, err
+		}
+		jobs[i] = job
+	}
+
+	return jobs, -1, nil
+}
+
+// executeBatch executes jobs in order, stopping at the first failure, whose index it returns with
+// the error. Each job finishes completely before the next starts, matching the ordering between
+// compute passes in one command buffer.
+func executeBatch(jobs []cpuJob, opts CPUOptions) (int, error) {
+	for i, job := range jobs {
+		if err := job.execute(opts); err != nil {
+			return i, err
+		}
+	}
+
+	return -1, nil
+}
+
+// execute runs the job's kernel once per thread, spreading whole threadgroups across worker
+// goroutines. Threadgroups are the size that the dispatch chose, or if it chose none, the size that
+// Run chooses by default for a GPU pipeline with the limits in opts. With uniform threadgroups every
+// thread of every threadgroup runs, so the dispatched grid is the requested grid rounded up to whole
+// threadgroups; otherwise the threadgroups along the far edges are trimmed to fit the grid exactly.
+//
+// A panic in the kernel (typically an out-of-range index) is recovered and returned as an error
+// naming the thread that caused it, and the remaining threadgroups are abandoned.
+func (job cpuJob) execute(opts CPUOptions) error {
+	threadgroup := job.threadgroup
+	if threadgroup == (Grid{}) {
+		limits := opts.limits()
+		threadgroup = defaultThreadgroupSize(limits.threadExecutionWidth, limits.maxTotalThreadsPerThreadgroup)
+	}
+	groups := Grid{
+		X: ceilDiv(job.grid.X, threadgroup.X),
+		Y: ceilDiv(job.grid.Y, threadgroup.Y),
+		Z: ceilDiv(job.grid.Z, threadgroup.Z),
+	}
+
+	gridSize := job.grid
+	if opts.UniformThreadgroups {
+		gridSize = Grid{X: groups.X * threadgroup.X, Y: groups.Y * threadgroup.Y, Z: groups.Z * threadgroup.Z}
+	}
+
+	numGroups := groups.X * groups.Y * groups.Z
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, numGroups)
+
+	var (
+		next     atomic.Int64
+		failed   atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var (
+				tc ThreadContext
+				ta msl.ThreadAttributes
+			)
+			defer func() {
+				if r := recover(); r != nil {
+					failed.Store(true)
+					errOnce.Do(func() {
+						// The interpreter panics to report a fault in the kernel, such as an
+						// out-of-bounds access, so only a Go kernel can truly panic.
+						what := "panicked"
+						if job.invocation != nil {
+							what = "failed"
+						}
+						firstErr = fmt.Errorf("kernel '%s' %s at thread position (%d, %d, %d): %v",
+							job.function.name, what, tc.Position.X, tc.Position.Y, tc.Position.Z, r)
+					})
+				}
+			}()
+
+			for !failed.Load() {
+				g := int(next.Add(1) - 1)
+				if g >= numGroups {
+					return
+				}
+
+				tc.GridSize = gridSize
+				tc.ThreadgroupPosition = Grid{X: g % groups.X, Y: (g / groups.X) % groups.Y, Z: g / (groups.X * groups.Y)}
+				tc.ThreadgroupSize = threadgroup
+				if !opts.UniformThreadgroups {
+					tc.ThreadgroupSize = Grid{
+						X: min(threadgroup.X, job.grid.X-tc.ThreadgroupPosition.X*threadgroup.X),
+						Y: min(threadgroup.Y, job.grid.Y-tc.ThreadgroupPosition.Y*threadgroup.Y),
+						Z: min(threadgroup.Z, job.grid.Z-tc.ThreadgroupPosition.Z*threadgroup.Z),
+					}
+				}
+
+				for z := 0; z < tc.ThreadgroupSize.Z; z++ {
+					for y := 0; y < tc.ThreadgroupSize.Y; y++ {
+						for x := 0; x < tc.ThreadgroupSize.X; x++ {
+							tc.PositionInThreadgroup = Grid{X: x, Y: y, Z: z}
+							tc.Position = Grid{
+								X: tc.ThreadgroupPosition.X*threadgroup.X + x,
+								Y: tc.ThreadgroupPosition.Y*threadgroup.Y + y,
+								Z: tc.ThreadgroupPosition.Z*threadgroup.Z + z,
+							}
+							if job.invocation != nil {
+								job.invocation.Run(threadAttributes(&tc, groups, &ta))
+							} else {
+								job.function.kernel(tc, job.inputs, job.bufs)
+							}
+						}
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// threadAttributes fills ta with the interpreter's view of tc, a thread in a grid of groups
+// threadgroups, and returns it.
+func threadAttributes(tc *ThreadContext, groups Grid, ta *msl.ThreadAttributes) *msl.ThreadAttributes {
+	dims := func(g Grid) [3]uint32 {
+		return [3]uint32{uint32(g.X), uint32(g.Y), uint32(g.Z)}
+	}
+
+	ta.PositionInGrid = dims(tc.Position)
+	ta.ThreadsPerGrid = dims(tc.GridSize)
+	ta.ThreadgroupPositionInGrid = dims(tc.ThreadgroupPosition)
+	ta.PositionInThreadgroup = dims(tc.PositionInThreadgroup)
+	ta.ThreadsPerThreadgroup = dims(tc.ThreadgroupSize)
+	ta.ThreadgroupsPerGrid = dims(groups)
+
+	return ta
+}
+
+// ceilDiv returns n/d rounded up, for positive n and d.
+func ceilDiv(n, d int) int {
+	return (n + d - 1) / d
+}
@@ -0,0 +1,1389 @@
+//go:build !darwin || !cgo
+
+// These tests run the CPU backend through the public API. They are limited to builds without the
+// Metal backend because there NewBuffer allocates from the CPU backend; on darwin with cgo buffers
+// come from the Metal allocator, whose sequential ids the darwin tests track.
+
+package metal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_cpuBackend_Function tests that NewFunction falls back to a registered CPU kernel and that the
+// resulting Function behaves like a GPU one.
+func Test_cpuBackend_Function(t *testing.T) {
+	function, err := NewFunction(sourceTransfer1D, "transfer1D")
+	require.NoError(t, err)
+	require.True(t, function.Valid())
+	require.Equal(t, "transfer1D", function.String())
+
+	require.NoError(t, function.Close())
+	require.False(t, function.Valid())
+	require.Equal(t, "", function.String())
+	require.ErrorIs(t, function.Close(), ErrInvalidFunctionId)
+
+	_, err = NewFunction(sourceTransfer1D, "")
+	require.EqualError(t, err, "unable to set up metal function: missing function name")
+
+	_, err = NewFunction("", "transfer1D")
+	require.EqualError(t, err, "unable to set up metal function: missing metal code")
+
+	_, err = NewFunction(sourceTransfer1D, "transfer2D")
+	require.EqualError(t, err, "unable to set up metal function: failed to find function 'transfer2D'")
+
+	_, err = NewFunction("kernel void broken(device float *result) { result[0] = }", "broken")
+	require.EqualError(t, err, "unable to set up metal function: failed to create library: 1:56: unexpected '}'")
+}
+
+// Test_cpuBackend_Arguments tests that the CPU backend describes a function's arguments from its
+// source, whether the function is interpreted or a registered Go kernel.
+func Test_cpuBackend_Arguments(t *testing.T) {
+	want := []Argument{
+		{Index: 0, Name: "input", Type: "float", AddressSpace: AddressSpaceConstant, Pointer: true},
+		{Index: 1, Name: "result", Type: "float", AddressSpace: AddressSpaceDevice, Pointer: true},
+		{Index: -1, Name: "pos", Type: "uint", Attribute: "thread_position_in_grid"},
+	}
+
+	function, err := NewFunction(sourceTransfer1D, "transfer1D")
+	require.NoError(t, err)
+	args, err := function.Arguments()
+	require.NoError(t, err)
+	require.Equal(t, want, args)
+
+	RegisterCPUKernel("argumentsTransfer1D", func(tc ThreadContext, inputs []float32, bufs []any) {})
+	registered, err := NewFunction(strings.ReplaceAll(sourceTransfer1D, "transfer1D", "argumentsTransfer1D"), "argumentsTransfer1D")
+	require.NoError(t, err)
+	args, err = registered.Arguments()
+	require.NoError(t, err)
+	require.Equal(t, want, args)
+
+	require.NoError(t, function.Close())
+	_, err = function.Arguments()
+	require.ErrorIs(t, err, ErrInvalidFunctionId)
+}
+
+// Test_cpuBackend_CompileOptions tests that the CPU backend preprocesses source with the options'
+// macros before interpreting it, and describes arguments declared through macros.
+func Test_cpuBackend_CompileOptions(t *testing.T) {
+	source := `#if __METAL_VERSION__ >= 300
+#define DATA device float *data [[buffer(0)]]
+#endif
+kernel void scaleBy(DATA, uint pos [[thread_position_in_grid]]) {
+    data[pos] = data[pos] * FACTOR;
+}`
+	opts := CompileOptions{
+		LanguageVersion:    Version{3, 0},
+		MathMode:           MathModeSafe,
+		PreprocessorMacros: map[string]string{"FACTOR": "3.0f"},
+	}
+
+	function, err := NewFunctionWithOptions(source, "scaleBy", opts)
+	require.NoError(t, err)
+
+	// The function keeps its own copy of the macros.
+	opts.PreprocessorMacros["FACTOR"] = "4.0f"
+
+	args, err := function.Arguments()
+	require.NoError(t, err)
+	require.Equal(t, []Argument{
+		{Index: 0, Name: "data", Type: "float", AddressSpace: AddressSpaceDevice, Pointer: true, Attribute: "buffer(0)"},
+		{Index: -1, Name: "pos", Type: "uint", Attribute: "thread_position_in_grid"},
+	}, args)
+
+	dataId, data, err := NewBufferWith([]float32{1, -2})
+	require.NoError(t, err)
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 2}, BufferIds: []BufferId{dataId}}))
+	require.Equal(t, []float32{3, -6}, data)
+	require.NoError(t, function.Close())
+
+	// A library's functions are compiled with the library's options.
+	library, err := NewLibrary(source, opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{"scaleBy"}, library.Functions())
+	function, err = library.Function("scaleBy")
+	require.NoError(t, err)
+	require.NoError(t, library.Close())
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 2}, BufferIds: []BufferId{dataId}}))
+	require.Equal(t, []float32{12, -24}, data)
+	require.NoError(t, function.Close())
+	require.NoError(t, dataId.Close())
+
+	_, err = NewFunction(source, "scaleBy")
+	require.EqualError(t, err, "unable to set up metal function: failed to create library: 4:21: unknown type 'DATA'")
+
+	_, err = NewFunctionWithOptions("#error no kernels\n", "scaleBy", CompileOptions{})
+	require.EqualError(t, err, "unable to set up metal function: failed to create library: 1:1: #error no kernels")
+	require.ErrorIs(t, err, ErrMetalUnavailable)
+
+	_, err = NewLibrary("#if 1\n", CompileOptions{})
+	require.EqualError(t, err, "unable to create metal library: failed to create library: 1:1: unterminated conditional directive")
+
+	_, err = NewFunctionWithOptions(source, "scaleBy", CompileOptions{LanguageVersion: Version{1, 0}})
+	require.EqualError(t, err, "unable to set up metal function: unsupported language version 1.0")
+
+	_, err = NewLibrary(source, CompileOptions{PreprocessorMacros: map[string]string{"1X": ""}})
+	require.EqualError(t, err, "unable to create metal library: invalid macro name '1X'")
+}
+
+// Test_cpuBackend_FunctionConstants tests that the CPU backend specializes functions with their
+// function constants, from source and from a library.
+func Test_cpuBackend_FunctionConstants(t *testing.T) {
+	source := `constant uint STRIDE [[function_constant(0)]];
+constant bool NEGATE [[function_constant(1)]];
+constant half SCALE [[function_constant(2)]];
+constant float factor = is_function_constant_defined(SCALE) ? float(SCALE) : 1.0f;
+
+kernel void specialized(device float *data [[buffer(0)]], uint pos [[thread_position_in_grid]]) {
+    float v = data[pos * STRIDE] * factor;
+    if (is_function_constant_defined(NEGATE) && NEGATE) {
+        v = -v;
+    }
+    data[pos * STRIDE] = v;
+}`
+
+	dataId, data, err := NewBufferWith([]float32{1, 2, 3, 4})
+	require.NoError(t, err)
+
+	function, err := NewFunctionWithOptions(source, "specialized", CompileOptions{Constants: []FunctionConstant{
+		{Name: "STRIDE", Value: uint32(2)},
+		{Index: 1, Value: true},
+		{Name: "SCALE", Value: Half(1.5)},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 2}, BufferIds: []BufferId{dataId}}))
+	require.Equal(t, []float32{-1.5, 2, -4.5, 4}, data)
+	require.NoError(t, function.Close())
+
+	library, err := NewLibrary(source, CompileOptions{Constants: []FunctionConstant{{Index: 0, Value: uint32(1)}}})
+	require.NoError(t, err)
+	function, err = library.Function("specialized")
+	require.NoError(t, err)
+	require.NoError(t, library.Close())
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 4}, BufferIds: []BufferId{dataId}}))
+	require.Equal(t, []float32{-1.5, 2, -4.5, 4}, data)
+	require.NoError(t, function.Close())
+	require.NoError(t, dataId.Close())
+
+	_, err = NewFunctionWithOptions(source, "specialized", CompileOptions{Constants: []FunctionConstant{{Name: "STRIDE", Value: int32(2)}}})
+	require.EqualError(t, err, "unable to set up metal function: function constant 'STRIDE' is declared uint, not int")
+
+	_, err = NewLibrary(source, CompileOptions{Constants: []FunctionConstant{{Name: "factor", Value: float32(2)}}})
+	require.EqualError(t, err, "unable to create metal library: no function constant 'factor' is declared")
+}
+
+// Test_cpuBackend_NewFunctionFS tests that includes are resolved against a file system before the
+// source is interpreted, and that errors point into the included files.
+func Test_cpuBackend_NewFunctionFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"shaders/square.metal": {Data: []byte("#include <metal_stdlib>\n#include \"common.h\"\n#include \"common.h\"\n\nkernel void square(device float *data [[buffer(0)]], uint pos [[thread_position_in_grid]]) {\n    data[pos] = sq(data[pos]);\n}\n")},
+		"shaders/common.h":     {Data: []byte("#pragma once\n#include \"math/sq.h\"\n")},
+		"math/sq.h":            {Data: []byte("#ifndef SQ_H\n#define SQ_H\nfloat sq(float x) { return x * x; }\n#endif\n")},
+		"broken.metal":         {Data: []byte("#include \"math/broken.h\"\nkernel void k() {}\n")},
+		"math/broken.h":        {Data: []byte("\nfloat f() { return 1 + ; }\n")},
+		"cycle.metal":          {Data: []byte("#include \"cycle.metal\"\n")},
+	}
+
+	function, err := NewFunctionFS(fsys, "shaders/square.metal", "square")
+	require.NoError(t, err)
+	require.Nil(t, function.Diagnostics())
+
+	dataId, data, err := NewBufferWith([]float32{1.5, -3})
+	require.NoError(t, err)
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 2}, BufferIds: []BufferId{dataId}}))
+	require.Equal(t, []float32{2.25, 9}, data)
+	require.NoError(t, function.Close())
+	require.NoError(t, dataId.Close())
+
+	_, err = NewFunctionFS(fsys, "broken.metal", "k")
+	require.EqualError(t, err, "unable to set up metal function: failed to create library: math/broken.h:2:24: unexpected ';'")
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, []Diagnostic{{File: "math/broken.h", Line: 2, Column: 24, Severity: SeverityError, Message: "unexpected ';'"}}, compileErr.Diagnostics)
+
+	_, err = NewFunctionFS(fsys, "cycle.metal", "k")
+	require.EqualError(t, err, "unable to set up metal function: cycle.metal:1:1: include cycle: cycle.metal -> cycle.metal")
+
+	_, err = NewFunctionFS(fsys, "missing.metal", "k")
+	require.EqualError(t, err, "unable to set up metal function: open missing.metal: file does not exist")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+// Test_cpuBackend_Validate tests that a run with Validate set is checked against the kernel's
+// arguments before anything is dispatched.
+func Test_cpuBackend_Validate(t *testing.T) {
+	function, err := NewFunction(sourceSine, "sine")
+	require.NoError(t, err)
+
+	inputId, _, err := NewBufferWith([]float32{1, 2, 3})
+	require.NoError(t, err)
+	defer inputId.Close()
+	outputId, output, err := NewBuffer[float32](3)
+	require.NoError(t, err)
+	defer outputId.Close()
+	shortId, _, err := NewBuffer[int16](6)
+	require.NoError(t, err)
+	defer shortId.Close()
+
+	require.NoError(t, function.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Inputs:    []float32{1},
+		BufferIds: []BufferId{inputId, outputId},
+		Validate:  true,
+	}))
+	require.Equal(t, float32(math.Sin(3)), output[2])
+
+	err = function.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Inputs:    []float32{1},
+		BufferIds: []BufferId{inputId, shortId},
+		Validate:  true,
+	})
+	var argErr *ArgumentError
+	require.ErrorAs(t, err, &argErr)
+	require.Equal(t, 2, argErr.Index)
+	require.Equal(t, "result", argErr.Name)
+
+	err = function.RunBatch([]RunParameters{
+		{Grid: Grid{X: 3}, Inputs: []float32{1}, BufferIds: []BufferId{inputId, outputId}, Validate: true},
+		{Grid: Grid{X: 3}, Inputs: []float32{1}, BufferIds: []BufferId{inputId}, Validate: true},
+	})
+	require.EqualError(t, err, "dispatch 1 of 'sine': invalid argument 'result' at buffer index 2: missing argument; only 2 inputs and buffers were supplied")
+
+	// A buffer that is not open is reported at its index, ahead of any mismatched argument.
+	closedId, _, err := NewBuffer[float32](3)
+	require.NoError(t, err)
+	staleId := closedId
+	require.NoError(t, closedId.Close())
+
+	err = function.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Inputs:    []float32{1},
+		BufferIds: []BufferId{shortId, staleId},
+		Validate:  true,
+	})
+	require.EqualError(t, err, fmt.Sprintf("buffer 2/2 is not open: invalid buffer id: %d", staleId))
+	require.ErrorIs(t, err, ErrInvalidBufferId)
+
+	err = function.RunBatch([]RunParameters{
+		{Grid: Grid{X: 3}, Inputs: []float32{1}, BufferIds: []BufferId{staleId, shortId}, Validate: true},
+	})
+	require.EqualError(t, err, fmt.Sprintf("dispatch 0 of 'sine': buffer 1/2 is not open: invalid buffer id: %d", staleId))
+	var batchErr *BatchError
+	require.ErrorAs(t, err, &batchErr)
+	require.Equal(t, 1, batchErr.Argument)
+	require.Equal(t, ErrInvalidBufferId, batchErr.Sentinel)
+
+	// An input may be bound to a device const argument, which the kernel only reads.
+	scale, err := NewFunction(`kernel void scaleConst(device const float *factor, device float *result,
+                       uint pos [[thread_position_in_grid]]) {
+    result[pos] = *factor * float(pos);
+}`, "scaleConst")
+	require.NoError(t, err)
+	defer scale.Close()
+	require.NoError(t, scale.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Inputs:    []float32{2},
+		BufferIds: []BufferId{outputId},
+		Validate:  true,
+	}))
+	require.Equal(t, []float32{0, 2, 4}, output)
+
+	// Without Validate, the mismatched buffer is bound anyway and silently reinterpreted.
+	require.NoError(t, function.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Inputs:    []float32{1},
+		BufferIds: []BufferId{inputId, shortId},
+	}))
+}
+
+// Test_cpuBackend_Scalars tests that typed scalar inputs reach an interpreted kernel with their own
+// types and widths.
+func Test_cpuBackend_Scalars(t *testing.T) {
+	const source = `
+kernel void scale(constant uint *count, constant short *offset, constant half *factor,
+                  device float *result, uint pos [[thread_position_in_grid]]) {
+    if (pos < *count) {
+        result[pos] = float(*factor) * float(int(pos) + *offset);
+    }
+}`
+
+	function, err := NewFunction(source, "scale")
+	require.NoError(t, err)
+
+	resultId, result, err := NewBuffer[float32](4)
+	require.NoError(t, err)
+	defer resultId.Close()
+
+	require.NoError(t, function.Run(RunParameters{
+		Grid:      Grid{X: 4},
+		Scalars:   []Scalar{Uint32(3), Int16(-1), Half(0.5)},
+		BufferIds: []BufferId{resultId},
+		Validate:  true,
+	}))
+	require.Equal(t, []float32{-0.5, 0, 0.5, 0}, result)
+
+	err = function.Run(RunParameters{
+		Grid:      Grid{X: 4},
+		Scalars:   []Scalar{Float32(3), Int16(-1), Half(0.5)},
+		BufferIds: []BufferId{resultId},
+		Validate:  true,
+	})
+	require.EqualError(t, err, "invalid argument 'count' at buffer index 0: input is float32, but the kernel expects uint")
+
+	err = function.Run(RunParameters{
+		Grid:      Grid{X: 4},
+		Inputs:    []float32{3},
+		Scalars:   []Scalar{Int16(-1)},
+		BufferIds: []BufferId{resultId},
+	})
+	require.EqualError(t, err, "cannot set both Inputs and Scalars")
+
+	err = function.Run(RunParameters{
+		Grid:      Grid{X: 4},
+		Scalars:   []Scalar{Uint32(3), {}, Half(0.5)},
+		BufferIds: []BufferId{resultId},
+	})
+	require.EqualError(t, err, "invalid scalar input")
+}
+
+// Test_cpuBackend_Structs tests that struct inputs are packed and checked before they are bound,
+// and that the CPU backend, which leaves them to Metal, rejects them for interpreted and registered
+// kernels alike.
+func Test_cpuBackend_Structs(t *testing.T) {
+	type params struct {
+		Scale [2]float32
+		Count uint32
+	}
+
+	function, err := NewFunction(sourceSine, "sine")
+	require.NoError(t, err)
+
+	inputId, _, err := NewBufferWith([]float32{1, 2, 3})
+	require.NoError(t, err)
+	defer inputId.Close()
+	outputId, _, err := NewBuffer[float32](3)
+	require.NoError(t, err)
+	defer outputId.Close()
+
+	err = function.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Structs:   []any{params{}},
+		BufferIds: []BufferId{inputId, outputId},
+		Validate:  true,
+	})
+	require.EqualError(t, err, "invalid argument 'mult' at buffer index 0: input is metal.params, but the kernel expects float")
+
+	err = function.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Structs:   []any{params{}, struct{ N int }{}},
+		BufferIds: []BufferId{inputId, outputId},
+	})
+	require.EqualError(t, err, "invalid struct input 1: field 'N': unsupported type int")
+
+	err = function.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Structs:   []any{struct{ Data [1025]float32 }{}},
+		BufferIds: []BufferId{inputId, outputId},
+	})
+	require.EqualError(t, err, "invalid struct input 0: 4100 bytes is larger than the 4096-byte limit")
+
+	// A struct that packs correctly is still not run, even where the kernel's parameter would take
+	// its bytes.
+	err = function.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Structs:   []any{struct{ Mult float32 }{2}},
+		BufferIds: []BufferId{inputId, outputId},
+	})
+	require.EqualError(t, err, "unable to run metal function: failed to bind arguments: struct inputs are not supported by the CPU backend")
+
+	_, err = NewFunction(`struct Params { float scale; };
+kernel void structsParams(constant Params &p, device float *result, uint pos [[thread_position_in_grid]]) {
+    result[pos] = p.scale;
+}`, "structsParams")
+	require.EqualError(t, err, "unable to set up metal function: failed to create library: 1:1: unsupported declaration 'struct'")
+
+	RegisterCPUKernel("structsScale", func(tc ThreadContext, inputs []float32, bufs []any) {})
+	registered, err := NewFunction("kernel void structsScale(device float *result) {}", "structsScale")
+	require.NoError(t, err)
+	err = registered.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Structs:   []any{&params{}},
+		BufferIds: []BufferId{outputId},
+	})
+	require.EqualError(t, err, "unable to run metal function: failed to bind arguments: struct inputs are not supported by the CPU backend")
+}
+
+// Test_cpuBackend_Buffers tests that typed buffers can be bound in place of buffer Ids.
+func Test_cpuBackend_Buffers(t *testing.T) {
+	function, err := NewFunction(sourceSine, "sine")
+	require.NoError(t, err)
+
+	input, err := NewTypedBufferWith([]float32{1, 2, 3})
+	require.NoError(t, err)
+	defer input.Close()
+	output, err := NewTypedBuffer[float32](3)
+	require.NoError(t, err)
+
+	require.NoError(t, function.Run(RunParameters{
+		Grid:     Grid{X: 3},
+		Inputs:   []float32{1},
+		Buffers:  []BufferBinding{input, output.Id()},
+		Validate: true,
+	}))
+	require.Equal(t, float32(math.Sin(3)), output.Slice()[2])
+
+	err = function.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Inputs:    []float32{1},
+		BufferIds: []BufferId{input.Id()},
+		Buffers:   []BufferBinding{output},
+	})
+	require.EqualError(t, err, "cannot set both BufferIds and Buffers")
+
+	err = function.Run(RunParameters{
+		Grid:    Grid{X: 3},
+		Inputs:  []float32{1},
+		Buffers: []BufferBinding{input, nil},
+	})
+	require.EqualError(t, err, "invalid nil buffer")
+
+	require.NoError(t, output.Close())
+	err = function.Run(RunParameters{
+		Grid:    Grid{X: 3},
+		Inputs:  []float32{1},
+		Buffers: []BufferBinding{input, output},
+	})
+	require.EqualError(t, err, "buffer 2/2 is not open: invalid buffer id: 0")
+	require.ErrorIs(t, err, ErrInvalidBufferId)
+}
+
+// Test_cpuBackend_BufferRanges tests that ranges of one buffer can be bound to different
+// arguments.
+func Test_cpuBackend_BufferRanges(t *testing.T) {
+	function, err := NewFunction(sourceSine, "sine")
+	require.NoError(t, err)
+
+	// The input is the first 3 elements of the arena and the output is 3 elements starting 64
+	// elements in, which is 256 bytes.
+	arena, err := NewTypedBuffer[float32](128)
+	require.NoError(t, err)
+	defer arena.Close()
+	copy(arena.Slice(), []float32{1, 2, 3})
+
+	require.NoError(t, function.Run(RunParameters{
+		Grid:     Grid{X: 3},
+		Inputs:   []float32{1},
+		Buffers:  []BufferBinding{arena.Range(0, 3), arena.Range(64, 3)},
+		Validate: true,
+	}))
+	require.Equal(t, []float32{float32(math.Sin(1)), float32(math.Sin(2)), float32(math.Sin(3))}, arena.Slice()[64:67])
+	require.Equal(t, float32(0), arena.Slice()[67])
+
+	err = function.Run(RunParameters{
+		Grid:    Grid{X: 3},
+		Inputs:  []float32{1},
+		Buffers: []BufferBinding{arena.Range(0, 3), BufferRange{Id: arena.Id(), Offset: 2, Length: 12}},
+	})
+	require.EqualError(t, err, "invalid range for buffer 2: offset 2 is not a multiple of the 4-byte element size")
+
+	err = function.Run(RunParameters{
+		Grid:    Grid{X: 3},
+		Inputs:  []float32{1},
+		Buffers: []BufferBinding{arena.Range(0, 3), arena.Range(126, 3)},
+	})
+	require.EqualError(t, err, "invalid range for buffer 2: 12 bytes at offset 504 is outside the buffer's 512 bytes")
+
+	// A range of 2 elements is too short for a grid of 3, which the interpreter reports.
+	err = function.Run(RunParameters{
+		Grid:    Grid{X: 3},
+		Inputs:  []float32{1},
+		Buffers: []BufferBinding{arena.Range(0, 3), arena.Range(64, 2)},
+	})
+	require.ErrorContains(t, err, "out-of-bounds access to 'result'")
+
+	// The CPU backend has no alignment for constant buffers beyond the element type's.
+	require.NoError(t, function.Run(RunParameters{
+		Grid:     Grid{X: 3},
+		Inputs:   []float32{1},
+		Buffers:  []BufferBinding{arena.Range(1, 3), arena.Range(64, 3)},
+		Validate: true,
+	}))
+	require.Equal(t, []float32{float32(math.Sin(2)), float32(math.Sin(3)), 0}, arena.Slice()[64:67])
+}
+
+// Test_cpuBackend_BufferPool tests that closed pooled buffers are handed out again.
+func Test_cpuBackend_BufferPool(t *testing.T) {
+	pool := NewBufferPool(PoolOptions{MaxBuffersPerClass: 1})
+
+	_, err := Get[float32](pool, 0)
+	require.EqualError(t, err, "invalid width")
+
+	a, err := Get[float32](pool, 20)
+	require.NoError(t, err)
+	require.Equal(t, 20, a.Len())
+	entry, ok := lookupBuffer(a.Id())
+	require.True(t, ok)
+	require.Equal(t, 80, entry.numBytes)
+
+	b, err := Get[float32](pool, 30)
+	require.NoError(t, err)
+	a.Slice()[0] = 7
+	aId, bId := a.Id(), b.Id()
+
+	require.NoError(t, a.Close())
+	require.NoError(t, b.Close())
+	require.Nil(t, a.Slice())
+	require.ErrorIs(t, a.Close(), ErrInvalidBufferId)
+	_, ok = lookupBuffer(aId)
+	require.False(t, ok)
+	require.Equal(t, PoolStats{Misses: 2, Releases: 1, BytesRetained: 128, BuffersRetained: 1}, pool.Stats())
+
+	// The buffer kept for the 128-byte class comes back cleared, with any element type that fits.
+	c, err := Get[int32](pool, 25)
+	require.NoError(t, err)
+	require.Equal(t, aId, c.Id())
+	require.Equal(t, make([]int32, 25), c.Slice())
+	require.Equal(t, PoolStats{Hits: 1, Misses: 2, Releases: 1}, pool.Stats())
+
+	// The released buffer was freed.
+	require.ErrorIs(t, cpu.closeBuffer(int32(bId)), ErrInvalidBufferId)
+
+	require.NoError(t, c.Close())
+	require.NoError(t, pool.Trim())
+	require.ErrorIs(t, cpu.closeBuffer(int32(aId)), ErrInvalidBufferId)
+	require.Equal(t, PoolStats{Hits: 1, Misses: 2, Releases: 2}, pool.Stats())
+
+	d, err := Get[uint8](pool, 10)
+	require.NoError(t, err)
+	require.NoError(t, pool.Close())
+	_, err = Get[uint8](pool, 10)
+	require.EqualError(t, err, "buffer pool is closed")
+	require.NoError(t, d.Close())
+	require.Equal(t, 0, pool.Stats().BuffersRetained)
+}
+
+// Test_cpuBackend_BufferPoolStaleId tests that the Id of a pooled buffer can be neither bound nor
+// closed once the buffer is back in its pool, so it cannot reach memory that the pool hands out
+// again.
+func Test_cpuBackend_BufferPoolStaleId(t *testing.T) {
+	function, err := NewFunction(sourceTransfer1D, "transfer1D")
+	require.NoError(t, err)
+	defer function.Close()
+	pool := NewBufferPool(PoolOptions{})
+	defer pool.Close()
+
+	input, err := Get[float32](pool, 3)
+	require.NoError(t, err)
+	output, err := Get[float32](pool, 3)
+	require.NoError(t, err)
+	defer output.Close()
+
+	// The Id of an open pooled buffer binds, but it does not close the buffer.
+	outputId := output.Id()
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 3}, BufferIds: []BufferId{input.Id(), outputId}}))
+	require.ErrorIs(t, outputId.Close(), ErrInvalidBufferId)
+	require.True(t, output.Valid())
+
+	staleId := input.Id()
+	require.NoError(t, input.Close())
+
+	err = function.Run(RunParameters{Grid: Grid{X: 3}, BufferIds: []BufferId{staleId, outputId}})
+	require.EqualError(t, err, fmt.Sprintf("buffer 1/2 is not open: invalid buffer id: %d", staleId))
+	require.ErrorIs(t, err, ErrInvalidBufferId)
+	err = function.Run(RunParameters{Grid: Grid{X: 3}, Buffers: []BufferBinding{BufferRange{Id: staleId, Length: 12}, output}})
+	require.ErrorIs(t, err, ErrInvalidBufferId)
+	require.ErrorIs(t, staleId.Close(), ErrInvalidBufferId)
+
+	// The next Get hands out the same memory under the same Id, which the stale copy cannot free.
+	reused, err := Get[float32](pool, 3)
+	require.NoError(t, err)
+	require.Equal(t, staleId, reused.Id())
+	require.ErrorIs(t, staleId.Close(), ErrInvalidBufferId)
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 3}, Buffers: []BufferBinding{reused, output}}))
+	require.NoError(t, reused.Close())
+	require.Equal(t, PoolStats{Hits: 1, Misses: 2, BytesRetained: 64, BuffersRetained: 1}, pool.Stats())
+}
+
+// Test_cpuBackend_NewLibrary tests that a library built from source lists its kernels from their
+// declarations and interprets them, and that its functions outlive it.
+func Test_cpuBackend_NewLibrary(t *testing.T) {
+	library, err := NewLibrary(sourceTransfer1D+"\n"+sourceNoop, CompileOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"noop", "transfer1D"}, library.Functions())
+
+	transfer, err := library.Function("transfer1D")
+	require.NoError(t, err)
+	noop, err := library.Function("noop")
+	require.NoError(t, err)
+	require.Equal(t, "noop", noop.String())
+
+	// Functions from a library built from source describe their arguments from it.
+	args, err := transfer.Arguments()
+	require.NoError(t, err)
+	require.Len(t, args, 3)
+
+	_, err = library.Function("transfer2D")
+	require.EqualError(t, err, "unable to set up metal function: failed to find function 'transfer2D'")
+	require.NoError(t, library.Close())
+
+	inputId, _, err := NewBufferWith([]float32{1, 2, 3})
+	require.NoError(t, err)
+	outputId, output, err := NewBuffer[float32](3)
+	require.NoError(t, err)
+	require.NoError(t, transfer.Run(RunParameters{Grid: Grid{X: 3}, BufferIds: []BufferId{inputId, outputId}}))
+	require.Equal(t, []float32{1, 2, 3}, output)
+	require.NoError(t, transfer.Close())
+	require.NoError(t, noop.Close())
+	require.NoError(t, inputId.Close())
+	require.NoError(t, outputId.Close())
+
+	// Kernels are listed even if the interpreter cannot run the source, and registered ones can
+	// still be set up.
+	RegisterCPUKernel("libraryInvert", func(tc ThreadContext, inputs []float32, bufs []any) {})
+	source := sourceTexture + "\nkernel void libraryInvert(device float *data) {}"
+	library, err = NewLibrary(source, CompileOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"invert", "libraryInvert"}, library.Functions())
+
+	function, err := library.Function("libraryInvert")
+	require.NoError(t, err)
+	require.NoError(t, function.Close())
+
+	_, err = library.Function("invert")
+	require.EqualError(t, err, "unable to set up metal function: failed to create library: 1:20: unknown type 'texture2d'")
+	require.ErrorIs(t, err, ErrMetalUnavailable)
+	require.NoError(t, library.Close())
+
+	_, err = NewLibrary("", CompileOptions{})
+	require.EqualError(t, err, "unable to create metal library: missing metal code")
+
+	_, err = NewLibrary("kernel void broken(", CompileOptions{})
+	require.ErrorContains(t, err, "unable to create metal library: failed to create library: ")
+	require.ErrorIs(t, err, ErrMetalUnavailable)
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, 1, compileErr.Diagnostics[0].Line)
+}
+
+// Test_cpuBackend_Library tests that functions are set up from a compiled metallib through the
+// kernels registered for them, and that they outlive their library.
+func Test_cpuBackend_Library(t *testing.T) {
+	RegisterCPUKernel("libraryDouble", func(tc ThreadContext, inputs []float32, bufs []any) {
+		data := bufs[0].([]float32)
+		data[tc.Position.X] *= 2
+	})
+	data := buildMetallib(metallibKernel("libraryDouble"), metallibKernel("libraryMissing"))
+
+	library, err := LoadLibrary(data)
+	require.NoError(t, err)
+	require.True(t, library.Valid())
+	require.Equal(t, []string{"libraryDouble", "libraryMissing"}, library.Functions())
+
+	function, err := library.Function("libraryDouble")
+	require.NoError(t, err)
+	require.Equal(t, "libraryDouble", function.String())
+
+	_, err = library.Function("libraryMissing")
+	require.EqualError(t, err, "unable to set up metal function: no CPU kernel is registered for 'libraryMissing'")
+	require.ErrorIs(t, err, ErrMetalUnavailable)
+
+	_, err = library.Function("libraryAbsent")
+	require.EqualError(t, err, "unable to set up metal function: failed to find function 'libraryAbsent'")
+
+	_, err = library.Function("")
+	require.EqualError(t, err, "unable to set up metal function: missing function name")
+
+	require.NoError(t, library.Close())
+	require.False(t, library.Valid())
+	require.Nil(t, library.Functions())
+	require.ErrorIs(t, library.Close(), ErrInvalidLibrary)
+	_, err = library.Function("libraryDouble")
+	require.ErrorIs(t, err, ErrInvalidLibrary)
+
+	// The function stays valid after its library is closed.
+	bufferId, buffer, err := NewBufferWith([]float32{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 3}, BufferIds: []BufferId{bufferId}}))
+	require.Equal(t, []float32{2, 4, 6}, buffer)
+	require.NoError(t, function.Close())
+	require.NoError(t, bufferId.Close())
+
+	function, err = NewFunctionFromLibrary(data, "libraryDouble")
+	require.NoError(t, err)
+	require.NoError(t, function.Close())
+
+	path := filepath.Join(t.TempDir(), "library.metallib")
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+	function, err = NewFunctionFromLibraryFile(path, "libraryDouble")
+	require.NoError(t, err)
+	require.NoError(t, function.Close())
+
+	_, err = NewFunctionFromLibraryFile(filepath.Join(t.TempDir(), "absent.metallib"), "libraryDouble")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = LoadLibrary([]byte("not a library"))
+	require.EqualError(t, err, "unable to load metal library: failed to create library: 13 bytes is too short for a metallib header")
+}
+
+// Test_cpuBackend_RegisterCPUKernel tests that a registered Go kernel takes precedence over
+// interpreting the metal source.
+func Test_cpuBackend_RegisterCPUKernel(t *testing.T) {
+	RegisterCPUKernel("goTransfer1D", func(tc ThreadContext, inputs []float32, bufs []any) {
+		input, result := bufs[0].([]float32), bufs[1].([]float32)
+		result[tc.Position.X] = input[tc.Position.X] * inputs[0]
+	})
+
+	function, err := NewFunction("this source is never parsed", "goTransfer1D")
+	require.NoError(t, err)
+	require.Equal(t, "goTransfer1D", function.String())
+
+	inputId, _, err := NewBufferWith([]float32{1, 2, 3})
+	require.NoError(t, err)
+	defer inputId.Close()
+	outputId, output, err := NewBuffer[float32](3)
+	require.NoError(t, err)
+	defer outputId.Close()
+
+	require.NoError(t, function.Run(RunParameters{
+		Grid:      Grid{X: 3},
+		Inputs:    []float32{-2},
+		BufferIds: []BufferId{inputId, outputId},
+	}))
+	require.Equal(t, []float32{-2, -4, -6}, output)
+}
+
+// Test_cpuBackend_Threadgroup tests that a dispatch runs in the threadgroups it asks for, within the
+// limits set by CPUOptions.
+func Test_cpuBackend_Threadgroup(t *testing.T) {
+	defer SetCPUOptions(CPUOptions{})
+
+	var mu sync.Mutex
+	sizes := make(map[Grid]int)
+	RegisterCPUKernel("threadgroupSizes", func(tc ThreadContext, _ []float32, _ []any) {
+		mu.Lock()
+		defer mu.Unlock()
+		sizes[tc.ThreadgroupSize]++
+	})
+
+	function, err := NewFunction("this source is never parsed", "threadgroupSizes")
+	require.NoError(t, err)
+	require.Equal(t, 32, function.ThreadExecutionWidth())
+	require.Equal(t, 1024, function.MaxTotalThreadsPerThreadgroup())
+
+	SetCPUOptions(CPUOptions{ThreadExecutionWidth: 16, MaxTotalThreadsPerThreadgroup: 64})
+	require.Equal(t, 16, function.ThreadExecutionWidth())
+	require.Equal(t, 64, function.MaxTotalThreadsPerThreadgroup())
+
+	run := func(params RunParameters) (map[Grid]int, error) {
+		clear(sizes)
+		err := function.Run(params)
+		return sizes, err
+	}
+
+	// The default threadgroup is 16x4x1.
+	seen, err := run(RunParameters{Grid: Grid{X: 32, Y: 8}})
+	require.NoError(t, err)
+	require.Equal(t, map[Grid]int{{X: 16, Y: 4, Z: 1}: 32 * 8}, seen)
+
+	seen, err = run(RunParameters{Grid: Grid{X: 32, Y: 8}, Threadgroup: Grid{X: 8, Y: 8}})
+	require.NoError(t, err)
+	require.Equal(t, map[Grid]int{{X: 8, Y: 8, Z: 1}: 32 * 8}, seen)
+
+	seen, err = run(RunParameters{Grid: Grid{X: 4, Y: 4, Z: 4}, Threadgroup: Grid{X: 2, Y: 2, Z: 2}})
+	require.NoError(t, err)
+	require.Equal(t, map[Grid]int{{X: 2, Y: 2, Z: 2}: 64}, seen)
+
+	_, err = run(RunParameters{Grid: Grid{X: 32, Y: 8}, Threadgroup: Grid{X: 16, Y: 8}})
+	require.EqualError(t, err, "threadgroup of 16x8x1 threads exceeds the function's limit of 64 threads per threadgroup")
+
+	_, err = run(RunParameters{Grid: Grid{X: 32}, Threadgroup: Grid{X: -1}})
+	require.EqualError(t, err, "invalid threadgroup dimension")
+
+	// Threadgroup memory is checked even though the CPU backend does not allocate it.
+	_, err = run(RunParameters{Grid: Grid{X: 32}, ThreadgroupMemory: []int{ThreadgroupMemoryFor[float32](64)}})
+	require.NoError(t, err)
+
+	_, err = run(RunParameters{Grid: Grid{X: 32}, ThreadgroupMemory: []int{16 << 10, 16 << 10, 1}})
+	require.EqualError(t, err, "threadgroup memory of 32784 bytes exceeds the device's limit of 32768 bytes")
+
+	_, err = run(RunParameters{Grid: Grid{X: 32}, ThreadgroupMemory: []int{-16}})
+	require.EqualError(t, err, "invalid threadgroup memory length -16 at index 0")
+
+	require.NoError(t, function.Close())
+	require.Zero(t, function.ThreadExecutionWidth())
+	require.Zero(t, function.MaxTotalThreadsPerThreadgroup())
+}
+
+// Test_cpuBackend_Run tests that Run executes registered kernels over 1, 2, and 3-dimensional grids
+// with the buffers and inputs bound in order.
+func Test_cpuBackend_Run(t *testing.T) {
+	t.Run("1D", func(t *testing.T) {
+		function, err := NewFunction(sourceSine, "sine")
+		require.NoError(t, err)
+
+		width := 10_000
+		inputId, input, err := NewBuffer[float32](width)
+		require.NoError(t, err)
+		defer inputId.Close()
+		outputId, output, err := NewBuffer[float32](width)
+		require.NoError(t, err)
+		defer outputId.Close()
+
+		for i := range input {
+			input[i] = float32(i) / 100
+		}
+
+		require.NoError(t, function.Run(RunParameters{
+			Grid:      Grid{X: width},
+			Inputs:    []float32{2},
+			BufferIds: []BufferId{inputId, outputId},
+		}))
+
+		for i := range output {
+			require.Equal(t, float32(math.Sin(float64(input[i])))*4, output[i])
+		}
+	})
+
+	t.Run("2D", func(t *testing.T) {
+		function, err := NewFunction(sourceTransfer2D, "transfer2D")
+		require.NoError(t, err)
+
+		width, height := 70, 45
+		inputId, input, err := NewBuffer[float32](width * height)
+		require.NoError(t, err)
+		defer inputId.Close()
+		outputId, output, err := NewBuffer[float32](width * height)
+		require.NoError(t, err)
+		defer outputId.Close()
+
+		for i := range input {
+			input[i] = float32(i)
+		}
+
+		require.NoError(t, function.Run(RunParameters{
+			Grid:      Grid{X: width, Y: height},
+			Inputs:    []float32{0.5},
+			BufferIds: []BufferId{inputId, outputId},
+		}))
+
+		for i := range output {
+			require.Equal(t, input[i]+0.5, output[i])
+		}
+	})
+
+	t.Run("3D", func(t *testing.T) {
+		function, err := NewFunction(sourceTransfer3D, "transfer3D")
+		require.NoError(t, err)
+
+		width, height, depth := 20, 30, 7
+		inputId, input, err := NewBuffer[float32](width * height * depth)
+		require.NoError(t, err)
+		defer inputId.Close()
+		outputId, output, err := NewBuffer[float32](width * height * depth)
+		require.NoError(t, err)
+		defer outputId.Close()
+
+		for i := range input {
+			input[i] = float32(i) * 3
+		}
+
+		require.NoError(t, function.Run(RunParameters{
+			Grid:      Grid{X: width, Y: height, Z: depth},
+			BufferIds: []BufferId{inputId, outputId},
+		}))
+		require.Equal(t, input, output)
+	})
+
+	t.Run("invalid buffer", func(t *testing.T) {
+		function, err := NewFunction(sourceTransfer1D, "transfer1D")
+		require.NoError(t, err)
+
+		err = function.Run(RunParameters{BufferIds: []BufferId{10000}})
+		require.EqualError(t, err, "buffer 1/1 is not open: invalid buffer id: 10000")
+		require.ErrorIs(t, err, ErrInvalidBufferId)
+	})
+
+	t.Run("closed buffer", func(t *testing.T) {
+		function, err := NewFunction(sourceTransfer1D, "transfer1D")
+		require.NoError(t, err)
+
+		bufferId, _, err := NewBuffer[float32](1)
+		require.NoError(t, err)
+		closedId := bufferId
+		require.NoError(t, bufferId.Close())
+		require.ErrorIs(t, closedId.Close(), ErrInvalidBufferId)
+
+		err = function.Run(RunParameters{BufferIds: []BufferId{closedId}})
+		require.ErrorIs(t, err, ErrInvalidBufferId)
+	})
+
+	t.Run("missing argument", func(t *testing.T) {
+		function, err := NewFunction(sourceTransfer1D, "transfer1D")
+		require.NoError(t, err)
+
+		inputId, _, err := NewBuffer[float32](1)
+		require.NoError(t, err)
+		defer inputId.Close()
+
+		err = function.Run(RunParameters{Grid: Grid{X: 1}, BufferIds: []BufferId{inputId}})
+		require.EqualError(t, err, "unable to run metal function: failed to bind arguments: missing buffer for parameter 'result' at index 1")
+	})
+
+	t.Run("invalid grid", func(t *testing.T) {
+		function, err := NewFunction(sourceNoop, "noop")
+		require.NoError(t, err)
+
+		require.EqualError(t, function.Run(RunParameters{Grid: Grid{X: -1}}), "invalid grid dimension")
+	})
+
+	t.Run("over-dispatch without bounds check", func(t *testing.T) {
+		defer SetCPUOptions(CPUOptions{})
+		SetCPUOptions(CPUOptions{UniformThreadgroups: true})
+
+		function, err := NewFunction(sourceTransfer1D, "transfer1D")
+		require.NoError(t, err)
+
+		width := 10
+		inputId, _, err := NewBuffer[float32](width)
+		require.NoError(t, err)
+		defer inputId.Close()
+		outputId, _, err := NewBuffer[float32](width)
+		require.NoError(t, err)
+		defer outputId.Close()
+
+		// transfer1D does not bounds-check its position, so the rounded-up grid indexes past the end
+		// of its buffers, which the CPU backend reports instead of corrupting memory.
+		err = function.Run(RunParameters{Grid: Grid{X: width}, BufferIds: []BufferId{inputId, outputId}})
+		require.ErrorContains(t, err, "unable to run metal function: kernel 'transfer1D' failed at thread position")
+	})
+}
+
+// Test_cpuBackend_types tests that interpreted kernels read and write each buffer type with the
+// same layout as the GPU, including the deliberate mismatches of Test_Function_types.
+func Test_cpuBackend_types(t *testing.T) {
+	testCPUType[float32](t, "float", false, func(i int) float32 { return float32(i) * 1.1 })
+	testCPUType[float32](t, "half", true, func(i int) float32 { return float32(i) * 1.1 })
+	testCPUType[int32](t, "int", false, func(i int) int32 { return int32(-i) })
+	testCPUType[int16](t, "short", false, func(i int) int16 { return int16(-i) })
+	testCPUType[int32](t, "short", true, func(i int) int32 { return int32(-i) })
+	testCPUType[uint32](t, "uint", false, func(i int) uint32 { return uint32(i) })
+	testCPUType[uint16](t, "ushort", false, func(i int) uint16 { return uint16(i) })
+	testCPUType[uint32](t, "ushort", true, func(i int) uint32 { return uint32(i) })
+}
+
+// testCPUType runs transferType for one buffer type on the CPU backend.
+func testCPUType[T BufferType](t *testing.T, metalType string, wantFail bool, setter func(int) T) {
+	t.Run(fmt.Sprintf("%s_%v", metalType, wantFail), func(t *testing.T) {
+		function, err := NewFunction(fmt.Sprintf(sourceTransferType, metalType, metalType), "transferType")
+		require.NoError(t, err)
+
+		inputId, input, err := NewBuffer[T](100)
+		require.NoError(t, err)
+		defer inputId.Close()
+		outputId, output, err := NewBuffer[T](100)
+		require.NoError(t, err)
+		defer outputId.Close()
+
+		for i := range input {
+			input[i] = setter(i)
+		}
+
+		require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 100}, BufferIds: []BufferId{inputId, outputId}}))
+
+		if wantFail {
+			require.NotEqual(t, input, output)
+		} else {
+			require.Equal(t, input, output)
+		}
+	})
+}
+
+// Test_cpuBackend_RunBatch tests that the batched and asynchronous variants run every dispatch and
+// reject a batch with any invalid dispatch before running any of it.
+func Test_cpuBackend_RunBatch(t *testing.T) {
+	function, err := NewFunction(sourceTransfer1D, "transfer1D")
+	require.NoError(t, err)
+
+	width := 500
+	newParams := func(n int) ([]RunParameters, [][]float32, [][]float32) {
+		params := make([]RunParameters, n)
+		inputs := make([][]float32, n)
+		outputs := make([][]float32, n)
+		for d := range params {
+			inputId, input, err := NewBuffer[float32](width)
+			require.NoError(t, err)
+			outputId, output, err := NewBuffer[float32](width)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				inputId.Close()
+				outputId.Close()
+			})
+
+			for i := range input {
+				input[i] = float32(i*(d+2)) - 0.25
+			}
+
+			params[d] = RunParameters{Grid: Grid{X: width}, BufferIds: []BufferId{inputId, outputId}}
+			inputs[d] = input
+			outputs[d] = output
+		}
+		return params, inputs, outputs
+	}
+
+	t.Run("RunBatch", func(t *testing.T) {
+		params, inputs, outputs := newParams(4)
+		require.NoError(t, function.RunBatch(params))
+		require.Equal(t, inputs, outputs)
+	})
+
+	t.Run("RunAsync", func(t *testing.T) {
+		params, inputs, outputs := newParams(1)
+		handle, err := function.RunAsync(params[0])
+		require.NoError(t, err)
+		require.NoError(t, handle.Wait())
+		require.Equal(t, inputs, outputs)
+		require.EqualError(t, handle.Wait(), "invalid run handle")
+	})
+
+	t.Run("RunBatchAsync", func(t *testing.T) {
+		params, inputs, outputs := newParams(3)
+		handle, err := function.RunBatchAsync(params)
+		require.NoError(t, err)
+		require.NoError(t, handle.Wait())
+		require.Equal(t, inputs, outputs)
+	})
+
+	t.Run("invalid dispatch runs nothing", func(t *testing.T) {
+		params, _, outputs := newParams(2)
+		params[1].BufferIds[0] = 10000
+
+		require.ErrorIs(t, function.RunBatch(params), ErrInvalidBufferId)
+		require.Equal(t, make([]float32, width), outputs[0])
+
+		handle, err := function.RunBatchAsync(params)
+		require.ErrorIs(t, err, ErrInvalidBufferId)
+		require.Nil(t, handle)
+	})
+}
+
+// Test_cpuBackend_Batch tests that a Batch runs dispatches of several functions in order, each
+// seeing the results of the ones before it, and runs none of them if any is invalid.
+func Test_cpuBackend_Batch(t *testing.T) {
+	transfer, err := NewFunction(sourceTransfer1D, "transfer1D")
+	require.NoError(t, err)
+	sine, err := NewFunction(sourceSine, "sine")
+	require.NoError(t, err)
+
+	width := 500
+	newBuffers := func() (input, output []float32, batch *Batch) {
+		inputId, input, err := NewBuffer[float32](width)
+		require.NoError(t, err)
+		scratchId, _, err := NewBuffer[float32](width)
+		require.NoError(t, err)
+		outputId, output, err := NewBuffer[float32](width)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			inputId.Close()
+			scratchId.Close()
+			outputId.Close()
+		})
+
+		for i := range input {
+			input[i] = float32(i) / 50
+		}
+
+		// Copy the input to scratch, then take the sine of scratch into the output.
+		batch = &Batch{}
+		batch.Add(transfer, RunParameters{Grid: Grid{X: width}, BufferIds: []BufferId{inputId, scratchId}})
+		batch.Add(sine, RunParameters{Grid: Grid{X: width}, Inputs: []float32{2}, BufferIds: []BufferId{scratchId, outputId}})
+		return input, output, batch
+	}
+
+	requireSine := func(t *testing.T, input, output []float32) {
+		for i := range output {
+			require.Equal(t, float32(math.Sin(float64(input[i])))*4, output[i])
+		}
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		var batch Batch
+		require.Zero(t, batch.Len())
+		require.NoError(t, batch.Run())
+
+		handle, err := batch.RunAsync()
+		require.NoError(t, err)
+		require.Nil(t, handle)
+	})
+
+	t.Run("Run", func(t *testing.T) {
+		input, output, batch := newBuffers()
+		require.Equal(t, 2, batch.Len())
+		require.NoError(t, batch.Run())
+		requireSine(t, input, output)
+	})
+
+	t.Run("RunAsync", func(t *testing.T) {
+		input, output, batch := newBuffers()
+		handle, err := batch.RunAsync()
+		require.NoError(t, err)
+		require.NoError(t, handle.Wait())
+		requireSine(t, input, output)
+		require.EqualError(t, handle.Wait(), "invalid run handle")
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		_, output, batch := newBuffers()
+		batch.Reset()
+		require.Zero(t, batch.Len())
+		require.NoError(t, batch.Run())
+		require.Equal(t, make([]float32, width), output)
+	})
+
+	t.Run("invalid dispatch runs nothing", func(t *testing.T) {
+		_, output, batch := newBuffers()
+		batch.Add(transfer, RunParameters{Grid: Grid{X: width}, BufferIds: []BufferId{10000, 10001}})
+
+		require.ErrorIs(t, batch.Run(), ErrInvalidBufferId)
+		require.Equal(t, make([]float32, width), output)
+
+		handle, err := batch.RunAsync()
+		require.ErrorIs(t, err, ErrInvalidBufferId)
+		require.Nil(t, handle)
+		require.Equal(t, make([]float32, width), output)
+
+		_, output, batch = newBuffers()
+		batch.Add(sine, RunParameters{Grid: Grid{X: -1}})
+		require.EqualError(t, batch.Run(), "dispatch 2 of 'sine': invalid grid dimension")
+		require.Equal(t, make([]float32, width), output)
+	})
+
+	t.Run("invalid function", func(t *testing.T) {
+		_, output, batch := newBuffers()
+		batch.Add(nil, RunParameters{})
+		require.EqualError(t, batch.Run(), "dispatch 2: invalid nil function")
+
+		_, output, batch = newBuffers()
+		batch.Add(&Function{}, RunParameters{})
+		require.ErrorIs(t, batch.Run(), ErrInvalidFunctionId)
+		require.Equal(t, make([]float32, width), output)
+	})
+
+	t.Run("different backends", func(t *testing.T) {
+		var batch Batch
+		batch.Add(transfer, RunParameters{})
+		batch.Add(&Function{b: defaultBackend}, RunParameters{})
+		require.EqualError(t, batch.Run(), "dispatch 1: cannot batch functions from different backends")
+
+		batch.Reset()
+		batch.Add(&Function{b: defaultBackend}, RunParameters{})
+		require.ErrorIs(t, batch.Run(), ErrMetalUnavailable)
+	})
+}
+
+// Test_cpuBackend_BatchError tests that the error of a batch names the dispatch, function, and
+// argument that failed, whether the dispatch is invalid, fails to bind, or fails while running.
+func Test_cpuBackend_BatchError(t *testing.T) {
+	RegisterCPUKernel("batchFail", func(tc ThreadContext, _ []float32, _ []any) {
+		panic("kernel failed")
+	})
+
+	transfer, err := NewFunction(sourceTransfer1D, "transfer1D")
+	require.NoError(t, err)
+	fail, err := NewFunction("this source is never parsed", "batchFail")
+	require.NoError(t, err)
+
+	width := 10
+	inputId, _, err := NewBuffer[float32](width)
+	require.NoError(t, err)
+	defer inputId.Close()
+	outputId, _, err := NewBuffer[float32](width)
+	require.NoError(t, err)
+	defer outputId.Close()
+	valid := RunParameters{Grid: Grid{X: width}, BufferIds: []BufferId{inputId, outputId}}
+
+	t.Run("invalid buffer", func(t *testing.T) {
+		params := []RunParameters{
+			valid,
+			{Grid: Grid{X: width}, Inputs: []float32{1}, BufferIds: []BufferId{inputId, 10000}},
+		}
+
+		err := transfer.RunBatch(params)
+		require.EqualError(t, err, "dispatch 1 of 'transfer1D': buffer 2/2 is not open: invalid buffer id: 10000")
+		require.ErrorIs(t, err, ErrInvalidBufferId)
+		var batchErr *BatchError
+		require.ErrorAs(t, err, &batchErr)
+		require.Equal(t, 1, batchErr.Index)
+		require.Equal(t, "transfer1D", batchErr.Function)
+		require.Equal(t, 2, batchErr.Argument)
+		require.Equal(t, ErrInvalidBufferId, batchErr.Sentinel)
+
+		handle, err := transfer.RunBatchAsync(params)
+		require.Nil(t, handle)
+		require.ErrorAs(t, err, &batchErr)
+		require.Equal(t, 1, batchErr.Index)
+		require.Equal(t, 2, batchErr.Argument)
+	})
+
+	t.Run("invalid arguments", func(t *testing.T) {
+		var batch Batch
+		batch.Add(fail, RunParameters{})
+		batch.Add(transfer, RunParameters{Grid: Grid{X: width}, BufferIds: []BufferId{inputId}, Validate: true})
+
+		err := batch.Run()
+		var batchErr *BatchError
+		require.ErrorAs(t, err, &batchErr)
+		require.Equal(t, 1, batchErr.Index)
+		require.Equal(t, "transfer1D", batchErr.Function)
+		require.Equal(t, 1, batchErr.Argument)
+		require.Nil(t, batchErr.Sentinel)
+		var argErr *ArgumentError
+		require.ErrorAs(t, err, &argErr)
+	})
+
+	t.Run("failed kernel", func(t *testing.T) {
+		var batch Batch
+		batch.Add(transfer, valid)
+		batch.Add(fail, RunParameters{})
+
+		err := batch.Run()
+		require.ErrorContains(t, err, "dispatch 1 of 'batchFail': ")
+		require.ErrorContains(t, err, "kernel failed")
+		var batchErr *BatchError
+		require.ErrorAs(t, err, &batchErr)
+		require.Equal(t, 1, batchErr.Index)
+		require.Equal(t, "batchFail", batchErr.Function)
+		require.Equal(t, -1, batchErr.Argument)
+		require.Nil(t, batchErr.Sentinel)
+
+		handle, err := batch.RunAsync()
+		require.NoError(t, err)
+		err = handle.Wait()
+		require.ErrorContains(t, err, "unable to wait for metal function: dispatch 1 of 'batchFail': ")
+		require.ErrorAs(t, err, &batchErr)
+		require.Equal(t, 1, batchErr.Index)
+
+		// A single dispatch is not a batch.
+		handle, err = fail.RunAsync(RunParameters{})
+		require.NoError(t, err)
+		err = handle.Wait()
+		require.ErrorContains(t, err, "kernel failed")
+		require.False(t, errors.As(err, &batchErr))
+	})
+}
+
+// Test_cpuBackend_RunContext tests that RunContext and WaitContext give up on a kernel that has not
+// finished when their context is done, and that the kernel still finishes in the background.
+func Test_cpuBackend_RunContext(t *testing.T) {
+	hang := make(chan struct{})
+	var finished atomic.Int32
+	RegisterCPUKernel("hang", func(tc ThreadContext, _ []float32, _ []any) {
+		<-hang
+		finished.Add(1)
+	})
+
+	function, err := NewFunction("this source is never parsed", "hang")
+	require.NoError(t, err)
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// Nothing is dispatched.
+		require.ErrorIs(t, function.RunContext(ctx, RunParameters{}), context.Canceled)
+		require.Zero(t, finished.Load())
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, function.RunContext(ctx, RunParameters{}), context.DeadlineExceeded)
+
+		handle, err := function.RunAsync(RunParameters{})
+		require.NoError(t, err)
+		require.ErrorIs(t, handle.WaitContext(ctx), context.DeadlineExceeded)
+
+		close(hang)
+		require.NoError(t, handle.Wait())
+		require.Eventually(t, func() bool { return finished.Load() == 2 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("finished", func(t *testing.T) {
+		require.NoError(t, function.RunContext(context.Background(), RunParameters{Grid: Grid{X: 4}}))
+		require.Equal(t, int32(6), finished.Load())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		err := function.RunContext(context.Background(), RunParameters{Grid: Grid{X: -1}})
+		require.EqualError(t, err, "invalid grid dimension")
+	})
+}
+
+// Test_cpuBackend_RunHandle tests that a RunHandle follows the progress of a dispatch on the CPU
+// backend.
+func Test_cpuBackend_RunHandle(t *testing.T) {
+	started := make(chan struct{})
+	hang := make(chan struct{})
+	RegisterCPUKernel("handleHang", func(tc ThreadContext, _ []float32, _ []any) {
+		close(started)
+		<-hang
+	})
+	RegisterCPUKernel("handleFail", func(tc ThreadContext, _ []float32, _ []any) {
+		panic("kernel failed")
+	})
+
+	function, err := NewFunction("this source is never parsed", "handleHang")
+	require.NoError(t, err)
+
+	handle, err := function.RunAsync(RunParameters{})
+	require.NoError(t, err)
+	<-started
+	require.Equal(t, RunStatusRunning, handle.Status())
+	require.NoError(t, handle.Err())
+
+	completed := make(chan error, 1)
+	handle.OnComplete(func(err error) { completed <- err })
+
+	close(hang)
+	<-handle.Done()
+	require.NoError(t, <-completed)
+	require.Equal(t, RunStatusCompleted, handle.Status())
+	require.NoError(t, handle.Wait())
+
+	function, err = NewFunction("this source is never parsed", "handleFail")
+	require.NoError(t, err)
+
+	handle, err = function.RunAsync(RunParameters{})
+	require.NoError(t, err)
+	<-handle.Done()
+	require.Equal(t, RunStatusErrored, handle.Status())
+	require.ErrorContains(t, handle.Err(), "kernel failed")
+	require.ErrorContains(t, handle.Wait(), "kernel failed")
+}
+
+// Test_cpuBackend_Force tests that CPUOptions.Force only affects Functions created while it is set.
+func Test_cpuBackend_Force(t *testing.T) {
+	defer SetCPUOptions(CPUOptions{})
+	SetCPUOptions(CPUOptions{Force: true})
+
+	function, err := NewFunction(sourceNoop, "noop")
+	require.NoError(t, err)
+	require.Equal(t, cpu, function.b)
+
+	SetCPUOptions(CPUOptions{})
+	require.NoError(t, function.Run(RunParameters{}))
+}
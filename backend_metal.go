@@ -0,0 +1,822 @@
+//go:build darwin && cgo
+
+package metal
+
+/*
+#cgo CFLAGS: -fobjc-arc
+#cgo LDFLAGS: -framework Metal -framework Foundation
+#include "Metal.h"
+*/
+import "C"
+
+import (
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/green-aloe/metal/internal/msl"
+)
+
+// metalAvailable reports whether metal_init succeeded at package load time. It
+// is written once in init (before any other goroutine can run) and only read
+// afterward, so it needs no synchronization.
+var metalAvailable bool
+
+func init() {
+	// Initialize the device that will be used to run the computations. A failure
+	// here is not fatal: the package degrades to returning ErrMetalUnavailable
+	// from its public functions so importing it on an unsupported machine does
+	// not abort the process.
+	metalAvailable = bool(C.metal_init())
+
+	defaultBackend = metalBackend{}
+}
+
+// metalBackend runs computations on the default GPU through the Objective-C layer in Metal.m,
+// Function.m, and Buffer.m.
+type metalBackend struct{}
+
+func (metalBackend) available() error {
+	if !metalAvailable {
+		return ErrMetalUnavailable
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Functions
+// ----------------------------------------------------------------------------
+
+func (metalBackend) newFunction(source, funcName string, opts *CompileOptions) (int32, []Diagnostic, error) {
+	src := C.CString(source)
+	defer C.free(unsafe.Pointer(src))
+
+	name := C.CString(funcName)
+	defer C.free(unsafe.Pointer(name))
+
+	cOpts, free := compileOptions(opts)
+	defer free()
+
+	// With the pipeline cache on, the pipeline is loaded from its cached archive if there is one,
+	// and otherwise stored in a new archive for the cache to keep.
+	var archiveIn, archiveOut *C.char
+	defer func() { freeCString(archiveIn); freeCString(archiveOut) }()
+	var status C.int
+	if cache := activePipelineCache.Load(); cache != nil {
+		key := pipelineKey(source, funcName, opts, deviceIdentity())
+		in, out := cache.begin(key)
+		if in != "" {
+			archiveIn = C.CString(in)
+		}
+		if out != "" {
+			archiveOut = C.CString(out)
+		}
+		defer func() { cache.finish(key, in, out, archiveStatus(status)) }()
+	}
+
+	// The C side may strdup the compiler's output into log and an error message into err; we must
+	// free them. It sets code if the source does not compile.
+	var log, err *C.char
+	defer func() { freeCString(log); freeCString(err) }()
+	var code C.int
+
+	id := int32(C.function_new(src, name, cOpts, archiveIn, archiveOut, &status, &log, &err, &code))
+	if id == 0 {
+		if code == errCodeCompile && log != nil {
+			return 0, nil, compileError(C.GoString(log), "unable to set up metal function")
+		}
+		// NewFunction failures (missing source, function not found) are not invalid-handle
+		// conditions, so the code is errCodeNone and no sentinel is attached: the handle does not
+		// exist yet.
+		return 0, nil, metalErrToError(err, "unable to set up metal function", errCodeNone)
+	}
+
+	return id, parseCompilerLog(C.GoString(log)), nil
+}
+
+// deviceIdentity describes the GPU and the system it runs on, which the pipeline cache keys on, as
+// a compiled pipeline can be reused only by the same GPU under the same system.
+var deviceIdentity = sync.OnceValue(func() string {
+	// metal_device_identity strdup's the result; we must free it.
+	identity := C.metal_device_identity()
+	defer freeCString(identity)
+
+	return C.GoString(identity)
+})
+
+func (metalBackend) functionName(id int32) string {
+	// function_name strdup's the result; we must free it.
+	name := C.function_name(C.int(id))
+	defer freeCString(name)
+
+	return C.GoString(name)
+}
+
+func (metalBackend) closeFunction(id int32) error {
+	// The C side may strdup an error message into err on failure; we must free it. It also
+	// categorizes the failure in code so metalErrToError can attach the matching sentinel.
+	var err *C.char
+	defer func() { freeCString(err) }()
+	var code C.int
+
+	if !C.function_close(C.int(id), &err, &code) {
+		return metalErrToError(err, "unable to close metal function", code)
+	}
+
+	return nil
+}
+
+func (metalBackend) limits(id int32) (pipelineLimits, bool) {
+	var width, maxThreads, maxMemory, staticMemory, constantAlign C.int
+	if !C.function_limits(C.int(id), &width, &maxThreads, &maxMemory, &staticMemory, &constantAlign) {
+		return pipelineLimits{}, false
+	}
+
+	return pipelineLimits{
+		threadExecutionWidth:          int(width),
+		maxTotalThreadsPerThreadgroup: int(maxThreads),
+		maxThreadgroupMemoryLength:    int(maxMemory),
+		staticThreadgroupMemoryLength: int(staticMemory),
+		constantOffsetAlignment:       int(constantAlign),
+	}, true
+}
+
+func (metalBackend) arguments(id int32) ([]Argument, error) {
+	// The C side may strdup an error message into err on failure; we must free it. It also
+	// categorizes the failure in code so metalErrToError can attach the matching sentinel.
+	var err *C.char
+	defer func() { freeCString(err) }()
+	var code C.int
+
+	var cArgs *C.FunctionArgument
+	n := int(C.function_arguments(C.int(id), &cArgs, &err, &code))
+	if n < 0 {
+		return nil, metalErrToError(err, "unable to get metal function arguments", code)
+	}
+	// function_arguments allocates the array and the strings in it; we must free them.
+	defer C.function_arguments_free(cArgs, C.int(n))
+	if n == 0 {
+		return nil, nil
+	}
+
+	args := make([]Argument, 0, n)
+	for _, cArg := range unsafe.Slice(cArgs, n) {
+		arg := Argument{
+			Index:   int(cArg.index),
+			Name:    C.GoString(cArg.name),
+			Type:    C.GoString(cArg.typeName),
+			Pointer: true,
+		}
+		switch {
+		case cArg.kind == C.FunctionArgumentThreadgroupMemory:
+			arg.AddressSpace = AddressSpaceThreadgroup
+		case bool(cArg.readOnly):
+			// Reflection does not say which address space a buffer is in, only whether the
+			// function can write to it.
+			arg.AddressSpace = AddressSpaceConstant
+		default:
+			arg.AddressSpace = AddressSpaceDevice
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+// ----------------------------------------------------------------------------
+// Libraries
+// ----------------------------------------------------------------------------
+
+func (metalBackend) newLibrary(source string, opts *CompileOptions) (int32, []string, []Diagnostic, error) {
+	src := C.CString(source)
+	defer C.free(unsafe.Pointer(src))
+
+	cOpts, free := compileOptions(opts)
+	defer free()
+
+	// The C side may strdup the compiler's output into log and an error message into err; we must
+	// free them. It sets code if the source does not compile.
+	var log, err *C.char
+	defer func() { freeCString(log); freeCString(err) }()
+	var code C.int
+
+	var cNames **C.char
+	var numNames C.int
+	id := int32(C.library_new_with_source(src, cOpts, &cNames, &numNames, &log, &err, &code))
+	if id == 0 {
+		if code == errCodeCompile && log != nil {
+			return 0, nil, nil, compileError(C.GoString(log), "unable to create metal library")
+		}
+		// As with newFunction, a library that cannot be created is not an invalid-handle condition.
+		return 0, nil, nil, metalErrToError(err, "unable to create metal library", errCodeNone)
+	}
+
+	return id, libraryNames(cNames, numNames), parseCompilerLog(C.GoString(log)), nil
+}
+
+func (metalBackend) loadLibrary(data []byte) (int32, []string, error) {
+	// The C side may strdup an error message into err on failure; we must free it.
+	var err *C.char
+	defer func() { freeCString(err) }()
+
+	// library_new_with_data copies data before it returns, so it only needs to stay pinned for the
+	// call, which cgo already guarantees.
+	var dataPtr unsafe.Pointer
+	if len(data) > 0 {
+		dataPtr = unsafe.Pointer(&data[0])
+	}
+
+	var cNames **C.char
+	var numNames C.int
+	id := int32(C.library_new_with_data(dataPtr, C.size_t(len(data)), &cNames, &numNames, &err))
+	if id == 0 {
+		// As with newFunction, a library that cannot be loaded is not an invalid-handle condition.
+		return 0, nil, metalErrToError(err, "unable to load metal library", errCodeNone)
+	}
+
+	return id, libraryNames(cNames, numNames), nil
+}
+
+// compileOptions converts opts into the options the C side compiles with. It returns nil for nil
+// opts, and a function that frees what was allocated, which must be called once the C call returns.
+func compileOptions(opts *CompileOptions) (*C.CompileOptions, func()) {
+	if opts == nil {
+		return nil, func() {}
+	}
+
+	// The struct and the arrays of macro names and values are allocated in C, because cgo does not
+	// allow C to be handed Go memory that holds Go pointers.
+	cOpts := (*C.CompileOptions)(C.calloc(1, C.size_t(unsafe.Sizeof(C.CompileOptions{}))))
+	cOpts.mathMode = C.int(opts.MathMode)
+	cOpts.preserveInvariance = C._Bool(opts.PreserveInvariance)
+	if v := opts.LanguageVersion; v != (Version{}) {
+		// MTLLanguageVersion packs the major version into the upper 16 bits.
+		cOpts.languageVersion = C.ulong(v.Major<<16 | v.Minor)
+	}
+
+	n := len(opts.PreprocessorMacros)
+	if n > 0 {
+		ptrSize := C.size_t(unsafe.Sizeof((*C.char)(nil)))
+		cOpts.macroNames = (**C.char)(C.calloc(C.size_t(n), ptrSize))
+		cOpts.macroValues = (**C.char)(C.calloc(C.size_t(n), ptrSize))
+		cOpts.numMacros = C.int(n)
+	}
+	names := unsafe.Slice(cOpts.macroNames, n)
+	values := unsafe.Slice(cOpts.macroValues, n)
+	i := 0
+	for name, value := range opts.PreprocessorMacros {
+		names[i] = C.CString(name)
+		values[i] = C.CString(value)
+		i++
+	}
+
+	nc := len(opts.Constants)
+	if nc > 0 {
+		cOpts.constants = (*C.FunctionConstantValue)(C.calloc(C.size_t(nc), C.size_t(unsafe.Sizeof(C.FunctionConstantValue{}))))
+		cOpts.numConstants = C.int(nc)
+	}
+	constants := unsafe.Slice(cOpts.constants, nc)
+	for i, c := range opts.Constants {
+		// The constants were checked when the options were, so every value has a supported type.
+		s, _ := c.scalar()
+		constants[i].index = C.int(c.Index)
+		constants[i]._type = constantType(s.typ)
+		constants[i].bits = C.uint(s.bits)
+		if c.Name != "" {
+			constants[i].name = C.CString(c.Name)
+		}
+	}
+
+	return cOpts, func() {
+		for i := range n {
+			C.free(unsafe.Pointer(names[i]))
+			C.free(unsafe.Pointer(values[i]))
+		}
+		for i := range nc {
+			C.free(unsafe.Pointer(constants[i].name))
+		}
+		C.free(unsafe.Pointer(cOpts.macroNames))
+		C.free(unsafe.Pointer(cOpts.macroValues))
+		C.free(unsafe.Pointer(cOpts.constants))
+		C.free(unsafe.Pointer(cOpts))
+	}
+}
+
+// constantType returns the C type of a function constant of scalar type s.
+func constantType(s msl.Scalar) C.int {
+	switch s {
+	case msl.Bool:
+		return C.FunctionConstantBool
+	case msl.UInt:
+		return C.FunctionConstantUInt
+	case msl.Float:
+		return C.FunctionConstantFloat
+	case msl.Half:
+		return C.FunctionConstantHalf
+	case msl.Short:
+		return C.FunctionConstantShort
+	case msl.UShort:
+		return C.FunctionConstantUShort
+	default:
+		return C.FunctionConstantInt
+	}
+}
+
+// libraryNames converts the kernel names that the C side reports for a new library and frees them.
+func libraryNames(cNames **C.char, numNames C.int) []string {
+	// The C side allocates the array and the strings in it; we must free them.
+	defer C.library_names_free(cNames, numNames)
+
+	names := make([]string, 0, int(numNames))
+	for _, name := range unsafe.Slice(cNames, int(numNames)) {
+		names = append(names, C.GoString(name))
+	}
+
+	return names
+}
+
+func (metalBackend) libraryFunction(libraryId int32, funcName string, opts *CompileOptions) (int32, error) {
+	name := C.CString(funcName)
+	defer C.free(unsafe.Pointer(name))
+
+	cOpts, free := compileOptions(opts)
+	defer free()
+
+	// The C side may strdup an error message into err on failure; we must free it. It also
+	// categorizes the failure in code so metalErrToError can attach the matching sentinel.
+	var err *C.char
+	defer func() { freeCString(err) }()
+	var code C.int
+
+	id := int32(C.library_function(C.int(libraryId), name, cOpts, &err, &code))
+	if id == 0 {
+		return 0, metalErrToError(err, "unable to set up metal function", code)
+	}
+
+	return id, nil
+}
+
+func (metalBackend) closeLibrary(id int32) error {
+	// The C side may strdup an error message into err on failure; we must free it. It also
+	// categorizes the failure in code so metalErrToError can attach the matching sentinel.
+	var err *C.char
+	defer func() { freeCString(err) }()
+	var code C.int
+
+	if !C.library_close(C.int(id), &err, &code) {
+		return metalErrToError(err, "unable to close metal library", code)
+	}
+
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Buffers
+// ----------------------------------------------------------------------------
+
+func (metalBackend) newBuffer(numBytes int) (int32, unsafe.Pointer, error) {
+	// The C side may strdup an error message into err on failure; we must free it.
+	var err *C.char
+	defer func() { freeCString(err) }()
+
+	// Allocate memory for the new buffer and get its contents pointer in one call.
+	var contents unsafe.Pointer
+	bufferId := C.buffer_new(C.size_t(numBytes), &contents, &err)
+	if int(bufferId) == 0 {
+		// buffer_new fails only on allocation failure or id exhaustion, neither of which is an
+		// invalid-handle condition, so the code is errCodeNone and no sentinel is attached.
+		return 0, nil, metalErrToError(err, "unable to create buffer", errCodeNone)
+	}
+
+	return int32(bufferId), contents, nil
+}
+
+func (metalBackend) closeBuffer(id int32) error {
+	// The C side may strdup an error message into err on failure; we must free it. It also
+	// categorizes the failure in code so metalErrToError can attach the matching sentinel.
+	var err *C.char
+	defer func() { freeCString(err) }()
+	var code C.int
+
+	if !C.buffer_close(C.int(id), &err, &code) {
+		return metalErrToError(err, "unable to free buffer", code)
+	}
+
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Dispatch: synchronous, batched, and asynchronous
+// ----------------------------------------------------------------------------
+
+func (metalBackend) run(d dispatch) error {
+	inputs, inputSizes := d.packInputs()
+	offsets := d.packOffsets()
+	inputsPtr, inputSizesPtr, bufferIdsPtr, offsetsPtr := d.pointers(inputs, inputSizes, offsets)
+	memory, memoryPtr := d.packThreadgroupMemory()
+
+	// The C side may strdup an error message into cErr on failure; we must free it. It also
+	// categorizes the failure in code (invalid function id vs. invalid buffer id) so
+	// metalErrToError can attach the matching sentinel.
+	var cErr *C.char
+	defer func() { freeCString(cErr) }()
+	var code, commandBufferError C.int
+
+	// Run the computation on the GPU.
+	ok := C.function_run(C.int(d.functionId), C.uint(d.width), C.uint(d.height), C.uint(d.depth),
+		C.uint(d.threadgroup.X), C.uint(d.threadgroup.Y), C.uint(d.threadgroup.Z), inputsPtr, inputSizesPtr,
+		C.int(len(inputSizes)), bufferIdsPtr, offsetsPtr, C.int(len(d.bufferIds)), memoryPtr, C.int(len(memory)),
+		&cErr, &code, &commandBufferError)
+
+	// Keep the input and buffer slices alive until function_run returns. The C call reads through
+	// inputsPtr/inputSizesPtr/bufferIdsPtr/offsetsPtr/memoryPtr (raw pointers into the slice backing
+	// arrays), which the Go garbage collector cannot see; without these the collector would be free
+	// to reclaim the slices while the GPU is still reading them.
+	runtime.KeepAlive(inputs)
+	runtime.KeepAlive(inputSizes)
+	runtime.KeepAlive(d.bufferIds)
+	runtime.KeepAlive(offsets)
+	runtime.KeepAlive(memory)
+
+	if !ok {
+		return metalErrToError(cErr, "unable to run metal function",
+			C.int(runErrorCode(code, commandBufferError)))
+	}
+
+	return nil
+}
+
+func (b metalBackend) runBatch(ds []dispatch) error {
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+
+	args := marshalBatch(ds, &pinner)
+
+	// On failure the C side also reports which dispatch and argument failed, if it can tell, and
+	// the MTLCommandBufferError code of a command buffer that failed on the GPU.
+	var cErr *C.char
+	defer func() { freeCString(cErr) }()
+	var code, commandBufferError C.int
+	failedDispatch, failedArgument := C.int(-1), C.int(-1)
+
+	ok := C.function_run_batch(C.int(len(ds)), &args.functionIds[0], &args.widths[0], &args.heights[0],
+		&args.depths[0], &args.threadgroupWidths[0], &args.threadgroupHeights[0], &args.threadgroupDepths[0],
+		&args.inputs[0], &args.inputSizes[0], &args.numInputs[0], &args.bufferIds[0],
+		&args.bufferOffsets[0], &args.numBufferIds[0], &args.threadgroupMemory[0], &args.numThreadgroupMemory[0],
+		&cErr, &code, &failedDispatch, &failedArgument, &commandBufferError)
+
+	if !ok {
+		return batchFailure(b, ds, int(failedDispatch), int(failedArgument), C.GoString(cErr),
+			"unable to run metal function batch", runErrorCode(code, commandBufferError))
+	}
+
+	return nil
+}
+
+func (metalBackend) runAsync(d dispatch, c completion) error {
+	inputs, inputSizes := d.packInputs()
+	offsets := d.packOffsets()
+	inputsPtr, inputSizesPtr, bufferIdsPtr, offsetsPtr := d.pointers(inputs, inputSizes, offsets)
+	memory, memoryPtr := d.packThreadgroupMemory()
+
+	var cErr *C.char
+	defer func() { freeCString(cErr) }()
+	var code C.int
+
+	// The command buffer can finish before function_run_async returns, so c must be registered
+	// before the call.
+	callback := completions.add(c, nil)
+	ok := C.function_run_async(C.int(d.functionId), C.uint(d.width), C.uint(d.height), C.uint(d.depth),
+		C.uint(d.threadgroup.X), C.uint(d.threadgroup.Y), C.uint(d.threadgroup.Z), inputsPtr, inputSizesPtr,
+		C.int(len(inputSizes)), bufferIdsPtr, offsetsPtr, C.int(len(d.bufferIds)), memoryPtr, C.int(len(memory)),
+		C.uintptr_t(callback), &cErr, &code)
+
+	// Keep the slices alive through encoding (which happens synchronously inside the C call). After
+	// the call returns the dispatch is fully encoded: inputs were copied via setBytes, and the
+	// buffers are referenced from the command buffer and held alive by the buffer cache.
+	runtime.KeepAlive(inputs)
+	runtime.KeepAlive(inputSizes)
+	runtime.KeepAlive(d.bufferIds)
+	runtime.KeepAlive(offsets)
+	runtime.KeepAlive(memory)
+
+	if !ok {
+		completions.remove(callback)
+		return metalErrToError(cErr, "unable to run metal function asynchronously", code)
+	}
+
+	return nil
+}
+
+func (b metalBackend) runBatchAsync(ds []dispatch, c completion) error {
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+
+	args := marshalBatch(ds, &pinner)
+
+	var cErr *C.char
+	defer func() { freeCString(cErr) }()
+	var code C.int
+	failedDispatch, failedArgument := C.int(-1), C.int(-1)
+
+	// ds is kept with the completion so that a failure on the GPU can name the failed dispatch.
+	callback := completions.add(c, ds)
+	ok := C.function_run_batch_async(C.int(len(ds)), &args.functionIds[0], &args.widths[0], &args.heights[0],
+		&args.depths[0], &args.threadgroupWidths[0], &args.threadgroupHeights[0], &args.threadgroupDepths[0],
+		&args.inputs[0], &args.inputSizes[0], &args.numInputs[0], &args.bufferIds[0],
+		&args.bufferOffsets[0], &args.numBufferIds[0], &args.threadgroupMemory[0], &args.numThreadgroupMemory[0],
+		C.uintptr_t(callback), &cErr, &code, &failedDispatch, &failedArgument)
+
+	if !ok {
+		completions.remove(callback)
+		return batchFailure(b, ds, int(failedDispatch), int(failedArgument), C.GoString(cErr),
+			"unable to run metal function batch asynchronously", int(code))
+	}
+
+	return nil
+}
+
+// completions holds the completion of every command buffer in flight. cgo does not let C keep a Go
+// pointer after a call returns, so a command buffer's handlers report back with the id that it was
+// registered under instead.
+var completions = &completionTable{m: make(map[uintptr]pendingRun)}
+
+// A completionTable maps the ids that command buffer handlers report back with to the runs that
+// they report on.
+type completionTable struct {
+	mu   sync.Mutex
+	m    map[uintptr]pendingRun
+	next uintptr
+}
+
+// A pendingRun is a command buffer in flight: the completion to report to, and the dispatches of
+// its batch, or nil if it runs a single dispatch.
+type pendingRun struct {
+	c     completion
+	batch []dispatch
+}
+
+// add registers c for a command buffer of the dispatches in batch and returns its id.
+func (t *completionTable) add(c completion, batch []dispatch) uintptr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.next++
+	t.m[t.next] = pendingRun{c: c, batch: batch}
+	return t.next
+}
+
+// get returns the completion registered under id, if it is still registered.
+func (t *completionTable) get(id uintptr) (completion, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	run, ok := t.m[id]
+	return run.c, ok
+}
+
+// remove unregisters the run registered under id and returns it, if it was still registered.
+func (t *completionTable) remove(id uintptr) (pendingRun, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	run, ok := t.m[id]
+	delete(t.m, id)
+	return run, ok
+}
+
+// runScheduled is called by a command buffer's scheduled handler once it is scheduled on the device,
+// which is when its RunHandle reports RunStatusRunning, though the GPU may not have started it yet.
+//
+//export runScheduled
+func runScheduled(callback C.uintptr_t) {
+	if c, ok := completions.get(uintptr(callback)); ok {
+		c.running()
+	}
+}
+
+// runCompleted is called by a command buffer's completed handler once it has finished, with an
+// error message if it finished in an error state. The message is on the C heap and is freed here.
+// failedDispatch is the index of the dispatch that faulted, or -1 if it is not known, and
+// commandBufferError is the command buffer's MTLCommandBufferError code.
+//
+//export runCompleted
+func runCompleted(callback C.uintptr_t, cErr *C.char, failedDispatch, commandBufferError C.int) {
+	defer freeCString(cErr)
+
+	run, ok := completions.remove(uintptr(callback))
+	if !ok {
+		return
+	}
+
+	var err error
+	if cErr != nil {
+		code := runErrorCode(errCodeNone, commandBufferError)
+		if run.batch == nil {
+			err = metalErrToError(cErr, "unable to wait for metal function", C.int(code))
+		} else {
+			err = batchFailure(metalBackend{}, run.batch, int(failedDispatch), -1, C.GoString(cErr),
+				"unable to wait for metal function", code)
+		}
+	}
+	run.c.finish(err)
+}
+
+// runErrorCode returns the error code of a run that failed with code, unless its command buffer
+// failed on the GPU with the MTLCommandBufferError commandBufferError, which classifies it instead.
+func runErrorCode(code, commandBufferError C.int) int {
+	if mtlCode := int(commandBufferError); mtlCode != 0 {
+		return commandBufferErrorCode(mtlCode)
+	}
+	return int(code)
+}
+
+// ----------------------------------------------------------------------------
+// Internal dispatch helpers
+// ----------------------------------------------------------------------------
+
+// packInputs encodes the inputs of d for the C layer: the bytes of every input and then every
+// struct input back to back, and the size of each one.
+func (d dispatch) packInputs() ([]byte, []C.int) {
+	var inputs []byte
+	inputSizes := make([]C.int, 0, len(d.inputs)+len(d.structs))
+	for _, input := range d.inputs {
+		b := input.bytes()
+		inputs = append(inputs, b...)
+		inputSizes = append(inputSizes, C.int(len(b)))
+	}
+	for _, b := range d.structs {
+		inputs = append(inputs, b...)
+		inputSizes = append(inputSizes, C.int(len(b)))
+	}
+
+	return inputs, inputSizes
+}
+
+// packOffsets returns the byte offset of every buffer of d for the C layer, or nil if every buffer
+// is bound from its start.
+func (d dispatch) packOffsets() []C.ulong {
+	if d.spans == nil {
+		return nil
+	}
+
+	offsets := make([]C.ulong, len(d.spans))
+	for i, span := range d.spans {
+		offsets[i] = C.ulong(span.offset)
+	}
+
+	return offsets
+}
+
+// packThreadgroupMemory returns the threadgroup memory lengths of d for the C layer and a pointer to
+// the first of them, or nil and a nil pointer if d has none. The pointer is only valid while the
+// caller keeps the lengths alive.
+func (d dispatch) packThreadgroupMemory() ([]C.ulong, *C.ulong) {
+	if len(d.threadgroupMemory) == 0 {
+		return nil, nil
+	}
+
+	lengths := make([]C.ulong, len(d.threadgroupMemory))
+	for i, n := range d.threadgroupMemory {
+		lengths[i] = C.ulong(n)
+	}
+
+	return lengths, &lengths[0]
+}
+
+// pointers returns C pointers into the packed inputs, the input sizes, the bufferIds, and the
+// buffer offsets backing arrays, or nil for an empty slice. byte/C.uchar and BufferId/C.int are
+// binary compatible on all Apple platforms, so the slices are cast directly without copying. The
+// returned pointers are only valid while the caller keeps inputs, inputSizes, d.bufferIds, and
+// offsets alive (see runtime.KeepAlive at the call sites).
+func (d dispatch) pointers(inputs []byte, inputSizes []C.int, offsets []C.ulong) (inputsPtr *C.uchar, inputSizesPtr *C.int, bufferIdsPtr *C.int, offsetsPtr *C.ulong) {
+	if len(inputs) > 0 {
+		inputsPtr = (*C.uchar)(unsafe.Pointer(&inputs[0]))
+	}
+	if len(inputSizes) > 0 {
+		inputSizesPtr = &inputSizes[0]
+	}
+	if len(d.bufferIds) > 0 {
+		bufferIdsPtr = (*C.int)(unsafe.Pointer(&d.bufferIds[0]))
+	}
+	if len(offsets) > 0 {
+		offsetsPtr = &offsets[0]
+	}
+
+	return
+}
+
+// batchArgs holds the parallel C arrays that the batch entry points read, one element per dispatch.
+type batchArgs struct {
+	functionIds          []C.int
+	widths               []C.uint
+	heights              []C.uint
+	depths               []C.uint
+	threadgroupWidths    []C.uint
+	threadgroupHeights   []C.uint
+	threadgroupDepths    []C.uint
+	inputs               []*C.uchar
+	inputSizes           []*C.int
+	numInputs            []C.int
+	bufferIds            []*C.int
+	bufferOffsets        []*C.ulong
+	numBufferIds         []C.int
+	threadgroupMemory    []*C.ulong
+	numThreadgroupMemory []C.int
+}
+
+// marshalBatch builds the parallel C arrays for the batch entry points.
+//
+// inputs[i], inputSizes[i], bufferIds[i], bufferOffsets[i], and threadgroupMemory[i] are Go
+// pointers into each dispatch's slice backing arrays, and they are stored inside Go slices that are
+// then passed to C by address. cgo forbids handing C a Go pointer that points at memory containing
+// other (unpinned) Go pointers, so each inner pointer is pinned via pinner. Pinning also keeps the
+// backing arrays alive for the call, so no separate runtime.KeepAlive is needed. The caller owns
+// pinner and must Unpin it once the C call returns.
+func marshalBatch(ds []dispatch, pinner *runtime.Pinner) batchArgs {
+	n := len(ds)
+	args := batchArgs{
+		functionIds:          make([]C.int, n),
+		widths:               make([]C.uint, n),
+		heights:              make([]C.uint, n),
+		depths:               make([]C.uint, n),
+		threadgroupWidths:    make([]C.uint, n),
+		threadgroupHeights:   make([]C.uint, n),
+		threadgroupDepths:    make([]C.uint, n),
+		inputs:               make([]*C.uchar, n),
+		inputSizes:           make([]*C.int, n),
+		numInputs:            make([]C.int, n),
+		bufferIds:            make([]*C.int, n),
+		bufferOffsets:        make([]*C.ulong, n),
+		numBufferIds:         make([]C.int, n),
+		threadgroupMemory:    make([]*C.ulong, n),
+		numThreadgroupMemory: make([]C.int, n),
+	}
+
+	for i, d := range ds {
+		inputs, inputSizes := d.packInputs()
+		offsets := d.packOffsets()
+		inputsPtr, inputSizesPtr, bufferIdsPtr, offsetsPtr := d.pointers(inputs, inputSizes, offsets)
+
+		args.functionIds[i] = C.int(d.functionId)
+		args.widths[i] = C.uint(d.width)
+		args.heights[i] = C.uint(d.height)
+		args.depths[i] = C.uint(d.depth)
+		args.threadgroupWidths[i] = C.uint(d.threadgroup.X)
+		args.threadgroupHeights[i] = C.uint(d.threadgroup.Y)
+		args.threadgroupDepths[i] = C.uint(d.threadgroup.Z)
+		if inputsPtr != nil {
+			pinner.Pin(inputsPtr)
+		}
+		args.inputs[i] = inputsPtr
+		if inputSizesPtr != nil {
+			pinner.Pin(inputSizesPtr)
+		}
+		args.inputSizes[i] = inputSizesPtr
+		args.numInputs[i] = C.int(len(inputSizes))
+		if bufferIdsPtr != nil {
+			pinner.Pin(bufferIdsPtr)
+		}
+		args.bufferIds[i] = bufferIdsPtr
+		if offsetsPtr != nil {
+			pinner.Pin(offsetsPtr)
+		}
+		args.bufferOffsets[i] = offsetsPtr
+		args.numBufferIds[i] = C.int(len(d.bufferIds))
+		memory, memoryPtr := d.packThreadgroupMemory()
+		if memoryPtr != nil {
+			pinner.Pin(memoryPtr)
+		}
+		args.threadgroupMemory[i] = memoryPtr
+		args.numThreadgroupMemory[i] = C.int(len(memory))
+	}
+
+	return args
+}
+
+// ----------------------------------------------------------------------------
+// C error handling
+// ----------------------------------------------------------------------------
+
+// metalErrToError builds a Go error from a C error message and category code. metalErr is the
+// human-readable message (C.GoString returns "" for a nil pointer); wrap and code are as for
+// newError, which does the actual construction so that every backend reports errors the same way.
+//
+// It returns nil only when there is no message and no wrap.
+func metalErrToError(metalErr *C.char, wrap string, code C.int) error {
+	return newError(C.GoString(metalErr), wrap, int(code))
+}
+
+// freeCString releases a C string allocated on the C heap (via strdup, malloc,
+// or C.CString). Safe to call with a nil pointer.
+func freeCString(s *C.char) {
+	if s != nil {
+		C.free(unsafe.Pointer(s))
+	}
+}
+
+// cgoString and cgoFree are wrappers around cgo functions for the test files. They must live in a
+// non-test file: Go does not support `import "C"` from _test.go files ("use of cgo in test not
+// supported"), so the tests reach C only through wrappers like these.
+func cgoString(s string) *C.char { return C.CString(s) }
+func cgoFree(s *C.char)          { C.free(unsafe.Pointer(s)) }
@@ -0,0 +1,83 @@
+//go:build !darwin || !cgo
+
+package metal
+
+import (
+	"unsafe"
+)
+
+func init() {
+	// Metal exists only on Apple platforms, and is reached only through cgo. Everywhere else, and
+	// in a darwin build without cgo, the package still compiles so that callers can branch on
+	// Available instead of keeping their own build-tag shims, but every entry point reports
+	// ErrMetalUnavailable.
+	defaultBackend = unavailableBackend{}
+}
+
+// unavailableBackend is the backend for platforms without Metal. Every method fails with
+// ErrMetalUnavailable.
+type unavailableBackend struct{}
+
+func (unavailableBackend) available() error {
+	return ErrMetalUnavailable
+}
+
+func (unavailableBackend) newFunction(string, string, *CompileOptions) (int32, []Diagnostic, error) {
+	return 0, nil, ErrMetalUnavailable
+}
+
+func (unavailableBackend) functionName(int32) string {
+	return ""
+}
+
+func (unavailableBackend) closeFunction(int32) error {
+	return ErrMetalUnavailable
+}
+
+func (unavailableBackend) arguments(int32) ([]Argument, error) {
+	return nil, ErrMetalUnavailable
+}
+
+func (unavailableBackend) limits(int32) (pipelineLimits, bool) {
+	return pipelineLimits{}, false
+}
+
+func (unavailableBackend) newLibrary(string, *CompileOptions) (int32, []string, []Diagnostic, error) {
+	return 0, nil, nil, ErrMetalUnavailable
+}
+
+func (unavailableBackend) loadLibrary([]byte) (int32, []string, error) {
+	return 0, nil, ErrMetalUnavailable
+}
+
+func (unavailableBackend) libraryFunction(int32, string, *CompileOptions) (int32, error) {
+	return 0, ErrMetalUnavailable
+}
+
+func (unavailableBackend) closeLibrary(int32) error {
+	return ErrMetalUnavailable
+}
+
+func (unavailableBackend) newBuffer(int) (int32, unsafe.Pointer, error) {
+	return 0, nil, ErrMetalUnavailable
+}
+
+func (unavailableBackend) closeBuffer(int32) error {
+	return ErrMetalUnavailable
+}
+
+func (unavailableBackend) run(dispatch) error {
+	return ErrMetalUnavailable
+}
+
+func (unavailableBackend) runBatch([]dispatch) error {
+	return ErrMetalUnavailable
+}
+
+func (unavailableBackend) runAsync(dispatch, completion) error {
+	return ErrMetalUnavailable
+}
+
+func (unavailableBackend) runBatchAsync([]dispatch, completion) error {
+	return ErrMetalUnavailable
+}
@@ -0,0 +1,42 @@
+//go:build !darwin || !cgo
+
+package metal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sourceTexture is a kernel that uses textures, which the CPU backend cannot interpret.
+const sourceTexture = `kernel void invert(texture2d<float, access::read_write> tex [[texture(0)]]) {}`
+
+// Test_Available_unavailable tests that the public entry points report ErrMetalUnavailable on a
+// platform without Metal when the CPU backend cannot run a function in its place, rather than
+// failing to compile or crashing.
+func Test_Available_unavailable(t *testing.T) {
+	require.ErrorIs(t, Available(), ErrMetalUnavailable)
+
+	function, err := NewFunction(sourceTexture, "invert")
+	require.EqualError(t, err, "unable to set up metal function: failed to create library: 1:20: unknown type 'texture2d'")
+	require.ErrorIs(t, err, ErrMetalUnavailable)
+	require.Nil(t, function)
+
+	// Buffers fall back to Go memory so that CPU kernels have something to run on.
+	bufferId, buffer, err := NewBufferWith([]float32{1, 2, 3})
+	require.NoError(t, err)
+	require.True(t, bufferId.Valid())
+	require.Equal(t, []float32{1, 2, 3}, buffer)
+	require.NoError(t, bufferId.Close())
+
+	var emptyFunction Function
+	err = emptyFunction.Run(RunParameters{})
+	require.EqualError(t, err, "unable to run metal function: failed to retrieve function: invalid function id: 0")
+	require.ErrorIs(t, err, ErrInvalidFunctionId)
+
+	handle, err := emptyFunction.RunAsync(RunParameters{})
+	require.ErrorIs(t, err, ErrInvalidFunctionId)
+	require.Nil(t, handle)
+
+	require.EqualError(t, handle.Wait(), "invalid run handle")
+}
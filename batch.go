@@ -0,0 +1,202 @@
+package metal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ----------------------------------------------------------------------------
+// Batches of several functions
+// ----------------------------------------------------------------------------
+
+// A Batch is a list of dispatches that run as a single GPU command buffer, like Function.RunBatch,
+// except that every dispatch can be of a different Function. A chain of kernels, such as
+// preprocess → transform → reduce, can then be submitted once instead of once per step. The
+// dispatches run in the order they were added, and each one finishes before the next starts, so a
+// dispatch sees everything the dispatches before it wrote to their buffers.
+//
+// Nothing is checked until the batch is run, and then all of it is checked before anything is
+// committed: if any dispatch is invalid or fails to encode, none of them run and that dispatch's
+// error is returned, as a *BatchError. The RunParameters are kept as they were added, so the slices
+// in them must not be changed until the batch has been run.
+//
+// The zero Batch is empty and ready to use. Building a Batch is not safe for concurrent use, but a
+// built Batch can be run any number of times, including concurrently.
+type Batch struct {
+	entries []batchEntry
+}
+
+// A batchEntry is one dispatch in a Batch.
+type batchEntry struct {
+	function *Function
+	params   RunParameters
+}
+
+// Add appends a dispatch of function with params to the end of the batch.
+func (b *Batch) Add(function *Function, params RunParameters) {
+	b.entries = append(b.entries, batchEntry{function: function, params: params})
+}
+
+// Len returns the number of dispatches in the batch.
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Reset removes every dispatch from the batch so that it can be built again. It keeps the memory
+// that holds them.
+func (b *Batch) Reset() {
+	clear(b.entries)
+	b.entries = b.entries[:0]
+}
+
+// Run executes every dispatch in the batch as a single command buffer and blocks until the GPU
+// finishes. The grid and over-dispatch semantics for each dispatch are identical to Function.Run.
+// An empty batch is a no-op that returns nil.
+func (b *Batch) Run() error {
+	be, ds, err := b.dispatches()
+	if err != nil || len(ds) == 0 {
+		return err
+	}
+
+	return be.runBatch(ds)
+}
+
+// RunAsync is the asynchronous counterpart of Run: it encodes every dispatch in the batch into a
+// single command buffer and commits it, but returns a RunHandle immediately instead of waiting.
+// Wait on the handle, or watch its Done channel, to learn when every dispatch has finished, and do
+// not close the buffers that the batch uses until the work has finished (Done is closed). Wait
+// returns the result at most once, and the command buffer is released whether or not anyone waits.
+// An empty batch returns a nil handle and nil error.
+func (b *Batch) RunAsync() (*RunHandle, error) {
+	be, ds, err := b.dispatches()
+	if err != nil || len(ds) == 0 {
+		return nil, err
+	}
+
+	h := newRunHandle()
+	if err := be.runBatchAsync(ds, h); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// dispatches validates every dispatch in the batch and returns them with the backend that they all
+// run on. A command buffer belongs to one backend, so every Function must have been set up on the
+// same one. It fails on the first invalid dispatch, so a batch is either fully valid or not run at
+// all.
+func (b *Batch) dispatches() (backend, []dispatch, error) {
+	if len(b.entries) == 0 {
+		return nil, nil, nil
+	}
+
+	var be backend
+	ds := make([]dispatch, len(b.entries))
+	for i, e := range b.entries {
+		if e.function == nil {
+			return nil, nil, newBatchError(i, "", -1, errors.New("invalid nil function"))
+		}
+
+		switch fb := e.function.backend(); {
+		case be == nil:
+			if err := fb.available(); err != nil {
+				return nil, nil, err
+			}
+			be = fb
+		case fb != be:
+			err := errors.New("cannot batch functions from different backends")
+			return nil, nil, newBatchError(i, e.function.String(), -1, err)
+		}
+
+		d, err := e.function.dispatch(e.params)
+		if err != nil {
+			return nil, nil, newBatchError(i, e.function.String(), -1, err)
+		}
+		ds[i] = d
+	}
+
+	return be, ds, nil
+}
+
+// ----------------------------------------------------------------------------
+// Batch errors
+// ----------------------------------------------------------------------------
+
+// A BatchError reports which dispatch of a batch failed, for a batch run by Function.RunBatch,
+// Function.RunBatchAsync, Batch.Run, or Batch.RunAsync, or waited on through their RunHandle. The
+// dispatch may have been invalid, may have failed to encode, or may have faulted on the GPU. A
+// command buffer that fails on the GPU cannot always tell which of its dispatches caused it, and
+// then Index is -1. Use errors.As to retrieve it; errors.Is still matches the sentinel through it.
+type BatchError struct {
+	// Index is the index of the failed dispatch in the batch, or -1 if the failure is of the batch
+	// as a whole.
+	Index int
+	// Function is the name of the function that the failed dispatch runs, or "" if it is not known,
+	// for example because the function was not valid.
+	Function string
+	// Argument is the buffer index of the argument that failed to bind, counting inputs first as
+	// ArgumentError.Index does, or -1 if the failure is not of one argument.
+	Argument int
+	// Sentinel is the sentinel error that the failure matches, such as ErrInvalidBufferId or
+	// ErrGPUPageFault, or nil if it matches none.
+	Sentinel error
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *BatchError) Error() string {
+	switch {
+	case e.Index < 0:
+		return e.Err.Error()
+	case e.Function == "":
+		return fmt.Sprintf("dispatch %d: %s", e.Index, e.Err)
+	default:
+		return fmt.Sprintf("dispatch %d of '%s': %s", e.Index, e.Function, e.Err)
+	}
+}
+
+func (e *BatchError) Unwrap() error { return e.Err }
+
+// newBatchError returns a *BatchError for err, the failure of the dispatch at index in a batch, of
+// the function named function, at the argument at argument. If argument is -1 and err is an
+// *ArgumentError or reports a buffer that is not open, the argument is taken from it.
+func newBatchError(index int, function string, argument int, err error) *BatchError {
+	var argErr *ArgumentError
+	var closedErr *closedBufferError
+	switch {
+	case argument >= 0:
+	case errors.As(err, &argErr):
+		argument = argErr.Index
+	case errors.As(err, &closedErr):
+		argument = closedErr.argument
+	}
+
+	return &BatchError{
+		Index:    index,
+		Function: function,
+		Argument: argument,
+		Sentinel: sentinelOf(err),
+		Err:      err,
+	}
+}
+
+// batchFailure returns the error for a batch of ds on be that failed with msg and code, as a
+// backend reports it: wrap describes what failed, as for newError, and index and argument locate
+// the failure as for newBatchError, either of them -1 if the backend could not tell.
+func batchFailure(be backend, ds []dispatch, index, argument int, msg, wrap string, code int) error {
+	if index >= len(ds) {
+		index, argument = -1, -1
+	}
+
+	var function string
+	if index >= 0 {
+		function = be.functionName(ds[index].functionId)
+	}
+
+	err := newError(msg, "", code)
+	if err == nil {
+		err = errors.New("unknown error")
+	}
+
+	return fmt.Errorf("%s: %w", wrap, newBatchError(index, function, argument, err))
+}
@@ -0,0 +1,112 @@
+package metal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_commandBufferErrorCode tests that the MTLCommandBufferError codes of a failed command buffer
+// are classified into the error codes, and so the sentinels, that they have.
+func Test_commandBufferErrorCode(t *testing.T) {
+	type subtest struct {
+		mtlCode  int
+		code     int
+		sentinel error
+	}
+
+	subtests := []subtest{
+		{0, errCodeNone, nil},
+		{1, errCodeNone, nil},
+		{mtlCommandBufferErrorTimeout, errCodeGPUTimeout, ErrGPUTimeout},
+		{mtlCommandBufferErrorPageFault, errCodeGPUPageFault, ErrGPUPageFault},
+		{4, errCodeNone, nil},
+		{7, errCodeNone, nil},
+		{mtlCommandBufferErrorOutOfMemory, errCodeGPUOutOfMemory, ErrGPUOutOfMemory},
+		{9, errCodeNone, nil},
+		{-1, errCodeNone, nil},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(fmt.Sprint(subtest.mtlCode), func(t *testing.T) {
+			code := commandBufferErrorCode(subtest.mtlCode)
+			require.Equal(t, subtest.code, code)
+			require.Equal(t, subtest.sentinel, sentinelForCode(code))
+		})
+	}
+}
+
+// Test_BatchError tests that a BatchError names the dispatch that failed, and that errors.As and
+// errors.Is reach it and its sentinel through the error of a batch.
+func Test_BatchError(t *testing.T) {
+	t.Run("Error", func(t *testing.T) {
+		type subtest struct {
+			err  *BatchError
+			want string
+		}
+
+		underlying := errors.New("failed")
+		subtests := []subtest{
+			{&BatchError{Index: 2, Function: "sine", Argument: -1, Err: underlying}, "dispatch 2 of 'sine': failed"},
+			{&BatchError{Index: 0, Argument: 1, Err: underlying}, "dispatch 0: failed"},
+			{&BatchError{Index: -1, Argument: -1, Err: underlying}, "failed"},
+		}
+
+		for _, subtest := range subtests {
+			require.EqualError(t, subtest.err, subtest.want)
+			require.ErrorIs(t, subtest.err, underlying)
+		}
+	})
+
+	t.Run("newBatchError", func(t *testing.T) {
+		err := newBatchError(1, "transfer", 3, newError("invalid buffer id: 7", "", errCodeInvalidBufferId))
+		require.Equal(t, 1, err.Index)
+		require.Equal(t, "transfer", err.Function)
+		require.Equal(t, 3, err.Argument)
+		require.Equal(t, ErrInvalidBufferId, err.Sentinel)
+		require.ErrorIs(t, err, ErrInvalidBufferId)
+
+		err = newBatchError(0, "transfer", -1, errors.New("invalid grid dimension"))
+		require.Equal(t, -1, err.Argument)
+		require.Nil(t, err.Sentinel)
+
+		// The argument of an *ArgumentError is taken from it.
+		err = newBatchError(0, "transfer", -1, &ArgumentError{Index: 2, Name: "result", Msg: "missing argument"})
+		require.Equal(t, 2, err.Argument)
+		var argErr *ArgumentError
+		require.ErrorAs(t, err, &argErr)
+	})
+
+	t.Run("batchFailure", func(t *testing.T) {
+		ds := []dispatch{{}, {}}
+
+		err := batchFailure(cpu, ds, 1, 2, "failed to retrieve buffer 1/1: invalid buffer id: 7",
+			"unable to run metal function batch", errCodeInvalidBufferId)
+		require.EqualError(t, err, "unable to run metal function batch: dispatch 1: failed to retrieve buffer 1/1: invalid buffer id: 7")
+		require.ErrorIs(t, err, ErrInvalidBufferId)
+		var batchErr *BatchError
+		require.ErrorAs(t, err, &batchErr)
+		require.Equal(t, 1, batchErr.Index)
+		require.Equal(t, 2, batchErr.Argument)
+
+		// A command buffer that failed without naming a dispatch fails the batch as a whole.
+		err = batchFailure(cpu, ds, -1, -1, "command buffer failed: page fault",
+			"unable to wait for metal function", commandBufferErrorCode(mtlCommandBufferErrorPageFault))
+		require.EqualError(t, err, "unable to wait for metal function: command buffer failed: page fault")
+		require.ErrorIs(t, err, ErrGPUPageFault)
+		require.ErrorAs(t, err, &batchErr)
+		require.Equal(t, -1, batchErr.Index)
+		require.Equal(t, ErrGPUPageFault, batchErr.Sentinel)
+
+		// An index outside of the batch is not trusted.
+		err = batchFailure(cpu, ds, 5, 0, "failed", "unable to run metal function batch", errCodeNone)
+		require.ErrorAs(t, err, &batchErr)
+		require.Equal(t, -1, batchErr.Index)
+		require.Equal(t, -1, batchErr.Argument)
+
+		err = batchFailure(cpu, ds, -1, -1, "", "unable to run metal function batch", errCodeNone)
+		require.EqualError(t, err, "unable to run metal function batch: unknown error")
+	})
+}
@@ -1,17 +1,11 @@
-//go:build darwin
-
 package metal
 
-/*
-#cgo CFLAGS: -fobjc-arc
-#cgo LDFLAGS: -framework Metal -framework Foundation
-#include "Metal.h"
-*/
-import "C"
-
 import (
 	"errors"
+	"fmt"
 	"math"
+	"reflect"
+	"sync"
 	"unsafe"
 )
 
@@ -52,7 +46,8 @@ type BufferType interface {
 // one-dimensional slice into a two-dimensional slice, use Fold(buffer, width). Or to go from one
 // dimensions to three, use Fold(Fold(buffer, width*height), width).
 func NewBuffer[T BufferType](width int) (BufferId, []T, error) {
-	if err := Available(); err != nil {
+	b := bufferBackend()
+	if err := b.available(); err != nil {
 		return 0, nil, err
 	}
 
@@ -69,22 +64,17 @@ func NewBuffer[T BufferType](width int) (BufferId, []T, error) {
 	}
 	numBytes := width * sizeof[T]()
 
-	// The C side may strdup an error message into err on failure; we must free it.
-	var err *C.char
-	defer func() { freeCString(err) }()
-
 	// Allocate memory for the new buffer and get its contents pointer in one call.
-	var contents unsafe.Pointer
-	bufferId := C.buffer_new(C.size_t(numBytes), &contents, &err)
-	if int(bufferId) == 0 {
-		// buffer_new fails only on allocation failure or id exhaustion, neither of which is an
-		// invalid-handle condition, so the code is errCodeNone and no sentinel is attached.
-		return 0, nil, metalErrToError(err, "unable to create buffer", errCodeNone)
+	bufferId, contents, err := b.newBuffer(numBytes)
+	if err != nil {
+		return 0, nil, err
 	}
 
 	// Wrap the buffer in a go slice.
 	slice := unsafe.Slice((*T)(contents), width)
 
+	registerBuffer(BufferId(bufferId), slice, contents, numBytes, false)
+
 	return BufferId(bufferId), slice, nil
 }
 
@@ -108,23 +98,318 @@ func NewBufferWith[T BufferType](data []T) (BufferId, []T, error) {
 // bufferId.Close() works when bufferId is a variable, but BufferId(7).Close() does not compile.
 // This differs from Function.Close, which already operates on a *Function and so reads naturally on
 // a function handle.
+//
+// When Metal is unavailable, buffers are allocated from Go memory, so the slice remains safe to read
+// after Close, but it is no longer associated with any buffer Id.
+//
+// Closing an Id that is not open returns ErrInvalidBufferId, as does closing the Id of a buffer from
+// a BufferPool, whose memory belongs to the pool; close its Buffer instead.
 func (id *BufferId) Close() error {
 	if id == nil || !id.Valid() {
 		return ErrInvalidBufferId
 	}
 
-	// The C side may strdup an error message into err on failure; we must free it. It also
-	// categorizes the failure in code so metalErrToError can attach the matching sentinel.
-	var err *C.char
-	defer func() { freeCString(err) }()
-	var code C.int
+	// The backend may still hold the memory of an Id that is no longer open, such as one whose
+	// pooled buffer went back to its pool, so only a registered buffer of its own is freed.
+	entry, ok := lookupBuffer(*id)
+	switch {
+	case !ok:
+		return ErrInvalidBufferId
+	case entry.pooled:
+		return fmt.Errorf("%w: buffer %d belongs to a pool; close its Buffer instead", ErrInvalidBufferId, *id)
+	}
 
-	if !C.buffer_close(C.int(*id), &err, &code) {
-		return metalErrToError(err, "unable to free buffer", code)
+	if err := bufferBackend().closeBuffer(int32(*id)); err != nil {
+		return err
 	}
+	unregisterBuffer(*id)
 
 	// Clear the buffer Id to mark that it's no longer valid.
 	*id = 0
 
 	return nil
 }
+
+// ----------------------------------------------------------------------------
+// Typed buffers
+// ----------------------------------------------------------------------------
+
+// A Buffer is a typed handle to a metal buffer: its Id together with the slice that wraps its
+// memory. Unlike the pair returned by NewBuffer, a Buffer keeps the element type with the buffer
+// and gives up its slice when it is closed, so a closed buffer's memory cannot be reached through
+// it.
+//
+// Create a Buffer with NewTypedBuffer or NewTypedBufferWith, and use it in RunParameters.Buffers or
+// pass its Id in RunParameters.BufferIds. A slice obtained from Slice before Close must not be used
+// after Close. A Buffer must not be closed while another goroutine is using it.
+type Buffer[T BufferType] struct {
+	id    BufferId
+	slice []T
+
+	// pool is the pool that the buffer came from, if any, and raw is the pool's record of it.
+	pool *BufferPool
+	raw  pooledBuffer
+}
+
+// An AnyBuffer is the type-erased form of a *Buffer, which holds a buffer of any element type.
+type AnyBuffer interface {
+	BufferBinding
+	// Id returns the buffer's Id, or 0 once the buffer is closed.
+	Id() BufferId
+	// Len returns the number of elements in the buffer, or 0 once the buffer is closed.
+	Len() int
+	// ElemType returns the Go type of the buffer's elements.
+	ElemType() reflect.Type
+	// Valid reports whether the buffer is open.
+	Valid() bool
+	// Close releases the buffer.
+	Close() error
+}
+
+// A BufferBinding is a buffer argument in RunParameters.Buffers. It is implemented by *Buffer,
+// BufferId, and BufferRange.
+type BufferBinding interface {
+	// binding returns the range of the buffer to bind.
+	binding() BufferRange
+}
+
+// NewTypedBuffer is the same as NewBuffer, but it returns the buffer as a *Buffer.
+func NewTypedBuffer[T BufferType](length int) (*Buffer[T], error) {
+	id, slice, err := NewBuffer[T](length)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Buffer[T]{id: id, slice: slice}, nil
+}
+
+// NewTypedBufferWith is the same as NewBufferWith, but it returns the buffer as a *Buffer.
+func NewTypedBufferWith[T BufferType](data []T) (*Buffer[T], error) {
+	id, slice, err := NewBufferWith(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Buffer[T]{id: id, slice: slice}, nil
+}
+
+// Id returns the buffer's Id, or 0, which is not a valid Id, once the buffer is closed.
+func (b *Buffer[T]) Id() BufferId {
+	if b == nil {
+		return 0
+	}
+	return b.id
+}
+
+// Slice returns the slice that wraps the buffer's memory, or nil once the buffer is closed. As with
+// NewBuffer, only the contents of the slice should be modified.
+func (b *Buffer[T]) Slice() []T {
+	if b == nil {
+		return nil
+	}
+	return b.slice
+}
+
+// Len returns the number of elements in the buffer, or 0 once the buffer is closed.
+func (b *Buffer[T]) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.slice)
+}
+
+// ElemType returns the Go type of the buffer's elements, T.
+func (b *Buffer[T]) ElemType() reflect.Type {
+	return reflect.TypeFor[T]()
+}
+
+// Valid reports whether the buffer is open.
+func (b *Buffer[T]) Valid() bool {
+	return b.Id().Valid()
+}
+
+// Close releases the buffer from the GPU memory, or returns it to its pool if it came from Get.
+// Afterward, Id and Len return 0 and Slice returns nil. Closing a buffer that is already closed
+// returns ErrInvalidBufferId.
+func (b *Buffer[T]) Close() error {
+	if b == nil || !b.id.Valid() {
+		return ErrInvalidBufferId
+	}
+
+	if b.pool != nil {
+		unregisterBuffer(b.id)
+		b.id, b.slice = 0, nil
+		return b.pool.put(b.raw)
+	}
+
+	if err := b.id.Close(); err != nil {
+		return err
+	}
+	b.slice = nil
+
+	return nil
+}
+
+// Range returns the range of the buffer that holds length elements starting at element first, for
+// binding part of the buffer in RunParameters.Buffers.
+func (b *Buffer[T]) Range(first, length int) BufferRange {
+	size := sizeof[T]()
+	return BufferRange{Id: b.Id(), Offset: first * size, Length: length * size}
+}
+
+// binding returns the whole buffer, whose Id is 0 once the buffer is closed.
+func (b *Buffer[T]) binding() BufferRange {
+	return BufferRange{Id: b.Id()}
+}
+
+// binding returns the whole buffer, so that a BufferId can be bound in RunParameters.Buffers.
+func (id BufferId) binding() BufferRange {
+	return BufferRange{Id: id}
+}
+
+// ----------------------------------------------------------------------------
+// Buffer ranges
+// ----------------------------------------------------------------------------
+
+// A BufferRange is a region of a buffer, for binding in RunParameters.Buffers. Binding a range
+// lets one large buffer supply several kernel arguments: the kernel's pointer starts at Offset, as
+// with setBuffer:offset:atIndex:, and the kernel must not access memory past Length.
+//
+// Offset must be a multiple of the size of the buffer's elements, and the range must lie within the
+// buffer. Metal also requires the offset of a buffer bound to a constant argument to be a multiple
+// of 256 bytes on Macs with Intel or AMD GPUs, and of 4 bytes on Apple GPUs; RunParameters.Validate
+// checks this for the device in use, along with the alignment of the kernel's element type. The CPU
+// backend has no such requirement.
+type BufferRange struct {
+	// Id is the buffer that the range is in.
+	Id BufferId
+	// Offset is the number of bytes from the start of the buffer to the start of the range.
+	Offset int
+	// Length is the number of bytes in the range. A length of 0 extends the range to the end of the
+	// buffer.
+	Length int
+}
+
+// binding returns r itself.
+func (r BufferRange) binding() BufferRange {
+	return r
+}
+
+// A bufferSpan is the resolved byte range of a BufferRange: length is never 0 for a span that is
+// bound.
+type bufferSpan struct {
+	offset int
+	length int
+}
+
+// span checks r against the buffer it is in, entry, and returns the bytes it covers.
+func (r BufferRange) span(entry bufferEntry) (bufferSpan, error) {
+	elemSize := entry.elemSize()
+
+	length := r.Length
+	if length == 0 {
+		length = entry.numBytes - r.Offset
+	}
+
+	switch {
+	case r.Offset < 0:
+		return bufferSpan{}, fmt.Errorf("negative offset %d", r.Offset)
+	case r.Length < 0:
+		return bufferSpan{}, fmt.Errorf("negative length %d", r.Length)
+	case r.Offset%elemSize != 0:
+		return bufferSpan{}, fmt.Errorf("offset %d is not a multiple of the %d-byte element size", r.Offset, elemSize)
+	case length%elemSize != 0:
+		return bufferSpan{}, fmt.Errorf("length %d is not a multiple of the %d-byte element size", length, elemSize)
+	case r.Offset >= entry.numBytes || r.Offset+length > entry.numBytes:
+		return bufferSpan{}, fmt.Errorf("%d bytes at offset %d is outside the buffer's %d bytes", length, r.Offset, entry.numBytes)
+	}
+
+	return bufferSpan{offset: r.Offset, length: length}, nil
+}
+
+// ----------------------------------------------------------------------------
+// Buffer registry
+// ----------------------------------------------------------------------------
+
+// A bufferEntry is the Go-side record of an open buffer, kept for every buffer regardless of which
+// backend allocated it.
+type bufferEntry struct {
+	// data is the slice returned by NewBuffer, as an any holding a []T.
+	data any
+	// contents points to the first byte of the buffer.
+	contents unsafe.Pointer
+	// numBytes is the size of the buffer in bytes.
+	numBytes int
+	// pooled is set for a buffer from a BufferPool, which is closed through its Buffer and never by
+	// its Id.
+	pooled bool
+}
+
+// bytes returns the buffer's memory as a byte slice.
+func (e bufferEntry) bytes() []byte {
+	return unsafe.Slice((*byte)(e.contents), e.numBytes)
+}
+
+// elemSize returns the size in bytes of one element of the buffer.
+func (e bufferEntry) elemSize() int {
+	return int(reflect.TypeOf(e.data).Elem().Size())
+}
+
+// slice returns the record for the part of the buffer covered by s, as if it were a buffer of its
+// own. The zero span covers the whole buffer.
+func (e bufferEntry) slice(s bufferSpan) bufferEntry {
+	if s.length == 0 {
+		return e
+	}
+
+	elemSize := e.elemSize()
+	return bufferEntry{
+		data:     reflect.ValueOf(e.data).Slice(s.offset/elemSize, (s.offset+s.length)/elemSize).Interface(),
+		contents: unsafe.Add(e.contents, s.offset),
+		numBytes: s.length,
+	}
+}
+
+var (
+	bufferRegistryMu sync.RWMutex
+	bufferRegistry   = make(map[BufferId]bufferEntry)
+)
+
+// registerBuffer records the slice for a newly created buffer, or for one handed out by a pool if
+// pooled is set.
+func registerBuffer(id BufferId, data any, contents unsafe.Pointer, numBytes int, pooled bool) {
+	bufferRegistryMu.Lock()
+	defer bufferRegistryMu.Unlock()
+
+	bufferRegistry[id] = bufferEntry{data: data, contents: contents, numBytes: numBytes, pooled: pooled}
+}
+
+// unregisterBuffer forgets a closed buffer.
+func unregisterBuffer(id BufferId) {
+	bufferRegistryMu.Lock()
+	defer bufferRegistryMu.Unlock()
+
+	delete(bufferRegistry, id)
+}
+
+// lookupBuffer returns the record for an open buffer, or false if id is not an open buffer.
+func lookupBuffer(id BufferId) (bufferEntry, bool) {
+	bufferRegistryMu.RLock()
+	defer bufferRegistryMu.RUnlock()
+
+	entry, ok := bufferRegistry[id]
+	return entry, ok
+}
+
+// A closedBufferError reports a buffer of a dispatch whose Id is not open. It is reported before the
+// dispatch reaches a backend, which may still hold the memory of a closed Id, and it matches
+// ErrInvalidBufferId with errors.Is.
+type closedBufferError struct {
+	// argument is the buffer index that the buffer is bound at.
+	argument int
+	msg      string
+}
+
+func (e *closedBufferError) Error() string { return e.msg }
+
+func (e *closedBufferError) Unwrap() error { return ErrInvalidBufferId }
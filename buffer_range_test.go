@@ -0,0 +1,62 @@
+package metal
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_BufferRange_span tests that a buffer range is checked against the buffer it is in.
+func Test_BufferRange_span(t *testing.T) {
+	data := make([]uint16, 8)
+	entry := bufferEntry{data: data, contents: unsafe.Pointer(&data[0]), numBytes: 16}
+
+	type subtest struct {
+		name string
+		r    BufferRange
+		span bufferSpan
+		err  string
+	}
+
+	subtests := []subtest{
+		{name: "whole", r: BufferRange{Offset: 0, Length: 16}, span: bufferSpan{offset: 0, length: 16}},
+		{name: "middle", r: BufferRange{Offset: 4, Length: 6}, span: bufferSpan{offset: 4, length: 6}},
+		{name: "to end", r: BufferRange{Offset: 10}, span: bufferSpan{offset: 10, length: 6}},
+		{name: "negative offset", r: BufferRange{Offset: -2}, err: "negative offset -2"},
+		{name: "negative length", r: BufferRange{Offset: 2, Length: -2}, err: "negative length -2"},
+		{name: "unaligned offset", r: BufferRange{Offset: 3, Length: 2}, err: "offset 3 is not a multiple of the 2-byte element size"},
+		{name: "unaligned length", r: BufferRange{Offset: 2, Length: 3}, err: "length 3 is not a multiple of the 2-byte element size"},
+		{name: "past end", r: BufferRange{Offset: 12, Length: 6}, err: "6 bytes at offset 12 is outside the buffer's 16 bytes"},
+		{name: "at end", r: BufferRange{Offset: 16}, err: "0 bytes at offset 16 is outside the buffer's 16 bytes"},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			span, err := subtest.r.span(entry)
+			if subtest.err != "" {
+				require.EqualError(t, err, subtest.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, subtest.span, span)
+		})
+	}
+}
+
+// Test_bufferEntry_slice tests that the part of a buffer covered by a span reads like a buffer of
+// its own.
+func Test_bufferEntry_slice(t *testing.T) {
+	data := []int32{1, 2, 3, 4, 5}
+	entry := bufferEntry{data: data, contents: unsafe.Pointer(&data[0]), numBytes: 20}
+
+	require.Equal(t, entry, entry.slice(bufferSpan{}))
+
+	part := entry.slice(bufferSpan{offset: 4, length: 8})
+	require.Equal(t, []int32{2, 3}, part.data)
+	require.Equal(t, 8, part.numBytes)
+	require.Equal(t, []byte{2, 0, 0, 0, 3, 0, 0, 0}, part.bytes())
+
+	part.data.([]int32)[1] = 30
+	require.Equal(t, []int32{1, 2, 30, 4, 5}, data)
+}
@@ -1,4 +1,4 @@
-//go:build darwin
+//go:build darwin && cgo
 
 package metal
 
@@ -328,9 +328,10 @@ func Test_BufferId_Close(t *testing.T) {
 		require.ErrorIs(t, zeroId.Close(), ErrInvalidBufferId)
 	})
 
-	t.Run("invalid cache id", func(t *testing.T) {
+	t.Run("unregistered buffer id", func(t *testing.T) {
+		// An Id that was never handed out, or is no longer open, never reaches the backend.
 		bufferId := BufferId(math.MaxInt32 - 1)
-		require.EqualError(t, bufferId.Close(), fmt.Sprintf("unable to free buffer: invalid buffer id: %d", math.MaxInt32-1))
+		require.EqualError(t, bufferId.Close(), "invalid buffer id")
 	})
 
 	t.Run("valid buffer id", func(t *testing.T) {
@@ -347,3 +348,98 @@ func Test_BufferId_Close(t *testing.T) {
 		require.False(t, bufferId.Valid())
 	})
 }
+
+// Test_Buffer tests that a typed buffer handle carries its buffer and refuses access once closed.
+func Test_Buffer(t *testing.T) {
+	t.Run("invalid width", func(t *testing.T) {
+		buffer, err := NewTypedBuffer[float32](0)
+		require.EqualError(t, err, "invalid width")
+		require.Nil(t, buffer)
+	})
+
+	t.Run("nil buffer", func(t *testing.T) {
+		var buffer *Buffer[float32]
+		require.Equal(t, BufferId(0), buffer.Id())
+		require.Nil(t, buffer.Slice())
+		require.Equal(t, 0, buffer.Len())
+		require.False(t, buffer.Valid())
+		require.ErrorIs(t, buffer.Close(), ErrInvalidBufferId)
+	})
+
+	t.Run("valid buffer", func(t *testing.T) {
+		buffer, err := NewTypedBufferWith([]uint16{1, 2, 3})
+		require.NoError(t, err)
+		require.True(t, validBufferId(buffer.Id()))
+		require.True(t, buffer.Valid())
+		require.Equal(t, []uint16{1, 2, 3}, buffer.Slice())
+		require.Equal(t, 3, buffer.Len())
+
+		var anyBuffer AnyBuffer = buffer
+		require.Equal(t, reflect.TypeFor[uint16](), anyBuffer.ElemType())
+
+		require.NoError(t, anyBuffer.Close())
+		require.False(t, buffer.Valid())
+		require.Equal(t, BufferId(0), buffer.Id())
+		require.Nil(t, buffer.Slice())
+		require.Equal(t, 0, buffer.Len())
+		require.ErrorIs(t, buffer.Close(), ErrInvalidBufferId)
+	})
+}
+
+// Test_BufferPool tests that a pool hands out the buffers that were closed into it.
+func Test_BufferPool(t *testing.T) {
+	pool := NewBufferPool(PoolOptions{})
+
+	buffer, err := Get[float32](pool, 100)
+	require.NoError(t, err)
+	require.True(t, validBufferId(buffer.Id()))
+	id := buffer.Id()
+	buffer.Slice()[99] = 1
+
+	require.NoError(t, buffer.Close())
+	require.False(t, buffer.Valid())
+
+	buffer, err = Get[float32](pool, 120)
+	require.NoError(t, err)
+	require.Equal(t, id, buffer.Id())
+	require.Equal(t, make([]float32, 120), buffer.Slice())
+	require.Equal(t, PoolStats{Hits: 1, Misses: 1}, pool.Stats())
+
+	require.NoError(t, buffer.Close())
+	require.Equal(t, PoolStats{Hits: 1, Misses: 1, BytesRetained: 512, BuffersRetained: 1}, pool.Stats())
+	require.NoError(t, pool.Close())
+	require.Equal(t, PoolStats{Hits: 1, Misses: 1, Releases: 1}, pool.Stats())
+}
+
+// Test_BufferPool_StaleId tests that the Id of a pooled buffer can be neither bound nor closed once
+// the buffer is back in its pool, although the Metal buffer cache still holds its memory.
+func Test_BufferPool_StaleId(t *testing.T) {
+	function, err := NewFunction(sourceTransfer1D, "transfer1D")
+	require.NoError(t, err)
+	defer function.Close()
+	pool := NewBufferPool(PoolOptions{})
+	defer pool.Close()
+
+	input, err := Get[float32](pool, 3)
+	require.NoError(t, err)
+	output, err := Get[float32](pool, 3)
+	require.NoError(t, err)
+	defer output.Close()
+
+	staleId := input.Id()
+	require.NoError(t, input.Close())
+
+	err = function.Run(RunParameters{Grid: Grid{X: 3}, BufferIds: []BufferId{staleId, output.Id()}})
+	require.EqualError(t, err, fmt.Sprintf("buffer 1/2 is not open: invalid buffer id: %d", staleId))
+	require.ErrorIs(t, staleId.Close(), ErrInvalidBufferId)
+
+	// The next Get hands out the same memory, which the stale Id must not have freed.
+	reused, err := Get[float32](pool, 3)
+	require.NoError(t, err)
+	require.Equal(t, staleId, reused.Id())
+	require.ErrorIs(t, staleId.Close(), ErrInvalidBufferId)
+	copy(reused.Slice(), []float32{1, 2, 3})
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 3}, Buffers: []BufferBinding{reused, output}}))
+	require.Equal(t, []float32{1, 2, 3}, output.Slice())
+	require.NoError(t, reused.Close())
+}
@@ -0,0 +1,182 @@
+package metal
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/green-aloe/metal/internal/msl"
+)
+
+// ----------------------------------------------------------------------------
+// Compile options
+// ----------------------------------------------------------------------------
+
+// A MathMode selects the floating-point optimizations that the compiler may make.
+type MathMode int
+
+const (
+	// MathModeDefault leaves the choice to Metal, which defaults to fast math.
+	MathModeDefault MathMode = iota
+	// MathModeSafe disables the optimizations that break IEEE 754 semantics, for numerically
+	// sensitive kernels.
+	MathModeSafe
+	// MathModeRelaxed allows optimizations that break IEEE 754 semantics, but keeps the handling of
+	// infinities and NaNs. Before macOS 15 it is compiled as MathModeSafe.
+	MathModeRelaxed
+	// MathModeFast allows every floating-point optimization, assuming that no value is an infinity
+	// or NaN.
+	MathModeFast
+)
+
+// String returns the name of the math mode.
+func (m MathMode) String() string {
+	switch m {
+	case MathModeDefault:
+		return "default"
+	case MathModeSafe:
+		return "safe"
+	case MathModeRelaxed:
+		return "relaxed"
+	case MathModeFast:
+		return "fast"
+	default:
+		return fmt.Sprintf("MathMode(%d)", int(m))
+	}
+}
+
+// languageVersions lists the versions of the Metal Shading Language that can be compiled for on
+// macOS.
+var languageVersions = []Version{
+	{1, 1}, {1, 2},
+	{2, 0}, {2, 1}, {2, 2}, {2, 3}, {2, 4},
+	{3, 0}, {3, 1}, {3, 2},
+}
+
+// CompileOptions control how metal source is compiled. The zero value compiles with Metal's
+// defaults.
+type CompileOptions struct {
+	// LanguageVersion is the version of the Metal Shading Language to compile for, such as
+	// Version{3, 1}. The zero value uses the newest version that the system supports.
+	LanguageVersion Version
+	// MathMode selects the floating-point optimizations that the compiler may make. It has no effect
+	// on the CPU backend, which always follows IEEE 754.
+	MathMode MathMode
+	// PreprocessorMacros are defined before the source is compiled, as if each began it as
+	// #define name value.
+	PreprocessorMacros map[string]string
+	// PreserveInvariance keeps the compiler from optimizing in ways that could change the results of
+	// calculations marked [[invariant]] between pipelines.
+	PreserveInvariance bool
+	// Constants specialize the function constants that the source declares. Each is checked against
+	// its declaration before anything is compiled: a constant that is not declared, or a value of a
+	// different type than the declaration's, is an error. A library applies them to every function
+	// that is set up from it.
+	Constants []FunctionConstant
+}
+
+// validate checks the options before they are handed to a backend.
+func (o *CompileOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+
+	if o.LanguageVersion != (Version{}) && !slices.Contains(languageVersions, o.LanguageVersion) {
+		return fmt.Errorf("unsupported language version %s", o.LanguageVersion)
+	}
+	if o.MathMode < MathModeDefault || o.MathMode > MathModeFast {
+		return fmt.Errorf("invalid math mode %s", o.MathMode)
+	}
+	for name := range o.PreprocessorMacros {
+		if !validIdentifier(name) {
+			return fmt.Errorf("invalid macro name '%s'", name)
+		}
+	}
+
+	return validateConstants(o.Constants)
+}
+
+// validIdentifier reports whether name is an identifier, and so can name a macro or a function
+// constant.
+func validIdentifier(name string) bool {
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// clone returns a copy of the options that does not share their macros or constants, or nil if o
+// is nil.
+func (o *CompileOptions) clone() *CompileOptions {
+	if o == nil {
+		return nil
+	}
+
+	c := *o
+	c.PreprocessorMacros = maps.Clone(o.PreprocessorMacros)
+	c.Constants = slices.Clone(o.Constants)
+	return &c
+}
+
+// key returns a string that is the same for two sets of options exactly when they compile source
+// into the same functions, so that it can key a cache of them. Macros are listed by name and
+// constants by name or index, so the order they are given in does not matter; nil has the key of
+// the zero options.
+func (o *CompileOptions) key() string {
+	if o == nil {
+		o = &CompileOptions{}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "version=%s;math=%s;invariance=%t", o.LanguageVersion, o.MathMode, o.PreserveInvariance)
+	for _, name := range slices.Sorted(maps.Keys(o.PreprocessorMacros)) {
+		fmt.Fprintf(&b, ";macro %s=%q", name, o.PreprocessorMacros[name])
+	}
+
+	constants := make([]string, 0, len(o.Constants))
+	for _, c := range o.Constants {
+		s, _ := c.scalar()
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", c.Index)
+		}
+		constants = append(constants, fmt.Sprintf(";constant %s=%s", name, s))
+	}
+	slices.Sort(constants)
+	for _, c := range constants {
+		b.WriteString(c)
+	}
+
+	return b.String()
+}
+
+// macros returns the macros that the preprocessor defines: PreprocessorMacros, and
+// __METAL_VERSION__ if LanguageVersion is set, which Metal defines as the version's digits, such as
+// 310 for 3.1.
+func (o *CompileOptions) macros() map[string]string {
+	if o == nil {
+		return nil
+	}
+
+	macros := maps.Clone(o.PreprocessorMacros)
+	if o.LanguageVersion != (Version{}) {
+		if macros == nil {
+			macros = make(map[string]string)
+		}
+		macros["__METAL_VERSION__"] = strconv.Itoa(o.LanguageVersion.Major*100 + o.LanguageVersion.Minor*10)
+	}
+	return macros
+}
+
+// preprocess runs the Go preprocessor over source with the options' macros. The Metal compiler runs
+// its own, so this is how the CPU backend and the argument parser see the source as it would.
+func (o *CompileOptions) preprocess(source string) (string, error) {
+	return msl.Preprocess(source, o.macros())
+}
@@ -0,0 +1,286 @@
+package metal
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_CompileOptions_validate tests that compile options are checked in Go before they reach a
+// backend.
+func Test_CompileOptions_validate(t *testing.T) {
+	type subtest struct {
+		name   string
+		opts   CompileOptions
+		errMsg string
+	}
+
+	subtests := []subtest{
+		{
+			name: "zero",
+		},
+		{
+			name: "valid",
+			opts: CompileOptions{
+				LanguageVersion:    Version{3, 1},
+				MathMode:           MathModeSafe,
+				PreprocessorMacros: map[string]string{"TILE": "16", "_DEBUG": "", "N2": "2"},
+				PreserveInvariance: true,
+			},
+		},
+		{
+			name:   "unknown language version",
+			opts:   CompileOptions{LanguageVersion: Version{2, 5}},
+			errMsg: "unsupported language version 2.5",
+		},
+		{
+			name:   "negative math mode",
+			opts:   CompileOptions{MathMode: -1},
+			errMsg: "invalid math mode MathMode(-1)",
+		},
+		{
+			name:   "unknown math mode",
+			opts:   CompileOptions{MathMode: MathModeFast + 1},
+			errMsg: "invalid math mode MathMode(4)",
+		},
+		{
+			name:   "empty macro name",
+			opts:   CompileOptions{PreprocessorMacros: map[string]string{"": "1"}},
+			errMsg: "invalid macro name ''",
+		},
+		{
+			name:   "macro name with a digit first",
+			opts:   CompileOptions{PreprocessorMacros: map[string]string{"2N": "1"}},
+			errMsg: "invalid macro name '2N'",
+		},
+		{
+			name:   "function-like macro name",
+			opts:   CompileOptions{PreprocessorMacros: map[string]string{"F(x)": "x"}},
+			errMsg: "invalid macro name 'F(x)'",
+		},
+		{
+			name: "constants",
+			opts: CompileOptions{Constants: []FunctionConstant{
+				{Name: "TILE", Value: uint32(16)},
+				{Index: 0, Value: true},
+				{Index: 65535, Value: Half(0.5)},
+			}},
+		},
+		{
+			name:   "invalid constant name",
+			opts:   CompileOptions{Constants: []FunctionConstant{{Name: "a-b", Value: true}}},
+			errMsg: "invalid function constant name 'a-b'",
+		},
+		{
+			name:   "negative constant index",
+			opts:   CompileOptions{Constants: []FunctionConstant{{Index: -1, Value: true}}},
+			errMsg: "invalid function constant index -1",
+		},
+		{
+			name:   "constant index out of range",
+			opts:   CompileOptions{Constants: []FunctionConstant{{Index: 65536, Value: true}}},
+			errMsg: "invalid function constant index 65536",
+		},
+		{
+			name:   "unsupported constant value",
+			opts:   CompileOptions{Constants: []FunctionConstant{{Name: "TILE", Value: 16}}},
+			errMsg: "function constant 'TILE' has a value of unsupported type int",
+		},
+		{
+			name:   "invalid scalar constant value",
+			opts:   CompileOptions{Constants: []FunctionConstant{{Index: 2, Value: Scalar{}}}},
+			errMsg: "function constant at index 2 has an invalid Scalar value",
+		},
+		{
+			name:   "repeated constant",
+			opts:   CompileOptions{Constants: []FunctionConstant{{Index: 1, Value: true}, {Index: 1, Value: false}}},
+			errMsg: "function constant at index 1 is given more than once",
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			err := subtest.opts.validate()
+			if subtest.errMsg == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, subtest.errMsg)
+			}
+		})
+	}
+
+	var nilOpts *CompileOptions
+	require.NoError(t, nilOpts.validate())
+}
+
+// Test_CompileOptions_preprocess tests that the Go preprocessor sees the options' macros and the
+// language version, as the Metal compiler does.
+func Test_CompileOptions_preprocess(t *testing.T) {
+	source := "#if __METAL_VERSION__ >= 300\nfloat x = SCALE;\n#else\nhalf x = SCALE;\n#endif"
+
+	var nilOpts *CompileOptions
+	out, err := nilOpts.preprocess(source)
+	require.NoError(t, err)
+	require.Equal(t, "\n\n\nhalf x = SCALE;\n", out)
+
+	opts := &CompileOptions{
+		LanguageVersion:    Version{3, 1},
+		PreprocessorMacros: map[string]string{"SCALE": "2.5f"},
+	}
+	out, err = opts.preprocess(source)
+	require.NoError(t, err)
+	require.Equal(t, "\nfloat x = 2.5f;\n\n\n", out)
+	require.Equal(t, map[string]string{"SCALE": "2.5f", "__METAL_VERSION__": "310"}, opts.macros())
+
+	// The macros of a clone are not shared with the original.
+	clone := opts.clone()
+	clone.PreprocessorMacros["SCALE"] = "1"
+	require.Equal(t, "2.5f", opts.PreprocessorMacros["SCALE"])
+	require.Nil(t, nilOpts.clone())
+
+	_, err = opts.preprocess("#error stop")
+	require.EqualError(t, err, "1:1: #error stop")
+}
+
+// Test_CompileOptions_specialize tests that function constants are checked against the constants
+// that the source declares.
+func Test_CompileOptions_specialize(t *testing.T) {
+	source := `
+#ifdef HALF
+#define SCALE_TYPE half
+#else
+#define SCALE_TYPE float
+#endif
+constant uint TILE [[function_constant(0)]];
+constant bool FAST [[function_constant(1)]];
+constant SCALE_TYPE SCALE [[function_constant(2)]];
+constant float4 BIAS [[function_constant(3)]];
+kernel void k() {}
+`
+
+	type subtest struct {
+		name      string
+		macros    map[string]string
+		constants []FunctionConstant
+		want      []FunctionConstant
+		errMsg    string
+	}
+
+	subtests := []subtest{
+		{
+			name: "by name and index",
+			constants: []FunctionConstant{
+				{Name: "FAST", Value: true},
+				{Index: 0, Value: uint32(8)},
+				{Name: "SCALE", Value: float32(0.5)},
+			},
+			want: []FunctionConstant{
+				{Name: "FAST", Index: 1, Value: true},
+				{Name: "TILE", Index: 0, Value: uint32(8)},
+				{Name: "SCALE", Index: 2, Value: float32(0.5)},
+			},
+		},
+		{
+			name:      "preprocessed",
+			macros:    map[string]string{"HALF": ""},
+			constants: []FunctionConstant{{Index: 2, Value: Half(0.5)}},
+			want:      []FunctionConstant{{Name: "SCALE", Index: 2, Value: Half(0.5)}},
+		},
+		{
+			name:      "wrong type",
+			constants: []FunctionConstant{{Name: "TILE", Value: int32(8)}},
+			errMsg:    "function constant 'TILE' is declared uint, not int",
+		},
+		{
+			name:      "wrong preprocessed type",
+			macros:    map[string]string{"HALF": ""},
+			constants: []FunctionConstant{{Name: "SCALE", Value: float32(0.5)}},
+			errMsg:    "function constant 'SCALE' is declared half, not float",
+		},
+		{
+			name:      "vector",
+			constants: []FunctionConstant{{Index: 3, Value: float32(1)}},
+			errMsg:    "function constant at index 3 is declared float4, not float",
+		},
+		{
+			name:      "unknown name",
+			constants: []FunctionConstant{{Name: "tile", Value: uint32(8)}},
+			errMsg:    "no function constant 'tile' is declared",
+		},
+		{
+			name:      "unknown index",
+			constants: []FunctionConstant{{Index: 4, Value: uint32(8)}},
+			errMsg:    "no function constant at index 4 is declared",
+		},
+		{
+			name:      "by name and by index",
+			constants: []FunctionConstant{{Name: "FAST", Value: true}, {Index: 1, Value: false}},
+			errMsg:    "function constant 'FAST' is given more than once",
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			opts := &CompileOptions{PreprocessorMacros: subtest.macros, Constants: subtest.constants}
+			require.NoError(t, opts.validate())
+			opts = opts.clone()
+
+			err := opts.specialize(source)
+			if subtest.errMsg != "" {
+				require.EqualError(t, err, subtest.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, subtest.want, opts.Constants)
+		})
+	}
+
+	// Constants are left to the compiler if the source cannot be scanned.
+	opts := &CompileOptions{Constants: []FunctionConstant{{Name: "TILE", Value: int32(8)}}}
+	require.NoError(t, opts.specialize("constant int TILE [[function_constant(0)]]; /* unterminated"))
+	require.NoError(t, (*CompileOptions)(nil).specialize(source))
+
+	require.Equal(t, map[string][]byte{"TILE": {8, 0, 0, 0}}, opts.constantValues())
+}
+
+// Test_CompileOptions_key tests that options that compile the same functions have the same key,
+// whatever order their macros and constants are given in.
+func Test_CompileOptions_key(t *testing.T) {
+	a := &CompileOptions{
+		LanguageVersion:    Version{3, 1},
+		PreprocessorMacros: map[string]string{"A": "1", "B": "x y"},
+		Constants:          []FunctionConstant{{Name: "TILE", Value: uint32(8)}, {Index: 1, Value: true}},
+	}
+	b := a.clone()
+	slices.Reverse(b.Constants)
+	require.Equal(t, `version=3.1;math=default;invariance=false;macro A="1";macro B="x y";constant #1=true (bool);constant TILE=8 (uint)`, a.key())
+	require.Equal(t, a.key(), b.key())
+
+	var nilOpts *CompileOptions
+	require.Equal(t, (&CompileOptions{}).key(), nilOpts.key())
+	require.Equal(t, "version=0.0;math=default;invariance=false", nilOpts.key())
+
+	for _, change := range []func(o *CompileOptions){
+		func(o *CompileOptions) { o.LanguageVersion = Version{3, 0} },
+		func(o *CompileOptions) { o.MathMode = MathModeFast },
+		func(o *CompileOptions) { o.PreserveInvariance = true },
+		func(o *CompileOptions) { o.PreprocessorMacros["B"] = "x" },
+		func(o *CompileOptions) { o.Constants[0].Value = uint32(16) },
+		func(o *CompileOptions) { o.Constants[0].Value = int32(8) },
+		func(o *CompileOptions) { o.Constants = o.Constants[:1] },
+	} {
+		c := a.clone()
+		change(c)
+		require.NotEqual(t, a.key(), c.key())
+	}
+}
+
+// Test_MathMode_String tests that math modes are named.
+func Test_MathMode_String(t *testing.T) {
+	require.Equal(t, "default", MathModeDefault.String())
+	require.Equal(t, "safe", MathModeSafe.String())
+	require.Equal(t, "relaxed", MathModeRelaxed.String())
+	require.Equal(t, "fast", MathModeFast.String())
+	require.Equal(t, "MathMode(7)", MathMode(7).String())
+}
@@ -0,0 +1,162 @@
+package metal
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/green-aloe/metal/internal/msl"
+)
+
+// ----------------------------------------------------------------------------
+// Function constants
+// ----------------------------------------------------------------------------
+
+// A FunctionConstant gives the value of a function constant: a program-scope declaration such as
+//
+//	constant uint TILE [[function_constant(0)]];
+//
+// whose value is fixed when a function is set up, so that one source can be compiled into
+// pipelines specialized for, say, a tile size or a fast path. The compiler treats the value as a
+// constant, so branches on it cost nothing. is_function_constant_defined reports whether a value was
+// given for a constant.
+type FunctionConstant struct {
+	// Name is the name of the constant. If it is empty, the constant is chosen by Index instead.
+	Name string
+	// Index is the index in the constant's function_constant attribute. It is used only if Name is
+	// empty.
+	Index int
+	// Value is the value of the constant: a bool, int32, uint32, float32, int16, or uint16 for a
+	// bool, int, uint, float, short, or ushort constant, or a Scalar, such as one made by Half for a
+	// half constant. Its type must be the type that the constant is declared with.
+	Value any
+}
+
+// maxFunctionConstantIndex is the largest index that a function constant may have.
+const maxFunctionConstantIndex = math.MaxUint16
+
+// label names the constant that c gives a value for, for error messages.
+func (c FunctionConstant) label() string {
+	if c.Name != "" {
+		return fmt.Sprintf("'%s'", c.Name)
+	}
+	return fmt.Sprintf("at index %d", c.Index)
+}
+
+// scalar returns the value of c as a Scalar. A bool is a scalar of its own type, which only
+// function constants use.
+func (c FunctionConstant) scalar() (Scalar, error) {
+	switch v := c.Value.(type) {
+	case bool:
+		s := Scalar{typ: msl.Bool}
+		if v {
+			s.bits = 1
+		}
+		return s, nil
+	case int32:
+		return Int32(v), nil
+	case uint32:
+		return Uint32(v), nil
+	case float32:
+		return Float32(v), nil
+	case int16:
+		return Int16(v), nil
+	case uint16:
+		return Uint16(v), nil
+	case Scalar:
+		if !v.valid() {
+			return Scalar{}, fmt.Errorf("function constant %s has an invalid Scalar value", c.label())
+		}
+		return v, nil
+	default:
+		return Scalar{}, fmt.Errorf("function constant %s has a value of unsupported type %T", c.label(), c.Value)
+	}
+}
+
+// validateConstants checks that each constant in consts is named by an identifier or a valid index,
+// has a value of a supported type, and is given only once.
+func validateConstants(consts []FunctionConstant) error {
+	seen := make(map[string]bool)
+	for _, c := range consts {
+		switch {
+		case c.Name != "" && !validIdentifier(c.Name):
+			return fmt.Errorf("invalid function constant name '%s'", c.Name)
+		case c.Name == "" && (c.Index < 0 || c.Index > maxFunctionConstantIndex):
+			return fmt.Errorf("invalid function constant index %d", c.Index)
+		}
+		if _, err := c.scalar(); err != nil {
+			return err
+		}
+		if seen[c.label()] {
+			return fmt.Errorf("function constant %s is given more than once", c.label())
+		}
+		seen[c.label()] = true
+	}
+
+	return nil
+}
+
+// specialize checks the options' constants against the function constants that source declares,
+// and fills in the name and index of each one from its declaration. A constant that source does
+// not declare, or whose value has a different type than its declaration, is an error. If source
+// cannot be scanned for its declarations, the constants are left for the compiler to check.
+func (o *CompileOptions) specialize(source string) error {
+	if o == nil || len(o.Constants) == 0 {
+		return nil
+	}
+
+	preprocessed, err := o.preprocess(source)
+	if err != nil {
+		preprocessed = source
+	}
+	decls, err := msl.ParseFunctionConstants(preprocessed)
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for i, c := range o.Constants {
+		j := slices.IndexFunc(decls, func(d msl.FunctionConstant) bool {
+			if c.Name != "" {
+				return d.Name == c.Name
+			}
+			return d.Index == c.Index
+		})
+		if j < 0 {
+			return fmt.Errorf("no function constant %s is declared", c.label())
+		}
+		d := decls[j]
+
+		s, err := c.scalar()
+		if err != nil {
+			return err
+		}
+		if d.Type.Scalar != s.typ || d.Type.Width != 1 || d.Type.Pointer {
+			return fmt.Errorf("function constant %s is declared %s, not %s", c.label(), d.TypeName, s.Type())
+		}
+
+		if seen[d.Name] {
+			return fmt.Errorf("function constant '%s' is given more than once", d.Name)
+		}
+		seen[d.Name] = true
+		o.Constants[i].Name, o.Constants[i].Index = d.Name, d.Index
+	}
+
+	return nil
+}
+
+// constantValues returns the values of the options' named constants, keyed by name and encoded as
+// the CPU backend's interpreter reads them.
+func (o *CompileOptions) constantValues() map[string][]byte {
+	if o == nil || len(o.Constants) == 0 {
+		return nil
+	}
+
+	values := make(map[string][]byte, len(o.Constants))
+	for _, c := range o.Constants {
+		if s, err := c.scalar(); err == nil && c.Name != "" {
+			values[c.Name] = s.bytes()
+		}
+	}
+	return values
+}
@@ -0,0 +1,144 @@
+package metal
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ----------------------------------------------------------------------------
+// CPU kernels
+// ----------------------------------------------------------------------------
+
+// A ThreadContext describes the position of one thread in a dispatch run by the CPU backend. Its
+// fields carry the same values that a Metal kernel receives through the matching attributes, so a
+// CPU kernel can index its buffers exactly like the MSL kernel it stands in for.
+type ThreadContext struct {
+	// Position is the thread's position in the grid ([[thread_position_in_grid]]).
+	Position Grid
+	// GridSize is the number of threads in each dimension of the dispatched grid
+	// ([[threads_per_grid]]). When the CPU backend emulates uniform threadgroups (see
+	// CPUOptions.UniformThreadgroups) this is the grid rounded up to whole threadgroups, which can
+	// be larger than RunParameters.Grid, just as it is on a GPU without non-uniform threadgroup
+	// support.
+	GridSize Grid
+	// ThreadgroupPosition is the position of the thread's threadgroup in the grid
+	// ([[threadgroup_position_in_grid]]).
+	ThreadgroupPosition Grid
+	// PositionInThreadgroup is the thread's position within its threadgroup
+	// ([[thread_position_in_threadgroup]]).
+	PositionInThreadgroup Grid
+	// ThreadgroupSize is the number of threads in each dimension of the thread's threadgroup
+	// ([[threads_per_threadgroup]]). With non-uniform threadgroups, the threadgroups along the far
+	// edges of the grid are smaller than the rest.
+	ThreadgroupSize Grid
+}
+
+// A CPUKernel is a Go implementation of a Metal compute kernel. The CPU backend calls it once per
+// thread in the grid, concurrently from several goroutines, so it must be safe for concurrent use
+// in the same way a GPU kernel is: threads may read shared data freely but must write only to the
+// elements they own.
+//
+// inputs holds RunParameters.Inputs, or the values of RunParameters.Scalars converted to float32.
+// A CPU kernel cannot receive RunParameters.Structs; a dispatch that sets them fails, as it does
+// for an interpreted kernel, so struct inputs run only on Metal.
+// bufs holds one element per RunParameters.BufferIds, in the same order, each being the slice
+// returned when the buffer was created (for example, a []float32 for a buffer created by
+// NewBuffer[float32]). Type-assert each element to its slice type.
+type CPUKernel func(tc ThreadContext, inputs []float32, bufs []any)
+
+var (
+	cpuKernelsMu sync.RWMutex
+	cpuKernels   = make(map[string]CPUKernel)
+)
+
+// RegisterCPUKernel registers a Go implementation of the metal function called name. When Metal is
+// unavailable, or when CPUOptions.Force is set, NewFunction looks up the kernel registered under
+// its funcName and returns a Function that runs it on the CPU instead of interpreting the metal
+// source. Register a kernel when its source uses features the interpreter does not support, or to
+// run a faster native version. Such a Function accepts the same RunParameters and BufferIds as its
+// GPU counterpart.
+//
+// Registering a name again replaces the earlier kernel for Functions created afterward. Functions
+// that already exist keep the kernel they were created with. RegisterCPUKernel panics if name is
+// empty or kernel is nil. It is safe for concurrent use.
+func RegisterCPUKernel(name string, kernel CPUKernel) {
+	if name == "" {
+		panic("metal: RegisterCPUKernel with empty name")
+	}
+	if kernel == nil {
+		panic("metal: RegisterCPUKernel with nil kernel")
+	}
+
+	cpuKernelsMu.Lock()
+	defer cpuKernelsMu.Unlock()
+
+	cpuKernels[name] = kernel
+}
+
+// lookupCPUKernel returns the kernel registered under name, or nil if there is none.
+func lookupCPUKernel(name string) CPUKernel {
+	cpuKernelsMu.RLock()
+	defer cpuKernelsMu.RUnlock()
+
+	return cpuKernels[name]
+}
+
+// ----------------------------------------------------------------------------
+// CPU options
+// ----------------------------------------------------------------------------
+
+// CPUOptions control when and how the CPU backend runs functions.
+type CPUOptions struct {
+	// Force makes NewFunction build every function on the CPU backend, even when Metal is
+	// available. It is read when a Function is created, so changing it does not move existing
+	// Functions between backends.
+	Force bool
+	// Workers is the number of goroutines that run a dispatch's threads. A value of 0 or less uses
+	// runtime.GOMAXPROCS(0).
+	Workers int
+	// UniformThreadgroups emulates a GPU without non-uniform threadgroup support: the grid is
+	// rounded up to whole threadgroups and every thread in every threadgroup runs, so a kernel sees
+	// positions past the end of RunParameters.Grid and must bounds-check them. This is what Run does
+	// on such hardware. When false, the grid is run exactly, as on Apple4 and later GPUs.
+	UniformThreadgroups bool
+	// ThreadExecutionWidth and MaxTotalThreadsPerThreadgroup are the pipeline limits used to size
+	// threadgroups, in the same way Run sizes them for a GPU pipeline. A value of 0 or less uses 32
+	// and 1024 respectively, which are typical of Apple GPUs.
+	ThreadExecutionWidth          int
+	MaxTotalThreadsPerThreadgroup int
+}
+
+// cpuOptions holds the options set by SetCPUOptions. It is nil until the first call, which reads
+// as the zero CPUOptions.
+var cpuOptions atomic.Pointer[CPUOptions]
+
+// SetCPUOptions replaces the options used by the CPU backend. It is safe for concurrent use; a
+// dispatch already in progress keeps the options it started with.
+func SetCPUOptions(opts CPUOptions) {
+	cpuOptions.Store(&opts)
+}
+
+// limits returns the pipeline limits that the options give CPU functions, with the defaults filled
+// in.
+func (opts CPUOptions) limits() pipelineLimits {
+	limits := pipelineLimits{
+		threadExecutionWidth:          32,
+		maxTotalThreadsPerThreadgroup: 1024,
+		maxThreadgroupMemoryLength:    defaultMaxThreadgroupMemoryLength,
+	}
+	if opts.ThreadExecutionWidth > 0 {
+		limits.threadExecutionWidth = opts.ThreadExecutionWidth
+	}
+	if opts.MaxTotalThreadsPerThreadgroup > 0 {
+		limits.maxTotalThreadsPerThreadgroup = opts.MaxTotalThreadsPerThreadgroup
+	}
+	return limits
+}
+
+// currentCPUOptions returns the options most recently set by SetCPUOptions.
+func currentCPUOptions() CPUOptions {
+	if opts := cpuOptions.Load(); opts != nil {
+		return *opts
+	}
+	return CPUOptions{}
+}
@@ -0,0 +1,301 @@
+package metal
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_RegisterCPUKernel tests that RegisterCPUKernel stores kernels by name and rejects invalid
+// registrations.
+func Test_RegisterCPUKernel(t *testing.T) {
+	t.Run("empty name panics", func(t *testing.T) {
+		require.Panics(t, func() { RegisterCPUKernel("", func(ThreadContext, []float32, []any) {}) })
+	})
+
+	t.Run("nil kernel panics", func(t *testing.T) {
+		require.Panics(t, func() { RegisterCPUKernel("nilKernel", nil) })
+	})
+
+	t.Run("re-registering replaces", func(t *testing.T) {
+		var calls []int
+		RegisterCPUKernel("replaced", func(ThreadContext, []float32, []any) { calls = append(calls, 1) })
+		RegisterCPUKernel("replaced", func(ThreadContext, []float32, []any) { calls = append(calls, 2) })
+
+		lookupCPUKernel("replaced")(ThreadContext{}, nil, nil)
+		require.Equal(t, []int{2}, calls)
+	})
+
+	t.Run("unknown name", func(t *testing.T) {
+		require.Nil(t, lookupCPUKernel("neverRegistered"))
+	})
+}
+
+// Test_defaultThreadgroupSize tests that threadgroups are sized to fill a pipeline's limits.
+func Test_defaultThreadgroupSize(t *testing.T) {
+	type subtest struct {
+		name                          string
+		threadExecutionWidth          int
+		maxTotalThreadsPerThreadgroup int
+		want                          Grid
+	}
+
+	subtests := []subtest{
+		{name: "defaults", want: Grid{X: 32, Y: 32, Z: 1}},
+		{name: "typical", threadExecutionWidth: 32, maxTotalThreadsPerThreadgroup: 1024, want: Grid{X: 32, Y: 32, Z: 1}},
+		{name: "not a multiple", threadExecutionWidth: 32, maxTotalThreadsPerThreadgroup: 100, want: Grid{X: 32, Y: 3, Z: 1}},
+		{name: "not a multiple of a small width", threadExecutionWidth: 8, maxTotalThreadsPerThreadgroup: 60, want: Grid{X: 8, Y: 7, Z: 1}},
+		{name: "between one and two rows", threadExecutionWidth: 32, maxTotalThreadsPerThreadgroup: 48, want: Grid{X: 32, Y: 1, Z: 1}},
+		{name: "register pressure clamps width", threadExecutionWidth: 32, maxTotalThreadsPerThreadgroup: 16, want: Grid{X: 16, Y: 1, Z: 1}},
+		{name: "limit not a divisor of width", threadExecutionWidth: 64, maxTotalThreadsPerThreadgroup: 40, want: Grid{X: 40, Y: 1, Z: 1}},
+		{name: "single thread", threadExecutionWidth: 32, maxTotalThreadsPerThreadgroup: 1, want: Grid{X: 1, Y: 1, Z: 1}},
+		{name: "negative limits use defaults", threadExecutionWidth: -1, maxTotalThreadsPerThreadgroup: -1, want: Grid{X: 32, Y: 32, Z: 1}},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			got := defaultThreadgroupSize(subtest.threadExecutionWidth, subtest.maxTotalThreadsPerThreadgroup)
+			require.Equal(t, subtest.want, got)
+			if subtest.maxTotalThreadsPerThreadgroup > 0 {
+				require.LessOrEqual(t, got.X*got.Y*got.Z, subtest.maxTotalThreadsPerThreadgroup)
+			}
+		})
+	}
+}
+
+// Test_threadgroupSize tests that a requested threadgroup is checked against a pipeline's limits,
+// and that the default size is used when none is requested.
+func Test_threadgroupSize(t *testing.T) {
+	type subtest struct {
+		name      string
+		requested Grid
+		limits    pipelineLimits
+		want      Grid
+		err       string
+	}
+
+	limits := func(threadExecutionWidth, maxTotalThreadsPerThreadgroup int) pipelineLimits {
+		return pipelineLimits{
+			threadExecutionWidth:          threadExecutionWidth,
+			maxTotalThreadsPerThreadgroup: maxTotalThreadsPerThreadgroup,
+		}
+	}
+
+	subtests := []subtest{
+		{name: "default", limits: limits(32, 1024), want: Grid{X: 32, Y: 32, Z: 1}},
+		{name: "default under pressure", limits: limits(32, 256), want: Grid{X: 32, Y: 8, Z: 1}},
+		{name: "default wide", limits: limits(64, 512), want: Grid{X: 64, Y: 8, Z: 1}},
+		{name: "default without limits", want: Grid{X: 32, Y: 32, Z: 1}},
+		{name: "tile", requested: Grid{X: 16, Y: 16}, limits: limits(32, 1024), want: Grid{X: 16, Y: 16, Z: 1}},
+		{name: "3D", requested: Grid{X: 8, Y: 8, Z: 4}, limits: limits(32, 256), want: Grid{X: 8, Y: 8, Z: 4}},
+		{name: "zero dimensions", requested: Grid{Y: 64}, limits: limits(32, 1024), want: Grid{X: 1, Y: 64, Z: 1}},
+		{name: "at the limit", requested: Grid{X: 32, Y: 8, Z: 1}, limits: limits(32, 256), want: Grid{X: 32, Y: 8, Z: 1}},
+		{
+			name:      "over the limit",
+			requested: Grid{X: 32, Y: 16},
+			limits:    limits(32, 256),
+			err:       "threadgroup of 32x16x1 threads exceeds the function's limit of 256 threads per threadgroup",
+		},
+		{
+			name:      "over the default limit",
+			requested: Grid{X: 2048},
+			err:       "threadgroup of 2048x1x1 threads exceeds the function's limit of 1024 threads per threadgroup",
+		},
+		{
+			name:      "huge dimensions",
+			requested: Grid{X: math.MaxInt32, Y: math.MaxInt32, Z: math.MaxInt32},
+			limits:    limits(32, 1024),
+			err:       "threadgroup of 2147483647x2147483647x2147483647 threads exceeds the function's limit of 1024 threads per threadgroup",
+		},
+		{name: "negative", requested: Grid{X: 16, Y: -1}, limits: limits(32, 1024), err: "invalid threadgroup dimension"},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			size, err := threadgroupSize(subtest.requested, subtest.limits)
+			if subtest.err != "" {
+				require.EqualError(t, err, subtest.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, subtest.want, size)
+		})
+	}
+}
+
+// Test_threadgroupMemory tests that threadgroup memory lengths are rounded up to Metal's alignment
+// and checked against a pipeline's limits.
+func Test_threadgroupMemory(t *testing.T) {
+	type subtest struct {
+		name      string
+		requested []int
+		limits    pipelineLimits
+		want      []int
+		err       string
+	}
+
+	limits := func(maxThreadgroupMemoryLength, staticThreadgroupMemoryLength int) pipelineLimits {
+		return pipelineLimits{
+			maxThreadgroupMemoryLength:    maxThreadgroupMemoryLength,
+			staticThreadgroupMemoryLength: staticThreadgroupMemoryLength,
+		}
+	}
+
+	subtests := []subtest{
+		{name: "nil", limits: limits(1024, 0)},
+		{name: "empty", requested: []int{}, limits: limits(1024, 0)},
+		{name: "aligned", requested: []int{16, 256}, limits: limits(1024, 0), want: []int{16, 256}},
+		{name: "rounded", requested: []int{1, 17, 100}, limits: limits(1024, 0), want: []int{16, 32, 112}},
+		{name: "unset index", requested: []int{0, 64}, limits: limits(1024, 0), want: []int{0, 64}},
+		{name: "at the limit", requested: []int{512, 512}, limits: limits(1024, 0), want: []int{512, 512}},
+		{name: "static memory", requested: []int{512}, limits: limits(1024, 512), want: []int{512}},
+		{name: "default limit", requested: []int{32 << 10}, want: []int{32 << 10}},
+		{
+			name:      "negative",
+			requested: []int{16, -1},
+			limits:    limits(1024, 0),
+			err:       "invalid threadgroup memory length -1 at index 1",
+		},
+		{
+			name:      "index over the limit",
+			requested: []int{16, math.MaxInt},
+			limits:    limits(1024, 0),
+			err:       fmt.Sprintf("threadgroup memory of %d bytes at index 1 exceeds the device's limit of 1024 bytes", math.MaxInt),
+		},
+		{
+			name:      "total over the limit",
+			requested: []int{512, 500, 20},
+			limits:    limits(1024, 0),
+			err:       "threadgroup memory of 1056 bytes exceeds the device's limit of 1024 bytes",
+		},
+		{
+			name:      "rounded over the limit",
+			requested: []int{1020, 1},
+			limits:    limits(1024, 0),
+			err:       "threadgroup memory of 1040 bytes exceeds the device's limit of 1024 bytes",
+		},
+		{
+			name:      "static memory over the limit",
+			requested: []int{768},
+			limits:    limits(1024, 512),
+			err:       "threadgroup memory of 1280 bytes, including 512 bytes declared by the function, exceeds the device's limit of 1024 bytes",
+		},
+		{
+			name:      "over the default limit",
+			requested: []int{16 << 10, 16 << 10, 16},
+			err:       "threadgroup memory of 32784 bytes exceeds the device's limit of 32768 bytes",
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			lengths, err := threadgroupMemory(subtest.requested, subtest.limits)
+			if subtest.err != "" {
+				require.EqualError(t, err, subtest.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, subtest.want, lengths)
+		})
+	}
+
+	t.Run("ThreadgroupMemoryFor", func(t *testing.T) {
+		require.Equal(t, 1024, ThreadgroupMemoryFor[float32](256))
+		require.Equal(t, 256, ThreadgroupMemoryFor[uint8](256))
+		require.Equal(t, 512, ThreadgroupMemoryFor[int16](256))
+		require.Zero(t, ThreadgroupMemoryFor[int32](0))
+	})
+}
+
+// Test_cpuJob_execute tests that a CPU dispatch visits the same threads, with the same attribute
+// values, as a GPU dispatch of the same grid.
+func Test_cpuJob_execute(t *testing.T) {
+	// visit runs a job over grid and returns every thread context the kernel saw, keyed by position.
+	visit := func(t *testing.T, grid Grid, opts CPUOptions) map[Grid]ThreadContext {
+		var mu sync.Mutex
+		seen := make(map[Grid]ThreadContext)
+		var dups []Grid
+
+		job := cpuJob{
+			function: cpuFunction{name: "visit", kernel: func(tc ThreadContext, _ []float32, _ []any) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if _, dup := seen[tc.Position]; dup {
+					dups = append(dups, tc.Position)
+				}
+				seen[tc.Position] = tc
+			}},
+			grid: grid,
+		}
+		require.NoError(t, job.execute(opts))
+		require.Empty(t, dups, "positions visited more than once")
+
+		return seen
+	}
+
+	t.Run("exact grid", func(t *testing.T) {
+		grid := Grid{X: 37, Y: 5, Z: 3}
+		seen := visit(t, grid, CPUOptions{ThreadExecutionWidth: 8, MaxTotalThreadsPerThreadgroup: 16})
+		require.Len(t, seen, 37*5*3)
+
+		for pos, tc := range seen {
+			require.Equal(t, grid, tc.GridSize)
+			require.Less(t, pos.X, grid.X)
+			require.Less(t, pos.Y, grid.Y)
+			require.Less(t, pos.Z, grid.Z)
+
+			// Threadgroups are 8x2x1, trimmed along the far edges.
+			require.Equal(t, Grid{X: pos.X / 8, Y: pos.Y / 2, Z: pos.Z}, tc.ThreadgroupPosition)
+			require.Equal(t, Grid{X: pos.X % 8, Y: pos.Y % 2, Z: 0}, tc.PositionInThreadgroup)
+			wantSize := Grid{X: 8, Y: 2, Z: 1}
+			if pos.X >= 32 {
+				wantSize.X = 5
+			}
+			if pos.Y >= 4 {
+				wantSize.Y = 1
+			}
+			require.Equal(t, wantSize, tc.ThreadgroupSize)
+		}
+	})
+
+	t.Run("uniform threadgroups over-dispatch", func(t *testing.T) {
+		grid := Grid{X: 37, Y: 5, Z: 3}
+		seen := visit(t, grid, CPUOptions{
+			UniformThreadgroups:           true,
+			ThreadExecutionWidth:          8,
+			MaxTotalThreadsPerThreadgroup: 16,
+		})
+
+		// The grid rounds up to whole 8x2x1 threadgroups: 40x6x3.
+		wantGrid := Grid{X: 40, Y: 6, Z: 3}
+		require.Len(t, seen, 40*6*3)
+		for _, tc := range seen {
+			require.Equal(t, wantGrid, tc.GridSize)
+			require.Equal(t, Grid{X: 8, Y: 2, Z: 1}, tc.ThreadgroupSize)
+		}
+		require.Contains(t, seen, Grid{X: 39, Y: 5, Z: 2})
+	})
+
+	t.Run("single worker", func(t *testing.T) {
+		seen := visit(t, Grid{X: 100, Y: 1, Z: 1}, CPUOptions{Workers: 1})
+		require.Len(t, seen, 100)
+	})
+
+	t.Run("panic is reported with its thread", func(t *testing.T) {
+		job := cpuJob{
+			function: cpuFunction{name: "outOfRange", kernel: func(tc ThreadContext, _ []float32, bufs []any) {
+				out := bufs[0].([]float32)
+				out[tc.Position.X] = 1
+			}},
+			grid: Grid{X: 11, Y: 1, Z: 1},
+			bufs: []any{make([]float32, 10)},
+		}
+
+		err := job.execute(CPUOptions{Workers: 1, ThreadExecutionWidth: 4, MaxTotalThreadsPerThreadgroup: 4})
+		require.ErrorContains(t, err, "kernel 'outOfRange' panicked at thread position (10, 0, 0)")
+	})
+}
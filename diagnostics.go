@@ -0,0 +1,152 @@
+package metal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/green-aloe/metal/internal/msl"
+)
+
+// ----------------------------------------------------------------------------
+// Compiler diagnostics
+// ----------------------------------------------------------------------------
+
+// A Severity is how serious a compiler diagnostic is.
+type Severity int
+
+const (
+	// SeverityError is a problem that keeps the source from compiling.
+	SeverityError Severity = iota
+	// SeverityWarning is a likely mistake that does not keep the source from compiling.
+	SeverityWarning
+	// SeverityNote adds detail to the error or warning before it, such as where a conflicting
+	// declaration is.
+	SeverityNote
+)
+
+// String returns the name of the severity, as the compiler prints it.
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	case SeverityNote:
+		return "note"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// A Diagnostic is one message from the compiler about a position in the source.
+type Diagnostic struct {
+	// File is the name of the file the position is in. Metal calls source that is compiled at run
+	// time program_source; #line directives, such as the ones NewFunctionFS writes, give other
+	// names. It is empty if the compiler did not say.
+	File string
+	// Line and Column are the 1-based position of the problem, or zero if the compiler did not say.
+	Line   int
+	Column int
+	// Severity is how serious the problem is.
+	Severity Severity
+	// Message describes the problem.
+	Message string
+}
+
+// String returns the diagnostic in the compiler's format, such as
+// "program_source:3:5: error: use of undeclared identifier 'x'".
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s%s: %s", d.position(), d.Severity, d.Message)
+}
+
+// position returns the diagnostic's position followed by ": ", or the empty string if it has none.
+func (d Diagnostic) position() string {
+	switch {
+	case d.Line > 0 && d.File != "":
+		return fmt.Sprintf("%s:%d:%d: ", d.File, d.Line, d.Column)
+	case d.Line > 0:
+		return fmt.Sprintf("%d:%d: ", d.Line, d.Column)
+	case d.File != "":
+		return d.File + ": "
+	default:
+		return ""
+	}
+}
+
+// A CompileError is returned when metal source fails to compile. Use errors.As to get it from the
+// error returned by NewFunction, NewFunctionWithOptions, NewFunctionFS, or NewLibrary.
+type CompileError struct {
+	// Diagnostics are the errors, warnings, and notes that the compiler reported, in order.
+	Diagnostics []Diagnostic
+	// Log is the compiler's output as it was written, including the source lines that the
+	// diagnostics point at.
+	Log string
+}
+
+// Error lists the positions and messages of the errors in e.
+func (e *CompileError) Error() string {
+	var msgs []string
+	for _, d := range e.Diagnostics {
+		if d.Severity == SeverityError {
+			msgs = append(msgs, d.position()+d.Message)
+		}
+	}
+	if len(msgs) == 0 {
+		msgs = append(msgs, strings.TrimSpace(e.Log))
+	}
+
+	return "failed to create library: " + strings.Join(msgs, "; ")
+}
+
+// compileError returns an error from compiling source, with wrap as its prefix. log is the
+// compiler's output, which is parsed into diagnostics.
+func compileError(log, wrap string) error {
+	return fmt.Errorf("%s: %w", wrap, &CompileError{Diagnostics: parseCompilerLog(log), Log: log})
+}
+
+// interpreterError returns err, an error from the CPU backend's preprocessor or parser, as a
+// compile error with wrap as its prefix.
+func interpreterError(err error, wrap string) error {
+	d := Diagnostic{Severity: SeverityError, Message: err.Error()}
+	var mslErr *msl.Error
+	if errors.As(err, &mslErr) {
+		d.File, d.Line, d.Column, d.Message = mslErr.Pos.File, mslErr.Pos.Line, mslErr.Pos.Column, mslErr.Msg
+	}
+
+	return fmt.Errorf("%s: %w", wrap, &CompileError{Diagnostics: []Diagnostic{d}, Log: d.String()})
+}
+
+// diagnosticLine matches the first line of a diagnostic in the compiler's output. The lines after
+// it, which quote the source and point at the problem, are not diagnostics of their own.
+var diagnosticLine = regexp.MustCompile(`^(.*?):(\d+):(\d+): (fatal error|error|warning|note): (.*)$`)
+
+// parseCompilerLog returns the diagnostics in the output of the Metal compiler. Lines that are not
+// diagnostics, such as the quoted source, "In file included from" lines, and the count of errors
+// generated, are skipped.
+func parseCompilerLog(log string) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, line := range strings.Split(log, "\n") {
+		m := diagnosticLine.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m == nil {
+			continue
+		}
+
+		d := Diagnostic{File: m[1], Message: m[5]}
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		switch m[4] {
+		case "warning":
+			d.Severity = SeverityWarning
+		case "note":
+			d.Severity = SeverityNote
+		default:
+			d.Severity = SeverityError
+		}
+		diagnostics = append(diagnostics, d)
+	}
+
+	return diagnostics
+}
@@ -0,0 +1,103 @@
+package metal
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/green-aloe/metal/internal/msl"
+	"github.com/stretchr/testify/require"
+)
+
+// Test_parseCompilerLog tests that diagnostics are parsed from captured compiler output.
+func Test_parseCompilerLog(t *testing.T) {
+	type subtest struct {
+		name string
+		file string
+		want []Diagnostic
+	}
+
+	subtests := []subtest{
+		{
+			name: "errors",
+			file: "test/compile_error.log",
+			want: []Diagnostic{
+				{File: "program_source", Line: 4, Column: 5, Severity: SeverityError, Message: "use of undeclared identifier 'reslt'; did you mean 'result'?"},
+				{File: "program_source", Line: 3, Column: 81, Severity: SeverityNote, Message: "'result' declared here"},
+				{File: "program_source", Line: 5, Column: 2, Severity: SeverityError, Message: "expected ';' after expression"},
+				{File: "program_source", Line: 2, Column: 7, Severity: SeverityWarning, Message: "unused variable 'scale' [-Wunused-variable]"},
+			},
+		},
+		{
+			name: "warnings",
+			file: "test/compile_warning.log",
+			want: []Diagnostic{
+				{File: "program_source", Line: 6, Column: 9, Severity: SeverityWarning, Message: "unused variable 'tmp' [-Wunused-variable]"},
+				{File: "program_source", Line: 7, Column: 18, Severity: SeverityWarning, Message: "implicit conversion loses floating-point precision: 'double' to 'float' [-Wimplicit-float-conversion]"},
+			},
+		},
+		{
+			name: "includes",
+			file: "test/compile_include.log",
+			want: []Diagnostic{
+				{File: "shaders/complex.metal", Line: 12, Column: 21, Severity: SeverityError, Message: "no matching function for call to 'cmul'"},
+				{File: "shaders/complex.metal", Line: 4, Column: 15, Severity: SeverityNote, Message: "candidate function not viable: requires 2 arguments, but 3 were provided"},
+				{File: "/System/Library/Frameworks/Metal.framework/include/metal_stdlib", Line: 9, Column: 10, Severity: SeverityError, Message: "'metal_missing' file not found"},
+			},
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			log, err := os.ReadFile(subtest.file)
+			require.NoError(t, err)
+			require.Equal(t, subtest.want, parseCompilerLog(string(log)))
+		})
+	}
+
+	require.Nil(t, parseCompilerLog(""))
+	require.Nil(t, parseCompilerLog("Compilation failed:\r\n\r\n1 error generated.\r\n"))
+	require.Equal(t, []Diagnostic{{File: "a.metal", Line: 1, Column: 2, Message: "x"}}, parseCompilerLog("a.metal:1:2: error: x\r\n"))
+}
+
+// Test_CompileError tests that a compile error lists its errors and can be extracted with errors.As.
+func Test_CompileError(t *testing.T) {
+	log, err := os.ReadFile("test/compile_error.log")
+	require.NoError(t, err)
+
+	err = compileError(string(log), "unable to set up metal function")
+	require.EqualError(t, err, "unable to set up metal function: failed to create library: "+
+		"program_source:4:5: use of undeclared identifier 'reslt'; did you mean 'result'?; "+
+		"program_source:5:2: expected ';' after expression")
+
+	var compileErr *CompileError
+	require.True(t, errors.As(err, &compileErr))
+	require.Equal(t, string(log), compileErr.Log)
+	require.Len(t, compileErr.Diagnostics, 4)
+	require.Equal(t, "program_source:3:81: note: 'result' declared here", compileErr.Diagnostics[1].String())
+
+	// Without any diagnostics, the log is the message.
+	err = compileError("  something went wrong\n", "unable to create metal library")
+	require.EqualError(t, err, "unable to create metal library: failed to create library: something went wrong")
+
+	err = interpreterError(&msl.Error{Pos: msl.Pos{File: "a.h", Line: 2, Column: 3}, Msg: "unexpected ';'"}, "unable to set up metal function")
+	require.EqualError(t, err, "unable to set up metal function: failed to create library: a.h:2:3: unexpected ';'")
+	require.True(t, errors.As(err, &compileErr))
+	require.Equal(t, []Diagnostic{{File: "a.h", Line: 2, Column: 3, Severity: SeverityError, Message: "unexpected ';'"}}, compileErr.Diagnostics)
+	require.Equal(t, "a.h:2:3: error: unexpected ';'", compileErr.Log)
+
+	err = interpreterError(&msl.Error{Msg: "invalid macro name '1N'"}, "unable to set up metal function")
+	require.EqualError(t, err, "unable to set up metal function: failed to create library: invalid macro name '1N'")
+	require.True(t, errors.As(err, &compileErr))
+	require.Equal(t, "error: invalid macro name '1N'", compileErr.Diagnostics[0].String())
+}
+
+// Test_Severity_String tests that severities are named as the compiler names them.
+func Test_Severity_String(t *testing.T) {
+	require.Equal(t, "error", SeverityError.String())
+	require.Equal(t, "warning", SeverityWarning.String())
+	require.Equal(t, "note", SeverityNote.String())
+	require.Equal(t, "Severity(3)", Severity(3).String())
+	require.Equal(t, "3:4: warning: w", Diagnostic{Line: 3, Column: 4, Severity: SeverityWarning, Message: "w"}.String())
+	require.Equal(t, "a.metal: note: n", Diagnostic{File: "a.metal", Severity: SeverityNote, Message: "n"}.String())
+}
@@ -24,9 +24,78 @@ The typical pattern is:
 
  4. Call [BufferId.Close] and [Function.Close] when resources are no longer needed.
 
+# Libraries
+
+[NewFunction] compiles its source every time it is called, which can take a noticeable share of a
+program's start-up for large shaders, and is repeated for every kernel of a source with many.
+[NewLibrary] compiles a source once into a [*Library], and [Library.Function] sets up any of its
+kernels from the compiled code. [Library.Functions] lists the kernels; on the CPU backend they are
+found by scanning the source for kernel declarations.
+
+A metallib file compiled ahead of time, for example with xcrun metal and xcrun metallib, avoids
+compiling at run time altogether: [LoadLibrary] or [LoadLibraryFile] loads it once as a
+[*Library], and [Library.Function] sets up any of its kernels without compiling them again.
+[NewFunctionFromLibrary] does the same for a single function. Functions stay valid after their
+Library is closed.
+
+[ReadLibraryInfo] reads the container header of a metallib file on any platform, reporting the
+functions in it, their types, the platform it targets, and the language version each function was
+compiled for.
+
+# Compile options
+
+[NewFunctionWithOptions] and [NewLibrary] compile with [CompileOptions]: the Metal Shading Language
+version to target, a [MathMode] that trades IEEE 754 semantics for speed, preprocessor macros, and
+whether to preserve invariance. The options are checked in Go before anything is compiled. The
+macros are also expanded by a preprocessor written in Go, so the CPU backend and
+[Function.Arguments] see the source as the Metal compiler does.
+
+# Function constants
+
+The Constants of [CompileOptions] specialize one source into several pipelines without templating
+it: each [FunctionConstant] sets a constant declared with [[function_constant(n)]], by name or by
+index, to a bool, int, uint, float, half, short, or ushort. The declarations are read from the
+source in Go, so a constant that is not declared, or a value of the wrong type, is reported before
+anything is compiled.
+
+# Pipeline cache
+
+Compiling a pipeline can take far longer than running it. [SetPipelineCache] keeps the pipelines
+that [NewFunction] and [NewFunctionWithOptions] compile as Metal binary archives in a directory,
+so that a later run loads them instead of compiling them again. Pipelines are keyed by a hash of
+the source, the function name, the [CompileOptions], and the GPU and system, and the least
+recently used are removed to keep the cache within [PipelineCacheOptions].MaxBytes. Processes may
+share a directory. A cached pipeline that cannot be used is compiled again and replaced, and a
+problem with the cache only means that the function is compiled without it.
+
+# Function interning
+
+Packages that each set up the same function would each compile its pipeline. With
+[SetFunctionInterning] on, identical calls to [NewFunction], [NewFunctionWithOptions], and
+[NewFunctionFS] (the same source, function name, and [CompileOptions]) share one pipeline: each
+returns its own [*Function], and the pipeline is released when the last of them is closed. [Stats]
+reports how many compilations were avoided.
+
+# Shader files
+
+Runtime compilation cannot resolve #include "common.h", so shaders that share headers would have
+to be concatenated by hand. [NewFunctionFS] reads a shader from an [io/fs.FS], such as an
+[embed.FS], and replaces each quoted include with the file it names, recursively, honouring
+#pragma once and include guards and reporting include cycles. #line directives mark where each
+file begins and ends, so compiler errors give positions in the original files.
+
+# Compile errors
+
+When metal source does not compile, the error wraps a [*CompileError], which [errors.As] can
+extract. Its Diagnostics list each error, warning, and note that the compiler reported as a
+[Diagnostic] with a file, line, column, [Severity], and message, and its Log holds the compiler's
+output as written. Warnings do not stop the source from compiling, so they are kept instead:
+[Function.Diagnostics] and [Library.Diagnostics] return them. On the CPU backend, a compile error
+holds the one problem that the interpreter found.
+
 # Running: synchronous, batched, and asynchronous
 
-There are four ways to dispatch work, trading simplicity for throughput:
+There are five ways to dispatch work, trading simplicity for throughput:
 
   - [Function.Run] encodes one dispatch, commits it, and blocks until the GPU finishes.
     Simplest; results are ready when it returns.
@@ -38,14 +107,43 @@ There are four ways to dispatch work, trading simplicity for throughput:
 
   - [Function.RunAsync] encodes and commits one dispatch but returns a [*RunHandle]
     immediately without waiting, so the CPU is free to encode more work or do other
-    computation while the GPU runs. Call [RunHandle.Wait] exactly once to block for
-    completion; the output buffers are only valid after Wait returns, and the dispatch's
-    buffers must not be closed before then.
+    computation while the GPU runs. Call [RunHandle.Wait] to block for completion; it
+    returns the result at most once, and the command buffer is released whether or not
+    anyone waits. The output buffers are only valid once the work has finished, and the
+    dispatch's buffers must not be closed before then ([RunHandle.Done] is closed).
 
   - [Function.RunBatchAsync] combines the two: it commits a whole batch as one command
     buffer and returns a [*RunHandle] without waiting. A single [RunHandle.Wait] completes
     the entire batch.
 
+  - A [Batch] is a batch whose dispatches can be of different Functions, for chains of
+    kernels such as preprocess → transform → reduce. Add each dispatch with [Batch.Add], then
+    submit them as one command buffer with [Batch.Run] or [Batch.RunAsync]. The dispatches run
+    in order, each seeing what the ones before it wrote.
+
+[Function.RunContext] and [RunHandle.WaitContext] stop waiting when a context is done and return
+its error, so a hung or very long kernel cannot stall the caller indefinitely. The GPU work itself
+is not interrupted: it keeps running, and its command buffer is released in the background once
+it finishes, so its buffers must stay open until then.
+
+A [RunHandle] can also be watched without blocking. [RunHandle.Done] returns a channel that is
+closed when the work finishes, so many dispatches can be selected on alongside other channels
+from one goroutine; [RunHandle.Err] and [RunHandle.Status] report its result and progress, and
+[RunHandle.OnComplete] registers a function to call when it finishes. None of them spend the
+handle. On the GPU they are driven by the command buffer's completion handlers, so no goroutine is
+parked per dispatch.
+
+[WaitAll] waits for many handles at once and joins the errors of the ones that failed, each
+naming its handle's index. [WaitAny] returns the handles one at a time in the order that their
+work finishes, and gives up when a context is done. Both spend only the handles whose results
+they return.
+
+When a dispatch of a batch fails, whether it is invalid, fails to encode, or faults on the GPU,
+the error is a [*BatchError], which [errors.As] retrieves to learn the index of the dispatch, the
+name of its function, and the argument that failed to bind. A command buffer that fails on the GPU
+reports [ErrGPUTimeout], [ErrGPUPageFault], or [ErrGPUOutOfMemory] for [errors.Is], from Run as
+well as from a batch.
+
 Apple recommends minimizing the number of command buffers and avoiding unnecessary CPU/GPU
 synchronization; the batched and async variants exist for workloads where the per-Run round
 trip dominates.
@@ -54,10 +152,41 @@ trip dominates.
 
 [Function.Run], [Function.RunBatch], [Function.RunAsync], and [Function.RunBatchAsync] are
 all safe for concurrent use — multiple goroutines may dispatch on the same [*Function]
-simultaneously. [NewFunction] and [NewBuffer] are also safe for concurrent use.
+simultaneously. [NewFunction] and [NewBuffer] are also safe for concurrent use, and so are
+[Batch.Run] and [Batch.RunAsync], though [Batch.Add] is not.
 [BufferId.Close] and [Function.Close] are NOT safe to call concurrently with a dispatch on
-the same resource; for the async variants this means the buffers must stay open until
-[RunHandle.Wait] returns.
+the same resource; for the async variants this means the buffers must stay open until the
+work has finished, when [RunHandle.Done] is closed.
+
+# CPU backend
+
+When Metal is unavailable (on any platform other than macOS, in a build without cgo, or on a Mac
+without a usable GPU), the package falls back to a CPU backend instead of failing outright.
+[NewFunction] then interprets the metal source with a pure-Go implementation of the subset of the
+Metal Shading Language that simple compute kernels use: scalar and vector arithmetic, the common
+metal_math functions, device and constant pointers, the thread position and grid size attributes,
+loops and conditionals, and local variables. The basic arithmetic operators give the same bits as a
+GPU; math functions such as sin are correctly rounded, which is within the error bounds the
+specification allows a GPU.
+
+A kernel that uses anything else (textures, atomics, threadgroup memory) can run only if a Go
+implementation of it is registered with [RegisterCPUKernel], under the same name as the metal
+function. Struct inputs are the exception: the interpreter does not parse struct declarations and
+a [CPUKernel] cannot receive [RunParameters].Structs, so a kernel that takes one runs only on Metal.
+A registered kernel always takes precedence over the source:
+
+	metal.RegisterCPUKernel("transfer2D", func(tc metal.ThreadContext, inputs []float32, bufs []any) {
+		input, result := bufs[0].([]float32), bufs[1].([]float32)
+		index := tc.Position.X*tc.GridSize.Y + tc.Position.Y
+		result[index] = input[index] + inputs[0]
+	})
+
+Either way, the [*Function] runs once per thread of the grid, spread across goroutines, and accepts
+the same [RunParameters] and [BufferId]s as its GPU counterpart. Buffers are allocated from Go
+memory when Metal is unavailable. Set [CPUOptions].Force with [SetCPUOptions] to use the CPU
+backend even when Metal is available, for example to compare results; such Functions read the
+same Metal buffers as GPU ones. Set [CPUOptions].UniformThreadgroups to reproduce the rounded-up
+over-dispatch of GPUs without non-uniform threadgroup support.
 
 # Buffers and dimensions
 
@@ -75,12 +204,71 @@ the same memory without copying:
 [Fold] partitions by column: Fold(buf, width) produces width sub-slices each of length
 N/width, so grid[x][y] maps to flat index x*(N/width)+y.
 
+# Threadgroups
+
+The grid is divided into threadgroups, whose threads can share threadgroup memory and synchronize
+with each other. By default a threadgroup is [Function.ThreadExecutionWidth] threads wide and as
+many rows tall as [Function.MaxTotalThreadsPerThreadgroup] allows. A kernel that is tiled in two
+dimensions, or that sizes its threadgroup memory for a particular tile, sets
+[RunParameters].Threadgroup to its tile instead. A threadgroup with more threads than the pipeline
+allows is an error before anything is dispatched.
+
+A kernel argument such as threadgroup float *scratch [[threadgroup(0)]] has no length in the
+shader, so [RunParameters].ThreadgroupMemory gives one for each [[threadgroup(i)]] index, in bytes;
+[ThreadgroupMemoryFor] computes the length of an array of a buffer type. Lengths are rounded up to a
+multiple of 16 bytes, and together with any threadgroup memory the function declares itself they
+must fit within the device's limit, which is typically 32 KiB.
+
+# Typed buffers
+
+[NewTypedBuffer] and [NewTypedBufferWith] return a [*Buffer], which keeps a buffer's Id, slice,
+and element type together. Bind it in [RunParameters].Buffers in place of an Id. Once closed, a
+Buffer gives up its slice, so its memory cannot be reached through it, and [AnyBuffer] holds
+buffers of different element types, for example to close them together.
+
+A [BufferRange] binds part of a buffer, so that one large buffer can supply several arguments.
+Its Offset and Length are in bytes; [Buffer.Range] builds one from an element index and count.
+The offset must be a multiple of the element size and the range must lie within the buffer.
+
+# Buffer pools
+
+Allocating a buffer is expensive. Code that creates and closes many short-lived buffers can take
+them from a [BufferPool] with [Get] instead: closing such a buffer returns it to the pool, which
+keeps it in a power-of-two size class and hands it out again, cleared, to the next Get of that
+class. [PoolOptions] cap how much idle memory the pool keeps, [BufferPool.Trim] frees all of it,
+and [BufferPool.Stats] reports hits, misses, and the memory retained.
+
 # Static scalar inputs
 
 [RunParameters].Inputs passes constant scalar values to the shader without allocating a
 buffer. They are passed as the first arguments to the kernel, before the buffers. Go always
 sends them as float32 bits; the Metal shader's parameter type governs interpretation.
 
+[RunParameters].Scalars is the typed alternative. Each [Scalar], made with [Int32], [Uint32],
+[Float32], [Int16], [Uint16], or [Half], is sent with the byte width and encoding of its Metal
+type, so a constant uint* parameter receives Uint32(5) as the integer 5. Set Inputs or Scalars,
+not both.
+
+[RunParameters].Structs passes Go structs to kernel parameters such as constant Params &p. Each
+one is laid out as Metal lays out the matching MSL struct, following Metal's alignment rules: a
+float2 field is aligned to 8 bytes, a float3 or float4 to 16, and a packed_float3 takes 12 bytes
+aligned to 4. An array of 2 to 4 scalars is a vector, and a metal struct tag names a type Go
+cannot express, such as `metal:"half"` or `metal:"packed_float3"`. The struct is bound as a single
+argument after the inputs. Struct inputs need the Metal backend; the CPU backend fails a dispatch
+that sets them.
+
+# Function arguments
+
+[Function.Arguments] describes each parameter of a kernel: the index it is bound at, its name,
+element type, and address space, whether it is a pointer, and its attribute. Tools can use it to
+print a kernel's interface, check arguments before a run, or generate bindings. On the GPU the
+indexes and element types of buffer arguments come from the compiled pipeline's reflection data;
+everything else, and everything on the CPU backend, comes from parsing the kernel's signature.
+
+Set [RunParameters].Validate to check a dispatch against those arguments before it runs. Without
+it, binding too few buffers, or an int16 buffer to a device float* parameter, gives wrong results
+and no error; with it, the dispatch fails with an [*ArgumentError] naming the offending argument.
+
 # Types
 
 This is the mapping of Go types to Metal types:
@@ -96,8 +284,10 @@ This is the mapping of Go types to Metal types:
 
 # Limitations
 
-  - macOS only. The package does not compile on other platforms (all files are
-    constrained to //go:build darwin).
+  - GPU execution is macOS only. The package compiles on every platform, but elsewhere
+    [Available] reports [ErrMetalUnavailable], so callers can branch on Available instead of
+    keeping their own build-tag shims. There, functions run on the CPU backend, which supports
+    only a subset of the Metal Shading Language.
   - Requires a Metal-capable GPU. On hardware with non-uniform threadgroup support
     (Apple4 and later, or the Mac2 family) the grid is dispatched exactly; on other
     Metal GPUs it falls back to rounded-up threadgroup dispatch, and kernels must
@@ -106,7 +296,8 @@ This is the mapping of Go types to Metal types:
     buffers are not supported.
   - Only compute kernels are supported (kernel void functions). Vertex and fragment
     shaders are not.
-  - MSL source is compiled at runtime. Pre-compiled .metallib files are not supported.
+  - The CPU backend cannot run the compiled code in a .metallib file. Functions from a [Library]
+    are available there only for the kernels registered with [RegisterCPUKernel].
 
 # Resources
 
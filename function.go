@@ -1,19 +1,16 @@
-//go:build darwin
-
 package metal
 
-/*
-#cgo CFLAGS: -fobjc-arc
-#cgo LDFLAGS: -framework Metal -framework Foundation
-#include "Metal.h"
-*/
-import "C"
-
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/fs"
 	"math"
-	"runtime"
-	"unsafe"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/green-aloe/metal/internal/msl"
 )
 
 // ----------------------------------------------------------------------------
@@ -25,28 +22,14 @@ import (
 // a sandbox that blocks GPU access). Use errors.Is to test for it.
 var ErrMetalUnavailable = errors.New("metal is not available on this system")
 
-// metalAvailable reports whether metal_init succeeded at package load time. It
-// is written once in init (before any other goroutine can run) and only read
-// afterward, so it needs no synchronization.
-var metalAvailable bool
-
-func init() {
-	// Initialize the device that will be used to run the computations. A failure
-	// here is not fatal: the package degrades to returning ErrMetalUnavailable
-	// from its public functions so importing it on an unsupported machine does
-	// not abort the process.
-	metalAvailable = bool(C.metal_init())
-}
-
 // Available reports whether Metal was successfully initialized and the package
-// can run computations on the GPU. If it returns an error, every other call
-// into the package will fail with that same error; callers that want to degrade
-// gracefully (for example, to a CPU implementation) should check this first.
+// can run computations on the GPU. If it returns an error, every call that needs
+// the GPU will fail with that same error; callers that want to degrade gracefully
+// should check this first, either to take their own fallback path or to rely on
+// the kernels they registered with RegisterCPUKernel. On platforms other than
+// macOS, and in a build without cgo, it always returns ErrMetalUnavailable.
 func Available() error {
-	if !metalAvailable {
-		return ErrMetalUnavailable
-	}
-	return nil
+	return defaultBackend.available()
 }
 
 // ----------------------------------------------------------------------------
@@ -56,42 +39,109 @@ func Available() error {
 var ErrInvalidFunctionId = errors.New("invalid function id")
 
 // A Function references a specific metal function.
-// It is used to run computational processes on the GPU.
+// It is used to run computational processes on the GPU, or on the CPU backend when Metal is
+// unavailable or CPUOptions.Force is set.
 type Function struct {
 	id int32
+	b  backend
+
+	// source, name, and opts are kept to describe the function's arguments, which are cached in
+	// args. The options, the cache, and the compiler's diagnostics are held by pointer so that a
+	// Function stays comparable.
+	source      string
+	name        string
+	opts        *CompileOptions
+	args        *argumentCache
+	diagnostics *[]Diagnostic
+
+	// shared is the pipeline that f shares with other Functions if it was interned, or nil if f holds
+	// its pipeline on its own.
+	shared *sharedPipeline
+}
+
+// An argumentCache holds a function's arguments once they have been described.
+type argumentCache struct {
+	once sync.Once
+	args []Argument
+	err  error
 }
 
 // NewFunction sets up a new function that will run on the default GPU. It is built with the
 // specified function in the provided metal code. This needs to be called only once for every
-// function that will be run. It returns ErrMetalUnavailable if Metal could not be initialized.
+// function that will be run.
+//
+// If Metal could not be initialized, or if CPUOptions.Force is set, the function is instead built on
+// the CPU backend from the kernel registered for funcName with RegisterCPUKernel. If Metal is
+// unavailable and no kernel is registered, the error matches ErrMetalUnavailable.
+//
+// If the source does not compile, the error wraps a *CompileError that lists the compiler's
+// diagnostics; use errors.As to get it.
 func NewFunction(metalSource, funcName string) (*Function, error) {
-	if err := Available(); err != nil {
-		return nil, err
-	}
+	return NewFunctionWithOptions(metalSource, funcName, CompileOptions{})
+}
 
-	src := C.CString(metalSource)
-	defer C.free(unsafe.Pointer(src))
+// NewFunctionWithOptions sets up a new function as NewFunction does, compiling the metal code with
+// the provided options. The options are checked before anything is compiled: an unknown language
+// version or math mode, a macro name that is not an identifier, or a function constant that the
+// source does not declare with the type of its value, is an error on every backend.
+func NewFunctionWithOptions(metalSource, funcName string, opts CompileOptions) (*Function, error) {
+	if err := opts.validate(); err != nil {
+		return nil, newError(err.Error(), "unable to set up metal function", errCodeNone)
+	}
+	o := opts.clone()
+	if err := o.specialize(metalSource); err != nil {
+		return nil, newError(err.Error(), "unable to set up metal function", errCodeNone)
+	}
 
-	name := C.CString(funcName)
-	defer C.free(unsafe.Pointer(name))
+	b := functionBackend()
+	if err := b.available(); err != nil {
+		return nil, err
+	}
 
-	// The C side may strdup an error message into err on failure; we must free it.
-	var err *C.char
-	defer func() { freeCString(err) }()
+	if interned.enabled.Load() {
+		return interned.function(b, metalSource, funcName, o)
+	}
+	return compileFunction(b, metalSource, funcName, o)
+}
 
-	id := int32(C.function_new(src, name, &err))
-	if id == 0 {
-		// NewFunction failures (missing source, MSL compile error, function not found) are not
-		// invalid-handle conditions, so the code is errCodeNone and no sentinel is attached: the
-		// handle does not exist yet.
-		return nil, metalErrToError(err, "unable to set up metal function", errCodeNone)
+// compileFunction compiles funcName in source with opts on b, whose options have already been
+// checked, and returns a Function that holds the pipeline on its own.
+func compileFunction(b backend, source, funcName string, opts *CompileOptions) (*Function, error) {
+	id, diagnostics, err := b.newFunction(source, funcName, opts)
+	if err != nil {
+		return nil, err
 	}
+	interned.countCompilation()
 
 	return &Function{
-		id: id,
+		id:          id,
+		b:           b,
+		source:      source,
+		name:        funcName,
+		opts:        opts,
+		args:        &argumentCache{},
+		diagnostics: &diagnostics,
 	}, nil
 }
 
+// NewFunctionFS sets up a new function as NewFunction does, from the metal code in the file at path
+// in fsys, such as an embed.FS. Runtime compilation cannot find the files named by #include
+// directives, so quoted ones are resolved against fsys first: each is looked for relative to the
+// file that includes it and then relative to the root of fsys, recursively. Includes of system
+// headers, such as #include <metal_stdlib>, are left to the compiler.
+//
+// A file that includes itself, directly or through other files, is an error unless it uses
+// #pragma once or an include guard, which are both honoured. The included files are marked with
+// #line directives, so the positions in compiler errors are in the files they come from.
+func NewFunctionFS(fsys fs.FS, path, funcName string) (*Function, error) {
+	source, err := msl.ResolveIncludes(fsys, path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up metal function: %w", err)
+	}
+
+	return NewFunction(source, funcName)
+}
+
 // Valid checks whether or not the function is valid and can be used to run a computational process
 // on the GPU.
 func (f *Function) Valid() bool {
@@ -110,29 +160,121 @@ func (f *Function) String() string {
 		return ""
 	}
 
-	// function_name strdup's the result; we must free it.
-	name := C.function_name(C.int(f.id))
-	defer freeCString(name)
+	return f.backend().functionName(f.id)
+}
+
+// Diagnostics returns the warnings and notes that the compiler reported for the function's source,
+// which does not stop it from compiling. It returns nil if there were none, or if the function is
+// not valid. Errors that stop the source from compiling are returned as a *CompileError instead.
+func (f *Function) Diagnostics() []Diagnostic {
+	if !f.Valid() || f.diagnostics == nil {
+		return nil
+	}
+
+	return slices.Clone(*f.diagnostics)
+}
+
+// ThreadExecutionWidth returns the number of threads that the GPU runs in lockstep for the function's
+// pipeline (the SIMD group width). A threadgroup whose width is a multiple of it keeps every SIMD
+// group full. It returns 0 if the function is not valid. On the CPU backend, it is
+// CPUOptions.ThreadExecutionWidth.
+func (f *Function) ThreadExecutionWidth() int {
+	limits, _ := f.limits()
+	return limits.threadExecutionWidth
+}
+
+// MaxTotalThreadsPerThreadgroup returns the most threads that one threadgroup of the function's
+// pipeline may have, which can be less than the device's limit for a kernel that uses many
+// registers or much threadgroup memory. It returns 0 if the function is not valid. On the CPU
+// backend, it is CPUOptions.MaxTotalThreadsPerThreadgroup.
+func (f *Function) MaxTotalThreadsPerThreadgroup() int {
+	limits, _ := f.limits()
+	return limits.maxTotalThreadsPerThreadgroup
+}
+
+// limits returns the limits of the function's pipeline, or false if the function is not valid.
+func (f *Function) limits() (pipelineLimits, bool) {
+	if !f.Valid() {
+		return pipelineLimits{}, false
+	}
+
+	return f.backend().limits(f.id)
+}
+
+// Arguments describes the parameters of the metal function, in declaration order. On the GPU, the
+// index and element type of each argument that is bound to memory come from the compiled pipeline's
+// reflection data; everything else comes from parsing the function's signature in its source. On
+// the CPU backend, all of it comes from the source.
+//
+// The source is first run through a preprocessor with the function's CompileOptions, so parameters
+// declared through macros are described as the compiler sees them. If the source cannot be
+// preprocessed, the signature is parsed from it as written. If the signature cannot be parsed, the
+// arguments reflected from the pipeline are returned on their own; they include only the arguments
+// bound to memory, and a const device argument is reported as constant.
+func (f *Function) Arguments() ([]Argument, error) {
+	if !f.Valid() {
+		return nil, ErrInvalidFunctionId
+	}
+
+	args, err := f.arguments()
+	if err != nil {
+		return nil, err
+	}
 
-	return C.GoString(name)
+	return slices.Clone(args), nil
+}
+
+// arguments describes the function's arguments the first time it is called and returns the same
+// result every time after that. The returned slice must not be modified.
+func (f *Function) arguments() ([]Argument, error) {
+	c := f.args
+	if c == nil {
+		c = &argumentCache{}
+	}
+
+	c.once.Do(func() {
+		reflected, err := f.backend().arguments(f.id)
+		if err != nil {
+			c.err = err
+			return
+		}
+
+		source, err := f.opts.preprocess(f.source)
+		if err != nil {
+			source = f.source
+		}
+
+		parsed, err := parseArguments(source, f.name)
+		switch {
+		case err == nil:
+			c.args = mergeArguments(parsed, reflected)
+		case reflected != nil:
+			c.args = reflected
+		default:
+			c.err = newError(err.Error(), "unable to get metal function arguments", errCodeNone)
+		}
+	})
+
+	return c.args, c.err
 }
 
 // Close releases the compiled pipeline for this function. The Function becomes invalid after this
 // call. It is the caller's responsibility to ensure no concurrent Run or String calls are in
-// progress.
+// progress. If the function was interned (see SetFunctionInterning), the pipeline is released only
+// when the last Function that shares it is closed.
 func (f *Function) Close() error {
 	if f == nil || !f.Valid() {
 		return ErrInvalidFunctionId
 	}
 
-	// The C side may strdup an error message into err on failure; we must free it. It also
-	// categorizes the failure in code so metalErrToError can attach the matching sentinel.
-	var err *C.char
-	defer func() { freeCString(err) }()
-	var code C.int
-
-	if !C.function_close(C.int(f.id), &err, &code) {
-		return metalErrToError(err, "unable to close metal function", code)
+	var err error
+	if f.shared != nil {
+		err = interned.release(f)
+	} else {
+		err = f.backend().closeFunction(f.id)
+	}
+	if err != nil {
+		return err
 	}
 
 	f.id = 0
@@ -179,27 +321,82 @@ type Grid struct {
 type RunParameters struct {
 	// Grid that defines the dimensions of the buffers used to run the computation.
 	Grid Grid
+	// Threadgroup is the size of each threadgroup that the grid is divided into. Its total number of
+	// threads, X*Y*Z, may be at most the function's MaxTotalThreadsPerThreadgroup, and a
+	// dimension of 0 is treated as 1. Kernels that are tiled in two dimensions, or that size their
+	// threadgroup memory for a particular tile, should set it to their tile. If it is left zero, the
+	// threadgroup is ThreadExecutionWidth threads wide and as many rows tall as the limit allows.
+	Threadgroup Grid
+	// ThreadgroupMemory holds the length in bytes of each threadgroup memory argument, such as
+	// threadgroup float *scratch [[threadgroup(0)]]: element i is the length for [[threadgroup(i)]],
+	// and a length of 0 leaves its index unset. Every length is rounded up to a multiple of 16
+	// bytes, as Metal requires, and together with the threadgroup memory that the function declares
+	// itself they may be at most the device's limit (typically 32 KiB). ThreadgroupMemoryFor gives
+	// the length of an array of a buffer type. The CPU backend checks the lengths but cannot run
+	// kernels that use threadgroup memory unless they are registered with RegisterCPUKernel.
+	ThreadgroupMemory []int
 	// List of static inputs that are used to run the computation. These are not indexed by position
 	// in the grid like the buffers are but are instead used as constants for every iteration. They
 	// are supplied as the first arguments to the metal function in the order given here.
+	//
+	// Each input is passed as the 4 bytes of a float32, whatever the type of the kernel's parameter,
+	// so an integer parameter receives the float's bits rather than its value. Use Scalars instead to
+	// pass inputs of other types.
 	Inputs []float32
+	// List of typed static inputs, used in place of Inputs: at most one of the two may be set. Each
+	// scalar is supplied as its own argument with the byte width of its type, in the order given
+	// here and before the buffers, just like Inputs.
+	Scalars []Scalar
+	// List of struct values, or pointers to them, for kernel parameters such as constant Params &p.
+	// Each struct is laid out as Metal lays out the matching MSL struct, with every field at the
+	// offset its alignment requires, and is supplied as a single argument after the inputs and
+	// before the buffers. A struct may be at most 4096 bytes; pass larger data in a buffer.
+	//
+	// Fields map to Metal types by their Go types: float32 to float, int32 to int, uint32 to uint,
+	// int16 to short, uint16 to ushort, int8 to char, uint8 to uchar, and bool to bool. An array of 2
+	// to 4 of these is a vector, such as [4]float32 for a float4 (aligned to 16 bytes) or [3]float32
+	// for a float3 (16 bytes, including padding), and any other array is an array. Nested structs are
+	// laid out recursively. A metal struct tag names the Metal type instead, which is needed for
+	// `metal:"half"` (on a uint16), packed vectors such as `metal:"packed_float3"` (on a [3]float32,
+	// 12 bytes and aligned to 4), and arrays of vectors such as `metal:"float2"` on a [4][2]float32.
+	// A field tagged `metal:"-"` is skipped.
+	//
+	// Struct inputs need the Metal backend. The CPU backend can neither interpret a kernel that
+	// declares a struct nor pass one to a CPUKernel, so it fails a dispatch that sets Structs.
+	Structs []any
 	// List of buffer Ids that are used to retrieve the correct block of memory for the buffers. The
 	// buffers are indexed by position in the grid. They are supplied as arguments to the metal
 	// function after the inputs in the order given here.
 	BufferIds []BufferId
-}
-
-// A RunHandle represents an in-flight asynchronous dispatch started by RunAsync or RunBatchAsync.
-// Call Wait exactly once to block until the GPU finishes and release the underlying command buffer.
-// A RunHandle must not be used after Wait returns.
-type RunHandle struct {
-	handle unsafe.Pointer
+	// List of buffers, used in place of BufferIds: at most one of the two may be set. Each element
+	// is a *Buffer, a BufferId, or a BufferRange, and the buffers are supplied in the order given
+	// here, just like BufferIds. A closed *Buffer is reported like a closed BufferId, and a buffer
+	// that is not open is reported before anything is dispatched, whatever the backend.
+	Buffers []BufferBinding
+	// Validate checks the inputs and buffers against the function's arguments (see
+	// Function.Arguments) before dispatching: the number supplied, that inputs are bound only to
+	// arguments the kernel only reads, constant or device const, and that each one holds a whole
+	// number of elements of the type the kernel expects. A mismatch is reported as an
+	// *ArgumentError and nothing is dispatched. Validation costs a check of every argument, so it
+	// is off by default.
+	Validate bool
 }
 
 // ----------------------------------------------------------------------------
 // Dispatch: synchronous, batched, and asynchronous
 // ----------------------------------------------------------------------------
 
+// The errors that a run returns, or its RunHandle reports, when its command buffer fails on the
+// GPU. Use errors.Is to test for them.
+var (
+	// ErrGPUTimeout means that the command buffer ran for too long and the GPU stopped it.
+	ErrGPUTimeout = errors.New("gpu timed out")
+	// ErrGPUPageFault means that a kernel accessed memory outside of its buffers.
+	ErrGPUPageFault = errors.New("gpu page fault")
+	// ErrGPUOutOfMemory means that the GPU ran out of memory for the command buffer.
+	ErrGPUOutOfMemory = errors.New("gpu out of memory")
+)
+
 // Run executes the computational function on the GPU. This can be called multiple times for the
 // same Function Id and/or same buffers and is safe for concurrent use.
 //
@@ -212,37 +409,35 @@ type RunHandle struct {
 // kernel must bounds-check its thread position against the real problem size before indexing a
 // buffer.
 func (f *Function) Run(params RunParameters) error {
-	if err := Available(); err != nil {
+	b := f.backend()
+	if err := b.available(); err != nil {
 		return err
 	}
 
-	width, height, depth, inputsPtr, bufferIdsPtr, err := params.prepare()
+	d, err := f.dispatch(params)
 	if err != nil {
 		return err
 	}
 
-	// The C side may strdup an error message into cErr on failure; we must free it. It also
-	// categorizes the failure in code (invalid function id vs. invalid buffer id) so
-	// metalErrToError can attach the matching sentinel.
-	var cErr *C.char
-	defer func() { freeCString(cErr) }()
-	var code C.int
-
 	// Run the computation on the GPU.
-	ok := C.function_run(C.int(f.id), width, height, depth, inputsPtr, C.int(len(params.Inputs)), bufferIdsPtr, C.int(len(params.BufferIds)), &cErr, &code)
+	return b.run(d)
+}
 
-	// Keep the input and buffer-id slices alive until function_run returns. The C call reads through
-	// inputsPtr/bufferIdsPtr (raw pointers into the slice backing arrays), which the Go garbage
-	// collector cannot see; without these the collector would be free to reclaim the slices while
-	// the GPU is still reading them.
-	runtime.KeepAlive(params.Inputs)
-	runtime.KeepAlive(params.BufferIds)
+// RunContext is like Run, but gives up waiting when ctx is done and returns ctx.Err(). If ctx is
+// already done, nothing is dispatched. Otherwise the dispatch keeps running after RunContext gives
+// up, and its command buffer is released in the background once it finishes. Its buffers must stay
+// open until then; to be able to wait for that, use RunAsync and RunHandle.WaitContext instead.
+func (f *Function) RunContext(ctx context.Context, params RunParameters) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	if !ok {
-		return metalErrToError(cErr, "unable to run metal function", code)
+	h, err := f.RunAsync(params)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return h.WaitContext(ctx)
 }
 
 // RunBatch executes several dispatches of this function as a single GPU command buffer. Every
@@ -253,243 +448,294 @@ func (f *Function) Run(params RunParameters) error {
 //
 // All dispatches share one command buffer, so they are not isolated: if any dispatch fails to encode
 // (invalid buffer id, invalid grid), nothing is committed and RunBatch returns that dispatch's error.
-// An empty params is a no-op that returns nil.
+// An empty params is a no-op that returns nil. Every error of a dispatch, whether it is found
+// before the batch is encoded or on the GPU, is a *BatchError that says which dispatch failed.
 //
 // Like Run, RunBatch is safe for concurrent use and blocks until the GPU finishes. The grid and
-// over-dispatch semantics for each dispatch are identical to Run.
+// over-dispatch semantics for each dispatch are identical to Run. To run dispatches of several
+// functions as one command buffer, use a Batch.
 func (f *Function) RunBatch(params []RunParameters) error {
-	if err := Available(); err != nil {
+	b := f.backend()
+	if err := b.available(); err != nil {
 		return err
 	}
 	if len(params) == 0 {
 		return nil
 	}
 
-	var pinner runtime.Pinner
-	defer pinner.Unpin()
-
-	args, err := f.marshalBatch(params, &pinner)
+	ds, err := f.dispatches(params)
 	if err != nil {
 		return err
 	}
 
-	var cErr *C.char
-	defer func() { freeCString(cErr) }()
-	var code C.int
-
-	ok := C.function_run_batch(C.int(len(params)), &args.functionIds[0], &args.widths[0], &args.heights[0],
-		&args.depths[0], &args.inputs[0], &args.numInputs[0], &args.bufferIds[0], &args.numBufferIds[0], &cErr, &code)
-
-	if !ok {
-		return metalErrToError(cErr, "unable to run metal function batch", code)
-	}
-
-	return nil
+	return b.runBatch(ds)
 }
 
 // RunAsync encodes and commits a dispatch like Run but returns immediately without waiting for the
 // GPU to finish, so the caller can keep the CPU busy (encoding more work, doing CPU computation)
-// while the GPU runs. The returned RunHandle must be passed to Wait exactly once to block for
-// completion; the results in the output buffers are only valid after Wait returns.
+// while the GPU runs. Wait on the returned RunHandle, or watch its Done channel, to learn when the
+// dispatch has finished; the results in the output buffers are only valid after that. Wait returns
+// the result at most once, and the command buffer is released whether or not anyone waits.
 //
-// The buffers referenced by params.BufferIds must not be closed until Wait has returned, since the
-// GPU reads and writes their shared memory while the dispatch is in flight. params.Inputs, by
-// contrast, are copied during the call and need not outlive it.
+// The buffers referenced by params.BufferIds or params.Buffers must not be closed until the work
+// has finished (Done is closed), since the GPU reads and writes their shared memory while the
+// dispatch is in flight.
+// params.Inputs, params.Scalars, and params.Structs, by contrast, are copied during the call and
+// need not outlive it.
 //
 // RunAsync is safe for concurrent use. The grid and over-dispatch semantics are identical to Run.
 func (f *Function) RunAsync(params RunParameters) (*RunHandle, error) {
-	if err := Available(); err != nil {
+	b := f.backend()
+	if err := b.available(); err != nil {
 		return nil, err
 	}
 
-	width, height, depth, inputsPtr, bufferIdsPtr, err := params.prepare()
+	d, err := f.dispatch(params)
 	if err != nil {
 		return nil, err
 	}
 
-	var cErr *C.char
-	defer func() { freeCString(cErr) }()
-	var code C.int
-	var handle unsafe.Pointer
-
-	ok := C.function_run_async(C.int(f.id), width, height, depth, inputsPtr, C.int(len(params.Inputs)),
-		bufferIdsPtr, C.int(len(params.BufferIds)), &handle, &cErr, &code)
-
-	// Keep the slices alive through encoding (which happens synchronously inside the C call). After
-	// the call returns the dispatch is fully encoded: inputs were copied via setBytes, and the
-	// buffers are referenced from the command buffer and held alive by the buffer cache.
-	runtime.KeepAlive(params.Inputs)
-	runtime.KeepAlive(params.BufferIds)
-
-	if !ok {
-		return nil, metalErrToError(cErr, "unable to run metal function asynchronously", code)
+	h := newRunHandle()
+	if err := b.runAsync(d, h); err != nil {
+		return nil, err
 	}
 
-	return &RunHandle{handle: handle}, nil
+	return h, nil
 }
 
 // RunBatchAsync is the asynchronous counterpart of RunBatch: it encodes every dispatch into a single
 // command buffer and commits it, but returns a RunHandle immediately instead of waiting. Because the
-// whole batch is one command buffer, the single returned handle covers all of it — call Wait exactly
-// once to block until every dispatch in the batch has finished.
+// whole batch is one command buffer, the single returned handle covers all of it: its Wait and Done
+// report on every dispatch in the batch. As with RunAsync, Wait returns the result at most once, and
+// the command buffer is released whether or not anyone waits.
 //
 // As with RunBatch, the dispatches are not isolated: if any one fails to encode, nothing is committed
 // and RunBatchAsync returns that dispatch's error with a nil handle. An empty params returns a nil
 // handle and nil error (there is nothing to wait on). As with RunAsync, the referenced buffers must
-// not be closed until Wait has returned.
+// not be closed until the work has finished (Done is closed).
 //
 // RunBatchAsync is safe for concurrent use.
 func (f *Function) RunBatchAsync(params []RunParameters) (*RunHandle, error) {
-	if err := Available(); err != nil {
+	b := f.backend()
+	if err := b.available(); err != nil {
 		return nil, err
 	}
 	if len(params) == 0 {
 		return nil, nil
 	}
 
-	var pinner runtime.Pinner
-	defer pinner.Unpin()
-
-	args, err := f.marshalBatch(params, &pinner)
+	ds, err := f.dispatches(params)
 	if err != nil {
 		return nil, err
 	}
 
-	var cErr *C.char
-	defer func() { freeCString(cErr) }()
-	var code C.int
-	var handle unsafe.Pointer
+	h := newRunHandle()
+	if err := b.runBatchAsync(ds, h); err != nil {
+		return nil, err
+	}
 
-	ok := C.function_run_batch_async(C.int(len(params)), &args.functionIds[0], &args.widths[0], &args.heights[0],
-		&args.depths[0], &args.inputs[0], &args.numInputs[0], &args.bufferIds[0], &args.numBufferIds[0], &handle, &cErr, &code)
+	return h, nil
+}
 
-	if !ok {
-		return nil, metalErrToError(cErr, "unable to run metal function batch asynchronously", code)
-	}
+// ----------------------------------------------------------------------------
+// Internal dispatch helpers
+// ----------------------------------------------------------------------------
 
-	return &RunHandle{handle: handle}, nil
+// backend returns the backend that f was created on. A zero Function has no backend of its own, so
+// it uses the one NewFunction would choose; its invalid id is then reported the same way as any
+// other.
+func (f *Function) backend() backend {
+	if f.b != nil {
+		return f.b
+	}
+	return functionBackend()
 }
 
-// Wait blocks until the asynchronous work behind this handle finishes on the GPU and releases the
-// underlying command buffer. It must be called exactly once per RunHandle returned by RunAsync or
-// RunBatchAsync; calling it twice, or on a zero-value handle, returns an error rather than crashing.
-// For a RunBatchAsync handle the single Wait covers the entire batch. After Wait returns, the output
-// buffers hold the results.
-func (h *RunHandle) Wait() error {
-	if h == nil || h.handle == nil {
-		return errors.New("invalid run handle")
+// dispatch validates the grid and inputs and returns the backend's view of these parameters for the
+// function with the given id. Inputs are converted to scalars and Buffers to their Ids, and the
+// returned dispatch shares the Scalars and BufferIds backing arrays rather than copying them.
+func (params RunParameters) dispatch(functionId int32) (d dispatch, err error) {
+	// Every dimension must be at least one unit long. A zero dimension is a convenience for "unused"
+	// and clamps to 1; a negative dimension is a caller bug.
+	if d.width, err = gridDimension(params.Grid.X); err != nil {
+		return dispatch{}, err
+	}
+	if d.height, err = gridDimension(params.Grid.Y); err != nil {
+		return dispatch{}, err
+	}
+	if d.depth, err = gridDimension(params.Grid.Z); err != nil {
+		return dispatch{}, err
 	}
 
-	var cErr *C.char
-	defer func() { freeCString(cErr) }()
+	switch {
+	case len(params.Inputs) > 0 && len(params.Scalars) > 0:
+		return dispatch{}, errors.New("cannot set both Inputs and Scalars")
+	case len(params.Inputs) > 0:
+		d.inputs = make([]Scalar, len(params.Inputs))
+		for i, input := range params.Inputs {
+			d.inputs[i] = Float32(input)
+		}
+	default:
+		for _, s := range params.Scalars {
+			if !s.valid() {
+				return dispatch{}, errors.New("invalid scalar input")
+			}
+		}
+		d.inputs = params.Scalars
+	}
 
-	ok := C.function_wait(h.handle, &cErr)
+	if len(params.Structs) > 0 {
+		d.structs = make([][]byte, len(params.Structs))
+		for i, v := range params.Structs {
+			b, err := packStruct(v)
+			if err != nil {
+				return dispatch{}, fmt.Errorf("invalid struct input %d: %w", i, err)
+			}
+			if len(b) > maxInputBytes {
+				return dispatch{}, fmt.Errorf("invalid struct input %d: %d bytes is larger than the %d-byte limit", i, len(b), maxInputBytes)
+			}
+			d.structs[i] = b
+		}
+	}
+
+	d.functionId = functionId
+	switch {
+	case len(params.BufferIds) > 0 && len(params.Buffers) > 0:
+		return dispatch{}, errors.New("cannot set both BufferIds and Buffers")
+	case len(params.Buffers) > 0:
+		d.bufferIds = make([]BufferId, len(params.Buffers))
+		for i, buffer := range params.Buffers {
+			if buffer == nil {
+				return dispatch{}, errors.New("invalid nil buffer")
+			}
+
+			r := buffer.binding()
+			d.bufferIds[i] = r.Id
+			entry, err := d.openBuffer(i)
+			if err != nil {
+				return dispatch{}, err
+			}
+			if r.Offset == 0 && r.Length == 0 {
+				continue
+			}
+
+			span, err := r.span(entry)
+			if err != nil {
+				return dispatch{}, fmt.Errorf("invalid range for buffer %d: %w", i+1, err)
+			}
+			if d.spans == nil {
+				d.spans = make([]bufferSpan, len(params.Buffers))
+			}
+			d.spans[i] = span
+		}
+	default:
+		d.bufferIds = params.BufferIds
+		for i := range d.bufferIds {
+			if _, err := d.openBuffer(i); err != nil {
+				return dispatch{}, err
+			}
+		}
+	}
 
-	// Clear the handle so a second Wait is a safe no-op error rather than a double free of the
-	// command buffer (function_wait took ownership of the retain via __bridge_transfer).
-	h.handle = nil
+	return d, nil
+}
 
+// openBuffer returns the record of the ith buffer of d, or a *closedBufferError if it is not open.
+// Every backend gets only open buffers: one may still hold the memory of a closed Id, such as one
+// whose pooled buffer went back to its pool, which the next Get hands out again.
+func (d dispatch) openBuffer(i int) (bufferEntry, error) {
+	id := d.bufferIds[i]
+	entry, ok := lookupBuffer(id)
 	if !ok {
-		return metalErrToError(cErr, "unable to wait for metal function", errCodeNone)
+		msg := fmt.Sprintf("buffer %d/%d is not open: invalid buffer id: %d", i+1, len(d.bufferIds), id)
+		return bufferEntry{}, &closedBufferError{argument: d.bufferArgument(i), msg: msg}
 	}
 
-	return nil
+	return entry, nil
 }
 
-// ----------------------------------------------------------------------------
-// Internal dispatch helpers
-// ----------------------------------------------------------------------------
-
-// prepare validates the grid and returns the C-typed grid dimensions plus pointers into the Inputs
-// and BufferIds backing arrays. float32/C.float and int32/C.int are binary compatible on all Apple
-// platforms, so the slices are cast directly without copying. The returned pointers are only valid
-// while the caller keeps params.Inputs and params.BufferIds alive (see runtime.KeepAlive at the
-// call sites).
-func (params RunParameters) prepare() (width, height, depth C.uint, inputsPtr *C.float, bufferIdsPtr *C.int, err error) {
-	// Every dimension must be at least one unit long. A zero dimension is a convenience for "unused"
-	// and clamps to 1; a negative dimension is a caller bug.
-	if width, err = gridDimension(params.Grid.X); err != nil {
-		return
+// dispatch validates params and returns the backend's view of them for this function, with the
+// threadgroup size chosen within the function's limits. If params.Validate is set, the inputs and
+// buffers are also checked against the function's arguments.
+func (f *Function) dispatch(params RunParameters) (dispatch, error) {
+	d, err := params.dispatch(f.id)
+	if err != nil {
+		return dispatch{}, err
 	}
-	if height, err = gridDimension(params.Grid.Y); err != nil {
-		return
+
+	// A function that is not valid is left for the backend to report, with the default threadgroup.
+	limits, _ := f.limits()
+	if d.threadgroup, err = threadgroupSize(params.Threadgroup, limits); err != nil {
+		return dispatch{}, err
 	}
-	if depth, err = gridDimension(params.Grid.Z); err != nil {
-		return
+	if d.threadgroupMemory, err = threadgroupMemory(params.ThreadgroupMemory, limits); err != nil {
+		return dispatch{}, err
 	}
 
-	if len(params.Inputs) > 0 {
-		inputsPtr = (*C.float)(unsafe.Pointer(&params.Inputs[0]))
-	}
-	if len(params.BufferIds) > 0 {
-		bufferIdsPtr = (*C.int)(unsafe.Pointer(&params.BufferIds[0]))
+	if params.Validate {
+		if err := f.validate(d, params.Structs, limits); err != nil {
+			return dispatch{}, err
+		}
 	}
 
-	return
+	return d, nil
 }
 
-// batchArgs holds the parallel C arrays that the batch entry points read, one element per dispatch.
-type batchArgs struct {
-	functionIds  []C.int
-	widths       []C.uint
-	heights      []C.uint
-	depths       []C.uint
-	inputs       []*C.float
-	numInputs    []C.int
-	bufferIds    []*C.int
-	numBufferIds []C.int
-}
+// validate checks the inputs and buffers of d, whose struct inputs were packed from structs,
+// against the function's arguments and the constant offset alignment in its limits.
+func (f *Function) validate(d dispatch, structs []any, limits pipelineLimits) error {
+	if !f.Valid() {
+		return nil
+	}
 
-// marshalBatch validates every dispatch and builds the parallel C arrays for the batch entry points.
-//
-// inputs[i] and bufferIds[i] are Go pointers into each RunParameters' slice backing arrays, and they
-// are stored inside Go slices that are then passed to C by address. cgo forbids handing C a Go
-// pointer that points at memory containing other (unpinned) Go pointers, so each inner pointer is
-// pinned via pinner. Pinning also keeps the backing arrays alive for the call, so no separate
-// runtime.KeepAlive is needed. The caller owns pinner and must Unpin it once the C call returns.
-func (f *Function) marshalBatch(params []RunParameters, pinner *runtime.Pinner) (batchArgs, error) {
-	n := len(params)
-	args := batchArgs{
-		functionIds:  make([]C.int, n),
-		widths:       make([]C.uint, n),
-		heights:      make([]C.uint, n),
-		depths:       make([]C.uint, n),
-		inputs:       make([]*C.float, n),
-		numInputs:    make([]C.int, n),
-		bufferIds:    make([]*C.int, n),
-		numBufferIds: make([]C.int, n),
+	args, err := f.arguments()
+	if err != nil {
+		return err
 	}
 
-	for i := range params {
-		width, height, depth, inputsPtr, bufferIdsPtr, err := params[i].prepare()
+	bound := make([]boundArgument, 0, len(d.inputs)+len(d.structs)+len(d.bufferIds))
+	for _, input := range d.inputs {
+		bound = append(bound, boundArgument{input: true, elem: input.typ, numBytes: input.Size()})
+	}
+	for i, b := range d.structs {
+		structType := reflect.Indirect(reflect.ValueOf(structs[i])).Type().String()
+		bound = append(bound, boundArgument{input: true, numBytes: len(b), structType: structType})
+	}
+	for i := range d.bufferIds {
+		// A buffer may have been closed since params.dispatch checked it.
+		entry, err := d.openBuffer(i)
 		if err != nil {
-			return batchArgs{}, err
+			return err
 		}
+		span := d.span(i)
+		entry = entry.slice(span)
+		bound = append(bound, boundArgument{elem: elementScalar(entry.data), numBytes: entry.numBytes, offset: span.offset})
+	}
 
-		args.functionIds[i] = C.int(f.id)
-		args.widths[i] = width
-		args.heights[i] = height
-		args.depths[i] = depth
-		if inputsPtr != nil {
-			pinner.Pin(inputsPtr)
-		}
-		args.inputs[i] = inputsPtr
-		args.numInputs[i] = C.int(len(params[i].Inputs))
-		if bufferIdsPtr != nil {
-			pinner.Pin(bufferIdsPtr)
+	return validateArguments(args, bound, limits.constantOffsetAlignment)
+}
+
+// dispatches validates every element of params and returns one dispatch per element, all against
+// this function. It fails on the first invalid element, with a *BatchError for it, so a batch is
+// either fully valid or not run at all.
+func (f *Function) dispatches(params []RunParameters) ([]dispatch, error) {
+	ds := make([]dispatch, len(params))
+	for i := range params {
+		d, err := f.dispatch(params[i])
+		if err != nil {
+			return nil, newBatchError(i, f.String(), -1, err)
 		}
-		args.bufferIds[i] = bufferIdsPtr
-		args.numBufferIds[i] = C.int(len(params[i].BufferIds))
+		ds[i] = d
 	}
 
-	return args, nil
+	return ds, nil
 }
 
-// gridDimension validates and normalizes a single grid dimension for the C layer. A size of 0 (an
-// unused dimension) clamps to 1; a negative size is a caller error. The C side takes the dimensions
-// as a 32-bit unsigned int, so a value above MaxInt32 is rejected rather than silently truncated
-// when the Go int (up to 64-bit) is narrowed to C.uint.
-func gridDimension(size int) (C.uint, error) {
+// gridDimension validates and normalizes a single grid dimension for a backend. A size of 0 (an
+// unused dimension) clamps to 1; a negative size is a caller error. Backends take the dimensions as
+// a 32-bit unsigned int (as does the C layer), so a value above MaxInt32 is rejected rather than
+// silently truncated when the Go int (up to 64-bit) is narrowed to uint32.
+func gridDimension(size int) (uint32, error) {
 	switch {
 	case size < 0:
 		return 0, errors.New("invalid grid dimension")
@@ -498,6 +744,130 @@ func gridDimension(size int) (C.uint, error) {
 	case size == 0:
 		return 1, nil
 	default:
-		return C.uint(size), nil
+		return uint32(size), nil
 	}
 }
+
+// pipelineLimits are the limits that a compiled pipeline puts on the threadgroups it is dispatched
+// with.
+type pipelineLimits struct {
+	// threadExecutionWidth is the number of threads that run in lockstep (the SIMD group width).
+	threadExecutionWidth int
+	// maxTotalThreadsPerThreadgroup is the most threads that one threadgroup may have.
+	maxTotalThreadsPerThreadgroup int
+	// maxThreadgroupMemoryLength is the most threadgroup memory, in bytes, that the device allows one
+	// threadgroup.
+	maxThreadgroupMemoryLength int
+	// staticThreadgroupMemoryLength is the threadgroup memory, in bytes, that the pipeline declares
+	// in its source, which counts against maxThreadgroupMemoryLength.
+	staticThreadgroupMemoryLength int
+	// constantOffsetAlignment is the alignment, in bytes, that the device requires for the offset of
+	// a buffer bound to a constant argument, or 0 if it requires none beyond the element type's.
+	constantOffsetAlignment int
+}
+
+// threadgroupSize returns the threadgroup size to dispatch with for a pipeline with the given
+// limits: requested if it is set, with each dimension of 0 treated as 1, or otherwise the default
+// size. A negative dimension, or a threadgroup of more threads than the limits allow, is an error.
+// Zero limits are treated as the typical Apple GPU values, as defaultThreadgroupSize treats them.
+func threadgroupSize(requested Grid, limits pipelineLimits) (Grid, error) {
+	if requested == (Grid{}) {
+		return defaultThreadgroupSize(limits.threadExecutionWidth, limits.maxTotalThreadsPerThreadgroup), nil
+	}
+
+	maxThreads := limits.maxTotalThreadsPerThreadgroup
+	if maxThreads <= 0 {
+		maxThreads = 1024
+	}
+
+	size := requested
+	threads := 1
+	for _, dim := range []*int{&size.X, &size.Y, &size.Z} {
+		switch {
+		case *dim < 0:
+			return Grid{}, errors.New("invalid threadgroup dimension")
+		case *dim == 0:
+			*dim = 1
+		}
+		// Stop multiplying once the limit is passed, so that a large dimension cannot overflow.
+		if threads <= maxThreads {
+			threads *= min(*dim, maxThreads+1)
+		}
+	}
+	if threads > maxThreads {
+		return Grid{}, fmt.Errorf("threadgroup of %dx%dx%d threads exceeds the function's limit of %d threads per threadgroup", size.X, size.Y, size.Z, maxThreads)
+	}
+
+	return size, nil
+}
+
+// threadgroupMemoryAlignment is the multiple of bytes that Metal requires every threadgroup memory
+// length to be.
+const threadgroupMemoryAlignment = 16
+
+// defaultMaxThreadgroupMemoryLength is the threadgroup memory limit of Apple GPUs, which is used
+// when a pipeline's limits do not give one.
+const defaultMaxThreadgroupMemoryLength = 32 << 10
+
+// ThreadgroupMemoryFor returns the length in bytes of a threadgroup memory argument that holds length
+// elements of type T, for RunParameters.ThreadgroupMemory.
+func ThreadgroupMemoryFor[T BufferType](length int) int {
+	return length * sizeof[T]()
+}
+
+// threadgroupMemory returns the threadgroup memory lengths to dispatch with for a pipeline with
+// the given limits: each length in requested rounded up to a multiple of 16 bytes, or nil if none
+// were requested. A negative length, or lengths that add up to more than the device allows beside
+// the pipeline's own threadgroup memory, is an error. A zero limit is treated as 32 KiB.
+func threadgroupMemory(requested []int, limits pipelineLimits) ([]int, error) {
+	if len(requested) == 0 {
+		return nil, nil
+	}
+
+	maxBytes := limits.maxThreadgroupMemoryLength
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxThreadgroupMemoryLength
+	}
+
+	lengths := make([]int, len(requested))
+	total := limits.staticThreadgroupMemoryLength
+	for i, n := range requested {
+		switch {
+		case n < 0:
+			return nil, fmt.Errorf("invalid threadgroup memory length %d at index %d", n, i)
+		case n > maxBytes:
+			// Checking each length first keeps the total from overflowing.
+			return nil, fmt.Errorf("threadgroup memory of %d bytes at index %d exceeds the device's limit of %d bytes", n, i, maxBytes)
+		}
+		lengths[i] = (n + threadgroupMemoryAlignment - 1) / threadgroupMemoryAlignment * threadgroupMemoryAlignment
+		total += lengths[i]
+	}
+
+	if total > maxBytes {
+		if static := limits.staticThreadgroupMemoryLength; static > 0 {
+			return nil, fmt.Errorf("threadgroup memory of %d bytes, including %d bytes declared by the function, exceeds the device's limit of %d bytes", total, static, maxBytes)
+		}
+		return nil, fmt.Errorf("threadgroup memory of %d bytes exceeds the device's limit of %d bytes", total, maxBytes)
+	}
+
+	return lengths, nil
+}
+
+// defaultThreadgroupSize returns the threadgroup size that Run uses for a pipeline with the given
+// limits: threadExecutionWidth threads wide and as many rows as maxTotalThreadsPerThreadgroup
+// allows, with no depth. A pipeline under heavy register pressure can have fewer total threads than
+// its execution width, so the width is clamped to maxTotalThreadsPerThreadgroup and the height to
+// at least one. A non-positive limit uses the typical Apple GPU value (32 and 1024).
+func defaultThreadgroupSize(threadExecutionWidth, maxTotalThreadsPerThreadgroup int) Grid {
+	if threadExecutionWidth <= 0 {
+		threadExecutionWidth = 32
+	}
+	if maxTotalThreadsPerThreadgroup <= 0 {
+		maxTotalThreadsPerThreadgroup = 1024
+	}
+
+	width := min(threadExecutionWidth, maxTotalThreadsPerThreadgroup)
+	height := max(maxTotalThreadsPerThreadgroup/width, 1)
+
+	return Grid{X: width, Y: height, Z: 1}
+}
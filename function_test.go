@@ -1,35 +1,24 @@
-//go:build darwin
+//go:build darwin && cgo
 
 package metal
 
 import (
-	_ "embed"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"math"
 	"math/rand"
 	"sort"
 	"strconv"
 	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
-var (
-	//go:embed test/noop.metal
-	sourceNoop string
-	//go:embed test/transfer1D.metal
-	sourceTransfer1D string
-	//go:embed test/transfer2D.metal
-	sourceTransfer2D string
-	//go:embed test/transfer3D.metal
-	sourceTransfer3D string
-	//go:embed test/sine.metal
-	sourceSine string
-	//go:embed test/transferType.metal
-	sourceTransferType string
-)
-
 var (
 	// nextFunctionId and nextBufferId track the IDs that should be returned for the next function
 	// and buffer respectively. We use these to verify the caches are working correctly — each new
@@ -174,6 +163,183 @@ func Test_Function_NewFunction(t *testing.T) {
 	}
 }
 
+// Test_Function_NewFunctionWithOptions tests that compile options reach the Metal compiler and that
+// invalid options are rejected before anything is compiled.
+func Test_Function_NewFunctionWithOptions(t *testing.T) {
+	source := `#include <metal_stdlib>
+#define DATA device float *data [[buffer(0)]]
+kernel void scaleBy(DATA, uint pos [[thread_position_in_grid]]) {
+    data[pos] = data[pos] * FACTOR;
+}`
+
+	_, err := NewFunctionWithOptions(source, "scaleBy", CompileOptions{MathMode: MathModeFast + 1})
+	require.EqualError(t, err, "unable to set up metal function: invalid math mode MathMode(4)")
+	require.False(t, validFunctionId(0))
+
+	_, err = NewFunction(source, "scaleBy")
+	require.ErrorContains(t, err, "use of undeclared identifier 'FACTOR'")
+
+	for _, mode := range []MathMode{MathModeDefault, MathModeSafe, MathModeRelaxed, MathModeFast} {
+		t.Run(mode.String(), func(t *testing.T) {
+			function, err := NewFunctionWithOptions(source, "scaleBy", CompileOptions{
+				LanguageVersion:    Version{2, 4},
+				MathMode:           mode,
+				PreprocessorMacros: map[string]string{"FACTOR": "3.0f"},
+				PreserveInvariance: true,
+			})
+			require.NoError(t, err)
+			require.True(t, validFunctionId(function.id))
+
+			args, err := function.Arguments()
+			require.NoError(t, err)
+			require.Equal(t, "data", args[0].Name)
+
+			dataId, data, err := NewBufferWith([]float32{1, -2})
+			require.NoError(t, err)
+			require.True(t, validBufferId(dataId))
+
+			require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 2}, BufferIds: []BufferId{dataId}}))
+			require.Equal(t, []float32{3, -6}, data)
+
+			require.NoError(t, function.Close())
+			require.NoError(t, dataId.Close())
+		})
+	}
+}
+
+// Test_Function_FunctionConstants tests that functions are specialized with their function
+// constants, by name and by index, and that mismatched constants are reported before compiling.
+func Test_Function_FunctionConstants(t *testing.T) {
+	source := `#include <metal_stdlib>
+using namespace metal;
+
+constant uint STRIDE [[function_constant(0)]];
+constant bool NEGATE [[function_constant(1)]];
+constant half SCALE [[function_constant(2)]];
+constant short OFFSET [[function_constant(3)]];
+constant float factor = is_function_constant_defined(SCALE) ? float(SCALE) : 1.0f;
+constant bool negate = is_function_constant_defined(NEGATE) && NEGATE;
+
+kernel void specialized(device float *data [[buffer(0)]], uint pos [[thread_position_in_grid]]) {
+    float v = data[pos * STRIDE] * factor + float(OFFSET);
+    data[pos * STRIDE] = negate ? -v : v;
+}`
+
+	_, err := NewFunctionWithOptions(source, "specialized", CompileOptions{Constants: []FunctionConstant{{Name: "STRIDE", Value: float32(2)}}})
+	require.EqualError(t, err, "unable to set up metal function: function constant 'STRIDE' is declared uint, not float")
+	require.False(t, validFunctionId(0))
+
+	_, err = NewFunctionWithOptions(source, "specialized", CompileOptions{Constants: []FunctionConstant{{Index: 4, Value: true}}})
+	require.EqualError(t, err, "unable to set up metal function: no function constant at index 4 is declared")
+	require.False(t, validFunctionId(0))
+
+	dataId, data, err := NewBufferWith([]float32{1, 2, 3, 4})
+	require.NoError(t, err)
+	require.True(t, validBufferId(dataId))
+
+	function, err := NewFunctionWithOptions(source, "specialized", CompileOptions{Constants: []FunctionConstant{
+		{Name: "STRIDE", Value: uint32(2)},
+		{Index: 1, Value: true},
+		{Name: "SCALE", Value: Half(1.5)},
+		{Index: 3, Value: int16(1)},
+	}})
+	require.NoError(t, err)
+	require.True(t, validFunctionId(function.id))
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 2}, BufferIds: []BufferId{dataId}}))
+	require.Equal(t, []float32{-2.5, 2, -5.5, 4}, data)
+	require.NoError(t, function.Close())
+
+	library, err := NewLibrary(source, CompileOptions{Constants: []FunctionConstant{
+		{Index: 0, Value: uint32(1)},
+		{Name: "OFFSET", Value: int16(-1)},
+	}})
+	require.NoError(t, err)
+	function, err = library.Function("specialized")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(function.id))
+	require.NoError(t, library.Close())
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 4}, BufferIds: []BufferId{dataId}}))
+	require.Equal(t, []float32{-3.5, 1, -6.5, 3}, data)
+	require.NoError(t, function.Close())
+	require.NoError(t, dataId.Close())
+}
+
+// Test_Function_NewFunctionFS tests that includes are resolved against a file system and that the
+// compiler's errors point into the included files.
+func Test_Function_NewFunctionFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"square.metal": {Data: []byte("#include <metal_stdlib>\n#include \"lib/common.h\"\n\nkernel void square(device float *data [[buffer(0)]], uint pos [[thread_position_in_grid]]) {\n    data[pos] = sq(data[pos]);\n}\n")},
+		"lib/common.h": {Data: []byte("#pragma once\n#include \"sq.h\"\n")},
+		"lib/sq.h":     {Data: []byte("#ifndef SQ_H\n#define SQ_H\nfloat sq(float x) { return x * x; }\n#endif\n")},
+		"broken.metal": {Data: []byte("#include \"lib/broken.h\"\nkernel void k() {}\n")},
+		"lib/broken.h": {Data: []byte("\nfloat f() { return 1 + ; }\n")},
+	}
+
+	_, err := NewFunctionFS(fsys, "missing.metal", "square")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.False(t, validFunctionId(0))
+
+	_, err = NewFunctionFS(fsys, "broken.metal", "k")
+	require.ErrorContains(t, err, "lib/broken.h:2:24: error: expected expression")
+	require.False(t, validFunctionId(0))
+
+	function, err := NewFunctionFS(fsys, "square.metal", "square")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(function.id))
+
+	dataId, data, err := NewBufferWith([]float32{1.5, -3})
+	require.NoError(t, err)
+	require.True(t, validBufferId(dataId))
+
+	require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 2}, BufferIds: []BufferId{dataId}}))
+	require.Equal(t, []float32{2.25, 9}, data)
+
+	require.NoError(t, function.Close())
+	require.NoError(t, dataId.Close())
+}
+
+// Test_Function_Diagnostics tests that compiler errors are returned as a *CompileError and that
+// warnings are kept when the source compiles.
+func Test_Function_Diagnostics(t *testing.T) {
+	_, err := NewFunction("kernel void broken(device float *a) {\n    a[0] = b;\n}\n", "broken")
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.False(t, validFunctionId(0))
+	require.NotEmpty(t, compileErr.Diagnostics)
+	require.Equal(t, Diagnostic{
+		File:     "program_source",
+		Line:     2,
+		Column:   12,
+		Severity: SeverityError,
+		Message:  "use of undeclared identifier 'b'",
+	}, compileErr.Diagnostics[0])
+	require.Contains(t, compileErr.Log, "a[0] = b;")
+
+	source := "kernel void unused(device float *a [[buffer(0)]], uint pos [[thread_position_in_grid]]) {\n    int tmp = 0;\n    a[pos] = 1;\n}\n"
+	function, err := NewFunction(source, "unused")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(function.id))
+
+	diagnostics := function.Diagnostics()
+	require.NotEmpty(t, diagnostics)
+	require.Equal(t, SeverityWarning, diagnostics[0].Severity)
+	require.Equal(t, 2, diagnostics[0].Line)
+	require.Contains(t, diagnostics[0].Message, "unused variable 'tmp'")
+
+	require.NoError(t, function.Close())
+	require.Nil(t, function.Diagnostics())
+
+	library, err := NewLibrary(source, CompileOptions{})
+	require.NoError(t, err)
+	require.Equal(t, diagnostics, library.Diagnostics())
+	function, err = library.Function("unused")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(function.id))
+	require.Equal(t, diagnostics, function.Diagnostics())
+	require.NoError(t, library.Close())
+	require.NoError(t, function.Close())
+}
+
 // Test_Function_Close tests that Function's Close method correctly releases the function.
 func Test_Function_Close(t *testing.T) {
 	t.Run("nil pointer", func(t *testing.T) {
@@ -202,6 +368,30 @@ func Test_Function_Close(t *testing.T) {
 	})
 }
 
+// Test_Function_interning tests that interned functions share one compiled pipeline, which stays
+// valid until the last of them is closed.
+func Test_Function_interning(t *testing.T) {
+	defer SetFunctionInterning(false)
+	SetFunctionInterning(true)
+
+	before := Stats()
+
+	f1, err := NewFunction(sourceNoop, "noop")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(f1.id))
+	f2, err := NewFunction(sourceNoop, "noop")
+	require.NoError(t, err)
+	require.Equal(t, f1.id, f2.id)
+	require.Equal(t, before.CompilationsAvoided+1, Stats().CompilationsAvoided)
+
+	require.NoError(t, f1.Close())
+	require.Equal(t, "noop", f2.String())
+	require.NoError(t, f2.Run(RunParameters{Grid: Grid{X: 1}}))
+	require.NoError(t, f2.Close())
+	require.False(t, f2.Valid())
+	require.Equal(t, before.Interned, Stats().Interned)
+}
+
 // Test_Function_Valid tests that Function's Valid method correctly identifies a valid function Id.
 func Test_Function_Valid(t *testing.T) {
 	// A valid function Id has a positive value. Let's run through a bunch of numbers and test that
@@ -255,6 +445,41 @@ func Test_Function_String(t *testing.T) {
 	})
 }
 
+// Test_Function_Arguments tests that Function's Arguments method describes every parameter of the
+// function, including the ones that are not bound to a buffer.
+func Test_Function_Arguments(t *testing.T) {
+	t.Run("uninitialized function", func(t *testing.T) {
+		var function Function
+		_, err := function.Arguments()
+		require.ErrorIs(t, err, ErrInvalidFunctionId)
+	})
+
+	t.Run("valid function", func(t *testing.T) {
+		function, err := NewFunction(sourceSine, "sine")
+		require.NoError(t, err)
+		require.True(t, validFunctionId(function.id))
+
+		args, err := function.Arguments()
+		require.NoError(t, err)
+		require.Equal(t, []Argument{
+			{Index: 0, Name: "mult", Type: "float", AddressSpace: AddressSpaceConstant, Pointer: true},
+			{Index: 1, Name: "input", Type: "float", AddressSpace: AddressSpaceConstant, Pointer: true},
+			{Index: 2, Name: "result", Type: "float", AddressSpace: AddressSpaceDevice, Pointer: true},
+			{Index: -1, Name: "pos", Type: "uint", Attribute: "thread_position_in_grid"},
+		}, args)
+	})
+
+	t.Run("closed function", func(t *testing.T) {
+		function, err := NewFunction(sourceSine, "sine")
+		require.NoError(t, err)
+		require.True(t, validFunctionId(function.id))
+
+		require.NoError(t, function.Close())
+		_, err = function.Arguments()
+		require.ErrorIs(t, err, ErrInvalidFunctionId)
+	})
+}
+
 // Test_Function_NewFunction_threadSafe tests that NewFunction can handle multiple parallel invocations and
 // still return the correct function Id.
 func Test_Function_NewFunction_threadSafe(t *testing.T) {
@@ -337,7 +562,7 @@ func Test_Function_Run_invalid(t *testing.T) {
 
 	t.Run("non-existent buffer", func(t *testing.T) {
 		err := function.Run(RunParameters{BufferIds: []BufferId{10000}})
-		require.EqualError(t, err, "unable to run metal function: failed to retrieve buffer 1/1: invalid buffer id: 10000")
+		require.EqualError(t, err, "buffer 1/1 is not open: invalid buffer id: 10000")
 		require.ErrorIs(t, err, ErrInvalidBufferId)
 	})
 
@@ -504,6 +729,120 @@ func Test_Function_Run_2D(t *testing.T) {
 	}
 }
 
+// Test_Function_Run_threadgroup tests that a dispatch can choose its threadgroup size within the
+// pipeline's limits.
+func Test_Function_Run_threadgroup(t *testing.T) {
+	function, err := NewFunction(sourceTransfer2D, "transfer2D")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(function.id))
+
+	width := function.ThreadExecutionWidth()
+	maxThreads := function.MaxTotalThreadsPerThreadgroup()
+	require.Positive(t, width)
+	require.GreaterOrEqual(t, maxThreads, width)
+
+	inputId, input, err := NewBuffer[float32](100 * 30)
+	require.NoError(t, err)
+	require.True(t, validBufferId(inputId))
+	outputId, output, err := NewBuffer[float32](100 * 30)
+	require.NoError(t, err)
+	require.True(t, validBufferId(outputId))
+	for i := range input {
+		input[i] = float32(i)
+	}
+
+	for _, threadgroup := range []Grid{{}, {X: 8, Y: 8}, {X: 1, Y: 16}, {X: maxThreads}} {
+		clear(output)
+		require.NoError(t, function.Run(RunParameters{
+			Grid:        Grid{X: 100, Y: 30},
+			Threadgroup: threadgroup,
+			Inputs:      []float32{1},
+			BufferIds:   []BufferId{inputId, outputId},
+		}))
+		for i := range output {
+			require.Equal(t, input[i]+1, output[i], "threadgroup %v", threadgroup)
+		}
+	}
+
+	err = function.Run(RunParameters{
+		Grid:        Grid{X: 100, Y: 30},
+		Threadgroup: Grid{X: maxThreads, Y: 2},
+		Inputs:      []float32{1},
+		BufferIds:   []BufferId{inputId, outputId},
+	})
+	require.EqualError(t, err, fmt.Sprintf("threadgroup of %dx2x1 threads exceeds the function's limit of %d threads per threadgroup", maxThreads, maxThreads))
+
+	require.NoError(t, function.Close())
+	require.Zero(t, function.ThreadExecutionWidth())
+	require.Zero(t, function.MaxTotalThreadsPerThreadgroup())
+}
+
+// Test_Function_Run_threadgroupMemory tests that threadgroup memory arguments are bound with the
+// requested lengths, and that lengths over the device's limit are rejected.
+func Test_Function_Run_threadgroupMemory(t *testing.T) {
+	source := `#include <metal_stdlib>
+using namespace metal;
+
+kernel void groupSum(device const float *input [[buffer(0)]], device float *sums [[buffer(1)]],
+                     threadgroup float *scratch [[threadgroup(0)]], uint pos [[thread_position_in_grid]],
+                     uint lid [[thread_position_in_threadgroup]], uint group [[threadgroup_position_in_grid]],
+                     uint size [[threads_per_threadgroup]]) {
+    scratch[lid] = input[pos];
+    threadgroup_barrier(mem_flags::mem_threadgroup);
+    for (uint stride = size / 2; stride > 0; stride /= 2) {
+        if (lid < stride) {
+            scratch[lid] += scratch[lid + stride];
+        }
+        threadgroup_barrier(mem_flags::mem_threadgroup);
+    }
+    if (lid == 0) {
+        sums[group] = scratch[0];
+    }
+}`
+
+	function, err := NewFunction(source, "groupSum")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(function.id))
+
+	const groupSize, groups = 64, 16
+
+	inputId, input, err := NewBuffer[float32](groupSize * groups)
+	require.NoError(t, err)
+	require.True(t, validBufferId(inputId))
+	sumsId, sums, err := NewBuffer[float32](groups)
+	require.NoError(t, err)
+	require.True(t, validBufferId(sumsId))
+	for i := range input {
+		input[i] = float32(i % 10)
+	}
+
+	require.NoError(t, function.Run(RunParameters{
+		Grid:              Grid{X: groupSize * groups},
+		Threadgroup:       Grid{X: groupSize},
+		ThreadgroupMemory: []int{ThreadgroupMemoryFor[float32](groupSize)},
+		BufferIds:         []BufferId{inputId, sumsId},
+	}))
+	for group := range groups {
+		var want float32
+		for _, v := range input[group*groupSize : (group+1)*groupSize] {
+			want += v
+		}
+		require.Equal(t, want, sums[group], "group %d", group)
+	}
+
+	err = function.Run(RunParameters{
+		Grid:              Grid{X: groupSize * groups},
+		Threadgroup:       Grid{X: groupSize},
+		ThreadgroupMemory: []int{1 << 30},
+		BufferIds:         []BufferId{inputId, sumsId},
+	})
+	require.ErrorContains(t, err, "threadgroup memory of 1073741824 bytes at index 0 exceeds the device's limit of")
+
+	require.NoError(t, function.Close())
+	require.NoError(t, inputId.Close())
+	require.NoError(t, sumsId.Close())
+}
+
 // Test_Function_Run_3D tests that Function's Run method correctly runs a 3-dimensional
 // computational process for small and large input sizes.
 func Test_Function_Run_3D(t *testing.T) {
@@ -711,6 +1050,107 @@ func testType[T BufferType](t *testing.T, metalType string, wantFail bool, sette
 	})
 }
 
+// Test_Function_Run_scalars tests that typed scalar inputs reach the kernel with the width and
+// encoding of their Metal types.
+func Test_Function_Run_scalars(t *testing.T) {
+	const source = `
+kernel void scale(constant uint *count, constant short *offset, constant half *factor,
+                  device float *result, uint pos [[thread_position_in_grid]]) {
+    if (pos < *count) {
+        result[pos] = float(*factor) * float(int(pos) + *offset);
+    }
+}`
+
+	function, err := NewFunction(source, "scale")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(function.id))
+
+	resultId, result, err := NewBuffer[float32](4)
+	require.NoError(t, err)
+	require.True(t, validBufferId(resultId))
+
+	err = function.Run(RunParameters{
+		Grid:      Grid{X: 4},
+		Scalars:   []Scalar{Uint32(3), Int16(-1), Half(0.5)},
+		BufferIds: []BufferId{resultId},
+		Validate:  true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []float32{-0.5, 0, 0.5, 0}, result)
+}
+
+// Test_Function_Run_structs tests that a struct input reaches the kernel with Metal's layout.
+func Test_Function_Run_structs(t *testing.T) {
+	const source = `
+struct Params {
+    uint count;
+    float2 scale;
+    packed_float3 offset;
+    half gain;
+    float4 bias;
+};
+
+kernel void affine(constant Params &p, device float *result, uint pos [[thread_position_in_grid]]) {
+    if (pos < p.count) {
+        result[pos] = float(p.gain) * (p.scale.x * pos + p.scale.y) + p.offset[pos % 3] + p.bias.w;
+    }
+}`
+
+	type params struct {
+		Count  uint32
+		Scale  [2]float32
+		Offset [3]float32 `metal:"packed_float3"`
+		Gain   uint16     `metal:"half"`
+		Bias   [4]float32
+	}
+
+	function, err := NewFunction(source, "affine")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(function.id))
+
+	resultId, result, err := NewBuffer[float32](4)
+	require.NoError(t, err)
+	require.True(t, validBufferId(resultId))
+
+	err = function.Run(RunParameters{
+		Grid: Grid{X: 4},
+		Structs: []any{params{
+			Count:  3,
+			Scale:  [2]float32{2, 1},
+			Offset: [3]float32{10, 20, 30},
+			Gain:   0x4000, // 2.0
+			Bias:   [4]float32{0, 0, 0, 0.5},
+		}},
+		BufferIds: []BufferId{resultId},
+		Validate:  true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []float32{12.5, 26.5, 40.5, 0}, result)
+}
+
+// Test_Function_Run_bufferRanges tests that ranges of one buffer are bound at their offsets.
+func Test_Function_Run_bufferRanges(t *testing.T) {
+	function, err := NewFunction(sourceSine, "sine")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(function.id))
+
+	arena, err := NewTypedBuffer[float32](128)
+	require.NoError(t, err)
+	require.True(t, validBufferId(arena.Id()))
+	copy(arena.Slice()[64:], []float32{1, 2, 3})
+
+	err = function.Run(RunParameters{
+		Grid:     Grid{X: 3},
+		Inputs:   []float32{1},
+		Buffers:  []BufferBinding{arena.Range(64, 3), arena.Range(4, 3)},
+		Validate: true,
+	})
+	require.NoError(t, err)
+	require.InDeltaSlice(t, []float32{0, 0, 0, 0, float32(math.Sin(1)), float32(math.Sin(2)), float32(math.Sin(3)), 0}, arena.Slice()[:8], 1e-6)
+
+	require.NoError(t, arena.Close())
+}
+
 // Test_Function_RunBatch tests that RunBatch dispatches every set of parameters against the same
 // function in a single command buffer and that each dispatch operates on its own buffers.
 func Test_Function_RunBatch(t *testing.T) {
@@ -770,6 +1210,14 @@ func Test_Function_RunBatch(t *testing.T) {
 			{Grid: Grid{X: width}, BufferIds: []BufferId{10000, outputId}},
 		})
 		require.ErrorIs(t, err, ErrInvalidBufferId)
+
+		// The error names the dispatch and the argument that failed.
+		var batchErr *BatchError
+		require.ErrorAs(t, err, &batchErr)
+		require.Equal(t, 1, batchErr.Index)
+		require.Equal(t, "transfer1D", batchErr.Function)
+		require.Equal(t, 0, batchErr.Argument)
+		require.Equal(t, ErrInvalidBufferId, batchErr.Sentinel)
 	})
 
 	t.Run("invalid grid in one dispatch fails the batch", func(t *testing.T) {
@@ -777,7 +1225,7 @@ func Test_Function_RunBatch(t *testing.T) {
 			{Grid: Grid{X: 10}},
 			{Grid: Grid{X: -1}},
 		})
-		require.EqualError(t, err, "invalid grid dimension")
+		require.EqualError(t, err, "dispatch 1 of 'transfer1D': invalid grid dimension")
 	})
 }
 
@@ -830,6 +1278,89 @@ func Test_Function_RunAsync(t *testing.T) {
 		require.EqualError(t, handle.Wait(), "invalid run handle")
 	})
 
+	t.Run("Done, Status, and OnComplete report completion", func(t *testing.T) {
+		width := 100_000
+		inputId, input, err := NewBuffer[float32](width)
+		require.NoError(t, err)
+		require.True(t, validBufferId(inputId))
+		outputId, output, err := NewBuffer[float32](width)
+		require.NoError(t, err)
+		require.True(t, validBufferId(outputId))
+
+		for i := range input {
+			input[i] = float32(i) - 3
+		}
+
+		handle, err := function.RunAsync(RunParameters{
+			Grid:      Grid{X: width},
+			BufferIds: []BufferId{inputId, outputId},
+		})
+		require.NoError(t, err)
+
+		completed := make(chan error, 1)
+		handle.OnComplete(func(err error) { completed <- err })
+
+		select {
+		case <-handle.Done():
+		case <-time.After(time.Minute):
+			t.Fatal("Done was not closed")
+		}
+		require.Equal(t, RunStatusCompleted, handle.Status())
+		require.NoError(t, handle.Err())
+		require.NoError(t, <-completed)
+		require.Equal(t, input, output)
+
+		require.NoError(t, handle.Wait())
+		require.EqualError(t, handle.Wait(), "invalid run handle")
+	})
+
+	t.Run("WaitAll and WaitAny", func(t *testing.T) {
+		width := 10_000
+		inputId, input, err := NewBuffer[float32](width)
+		require.NoError(t, err)
+		require.True(t, validBufferId(inputId))
+		for i := range input {
+			input[i] = float32(i) * 0.5
+		}
+
+		outputs := make([][]float32, 4)
+		handles := make([]*RunHandle, len(outputs))
+		for d := range handles {
+			outputId, output, err := NewBuffer[float32](width)
+			require.NoError(t, err)
+			require.True(t, validBufferId(outputId))
+			outputs[d] = output
+
+			handles[d], err = function.RunAsync(RunParameters{
+				Grid:      Grid{X: width},
+				BufferIds: []BufferId{inputId, outputId},
+			})
+			require.NoError(t, err)
+		}
+
+		// Wait for the first two in the order they finish, then for the rest together.
+		seen := make(map[int]bool)
+		for range 2 {
+			i, err := WaitAny(context.Background(), handles...)
+			require.NoError(t, err)
+			require.False(t, seen[i])
+			seen[i] = true
+			require.Equal(t, input, outputs[i])
+		}
+
+		var rest []*RunHandle
+		for i, h := range handles {
+			if !seen[i] {
+				rest = append(rest, h)
+			}
+		}
+		require.NoError(t, WaitAll(rest...))
+		for _, output := range outputs {
+			require.Equal(t, input, output)
+		}
+		require.Error(t, WaitAll(handles...))
+	})
+
 	t.Run("nil handle Wait is a safe error", func(t *testing.T) {
 		var handle *RunHandle
 		require.EqualError(t, handle.Wait(), "invalid run handle")
@@ -917,6 +1448,10 @@ func Test_Function_RunBatchAsync(t *testing.T) {
 		})
 		require.ErrorIs(t, err, ErrInvalidBufferId)
 		require.Nil(t, handle)
+		var batchErr *BatchError
+		require.ErrorAs(t, err, &batchErr)
+		require.Equal(t, 1, batchErr.Index)
+		require.Equal(t, 0, batchErr.Argument)
 	})
 
 	t.Run("invalid grid fails before returning a handle", func(t *testing.T) {
@@ -924,11 +1459,138 @@ func Test_Function_RunBatchAsync(t *testing.T) {
 			{Grid: Grid{X: 10}},
 			{Grid: Grid{X: -1}},
 		})
-		require.EqualError(t, err, "invalid grid dimension")
+		require.EqualError(t, err, "dispatch 1 of 'transfer1D': invalid grid dimension")
 		require.Nil(t, handle)
 	})
 }
 
+// Test_Function_RunContext tests that RunContext runs a dispatch to completion, and that it
+// dispatches nothing once its context is done.
+func Test_Function_RunContext(t *testing.T) {
+	function, err := NewFunction(sourceTransfer1D, "transfer1D")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(function.id))
+
+	width := 10_000
+	inputId, input, err := NewBuffer[float32](width)
+	require.NoError(t, err)
+	require.True(t, validBufferId(inputId))
+	outputId, output, err := NewBuffer[float32](width)
+	require.NoError(t, err)
+	require.True(t, validBufferId(outputId))
+
+	for i := range input {
+		input[i] = float32(i) * 2.5
+	}
+	params := RunParameters{Grid: Grid{X: width}, BufferIds: []BufferId{inputId, outputId}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, function.RunContext(ctx, params), context.Canceled)
+	require.Equal(t, make([]float32, width), output)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.NoError(t, function.RunContext(ctx, params))
+	require.Equal(t, input, output)
+
+	// A handle that gave up waiting still returns the result later.
+	clear(output)
+	handle, err := function.RunAsync(params)
+	require.NoError(t, err)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = handle.WaitContext(canceled)
+	if errors.Is(err, context.Canceled) {
+		err = handle.WaitContext(ctx)
+	}
+	require.NoError(t, err)
+	require.Equal(t, input, output)
+
+	require.NoError(t, function.Close())
+	require.NoError(t, inputId.Close())
+	require.NoError(t, outputId.Close())
+}
+
+// Test_Batch tests that a Batch runs dispatches of several functions as one command buffer, in
+// order, and that an invalid dispatch fails the whole batch.
+func Test_Batch(t *testing.T) {
+	transfer, err := NewFunction(sourceTransfer1D, "transfer1D")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(transfer.id))
+	sine, err := NewFunction(sourceSine, "sine")
+	require.NoError(t, err)
+	require.True(t, validFunctionId(sine.id))
+
+	width := 5000
+	inputId, input, err := NewBuffer[float32](width)
+	require.NoError(t, err)
+	require.True(t, validBufferId(inputId))
+	scratchId, _, err := NewBuffer[float32](width)
+	require.NoError(t, err)
+	require.True(t, validBufferId(scratchId))
+	outputId, output, err := NewBuffer[float32](width)
+	require.NoError(t, err)
+	require.True(t, validBufferId(outputId))
+
+	for i := range input {
+		input[i] = float32(i) / 500
+	}
+
+	// Copy the input to scratch, take the sine of scratch into the output, and copy the output back
+	// to scratch. Each dispatch reads what the one before it wrote.
+	var batch Batch
+	batch.Add(transfer, RunParameters{Grid: Grid{X: width}, BufferIds: []BufferId{inputId, scratchId}})
+	batch.Add(sine, RunParameters{Grid: Grid{X: width}, Inputs: []float32{2}, BufferIds: []BufferId{scratchId, outputId}})
+	require.Equal(t, 2, batch.Len())
+
+	requireSine := func(t *testing.T) {
+		for i := range output {
+			require.InDelta(t, math.Sin(float64(input[i]))*4, output[i], 1e-4, "index %d", i)
+		}
+	}
+
+	t.Run("Run", func(t *testing.T) {
+		clear(output)
+		require.NoError(t, batch.Run())
+		requireSine(t)
+	})
+
+	t.Run("RunAsync", func(t *testing.T) {
+		clear(output)
+		handle, err := batch.RunAsync()
+		require.NoError(t, err)
+		require.NoError(t, handle.Wait())
+		requireSine(t)
+		require.EqualError(t, handle.Wait(), "invalid run handle")
+	})
+
+	t.Run("invalid dispatch runs nothing", func(t *testing.T) {
+		clear(output)
+		var invalid Batch
+		invalid.Add(sine, RunParameters{Grid: Grid{X: width}, Inputs: []float32{2}, BufferIds: []BufferId{inputId, outputId}})
+		invalid.Add(transfer, RunParameters{Grid: Grid{X: width}, BufferIds: []BufferId{10000, outputId}})
+		require.ErrorIs(t, invalid.Run(), ErrInvalidBufferId)
+		require.Equal(t, make([]float32, width), output)
+
+		handle, err := invalid.RunAsync()
+		require.ErrorIs(t, err, ErrInvalidBufferId)
+		require.Nil(t, handle)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		batch.Reset()
+		require.Zero(t, batch.Len())
+		require.NoError(t, batch.Run())
+	})
+
+	require.NoError(t, transfer.Close())
+	require.NoError(t, sine.Close())
+	require.NoError(t, inputId.Close())
+	require.NoError(t, scratchId.Close())
+	require.NoError(t, outputId.Close())
+}
+
 // Benchmark_Run benchmarks running a computational process for a wide range of widths both in the
 // standard, serial method and in the GPU-accelerated parallel method.
 func Benchmark_Run(b *testing.B) {
@@ -0,0 +1,273 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Run handles
+// ----------------------------------------------------------------------------
+
+// A RunStatus is the progress of the work behind a RunHandle.
+type RunStatus int
+
+const (
+	// RunStatusScheduled is the status of work that has been committed but that the device has not
+	// taken on yet.
+	RunStatusScheduled RunStatus = iota
+	// RunStatusRunning is the status of work that the device has taken on. On Metal that is when
+	// the command buffer is scheduled on the device, once its dependencies have resolved, which can
+	// be before the GPU starts executing it. On the CPU backend it is when the work's threads start.
+	RunStatusRunning
+	// RunStatusCompleted is the status of work that has finished successfully.
+	RunStatusCompleted
+	// RunStatusErrored is the status of work that has finished with an error.
+	RunStatusErrored
+)
+
+// String returns the name of the status.
+func (s RunStatus) String() string {
+	switch s {
+	case RunStatusScheduled:
+		return "scheduled"
+	case RunStatusRunning:
+		return "running"
+	case RunStatusCompleted:
+		return "completed"
+	case RunStatusErrored:
+		return "errored"
+	default:
+		return fmt.Sprintf("RunStatus(%d)", int(s))
+	}
+}
+
+// A RunHandle represents an in-flight asynchronous dispatch started by RunAsync, RunBatchAsync, or
+// Batch.RunAsync. Call Wait or WaitContext to block until the GPU finishes. Once a wait has
+// returned the dispatch's result, the handle is spent and every later wait returns an error.
+//
+// Done, Err, Status, and OnComplete report on the dispatch without blocking and without spending
+// the handle, so many dispatches can be waited on from one goroutine, for example by selecting on
+// their Done channels alongside other channels. Every method is safe for concurrent use.
+type RunHandle struct {
+	mu     sync.Mutex
+	status RunStatus
+	// done is closed once the work has finished and err is set.
+	done      chan struct{}
+	err       error
+	callbacks []func(error)
+	// waited is set once a wait has returned err.
+	waited bool
+}
+
+// newRunHandle returns a RunHandle for work that is about to be committed.
+func newRunHandle() *RunHandle {
+	return &RunHandle{done: make(chan struct{})}
+}
+
+// closedDone is the Done channel of an invalid RunHandle, which never has work in flight.
+var closedDone = func() chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}()
+
+// Wait blocks until the asynchronous work behind this handle finishes on the GPU and releases the
+// underlying command buffer. It returns the work's result once per RunHandle returned by RunAsync or
+// RunBatchAsync; calling it again, or on a zero-value handle, returns an error rather than crashing.
+// For a RunBatchAsync handle the single Wait covers the entire batch. After Wait returns, the output
+// buffers hold the results.
+func (h *RunHandle) Wait() error {
+	return h.WaitContext(context.Background())
+}
+
+// WaitContext is like Wait, but gives up when ctx is done and returns ctx.Err(). Giving up does not
+// spend the handle: the work keeps running, its command buffer is released in the background once
+// it finishes, and a later Wait or WaitContext still returns its result. The buffers it uses must
+// stay open until it finishes, even if nothing waits for it again.
+func (h *RunHandle) WaitContext(ctx context.Context) error {
+	if !h.valid() || h.spent() {
+		return errors.New("invalid run handle")
+	}
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		// The work may have finished at the same moment, in which case its result wins.
+		select {
+		case <-h.done:
+		default:
+			return ctx.Err()
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.waited {
+		return errors.New("invalid run handle")
+	}
+	h.waited = true
+
+	return h.err
+}
+
+// Done returns a channel that is closed once the work behind this handle has finished, successfully
+// or not, and its command buffer has been released. The output buffers hold the results once it is
+// closed. For a zero-value handle the channel is already closed.
+func (h *RunHandle) Done() <-chan struct{} {
+	if !h.valid() {
+		return closedDone
+	}
+	return h.done
+}
+
+// Err returns nil until Done is closed, and then the result of the work: nil if it completed
+// successfully, or the error it finished with. Unlike Wait, it does not spend the handle. For a
+// zero-value handle it returns an error.
+func (h *RunHandle) Err() error {
+	if !h.valid() {
+		return errors.New("invalid run handle")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.err
+}
+
+// Status returns the progress of the work behind this handle. Work moves from RunStatusScheduled
+// to RunStatusRunning once the device takes it on, which on Metal means once it is scheduled on the
+// device rather than once the GPU starts it, and then to RunStatusCompleted or RunStatusErrored
+// once Done is closed; a backend that cannot tell when the device takes work on moves it straight
+// on to one of the last two. A zero-value handle reports RunStatusErrored.
+func (h *RunHandle) Status() RunStatus {
+	if !h.valid() {
+		return RunStatusErrored
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.status
+}
+
+// OnComplete arranges for f to be called with the result of the work behind this handle once it has
+// finished, as Err would return it. If the work has already finished, f is called before OnComplete
+// returns; otherwise it is called on the goroutine that learns that the work finished, so it should
+// not block. Any number of functions can be registered, and each is called once. For a zero-value
+// handle f is called at once with an error.
+func (h *RunHandle) OnComplete(f func(error)) {
+	if f == nil {
+		return
+	}
+	if !h.valid() {
+		f(errors.New("invalid run handle"))
+		return
+	}
+
+	h.mu.Lock()
+	select {
+	case <-h.done:
+		err := h.err
+		h.mu.Unlock()
+		f(err)
+	default:
+		h.callbacks = append(h.callbacks, f)
+		h.mu.Unlock()
+	}
+}
+
+// WaitAll waits for the work behind every handle to finish and returns the errors of the ones that
+// failed, joined, each naming the index of its handle. Like Wait, it returns each handle's result
+// once: a handle that has already been waited on, or that appears twice, fails with an error.
+func WaitAll(handles ...*RunHandle) error {
+	var errs []error
+	for i, h := range handles {
+		if err := h.Wait(); err != nil {
+			errs = append(errs, fmt.Errorf("run handle %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// WaitAny waits for the work behind any one of the handles to finish, and returns the index of its
+// handle and its result, as Wait would. Only that handle is spent, so a pipeline can wait for its
+// handles in the order that they finish by calling WaitAny until every one has been returned. If
+// several have finished, which one is returned is unspecified. Handles that are nil, or whose
+// result a wait has already returned, are skipped, and if no handle is left WaitAny returns an
+// error. If ctx is done before any work finishes, WaitAny returns -1 and ctx.Err() without spending
+// any handle.
+func WaitAny(ctx context.Context, handles ...*RunHandle) (int, error) {
+	cases := make([]reflect.SelectCase, 0, len(handles)+1)
+	indexes := make([]int, 0, len(handles))
+	for i, h := range handles {
+		if !h.valid() || h.spent() {
+			continue
+		}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(h.done)})
+		indexes = append(indexes, i)
+	}
+	if len(cases) == 0 {
+		return -1, errors.New("no run handles to wait for")
+	}
+
+	// Work that has already finished wins over a ctx that is already done.
+	chosen, _, _ := reflect.Select(append(cases, reflect.SelectCase{Dir: reflect.SelectDefault}))
+	if chosen == len(cases) {
+		done := reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+		if chosen, _, _ = reflect.Select(append(cases, done)); chosen == len(cases) {
+			return -1, ctx.Err()
+		}
+	}
+
+	i := indexes[chosen]
+	return i, handles[i].Wait()
+}
+
+// running records that the device has taken on the work, which on Metal is when its command buffer
+// is scheduled. It has no effect once the work has finished.
+func (h *RunHandle) running() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.status == RunStatusScheduled {
+		h.status = RunStatusRunning
+	}
+}
+
+// finish records the result of the work, which the backend has released, and calls the functions
+// registered with OnComplete.
+func (h *RunHandle) finish(err error) {
+	h.mu.Lock()
+	h.err = err
+	h.status = RunStatusCompleted
+	if err != nil {
+		h.status = RunStatusErrored
+	}
+	callbacks := h.callbacks
+	h.callbacks = nil
+	close(h.done)
+	h.mu.Unlock()
+
+	for _, f := range callbacks {
+		f(err)
+	}
+}
+
+// valid reports whether h was returned for work that was committed.
+func (h *RunHandle) valid() bool {
+	return h != nil && h.done != nil
+}
+
+// spent reports whether a wait has already returned the result of h's work.
+func (h *RunHandle) spent() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.waited
+}
@@ -0,0 +1,388 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSource plays the part of a backend for a RunHandle: it reports the progress of work that the
+// test starts and finishes.
+type fakeSource struct {
+	c completion
+}
+
+// start starts the work.
+func (s fakeSource) start() {
+	s.c.running()
+}
+
+// finishLater finishes the work with err on another goroutine, as a backend's completion handler
+// would, once release is closed.
+func (s fakeSource) finishLater(release <-chan struct{}, err error) {
+	go func() {
+		<-release
+		s.c.finish(err)
+	}()
+}
+
+// Test_RunStatus_String tests that every RunStatus has a name.
+func Test_RunStatus_String(t *testing.T) {
+	require.Equal(t, "scheduled", RunStatusScheduled.String())
+	require.Equal(t, "running", RunStatusRunning.String())
+	require.Equal(t, "completed", RunStatusCompleted.String())
+	require.Equal(t, "errored", RunStatusErrored.String())
+	require.Equal(t, "RunStatus(4)", RunStatus(4).String())
+}
+
+// Test_RunHandle_Wait tests that Wait returns the result of a handle's work once.
+func Test_RunHandle_Wait(t *testing.T) {
+	t.Run("result", func(t *testing.T) {
+		h := newRunHandle()
+		h.finish(nil)
+
+		require.NoError(t, h.Wait())
+		require.EqualError(t, h.Wait(), "invalid run handle")
+		require.EqualError(t, h.WaitContext(context.Background()), "invalid run handle")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		h := newRunHandle()
+		release := make(chan struct{})
+		fakeSource{h}.finishLater(release, errors.New("command buffer failed"))
+		close(release)
+
+		require.EqualError(t, h.Wait(), "command buffer failed")
+		require.EqualError(t, h.Wait(), "invalid run handle")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var h *RunHandle
+		require.EqualError(t, h.Wait(), "invalid run handle")
+		require.EqualError(t, h.WaitContext(context.Background()), "invalid run handle")
+		require.EqualError(t, (&RunHandle{}).Wait(), "invalid run handle")
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		h := newRunHandle()
+		release := make(chan struct{})
+		fakeSource{h}.finishLater(release, nil)
+
+		const n = 8
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = h.Wait()
+			}()
+		}
+		close(release)
+		wg.Wait()
+
+		// Exactly one of the waits returns the result.
+		var results int
+		for _, err := range errs {
+			if err == nil {
+				results++
+				continue
+			}
+			require.EqualError(t, err, "invalid run handle")
+		}
+		require.Equal(t, 1, results)
+	})
+}
+
+// Test_RunHandle_WaitContext tests that WaitContext gives up when its context is done, without
+// spending the handle, and that the work still finishes in the background.
+func Test_RunHandle_WaitContext(t *testing.T) {
+	t.Run("canceled", func(t *testing.T) {
+		h := newRunHandle()
+		release := make(chan struct{})
+		fakeSource{h}.finishLater(release, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.ErrorIs(t, h.WaitContext(ctx), context.Canceled)
+		require.Equal(t, RunStatusScheduled, h.Status())
+
+		// Waiting again waits for the same work.
+		close(release)
+		require.NoError(t, h.Wait())
+		require.Equal(t, RunStatusCompleted, h.Status())
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		h := newRunHandle()
+		release := make(chan struct{})
+		fakeSource{h}.finishLater(release, errors.New("command buffer failed"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, h.WaitContext(ctx), context.DeadlineExceeded)
+		require.ErrorIs(t, h.WaitContext(ctx), context.DeadlineExceeded)
+
+		close(release)
+		require.EqualError(t, h.WaitContext(context.Background()), "command buffer failed")
+		require.EqualError(t, h.Wait(), "invalid run handle")
+	})
+
+	t.Run("finished in the background", func(t *testing.T) {
+		h := newRunHandle()
+		release := make(chan struct{})
+		fakeSource{h}.finishLater(release, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.ErrorIs(t, h.WaitContext(ctx), context.Canceled)
+
+		// Nothing waits for the work again, but it still finishes.
+		close(release)
+		<-h.Done()
+		require.Equal(t, RunStatusCompleted, h.Status())
+	})
+
+	t.Run("finished work wins", func(t *testing.T) {
+		h := newRunHandle()
+		h.finish(nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.NoError(t, h.WaitContext(ctx))
+	})
+}
+
+// Test_RunHandle_Done tests that Done, Err, and Status follow the progress of a handle's work
+// without spending the handle.
+func Test_RunHandle_Done(t *testing.T) {
+	t.Run("completed", func(t *testing.T) {
+		h := newRunHandle()
+		source := fakeSource{h}
+		release := make(chan struct{})
+
+		require.Equal(t, RunStatusScheduled, h.Status())
+		source.start()
+		require.Equal(t, RunStatusRunning, h.Status())
+		require.NoError(t, h.Err())
+		select {
+		case <-h.Done():
+			t.Fatal("Done is closed before the work finished")
+		default:
+		}
+
+		source.finishLater(release, nil)
+		close(release)
+		select {
+		case <-h.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Done is not closed after the work finished")
+		}
+		require.Equal(t, RunStatusCompleted, h.Status())
+		require.NoError(t, h.Err())
+
+		// The handle is not spent until a wait returns the result.
+		require.NoError(t, h.Wait())
+		require.NoError(t, h.Err())
+		require.Equal(t, RunStatusCompleted, h.Status())
+		require.EqualError(t, h.Wait(), "invalid run handle")
+	})
+
+	t.Run("errored", func(t *testing.T) {
+		h := newRunHandle()
+		h.finish(errors.New("command buffer failed"))
+
+		<-h.Done()
+		require.Equal(t, RunStatusErrored, h.Status())
+		require.EqualError(t, h.Err(), "command buffer failed")
+		require.EqualError(t, h.Err(), "command buffer failed")
+
+		// A backend can report that the work started after it finished; the status stays final.
+		h.running()
+		require.Equal(t, RunStatusErrored, h.Status())
+	})
+
+	t.Run("select", func(t *testing.T) {
+		handles := []*RunHandle{newRunHandle(), newRunHandle(), newRunHandle()}
+		release := make(chan struct{})
+		fakeSource{handles[1]}.finishLater(release, nil)
+		close(release)
+
+		var finished int
+		select {
+		case <-handles[0].Done():
+		case <-handles[1].Done():
+			finished = 1
+		case <-handles[2].Done():
+		}
+		require.Equal(t, 1, finished)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, h := range []*RunHandle{nil, {}} {
+			<-h.Done()
+			require.EqualError(t, h.Err(), "invalid run handle")
+			require.Equal(t, RunStatusErrored, h.Status())
+		}
+	})
+}
+
+// Test_RunHandle_OnComplete tests that every function registered with OnComplete is called once
+// with the result of a handle's work, whether it was registered before or after the work finished.
+func Test_RunHandle_OnComplete(t *testing.T) {
+	h := newRunHandle()
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	var results []error
+	var wg sync.WaitGroup
+	record := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, err)
+		wg.Done()
+	}
+
+	wg.Add(2)
+	h.OnComplete(record)
+	h.OnComplete(record)
+	h.OnComplete(nil)
+	mu.Lock()
+	require.Empty(t, results)
+	mu.Unlock()
+
+	failed := errors.New("command buffer failed")
+	fakeSource{h}.finishLater(release, failed)
+	close(release)
+	wg.Wait()
+	require.Equal(t, []error{failed, failed}, results)
+
+	// Functions registered after the work finished are called before OnComplete returns.
+	wg.Add(1)
+	h.OnComplete(record)
+	require.Equal(t, []error{failed, failed, failed}, results)
+
+	// OnComplete does not spend the handle.
+	require.ErrorIs(t, h.Wait(), failed)
+
+	t.Run("invalid", func(t *testing.T) {
+		var err error
+		(&RunHandle{}).OnComplete(func(e error) { err = e })
+		require.EqualError(t, err, "invalid run handle")
+	})
+}
+
+// Test_WaitAll tests that WaitAll waits for every handle, spends each one, and reports every
+// failure with the index of its handle.
+func Test_WaitAll(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		handles := []*RunHandle{newRunHandle(), newRunHandle(), newRunHandle()}
+		release := make(chan struct{})
+		for _, h := range handles {
+			fakeSource{h}.finishLater(release, nil)
+		}
+		close(release)
+
+		require.NoError(t, WaitAll(handles...))
+		for _, h := range handles {
+			require.EqualError(t, h.Wait(), "invalid run handle")
+		}
+		require.NoError(t, WaitAll())
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		handles := []*RunHandle{newRunHandle(), newRunHandle(), newRunHandle(), nil}
+		failed := errors.New("command buffer failed")
+		release := make(chan struct{})
+		fakeSource{handles[0]}.finishLater(release, failed)
+		fakeSource{handles[1]}.finishLater(release, nil)
+		fakeSource{handles[2]}.finishLater(release, failed)
+		close(release)
+
+		err := WaitAll(handles...)
+		require.EqualError(t, err, "run handle 0: command buffer failed\n"+
+			"run handle 2: command buffer failed\n"+
+			"run handle 3: invalid run handle")
+		require.ErrorIs(t, err, failed)
+
+		// Every handle was spent, including the ones that failed.
+		err = WaitAll(handles[:3]...)
+		require.EqualError(t, err, "run handle 0: invalid run handle\n"+
+			"run handle 1: invalid run handle\n"+
+			"run handle 2: invalid run handle")
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		h := newRunHandle()
+		h.finish(nil)
+		require.EqualError(t, WaitAll(h, h), "run handle 1: invalid run handle")
+	})
+}
+
+// Test_WaitAny tests that WaitAny returns handles in the order that their work finishes, spending
+// only the one it returns, and gives up when its context is done.
+func Test_WaitAny(t *testing.T) {
+	t.Run("order", func(t *testing.T) {
+		handles := []*RunHandle{newRunHandle(), newRunHandle(), newRunHandle()}
+		releases := []chan struct{}{make(chan struct{}), make(chan struct{}), make(chan struct{})}
+		failed := errors.New("command buffer failed")
+		fakeSource{handles[0]}.finishLater(releases[0], nil)
+		fakeSource{handles[1]}.finishLater(releases[1], failed)
+		fakeSource{handles[2]}.finishLater(releases[2], nil)
+
+		for _, want := range []int{2, 0, 1} {
+			close(releases[want])
+
+			i, err := WaitAny(context.Background(), handles...)
+			require.Equal(t, want, i)
+			if want == 1 {
+				require.ErrorIs(t, err, failed)
+			} else {
+				require.NoError(t, err)
+			}
+			require.EqualError(t, handles[i].Wait(), "invalid run handle")
+		}
+
+		i, err := WaitAny(context.Background(), handles...)
+		require.Equal(t, -1, i)
+		require.EqualError(t, err, "no run handles to wait for")
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		i, err := WaitAny(context.Background())
+		require.Equal(t, -1, i)
+		require.EqualError(t, err, "no run handles to wait for")
+
+		h := newRunHandle()
+		h.finish(nil)
+		i, err = WaitAny(context.Background(), nil, &RunHandle{}, h)
+		require.Equal(t, 2, i)
+		require.NoError(t, err)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		handles := []*RunHandle{newRunHandle(), newRunHandle()}
+		release := make(chan struct{})
+		fakeSource{handles[1]}.finishLater(release, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		i, err := WaitAny(ctx, handles...)
+		require.Equal(t, -1, i)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// No handle was spent, and finished work wins over a context that is already done.
+		close(release)
+		<-handles[1].Done()
+		i, err = WaitAny(ctx, handles...)
+		require.Equal(t, 1, i)
+		require.NoError(t, err)
+
+		handles[0].finish(nil)
+		require.NoError(t, handles[0].Wait())
+	})
+}
@@ -1,12 +1,5 @@
-//go:build darwin
-
 package metal
 
-/*
-#include <stdlib.h>
-*/
-import "C"
-
 import (
 	"errors"
 	"fmt"
@@ -39,38 +32,90 @@ func sizeof[T any]() int {
 	return int(unsafe.Sizeof(t))
 }
 
-// The error categories the C layer reports through its errorCode out-param. These must stay in
-// sync with enum MetalErrorCode in Error.h. errCodeNone (the zero value) means the failure has no
+// The error categories the C layer reports through its errorCode out-param, which the other
+// backends reuse for the same conditions. These must stay in sync with enum MetalErrorCode in
+// Error.h. errCodeNone (the zero value) means the failure has no
 // associated sentinel; it is what every out-param starts at and what plain errors leave behind.
 const (
 	errCodeNone              = 0
 	errCodeInvalidFunctionId = 1
 	errCodeInvalidBufferId   = 2
+	errCodeInvalidLibraryId  = 3
+	errCodeCompile           = 4
+	errCodeGPUTimeout        = 5
+	errCodeGPUPageFault      = 6
+	errCodeGPUOutOfMemory    = 7
+)
+
+// The MTLCommandBufferError codes of a command buffer that failed while running that have a
+// sentinel of their own. The C layer reports the code as Metal gives it, and commandBufferErrorCode
+// classifies it, so that the mapping can be tested without a GPU.
+const (
+	mtlCommandBufferErrorTimeout     = 2
+	mtlCommandBufferErrorPageFault   = 3
+	mtlCommandBufferErrorOutOfMemory = 8
 )
 
-// sentinelForCode maps a C error code to the Go sentinel callers test for with errors.Is. An
+// commandBufferErrorCode maps the MTLCommandBufferError code of a command buffer that failed while
+// running to an error code. A failure without a sentinel of its own, such as an internal error,
+// maps to errCodeNone.
+func commandBufferErrorCode(mtlCode int) int {
+	switch mtlCode {
+	case mtlCommandBufferErrorTimeout:
+		return errCodeGPUTimeout
+	case mtlCommandBufferErrorPageFault:
+		return errCodeGPUPageFault
+	case mtlCommandBufferErrorOutOfMemory:
+		return errCodeGPUOutOfMemory
+	default:
+		return errCodeNone
+	}
+}
+
+// sentinelForCode maps an error code to the Go sentinel callers test for with errors.Is. An
 // unrecognized or none code maps to nil (no sentinel).
-func sentinelForCode(code C.int) error {
-	switch int(code) {
+func sentinelForCode(code int) error {
+	switch code {
 	case errCodeInvalidFunctionId:
 		return ErrInvalidFunctionId
 	case errCodeInvalidBufferId:
 		return ErrInvalidBufferId
+	case errCodeInvalidLibraryId:
+		return ErrInvalidLibrary
+	case errCodeGPUTimeout:
+		return ErrGPUTimeout
+	case errCodeGPUPageFault:
+		return ErrGPUPageFault
+	case errCodeGPUOutOfMemory:
+		return ErrGPUOutOfMemory
 	default:
 		return nil
 	}
 }
 
-// metalErrToError builds a Go error from a C error message and category code. metalErr is the
-// human-readable message (C.GoString returns "" for a nil pointer); wrap is an optional Go-side
-// prefix; code is the category the C layer set, used to attach a sentinel so callers can match
-// with errors.Is. The message and the sentinel are independent: the sentinel is decided by the
-// code alone, never by parsing the message text.
+// sentinelOf returns the sentinel that err matches with errors.Is out of those that an error code
+// can attach, or nil if it matches none.
+func sentinelOf(err error) error {
+	for _, sentinel := range []error{
+		ErrInvalidFunctionId, ErrInvalidBufferId, ErrInvalidLibrary,
+		ErrGPUTimeout, ErrGPUPageFault, ErrGPUOutOfMemory,
+	} {
+		if errors.Is(err, sentinel) {
+			return sentinel
+		}
+	}
+
+	return nil
+}
+
+// newError builds a Go error from a backend error message and category code. msg is the
+// human-readable message; wrap is an optional Go-side prefix; code is the category the backend
+// assigned, used to attach a sentinel so callers can match with errors.Is. The message and the
+// sentinel are independent: the sentinel is decided by the code alone, never by parsing the message
+// text.
 //
 // It returns nil only when there is no message and no wrap.
-func metalErrToError(metalErr *C.char, wrap string, code C.int) error {
-	msg := C.GoString(metalErr)
-
+func newError(msg, wrap string, code int) error {
 	var err error
 	switch {
 	case msg == "" && wrap == "":
@@ -105,17 +150,3 @@ func (e sentinelError) Error() string { return e.err.Error() }
 func (e sentinelError) Is(target error) bool { return target == e.sentinel }
 
 func (e sentinelError) Unwrap() error { return e.err }
-
-// freeCString releases a C string allocated on the C heap (via strdup, malloc,
-// or C.CString). Safe to call with a nil pointer.
-func freeCString(s *C.char) {
-	if s != nil {
-		C.free(unsafe.Pointer(s))
-	}
-}
-
-// cgoString and cgoFree are wrappers around cgo functions for the test files. They must live in a
-// non-test file: Go does not support `import "C"` from _test.go files ("use of cgo in test not
-// supported"), so the tests reach C only through wrappers like these.
-func cgoString(s string) *C.char { return C.CString(s) }
-func cgoFree(s *C.char)          { C.free(unsafe.Pointer(s)) }
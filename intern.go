@@ -0,0 +1,167 @@
+package metal
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ----------------------------------------------------------------------------
+// Function interning
+// ----------------------------------------------------------------------------
+
+// SetFunctionInterning turns interning of functions on or off. While it is on, NewFunction,
+// NewFunctionWithOptions, and NewFunctionFS compile a pipeline only the first time they are called
+// with a given source, function name, and CompileOptions on a backend. Later identical calls return
+// a new Function that shares the compiled pipeline instead, which saves the compilation when
+// several packages set up the same function independently.
+//
+// Every Function is still closed on its own: the shared pipeline is released when the last
+// Function that holds it is closed, and closing one does not invalidate the others. Turning
+// interning off stops new Functions from being shared, but Functions that already share a pipeline
+// keep sharing it. Functions set up from a Library are never interned. Interning is off by default,
+// and SetFunctionInterning is safe for concurrent use.
+func SetFunctionInterning(enabled bool) {
+	interned.enabled.Store(enabled)
+}
+
+// FunctionStats report how often pipelines were compiled and shared.
+type FunctionStats struct {
+	// Compilations is the number of pipelines compiled for NewFunction, NewFunctionWithOptions, and
+	// NewFunctionFS.
+	Compilations int
+	// CompilationsAvoided is the number of Functions that shared an interned pipeline instead of
+	// compiling their own.
+	CompilationsAvoided int
+	// Interned is the number of interned pipelines that are currently held by at least one
+	// Function.
+	Interned int
+}
+
+// Stats returns how often pipelines have been compiled and shared since the program started.
+func Stats() FunctionStats {
+	return interned.stats()
+}
+
+// interned holds the pipelines that are shared by interned Functions.
+var interned = &internTable{pipelines: make(map[internKey]*sharedPipeline)}
+
+// An internTable holds the interned pipelines, keyed by everything that makes one pipeline differ
+// from another.
+type internTable struct {
+	enabled atomic.Bool
+
+	mu        sync.Mutex
+	pipelines map[internKey]*sharedPipeline
+	compiled  int
+	avoided   int
+}
+
+// An internKey identifies an interned pipeline. Ids are only meaningful to the backend that handed
+// them out, so the backend is part of the key.
+type internKey struct {
+	b   backend
+	key string
+}
+
+// A sharedPipeline is a compiled pipeline and the number of Functions that hold it.
+type sharedPipeline struct {
+	key internKey
+	// ready is closed once the pipeline has been compiled, or has failed to compile. Until then, fn
+	// and err are not set.
+	ready chan struct{}
+	// fn is the Function that the pipeline was compiled for, which every Function that shares it is a
+	// copy of.
+	fn  Function
+	err error
+	// refs is the number of Functions that hold the pipeline, or are waiting for it to compile.
+	refs int
+}
+
+// function returns a Function for funcName in source, compiled with opts on b, that shares the
+// pipeline of every other interned Function with the same key. The pipeline is compiled if no
+// interned Function holds it, and calls that ask for it while it compiles wait for it, and share
+// its error if it does not compile.
+func (t *internTable) function(b backend, source, funcName string, opts *CompileOptions) (*Function, error) {
+	key := internKey{b: b, key: pipelineKey(source, funcName, opts, "")}
+
+	t.mu.Lock()
+	p, ok := t.pipelines[key]
+	if !ok {
+		p = &sharedPipeline{key: key, ready: make(chan struct{})}
+		t.pipelines[key] = p
+	}
+	p.refs++
+	t.mu.Unlock()
+
+	if ok {
+		<-p.ready
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if p.err != nil {
+			p.refs--
+			return nil, p.err
+		}
+		t.avoided++
+		f := p.fn
+		return &f, nil
+	}
+
+	f, err := compileFunction(b, source, funcName, opts)
+
+	t.mu.Lock()
+	if err != nil {
+		// The failure is shared only with the calls that are already waiting for it.
+		p.err = err
+		p.refs--
+		delete(t.pipelines, key)
+	} else {
+		f.shared = p
+		p.fn = *f
+	}
+	t.mu.Unlock()
+	close(p.ready)
+
+	return f, err
+}
+
+// release drops f's hold on its shared pipeline, and closes the pipeline if f was the last Function
+// that held it.
+func (t *internTable) release(f *Function) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := f.shared
+	p.refs--
+	if p.refs > 0 {
+		return nil
+	}
+	if t.pipelines[p.key] == p {
+		delete(t.pipelines, p.key)
+	}
+
+	return f.backend().closeFunction(f.id)
+}
+
+// countCompilation records that a pipeline was compiled for NewFunctionWithOptions.
+func (t *internTable) countCompilation() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.compiled++
+}
+
+// stats returns the table's counts.
+func (t *internTable) stats() FunctionStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := FunctionStats{Compilations: t.compiled, CompilationsAvoided: t.avoided}
+	for _, p := range t.pipelines {
+		if p.fn.Valid() {
+			s.Interned++
+		}
+	}
+	return s
+}
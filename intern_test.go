@@ -0,0 +1,152 @@
+package metal
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// These tests force the CPU backend, so that they share no function ids with the darwin tests that
+// track the Metal backend's.
+
+// Test_SetFunctionInterning tests that identical functions share one pipeline while interning is
+// on, and that the pipeline is released only when the last of them is closed.
+func Test_SetFunctionInterning(t *testing.T) {
+	defer SetCPUOptions(CPUOptions{})
+	SetCPUOptions(CPUOptions{Force: true})
+	defer SetFunctionInterning(false)
+	SetFunctionInterning(true)
+
+	before := Stats()
+
+	f1, err := NewFunction(sourceTransfer1D, "transfer1D")
+	require.NoError(t, err)
+	f2, err := NewFunctionWithOptions(sourceTransfer1D, "transfer1D", CompileOptions{})
+	require.NoError(t, err)
+	require.NotSame(t, f1, f2)
+	require.Equal(t, f1.id, f2.id)
+	require.Equal(t, FunctionStats{
+		Compilations:        before.Compilations + 1,
+		CompilationsAvoided: before.CompilationsAvoided + 1,
+		Interned:            before.Interned + 1,
+	}, Stats())
+
+	t.Run("different", func(t *testing.T) {
+		// Each of these compiles a pipeline of its own.
+		f3, err := NewFunction(sourceTransfer1D+"\n", "transfer1D")
+		require.NoError(t, err)
+		f4, err := NewFunctionWithOptions(sourceTransfer1D, "transfer1D", CompileOptions{MathMode: MathModeSafe})
+		require.NoError(t, err)
+		require.NotEqual(t, f1.id, f3.id)
+		require.NotEqual(t, f1.id, f4.id)
+		require.NotEqual(t, f3.id, f4.id)
+		require.Equal(t, before.Compilations+3, Stats().Compilations)
+		require.Equal(t, before.Interned+3, Stats().Interned)
+
+		require.NoError(t, f3.Close())
+		require.NoError(t, f4.Close())
+		require.Equal(t, before.Interned+1, Stats().Interned)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		id := f1.id
+
+		require.NoError(t, f1.Close())
+		require.False(t, f1.Valid())
+		require.ErrorIs(t, f1.Close(), ErrInvalidFunctionId)
+
+		// f2 still holds the pipeline.
+		_, ok := cpu.lookupFunction(id)
+		require.True(t, ok)
+		require.Equal(t, "transfer1D", f2.String())
+		args, err := f2.Arguments()
+		require.NoError(t, err)
+		require.Len(t, args, 3)
+
+		require.NoError(t, f2.Close())
+		_, ok = cpu.lookupFunction(id)
+		require.False(t, ok)
+		require.Equal(t, before.Interned, Stats().Interned)
+
+		// The next function compiles the pipeline again.
+		f5, err := NewFunction(sourceTransfer1D, "transfer1D")
+		require.NoError(t, err)
+		require.NotEqual(t, id, f5.id)
+		require.Equal(t, before.Compilations+4, Stats().Compilations)
+		require.NoError(t, f5.Close())
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		// A function that does not compile is not interned.
+		_, err := NewFunction(sourceTransfer1D, "transfer2D")
+		require.EqualError(t, err, "unable to set up metal function: failed to find function 'transfer2D'")
+		_, err = NewFunction(sourceTransfer1D, "transfer2D")
+		require.Error(t, err)
+		require.Equal(t, before.Interned, Stats().Interned)
+		require.Equal(t, before.CompilationsAvoided+1, Stats().CompilationsAvoided)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		SetFunctionInterning(false)
+		defer SetFunctionInterning(true)
+
+		f6, err := NewFunction(sourceTransfer1D, "transfer1D")
+		require.NoError(t, err)
+		f7, err := NewFunction(sourceTransfer1D, "transfer1D")
+		require.NoError(t, err)
+		require.NotEqual(t, f6.id, f7.id)
+		require.Nil(t, f6.shared)
+		require.Equal(t, before.Interned, Stats().Interned)
+		require.NoError(t, f6.Close())
+		require.NoError(t, f7.Close())
+	})
+}
+
+// Test_SetFunctionInterning_threadSafe tests that functions set up at the same time share one
+// pipeline, which is compiled once.
+func Test_SetFunctionInterning_threadSafe(t *testing.T) {
+	defer SetCPUOptions(CPUOptions{})
+	SetCPUOptions(CPUOptions{Force: true})
+	defer SetFunctionInterning(false)
+	SetFunctionInterning(true)
+
+	before := Stats()
+
+	const n = 16
+	functions := make([]*Function, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			functions[i], errs[i] = NewFunction(sourceSine, "sine")
+		}()
+	}
+	wg.Wait()
+
+	for i := range n {
+		require.NoError(t, errs[i])
+		require.Equal(t, functions[0].id, functions[i].id)
+	}
+	require.Equal(t, before.Compilations+1, Stats().Compilations)
+	require.Equal(t, before.CompilationsAvoided+n-1, Stats().CompilationsAvoided)
+
+	id := functions[0].id
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = functions[i].Close()
+		}()
+	}
+	wg.Wait()
+
+	for i := range n {
+		require.NoError(t, errs[i])
+	}
+	_, ok := cpu.lookupFunction(id)
+	require.False(t, ok)
+	require.Equal(t, before.Interned, Stats().Interned)
+}
@@ -0,0 +1,221 @@
+package msl
+
+// The syntax tree produced by the parser. Nodes carry only what the source says; types are
+// resolved and checked when a function is compiled.
+
+// A typeSpec is a written type: an optional address space and qualifiers, a scalar or vector
+// name, and an optional pointer or reference declarator.
+type typeSpec struct {
+	pos     Pos
+	name    string
+	typ     Type
+	space   AddressSpace
+	spaced  bool
+	isConst bool
+	pointer bool
+	ref     bool
+}
+
+// An attribute is one [[name]] or [[name(args)]] attribute. args holds the raw text of the
+// comma-separated arguments.
+type attribute struct {
+	pos  Pos
+	name string
+	args []string
+}
+
+type (
+	expr interface{ exprPos() Pos }
+
+	litExpr struct {
+		pos Pos
+		typ Type
+		v   value
+	}
+
+	identExpr struct {
+		pos  Pos
+		name string
+	}
+
+	unaryExpr struct {
+		pos Pos
+		op  string
+		x   expr
+	}
+
+	postfixExpr struct {
+		pos Pos
+		op  string
+		x   expr
+	}
+
+	binaryExpr struct {
+		pos  Pos
+		op   string
+		x, y expr
+	}
+
+	assignExpr struct {
+		pos  Pos
+		op   string
+		x, y expr
+	}
+
+	condExpr struct {
+		pos        Pos
+		cond, x, y expr
+	}
+
+	// callExpr is a function call, a vector constructor (when name is a type), or a template call
+	// such as static_cast<float>(x) (when targ is set).
+	callExpr struct {
+		pos  Pos
+		name string
+		targ *typeSpec
+		args []expr
+	}
+
+	castExpr struct {
+		pos Pos
+		typ typeSpec
+		x   expr
+	}
+
+	indexExpr struct {
+		pos      Pos
+		x, index expr
+	}
+
+	memberExpr struct {
+		pos  Pos
+		x    expr
+		name string
+	}
+
+	initListExpr struct {
+		pos   Pos
+		elems []expr
+	}
+)
+
+func (e *litExpr) exprPos() Pos      { return e.pos }
+func (e *identExpr) exprPos() Pos    { return e.pos }
+func (e *unaryExpr) exprPos() Pos    { return e.pos }
+func (e *postfixExpr) exprPos() Pos  { return e.pos }
+func (e *binaryExpr) exprPos() Pos   { return e.pos }
+func (e *assignExpr) exprPos() Pos   { return e.pos }
+func (e *condExpr) exprPos() Pos     { return e.pos }
+func (e *callExpr) exprPos() Pos     { return e.pos }
+func (e *castExpr) exprPos() Pos     { return e.pos }
+func (e *indexExpr) exprPos() Pos    { return e.pos }
+func (e *memberExpr) exprPos() Pos   { return e.pos }
+func (e *initListExpr) exprPos() Pos { return e.pos }
+
+type (
+	stmt interface{ stmtPos() Pos }
+
+	blockStmt struct {
+		pos   Pos
+		stmts []stmt
+	}
+
+	// declarator is one name in a declaration, with its optional array length, attributes, and
+	// initializer. An array declared with empty brackets has array set and a nil arrayLen.
+	declarator struct {
+		pos      Pos
+		name     string
+		array    bool
+		arrayLen expr
+		attrs    []attribute
+		init     expr
+	}
+
+	declStmt struct {
+		pos   Pos
+		typ   typeSpec
+		decls []declarator
+	}
+
+	exprStmt struct {
+		pos Pos
+		x   expr
+	}
+
+	ifStmt struct {
+		pos  Pos
+		cond expr
+		then stmt
+		els  stmt
+	}
+
+	forStmt struct {
+		pos  Pos
+		init stmt
+		cond expr
+		post expr
+		body stmt
+	}
+
+	whileStmt struct {
+		pos  Pos
+		cond expr
+		body stmt
+	}
+
+	doStmt struct {
+		pos  Pos
+		body stmt
+		cond expr
+	}
+
+	returnStmt struct {
+		pos Pos
+		x   expr
+	}
+
+	branchStmt struct {
+		pos Pos
+		tok string
+	}
+
+	emptyStmt struct {
+		pos Pos
+	}
+)
+
+func (s *blockStmt) stmtPos() Pos  { return s.pos }
+func (s *declStmt) stmtPos() Pos   { return s.pos }
+func (s *exprStmt) stmtPos() Pos   { return s.pos }
+func (s *ifStmt) stmtPos() Pos     { return s.pos }
+func (s *forStmt) stmtPos() Pos    { return s.pos }
+func (s *whileStmt) stmtPos() Pos  { return s.pos }
+func (s *doStmt) stmtPos() Pos     { return s.pos }
+func (s *returnStmt) stmtPos() Pos { return s.pos }
+func (s *branchStmt) stmtPos() Pos { return s.pos }
+func (s *emptyStmt) stmtPos() Pos  { return s.pos }
+
+// A paramDecl is one function parameter.
+type paramDecl struct {
+	pos   Pos
+	typ   typeSpec
+	name  string
+	attrs []attribute
+}
+
+// A funcDecl is a function definition (or, if body is nil, a declaration).
+type funcDecl struct {
+	pos    Pos
+	kernel bool
+	attrs  []attribute
+	ret    typeSpec
+	name   string
+	params []paramDecl
+	body   *blockStmt
+}
+
+// A file is a parsed source file: its functions and program-scope variables, in source order.
+type file struct {
+	funcs   []*funcDecl
+	globals []*declStmt
+}
@@ -0,0 +1,460 @@
+package msl
+
+import (
+	"math"
+)
+
+// A builtin compiles a call to a function of the Metal standard library.
+type builtin func(fc *funcCompiler, pos Pos, name string, args []operand) operand
+
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		// metal_math
+		"acos":     floatFunc1(math.Acos),
+		"acosh":    floatFunc1(math.Acosh),
+		"asin":     floatFunc1(math.Asin),
+		"asinh":    floatFunc1(math.Asinh),
+		"atan":     floatFunc1(math.Atan),
+		"atanh":    floatFunc1(math.Atanh),
+		"ceil":     floatFunc1(math.Ceil),
+		"cos":      floatFunc1(math.Cos),
+		"cosh":     floatFunc1(math.Cosh),
+		"cospi":    floatFunc1(func(x float64) float64 { return math.Cos(math.Pi * x) }),
+		"exp":      floatFunc1(math.Exp),
+		"exp2":     floatFunc1(math.Exp2),
+		"exp10":    floatFunc1(func(x float64) float64 { return math.Pow(10, x) }),
+		"fabs":     floatFunc1(math.Abs),
+		"floor":    floatFunc1(math.Floor),
+		"fract":    floatFunc1(fract),
+		"log":      floatFunc1(math.Log),
+		"log2":     floatFunc1(math.Log2),
+		"log10":    floatFunc1(math.Log10),
+		"rint":     floatFunc1(math.RoundToEven),
+		"round":    floatFunc1(math.Round),
+		"rsqrt":    floatFunc1(func(x float64) float64 { return 1 / math.Sqrt(x) }),
+		"sin":      floatFunc1(math.Sin),
+		"sinh":     floatFunc1(math.Sinh),
+		"sinpi":    floatFunc1(func(x float64) float64 { return math.Sin(math.Pi * x) }),
+		"sqrt":     floatFunc1(math.Sqrt),
+		"tan":      floatFunc1(math.Tan),
+		"tanh":     floatFunc1(math.Tanh),
+		"tanpi":    floatFunc1(func(x float64) float64 { return math.Tan(math.Pi * x) }),
+		"trunc":    floatFunc1(math.Trunc),
+		"atan2":    floatFunc2(math.Atan2),
+		"copysign": floatFunc2(math.Copysign),
+		"fdim":     floatFunc2(math.Dim),
+		"fmax":     floatFunc2(fmax),
+		"fmin":     floatFunc2(fmin),
+		"fmod":     floatFunc2(math.Mod),
+		"hypot":    floatFunc2(math.Hypot),
+		"pow":      floatFunc2(math.Pow),
+		"powr":     floatFunc2(math.Pow),
+		"fma":      floatFunc3(math.FMA),
+		"mad":      floatFunc3(math.FMA),
+
+		// metal_common
+		"mix":        floatFunc3(func(x, y, a float64) float64 { return x + (y-x)*a }),
+		"saturate":   floatFunc1(func(x float64) float64 { return fmin(fmax(x, 0), 1) }),
+		"sign":       floatFunc1(sign),
+		"smoothstep": floatFunc3(smoothstep),
+		"step":       floatFunc2(func(edge, x float64) float64 { return boolFloat(x >= edge) }),
+
+		// metal_integer and the functions common to integers and floats
+		"abs":      absBuiltin,
+		"clamp":    clampBuiltin,
+		"max":      minMaxBuiltin,
+		"min":      minMaxBuiltin,
+		"clz":      intFunc1(countLeadingZeros),
+		"ctz":      intFunc1(countTrailingZeros),
+		"popcount": intFunc1(popCount),
+
+		// metal_geometric
+		"cross":     crossBuiltin,
+		"distance":  geometricBuiltin,
+		"dot":       geometricBuiltin,
+		"length":    geometricBuiltin,
+		"normalize": geometricBuiltin,
+
+		// metal_relational
+		"all":      allAnyBuiltin,
+		"any":      allAnyBuiltin,
+		"isfinite": floatPredicate(func(x float64) bool { return !math.IsInf(x, 0) && !math.IsNaN(x) }),
+		"isinf":    floatPredicate(func(x float64) bool { return math.IsInf(x, 0) }),
+		"isnan":    floatPredicate(math.IsNaN),
+		"signbit":  floatPredicate(math.Signbit),
+		"select":   selectBuiltin,
+	}
+}
+
+func fract(x float64) float64 {
+	// The result is less than one even when x is a tiny negative number.
+	return math.Min(x-math.Floor(x), 0x1.fffffep-1)
+}
+
+func fmax(x, y float64) float64 {
+	// Unlike math.Max, fmax returns the other operand when one is NaN.
+	switch {
+	case math.IsNaN(x):
+		return y
+	case math.IsNaN(y):
+		return x
+	}
+	return math.Max(x, y)
+}
+
+func fmin(x, y float64) float64 {
+	switch {
+	case math.IsNaN(x):
+		return y
+	case math.IsNaN(y):
+		return x
+	}
+	return math.Min(x, y)
+}
+
+func sign(x float64) float64 {
+	switch {
+	case x > 0:
+		return 1
+	case x < 0:
+		return -1
+	case math.IsNaN(x):
+		return 0
+	}
+	return x
+}
+
+func smoothstep(edge0, edge1, x float64) float64 {
+	t := fmin(fmax((x-edge0)/(edge1-edge0), 0), 1)
+	return t * t * (3 - 2*t)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ----------------------------------------------------------------------------
+// Argument checking
+// ----------------------------------------------------------------------------
+
+// checkArgs panics unless there are n arguments, all scalars or vectors of numbers.
+func checkArgs(pos Pos, name string, args []operand, n int) {
+	if len(args) != n {
+		panic(errorf(pos, "%s expects %d arguments, found %d", name, n, len(args)))
+	}
+	for _, arg := range args {
+		if !arg.typ.isArith() || arg.typ.Scalar == Bool {
+			panic(errorf(pos, "invalid argument of type %s to %s", arg.typ, name))
+		}
+	}
+}
+
+// unify converts the arguments to their common type, which is a floating-point type if float is
+// set. Scalars broadcast to the width of a vector argument; vectors must all have the same type.
+func (fc *funcCompiler) unify(pos Pos, name string, args []operand, float bool) (Type, []evalFn) {
+	t := args[0].typ.Elem()
+	for _, arg := range args[1:] {
+		u, ok := commonType(t, arg.typ)
+		if !ok {
+			panic(errorf(pos, "no matching function for call to %s(%s, %s)", name, t, arg.typ))
+		}
+		// Unlike an operator, a builtin does not promote narrow integers, so min(short, short) is a
+		// short.
+		if !t.IsVector() && !arg.typ.IsVector() && t.Scalar == arg.typ.Scalar {
+			u = t
+		}
+		t = u
+	}
+	if float && !t.Scalar.IsFloat() {
+		t = vectorType(Float, t.Width)
+	}
+
+	evals := make([]evalFn, len(args))
+	for i, arg := range args {
+		evals[i] = fc.explicitConvert(arg, t, pos).eval
+	}
+	return t, evals
+}
+
+func allKonst(args []operand) bool {
+	for _, arg := range args {
+		if !arg.konst {
+			return false
+		}
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------------
+// Builtin families
+// ----------------------------------------------------------------------------
+
+// floatFunc1 returns a builtin that applies f to each component of one floating-point argument.
+// Integer arguments convert to float.
+func floatFunc1(f func(x float64) float64) builtin {
+	return func(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+		checkArgs(pos, name, args, 1)
+		t, evals := fc.unify(pos, name, args, true)
+		return operand{typ: t, eval: lanewise1(t.Width, evals[0], floatLane1(t.Scalar, f)), konst: allKonst(args)}
+	}
+}
+
+// floatFunc2 is floatFunc1 for functions of two arguments.
+func floatFunc2(f func(x, y float64) float64) builtin {
+	return func(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+		checkArgs(pos, name, args, 2)
+		t, evals := fc.unify(pos, name, args, true)
+		return operand{typ: t, eval: lanewise2(t.Width, evals[0], evals[1], floatLane2(t.Scalar, f)), konst: allKonst(args)}
+	}
+}
+
+// floatFunc3 is floatFunc1 for functions of three arguments.
+func floatFunc3(f func(x, y, z float64) float64) builtin {
+	return func(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+		checkArgs(pos, name, args, 3)
+		t, evals := fc.unify(pos, name, args, true)
+		return operand{typ: t, eval: lanewise3(t.Width, evals[0], evals[1], evals[2], floatLane3(t.Scalar, f)), konst: allKonst(args)}
+	}
+}
+
+// intFunc1 returns a builtin that applies f to each component of one integer argument.
+func intFunc1(f func(s Scalar, a uint64) uint64) builtin {
+	return func(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+		checkArgs(pos, name, args, 1)
+		t, evals := fc.unify(pos, name, args, false)
+		if !t.Scalar.IsInteger() {
+			panic(errorf(pos, "invalid argument of type %s to %s", args[0].typ, name))
+		}
+		s := t.Scalar
+		return operand{typ: t, eval: lanewise1(t.Width, evals[0], func(a uint64) uint64 {
+			return uint64(wrapInt(s, int64(f(s, a))))
+		}), konst: allKonst(args)}
+	}
+}
+
+// floatPredicate returns a builtin that tests each component of one floating-point argument,
+// producing a bool or bool vector.
+func floatPredicate(f func(x float64) bool) builtin {
+	return func(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+		checkArgs(pos, name, args, 1)
+		t, evals := fc.unify(pos, name, args, true)
+		return operand{typ: vectorType(Bool, t.Width), eval: lanewise1(t.Width, evals[0], func(a uint64) uint64 {
+			return boolLane(f(math.Float64frombits(a)))
+		}), konst: allKonst(args)}
+	}
+}
+
+func absBuiltin(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+	checkArgs(pos, name, args, 1)
+	t, evals := fc.unify(pos, name, args, false)
+	s := t.Scalar
+	var f func(a uint64) uint64
+	switch {
+	case s.IsFloat():
+		f = floatLane1(s, math.Abs)
+	case s.IsSigned():
+		f = func(a uint64) uint64 {
+			if int64(a) < 0 {
+				return uint64(wrapInt(s, -int64(a)))
+			}
+			return a
+		}
+	default:
+		f = func(a uint64) uint64 { return a }
+	}
+	return operand{typ: t, eval: lanewise1(t.Width, evals[0], f), konst: allKonst(args)}
+}
+
+// lessFunc returns the less-than comparison for lanes of s.
+func lessFunc(s Scalar) func(a, b uint64) bool {
+	if s.IsFloat() {
+		return func(a, b uint64) bool { return math.Float64frombits(a) < math.Float64frombits(b) }
+	}
+	return intLess(s)
+}
+
+func minMaxBuiltin(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+	checkArgs(pos, name, args, 2)
+	t, evals := fc.unify(pos, name, args, false)
+	s := t.Scalar
+
+	var f laneOp
+	switch {
+	case s.IsFloat() && name == "min":
+		f = floatLane2(s, fmin)
+	case s.IsFloat():
+		f = floatLane2(s, fmax)
+	default:
+		less := intLess(s)
+		if name == "min" {
+			f = func(a, b uint64) uint64 {
+				if less(b, a) {
+					return b
+				}
+				return a
+			}
+		} else {
+			f = func(a, b uint64) uint64 {
+				if less(a, b) {
+					return b
+				}
+				return a
+			}
+		}
+	}
+	return operand{typ: t, eval: lanewise2(t.Width, evals[0], evals[1], f), konst: allKonst(args)}
+}
+
+func clampBuiltin(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+	checkArgs(pos, name, args, 3)
+	t, evals := fc.unify(pos, name, args, false)
+	s := t.Scalar
+
+	var f func(x, lo, hi uint64) uint64
+	if s.IsFloat() {
+		f = floatLane3(s, func(x, lo, hi float64) float64 { return fmin(fmax(x, lo), hi) })
+	} else {
+		less := lessFunc(s)
+		f = func(x, lo, hi uint64) uint64 {
+			if less(x, lo) {
+				x = lo
+			}
+			if less(hi, x) {
+				x = hi
+			}
+			return x
+		}
+	}
+	return operand{typ: t, eval: lanewise3(t.Width, evals[0], evals[1], evals[2], f), konst: allKonst(args)}
+}
+
+// geometricBuiltin compiles dot, length, distance, and normalize. The sums are computed in double
+// precision and rounded once.
+func geometricBuiltin(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+	n := 1
+	if name == "dot" || name == "distance" {
+		n = 2
+	}
+	checkArgs(pos, name, args, n)
+	t, evals := fc.unify(pos, name, args, true)
+	s, width := t.Scalar, t.Width
+
+	lanes := func(v value, i int) float64 { return math.Float64frombits(v.lanes[i]) }
+	rt := scalarType(s)
+	var eval evalFn
+
+	switch name {
+	case "dot":
+		x, y := evals[0], evals[1]
+		eval = func(fr *frame) value {
+			a, b := x(fr), y(fr)
+			sum := 0.0
+			for i := 0; i < width; i++ {
+				sum += lanes(a, i) * lanes(b, i)
+			}
+			return floatValue(s, 1, sum)
+		}
+	case "length":
+		x := evals[0]
+		eval = func(fr *frame) value {
+			a := x(fr)
+			sum := 0.0
+			for i := 0; i < width; i++ {
+				sum += lanes(a, i) * lanes(a, i)
+			}
+			return floatValue(s, 1, math.Sqrt(sum))
+		}
+	case "distance":
+		x, y := evals[0], evals[1]
+		eval = func(fr *frame) value {
+			a, b := x(fr), y(fr)
+			sum := 0.0
+			for i := 0; i < width; i++ {
+				d := lanes(a, i) - lanes(b, i)
+				sum += d * d
+			}
+			return floatValue(s, 1, math.Sqrt(sum))
+		}
+	case "normalize":
+		rt = t
+		x := evals[0]
+		eval = func(fr *frame) value {
+			a := x(fr)
+			sum := 0.0
+			for i := 0; i < width; i++ {
+				sum += lanes(a, i) * lanes(a, i)
+			}
+			scale := 1 / math.Sqrt(sum)
+			var out value
+			for i := 0; i < width; i++ {
+				out.lanes[i] = math.Float64bits(roundFloat(s, lanes(a, i)*scale))
+			}
+			return out
+		}
+	}
+
+	return operand{typ: rt, eval: eval, konst: allKonst(args)}
+}
+
+func crossBuiltin(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+	checkArgs(pos, name, args, 2)
+	t, evals := fc.unify(pos, name, args, true)
+	if t.Width != 3 {
+		panic(errorf(pos, "cross expects 3-component vectors, not %s", t))
+	}
+	s := t.Scalar
+	x, y := evals[0], evals[1]
+	return operand{typ: t, eval: func(fr *frame) value {
+		a, b := x(fr), y(fr)
+		f := func(v value, i int) float64 { return math.Float64frombits(v.lanes[i]) }
+		var out value
+		for i := 0; i < 3; i++ {
+			j, k := (i+1)%3, (i+2)%3
+			out.lanes[i] = math.Float64bits(roundFloat(s, f(a, j)*f(b, k)-f(a, k)*f(b, j)))
+		}
+		return out
+	}, konst: allKonst(args)}
+}
+
+func allAnyBuiltin(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+	if len(args) != 1 || !args[0].typ.isArith() {
+		panic(errorf(pos, "%s expects one bool vector argument", name))
+	}
+	t := vectorType(Bool, args[0].typ.Width)
+	x := fc.explicitConvert(args[0], t, pos).eval
+	width := t.Width
+	all := name == "all"
+	return operand{typ: boolType, eval: func(fr *frame) value {
+		v := x(fr)
+		for i := 0; i < width; i++ {
+			if (v.lanes[i] != 0) != all {
+				return boolValue(!all)
+			}
+		}
+		return boolValue(all)
+	}, konst: allKonst(args)}
+}
+
+// selectBuiltin compiles select(a, b, c), which is c ? b : a component-wise.
+func selectBuiltin(fc *funcCompiler, pos Pos, name string, args []operand) operand {
+	if len(args) != 3 {
+		panic(errorf(pos, "%s expects 3 arguments, found %d", name, len(args)))
+	}
+	checkArgs(pos, name, args[:2], 2)
+	t, evals := fc.unify(pos, name, args[:2], false)
+	if !args[2].typ.isArith() || (args[2].typ.IsVector() && args[2].typ.Width != t.Width) {
+		panic(errorf(pos, "invalid condition of type %s to %s", args[2].typ, name))
+	}
+	c := fc.explicitConvert(args[2], vectorType(Bool, t.Width), pos).eval
+	return operand{typ: t, eval: lanewise3(t.Width, evals[0], evals[1], c, func(a, b, c uint64) uint64 {
+		if c != 0 {
+			return b
+		}
+		return a
+	}), konst: allKonst(args)}
+}
@@ -0,0 +1,1716 @@
+package msl
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Functions are compiled into trees of closures over a frame, so that running a kernel does no
+// parsing, name lookup, or type checking.
+
+// A frame holds the state of one function call on one thread: a slot for every parameter and local
+// variable, and the return value.
+type frame struct {
+	slots []value
+	ret   value
+}
+
+// A ctl reports how a statement finished.
+type ctl int
+
+const (
+	ctlNext ctl = iota
+	ctlBreak
+	ctlContinue
+	ctlReturn
+)
+
+type (
+	// An evalFn evaluates a compiled expression.
+	evalFn func(fr *frame) value
+	// An execFn executes a compiled statement.
+	execFn func(fr *frame) ctl
+)
+
+// An operand is a compiled expression.
+type operand struct {
+	typ  Type
+	eval evalFn
+	// lv is non-nil if the expression designates a location that can be assigned to or, if it is
+	// in memory, have its address taken.
+	lv *lvalue
+	// konst reports whether eval is independent of the frame, so that it can be evaluated during
+	// compilation (with a nil frame).
+	konst bool
+	// array is the length of the array that the expression names, which then decays to a pointer
+	// to its first element, or 0.
+	array int
+}
+
+// An lvalue describes how to find the location that an expression designates.
+type lvalue struct {
+	readonly bool
+	// inMemory reports whether the location is in memory (as opposed to a variable's slot), and
+	// space is its address space if so.
+	inMemory bool
+	space    AddressSpace
+	loc      func(fr *frame) location
+}
+
+// A location is a resolved lvalue: either a slot or a byte offset in memory, holding a value of
+// type typ, optionally narrowed to some of its lanes.
+type location struct {
+	slot  *value
+	mem   *memory
+	off   int
+	typ   Type
+	lanes [4]uint8
+	// n is the number of lanes selected by lanes, or 0 for the whole value.
+	n int
+}
+
+func (l location) load() value {
+	if l.n == 0 {
+		if l.mem != nil {
+			return load(l.mem, l.off, l.typ)
+		}
+		return *l.slot
+	}
+
+	var v value
+	if l.mem != nil {
+		s := l.typ.Scalar
+		for i := 0; i < l.n; i++ {
+			off := l.off + int(l.lanes[i])*s.Size()
+			checkAccess(l.mem, off, scalarType(s))
+			v.lanes[i] = loadScalar(l.mem.bytes[off:], s)
+		}
+		return v
+	}
+	for i := 0; i < l.n; i++ {
+		v.lanes[i] = l.slot.lanes[l.lanes[i]]
+	}
+	return v
+}
+
+func (l location) store(v value) {
+	if l.n == 0 {
+		if l.mem != nil {
+			store(l.mem, l.off, l.typ, v)
+		} else {
+			*l.slot = v
+		}
+		return
+	}
+
+	// Write only the selected lanes, so that threads writing different components of the same
+	// vector in memory do not interfere.
+	if l.mem != nil {
+		s := l.typ.Scalar
+		for i := 0; i < l.n; i++ {
+			off := l.off + int(l.lanes[i])*s.Size()
+			checkAccess(l.mem, off, scalarType(s))
+			storeScalar(l.mem.bytes[off:], s, v.lanes[i])
+		}
+		return
+	}
+	for i := 0; i < l.n; i++ {
+		l.slot.lanes[l.lanes[i]] = v.lanes[i]
+	}
+}
+
+// lane narrows l to lane i of its (vector) value.
+func (l location) lane(i, width int) location {
+	if i < 0 || i >= width {
+		panic(fmt.Sprintf("vector index %d out of range for %d components", i, width))
+	}
+	if l.n > 0 {
+		i = int(l.lanes[i])
+	}
+	l.lanes[0], l.n = uint8(i), 1
+	return l
+}
+
+// swizzle narrows l to the given lanes of its (vector) value.
+func (l location) swizzle(lanes []int) location {
+	var out [4]uint8
+	for i, lane := range lanes {
+		if l.n > 0 {
+			lane = int(l.lanes[lane])
+		}
+		out[i] = uint8(lane)
+	}
+	l.lanes, l.n = out, len(lanes)
+	return l
+}
+
+// ----------------------------------------------------------------------------
+// Symbols and scopes
+// ----------------------------------------------------------------------------
+
+type symbolKind int
+
+const (
+	// symVar is a variable or value parameter held in a slot.
+	symVar symbolKind = iota
+	// symRef is a reference, whose slot holds a pointer to the referenced location.
+	symRef
+	// symArray is an array, whose slot holds a pointer to its first element.
+	symArray
+	// symConst is a program-scope constant whose value is known during compilation.
+	symConst
+)
+
+// A symbol is a named variable, parameter, or constant.
+type symbol struct {
+	kind symbolKind
+	// typ is the type of the variable. For a reference or an array, it is a pointer to the element.
+	typ      Type
+	slot     int
+	readonly bool
+	val      value
+	length   int
+	// function reports whether the symbol is a function constant, and defined whether the program
+	// was specialized with a value for it.
+	function bool
+	defined  bool
+}
+
+type scope struct {
+	parent  *scope
+	symbols map[string]*symbol
+}
+
+func (s *scope) lookup(name string) *symbol {
+	for ; s != nil; s = s.parent {
+		if sym, ok := s.symbols[name]; ok {
+			return sym
+		}
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Programs and functions
+// ----------------------------------------------------------------------------
+
+// A compiler holds the program-wide state of compilation: the functions by name, the
+// program-scope constants, and the values that function constants are specialized with.
+type compiler struct {
+	funcs     map[string][]*function
+	globals   *scope
+	constants map[string][]byte
+}
+
+// A function is a function declaration and, once compiled, its body.
+type function struct {
+	decl   *funcDecl
+	ret    Type
+	params []Type
+	refs   []bool
+	// state is 0 before compilation starts, 1 during, and 2 after, so that recursion (which MSL
+	// forbids) is detected rather than looping forever.
+	state  int
+	body   execFn
+	nslots int
+}
+
+// newCompiler collects the functions of f and evaluates its program-scope constants, giving its
+// function constants the values in constants.
+func newCompiler(f *file, constants map[string][]byte) (c *compiler, err error) {
+	defer recoverError(&err)
+
+	c = &compiler{
+		funcs:     make(map[string][]*function),
+		globals:   &scope{symbols: make(map[string]*symbol)},
+		constants: constants,
+	}
+
+	fc := &funcCompiler{c: c, scope: c.globals}
+	for _, g := range f.globals {
+		fc.global(g)
+	}
+	for _, name := range slices.Sorted(maps.Keys(constants)) {
+		if sym := c.globals.lookup(name); sym == nil || !sym.function {
+			return nil, &Error{Msg: fmt.Sprintf("no function constant named '%s'", name)}
+		}
+	}
+
+	for _, decl := range f.funcs {
+		fn := &function{decl: decl, ret: fc.valueType(decl.ret, true)}
+		for _, param := range decl.params {
+			fn.params = append(fn.params, fc.paramType(param))
+			fn.refs = append(fn.refs, param.typ.ref)
+		}
+
+		// A prototype followed by a definition is one function.
+		merged := false
+		for i, other := range c.funcs[decl.name] {
+			if sameSignature(fn, other) {
+				if other.decl.body == nil {
+					c.funcs[decl.name][i] = fn
+				} else if decl.body != nil {
+					panic(errorf(decl.pos, "redefinition of function '%s'", decl.name))
+				}
+				merged = true
+			}
+		}
+		if !merged {
+			c.funcs[decl.name] = append(c.funcs[decl.name], fn)
+		}
+	}
+
+	return c, nil
+}
+
+func sameSignature(f, g *function) bool {
+	if len(f.params) != len(g.params) {
+		return false
+	}
+	for i := range f.params {
+		if f.params[i] != g.params[i] || f.refs[i] != g.refs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// compileFunction compiles the body of fn if it has not been compiled yet.
+func (c *compiler) compileFunction(fn *function) {
+	switch fn.state {
+	case 1:
+		panic(errorf(fn.decl.pos, "recursive call to function '%s'", fn.decl.name))
+	case 2:
+		return
+	}
+	if fn.decl.body == nil {
+		panic(errorf(fn.decl.pos, "function '%s' is declared but never defined", fn.decl.name))
+	}
+	fn.state = 1
+	defer func() {
+		if fn.state != 2 {
+			// Compilation failed, so a later attempt should fail the same way rather than report
+			// recursion.
+			fn.state = 0
+		}
+	}()
+
+	fc := &funcCompiler{c: c, fn: fn, scope: &scope{parent: c.globals, symbols: make(map[string]*symbol)}}
+	for i, param := range fn.decl.params {
+		kind := symVar
+		if fn.refs[i] {
+			kind = symRef
+		}
+		fc.declare(param.pos, param.name, &symbol{
+			kind:     kind,
+			typ:      fn.params[i],
+			slot:     fc.newSlot(),
+			readonly: param.typ.isConst && !param.typ.pointer && !param.typ.ref,
+		})
+	}
+
+	body := fc.block(fn.decl.body.stmts)
+	fn.body = body
+	fn.nslots = fc.nslots
+	fn.state = 2
+}
+
+// recoverError recovers a panic with an *Error into *err. Any other panic is re-raised.
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(*Error)
+		if !ok {
+			panic(r)
+		}
+		*err = e
+	}
+}
+
+// A funcCompiler compiles the body of one function.
+type funcCompiler struct {
+	c      *compiler
+	fn     *function
+	scope  *scope
+	nslots int
+	loops  int
+}
+
+func (fc *funcCompiler) newSlot() int {
+	fc.nslots++
+	return fc.nslots - 1
+}
+
+func (fc *funcCompiler) declare(pos Pos, name string, sym *symbol) {
+	if _, ok := fc.scope.symbols[name]; ok {
+		panic(errorf(pos, "redefinition of '%s'", name))
+	}
+	fc.scope.symbols[name] = sym
+}
+
+func (fc *funcCompiler) push() {
+	fc.scope = &scope{parent: fc.scope, symbols: make(map[string]*symbol)}
+}
+
+func (fc *funcCompiler) pop() {
+	fc.scope = fc.scope.parent
+}
+
+// valueType returns the type that ts declares. A reference declares its referenced type, and void
+// is only allowed if allowVoid is set.
+func (fc *funcCompiler) valueType(ts typeSpec, allowVoid bool) Type {
+	if ts.typ.Scalar == Void && !ts.pointer && !allowVoid {
+		panic(errorf(ts.pos, "variable has incomplete type 'void'"))
+	}
+	if ts.pointer {
+		space := ts.space
+		if !ts.spaced {
+			space = Thread
+		}
+		return Type{Scalar: ts.typ.Scalar, Width: ts.typ.Width, Pointer: true, Space: space, Const: ts.isConst || space == Constant}
+	}
+	return ts.typ
+}
+
+// paramType returns the type of a parameter. A reference parameter is represented by a pointer to
+// the referenced type.
+func (fc *funcCompiler) paramType(param paramDecl) Type {
+	if param.typ.ref {
+		ts := param.typ
+		ts.pointer = true
+		return fc.valueType(ts, false)
+	}
+	return fc.valueType(param.typ, false)
+}
+
+// global compiles a program-scope variable declaration. Program-scope variables must be in the
+// constant address space and initialized with constant expressions.
+func (fc *funcCompiler) global(d *declStmt) {
+	if d.typ.pointer || d.typ.ref {
+		panic(errorf(d.pos, "program-scope pointers and references are not supported"))
+	}
+	if !d.typ.spaced || d.typ.space != Constant {
+		panic(errorf(d.pos, "program-scope variables must be declared in the constant address space"))
+	}
+	typ := fc.valueType(d.typ, false)
+
+	for _, decl := range d.decls {
+		if index, ok := functionConstantIndex(decl.attrs); ok {
+			fc.functionConstant(decl, typ, index)
+			continue
+		}
+		if decl.init == nil {
+			panic(errorf(decl.pos, "constant variable '%s' must be initialized", decl.name))
+		}
+
+		if !decl.array {
+			x := fc.convert(fc.expr(decl.init), typ, decl.pos)
+			fc.declare(decl.pos, decl.name, &symbol{kind: symConst, typ: typ, val: fc.constValue(x, decl.pos), readonly: true})
+			continue
+		}
+
+		n := fc.arrayLength(decl)
+		mem := &memory{name: decl.name, bytes: make([]byte, n*typ.Size()), space: Constant}
+		elems := fc.initElems(decl, typ, n)
+		for i, x := range elems {
+			store(mem, i*typ.Size(), typ, fc.constValue(x, decl.pos))
+		}
+		ptr := Type{Scalar: typ.Scalar, Width: typ.Width, Pointer: true, Space: Constant, Const: true}
+		fc.declare(decl.pos, decl.name, &symbol{kind: symConst, typ: ptr, val: value{mem: mem}, readonly: true, length: n})
+	}
+}
+
+// functionConstant compiles the declaration of a function constant, such as
+// constant int n [[function_constant(0)]]. Its value is the one the program is specialized with, or
+// zero if it is given none, in which case is_function_constant_defined reports false for it.
+func (fc *funcCompiler) functionConstant(decl declarator, typ Type, index int) {
+	if index < 0 {
+		panic(errorf(decl.pos, "invalid function constant index for '%s'", decl.name))
+	}
+	if decl.array || decl.init != nil {
+		panic(errorf(decl.pos, "function constant '%s' must be a scalar or vector without an initializer", decl.name))
+	}
+
+	sym := &symbol{kind: symConst, typ: typ, readonly: true, function: true}
+	if b, ok := fc.c.constants[decl.name]; ok {
+		if len(b) != typ.Size() {
+			panic(errorf(decl.pos, "function constant '%s' has type %s, which is %d bytes, not %d", decl.name, typ, typ.Size(), len(b)))
+		}
+		sym.val = load(&memory{name: decl.name, bytes: b, space: Constant}, 0, typ)
+		sym.defined = true
+	}
+	fc.declare(decl.pos, decl.name, sym)
+}
+
+// functionConstantIndex returns the index of the function_constant attribute in attrs, or -1 if
+// its index is invalid. It reports false if attrs has no such attribute.
+func functionConstantIndex(attrs []attribute) (int, bool) {
+	for _, attr := range attrs {
+		if attr.name != "function_constant" {
+			continue
+		}
+		if len(attr.args) != 1 {
+			return -1, true
+		}
+		n, err := strconv.ParseUint(attr.args[0], 0, 16)
+		if err != nil {
+			return -1, true
+		}
+		return int(n), true
+	}
+	return 0, false
+}
+
+// constValue evaluates a constant expression during compilation.
+func (fc *funcCompiler) constValue(x operand, pos Pos) (v value) {
+	if !x.konst {
+		panic(errorf(pos, "expression is not a constant expression"))
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			panic(errorf(pos, "%v", r))
+		}
+	}()
+	return x.eval(nil)
+}
+
+// arrayLength returns the length of an array declarator, from its explicit length or, failing
+// that, its initializer list.
+func (fc *funcCompiler) arrayLength(decl declarator) int {
+	if decl.arrayLen == nil {
+		list, ok := decl.init.(*initListExpr)
+		if !ok {
+			panic(errorf(decl.pos, "array '%s' must be initialized with a braced list", decl.name))
+		}
+		if len(list.elems) == 0 {
+			panic(errorf(decl.pos, "array '%s' has zero length", decl.name))
+		}
+		return len(list.elems)
+	}
+
+	x := fc.expr(decl.arrayLen)
+	if !x.typ.isArith() || !x.typ.Scalar.IsInteger() || x.typ.IsVector() {
+		panic(errorf(decl.arrayLen.exprPos(), "array length must be an integer"))
+	}
+	n := fc.constValue(x, decl.arrayLen.exprPos()).int(0)
+	if n <= 0 || n > 1<<20 {
+		panic(errorf(decl.arrayLen.exprPos(), "invalid array length %d", n))
+	}
+	return int(n)
+}
+
+// initElems compiles the initializer of an array declarator, returning one operand (converted to
+// the element type) for each initialized element.
+func (fc *funcCompiler) initElems(decl declarator, elem Type, n int) []operand {
+	if decl.init == nil {
+		return nil
+	}
+	list, ok := decl.init.(*initListExpr)
+	if !ok {
+		panic(errorf(decl.pos, "array '%s' must be initialized with a braced list", decl.name))
+	}
+	if len(list.elems) > n {
+		panic(errorf(list.pos, "too many initializers for array of length %d", n))
+	}
+
+	xs := make([]operand, len(list.elems))
+	for i, e := range list.elems {
+		xs[i] = fc.initValue(e, elem)
+	}
+	return xs
+}
+
+// initValue compiles one element of an initializer list. A nested braced list initializes a
+// vector component by component.
+func (fc *funcCompiler) initValue(e expr, typ Type) operand {
+	list, ok := e.(*initListExpr)
+	if !ok {
+		return fc.convert(fc.expr(e), typ, e.exprPos())
+	}
+	args := make([]operand, len(list.elems))
+	for i, elem := range list.elems {
+		args[i] = fc.expr(elem)
+	}
+	if len(args) == 0 {
+		var zero value
+		return operand{typ: typ, eval: func(*frame) value { return zero }, konst: true}
+	}
+	return fc.construct(list.pos, typ, args)
+}
+
+// ----------------------------------------------------------------------------
+// Statements
+// ----------------------------------------------------------------------------
+
+// block compiles a list of statements in a new scope.
+func (fc *funcCompiler) block(stmts []stmt) execFn {
+	fc.push()
+	defer fc.pop()
+
+	fns := make([]execFn, 0, len(stmts))
+	for _, s := range stmts {
+		if f := fc.stmt(s); f != nil {
+			fns = append(fns, f)
+		}
+	}
+
+	switch len(fns) {
+	case 0:
+		return func(*frame) ctl { return ctlNext }
+	case 1:
+		return fns[0]
+	}
+	return func(fr *frame) ctl {
+		for _, f := range fns {
+			if c := f(fr); c != ctlNext {
+				return c
+			}
+		}
+		return ctlNext
+	}
+}
+
+// stmt compiles a statement. It returns nil for statements that do nothing.
+func (fc *funcCompiler) stmt(s stmt) execFn {
+	switch s := s.(type) {
+	case *blockStmt:
+		return fc.block(s.stmts)
+
+	case *emptyStmt:
+		return nil
+
+	case *exprStmt:
+		x := fc.expr(s.x).eval
+		return func(fr *frame) ctl {
+			x(fr)
+			return ctlNext
+		}
+
+	case *declStmt:
+		return fc.decl(s)
+
+	case *ifStmt:
+		cond := fc.cond(s.cond)
+		fc.push()
+		then := fc.stmtOrNop(s.then)
+		fc.pop()
+		if s.els == nil {
+			return func(fr *frame) ctl {
+				if cond(fr).bool() {
+					return then(fr)
+				}
+				return ctlNext
+			}
+		}
+		fc.push()
+		els := fc.stmtOrNop(s.els)
+		fc.pop()
+		return func(fr *frame) ctl {
+			if cond(fr).bool() {
+				return then(fr)
+			}
+			return els(fr)
+		}
+
+	case *forStmt:
+		fc.push()
+		defer fc.pop()
+		var init execFn
+		if s.init != nil {
+			init = fc.stmt(s.init)
+		}
+		cond := func(*frame) value { return boolValue(true) }
+		if s.cond != nil {
+			cond = fc.cond(s.cond)
+		}
+		var post evalFn
+		if s.post != nil {
+			post = fc.expr(s.post).eval
+		}
+		body := fc.loopBody(s.body)
+		return func(fr *frame) ctl {
+			if init != nil {
+				init(fr)
+			}
+			for cond(fr).bool() {
+				switch body(fr) {
+				case ctlBreak:
+					return ctlNext
+				case ctlReturn:
+					return ctlReturn
+				}
+				if post != nil {
+					post(fr)
+				}
+			}
+			return ctlNext
+		}
+
+	case *whileStmt:
+		cond := fc.cond(s.cond)
+		body := fc.loopBody(s.body)
+		return func(fr *frame) ctl {
+			for cond(fr).bool() {
+				switch body(fr) {
+				case ctlBreak:
+					return ctlNext
+				case ctlReturn:
+					return ctlReturn
+				}
+			}
+			return ctlNext
+		}
+
+	case *doStmt:
+		body := fc.loopBody(s.body)
+		cond := fc.cond(s.cond)
+		return func(fr *frame) ctl {
+			for {
+				switch body(fr) {
+				case ctlBreak:
+					return ctlNext
+				case ctlReturn:
+					return ctlReturn
+				}
+				if !cond(fr).bool() {
+					return ctlNext
+				}
+			}
+		}
+
+	case *returnStmt:
+		ret := fc.fn.ret
+		if s.x == nil {
+			if ret.Scalar != Void {
+				panic(errorf(s.pos, "non-void function '%s' must return a value", fc.fn.decl.name))
+			}
+			return func(*frame) ctl { return ctlReturn }
+		}
+		if ret.Scalar == Void && !ret.Pointer {
+			panic(errorf(s.pos, "void function '%s' cannot return a value", fc.fn.decl.name))
+		}
+		x := fc.convert(fc.expr(s.x), ret, s.pos).eval
+		return func(fr *frame) ctl {
+			fr.ret = x(fr)
+			return ctlReturn
+		}
+
+	case *branchStmt:
+		if fc.loops == 0 {
+			panic(errorf(s.pos, "'%s' statement not in loop", s.tok))
+		}
+		c := ctlBreak
+		if s.tok == "continue" {
+			c = ctlContinue
+		}
+		return func(*frame) ctl { return c }
+	}
+
+	panic(errorf(s.stmtPos(), "unsupported statement"))
+}
+
+// stmtOrNop compiles a statement, substituting a no-op for statements that do nothing.
+func (fc *funcCompiler) stmtOrNop(s stmt) execFn {
+	if f := fc.stmt(s); f != nil {
+		return f
+	}
+	return func(*frame) ctl { return ctlNext }
+}
+
+// loopBody compiles the body of a loop in its own scope.
+func (fc *funcCompiler) loopBody(s stmt) execFn {
+	fc.loops++
+	defer func() { fc.loops-- }()
+	fc.push()
+	defer fc.pop()
+	return fc.stmtOrNop(s)
+}
+
+// cond compiles a condition, which must be a scalar convertible to bool.
+func (fc *funcCompiler) cond(e expr) evalFn {
+	x := fc.expr(e)
+	if x.typ.IsVector() {
+		panic(errorf(e.exprPos(), "condition must be a scalar, not %s", x.typ))
+	}
+	if x.typ.Pointer {
+		eval := x.eval
+		return func(fr *frame) value { return boolValue(eval(fr).mem != nil) }
+	}
+	return fc.convert(x, boolType, e.exprPos()).eval
+}
+
+// decl compiles a local variable declaration.
+func (fc *funcCompiler) decl(d *declStmt) execFn {
+	if d.typ.spaced && !d.typ.pointer && !d.typ.ref {
+		switch d.typ.space {
+		case Thread:
+		case Threadgroup:
+			panic(errorf(d.pos, "threadgroup memory is not supported"))
+		default:
+			panic(errorf(d.pos, "local variables cannot be declared in the %s address space", d.typ.space))
+		}
+	}
+
+	var fns []execFn
+	for _, decl := range d.decls {
+		if _, ok := functionConstantIndex(decl.attrs); ok {
+			panic(errorf(decl.pos, "function constant '%s' must be declared at program scope", decl.name))
+		}
+		if d.typ.ref {
+			fns = append(fns, fc.refDecl(d, decl))
+			continue
+		}
+
+		typ := fc.valueType(d.typ, false)
+		slot := fc.newSlot()
+
+		if decl.array {
+			fns = append(fns, fc.arrayDecl(d, decl, typ, slot))
+			continue
+		}
+
+		var init evalFn
+		if decl.init != nil {
+			init = fc.initValue(decl.init, typ).eval
+		}
+		// The variable comes into scope after its own initializer.
+		fc.declare(decl.pos, decl.name, &symbol{kind: symVar, typ: typ, slot: slot, readonly: d.typ.isConst && !typ.Pointer})
+
+		if init == nil {
+			// Uninitialized variables are zeroed, so that a loop body does not see the value from
+			// the previous iteration.
+			fns = append(fns, func(fr *frame) ctl {
+				fr.slots[slot] = value{}
+				return ctlNext
+			})
+			continue
+		}
+		fns = append(fns, func(fr *frame) ctl {
+			fr.slots[slot] = init(fr)
+			return ctlNext
+		})
+	}
+
+	if len(fns) == 1 {
+		return fns[0]
+	}
+	return func(fr *frame) ctl {
+		for _, f := range fns {
+			f(fr)
+		}
+		return ctlNext
+	}
+}
+
+// arrayDecl compiles the declaration of a local array. Every execution of the declaration allocates
+// fresh, zeroed memory for it.
+func (fc *funcCompiler) arrayDecl(d *declStmt, decl declarator, elem Type, slot int) execFn {
+	if elem.Pointer {
+		panic(errorf(decl.pos, "arrays of pointers are not supported"))
+	}
+	n := fc.arrayLength(decl)
+	elems := fc.initElems(decl, elem, n)
+	size := elem.Size()
+	name := decl.name
+
+	ptr := Type{Scalar: elem.Scalar, Width: elem.Width, Pointer: true, Space: Thread, Const: d.typ.isConst}
+	fc.declare(decl.pos, decl.name, &symbol{kind: symArray, typ: ptr, slot: slot, length: n})
+
+	evals := make([]evalFn, len(elems))
+	for i, x := range elems {
+		evals[i] = x.eval
+	}
+	return func(fr *frame) ctl {
+		mem := &memory{name: name, bytes: make([]byte, n*size), space: Thread}
+		for i, eval := range evals {
+			store(mem, i*size, elem, eval(fr))
+		}
+		fr.slots[slot] = value{mem: mem}
+		return ctlNext
+	}
+}
+
+// refDecl compiles the declaration of a local reference, which must be bound to a location in
+// memory.
+func (fc *funcCompiler) refDecl(d *declStmt, decl declarator) execFn {
+	if decl.init == nil || decl.array {
+		panic(errorf(decl.pos, "reference '%s' must be initialized", decl.name))
+	}
+	ts := d.typ
+	ts.pointer = true
+	ptr := fc.valueType(ts, false)
+	if !d.typ.spaced {
+		ptr.Space = Thread
+	}
+
+	addr := fc.addressOf(fc.expr(decl.init), decl.init.exprPos())
+	if !ptr.Const && addr.typ.Const {
+		panic(errorf(decl.pos, "cannot bind non-const reference '%s' to a read-only location", decl.name))
+	}
+	if addr.typ.Elem() != ptr.Elem() {
+		panic(errorf(decl.pos, "cannot bind reference of type %s to a value of type %s", ptr.Elem(), addr.typ.Elem()))
+	}
+	ptr.Space = addr.typ.Space
+
+	slot := fc.newSlot()
+	fc.declare(decl.pos, decl.name, &symbol{kind: symRef, typ: ptr, slot: slot})
+	eval := addr.eval
+	return func(fr *frame) ctl {
+		fr.slots[slot] = eval(fr)
+		return ctlNext
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Expressions
+// ----------------------------------------------------------------------------
+
+// expr compiles an expression.
+func (fc *funcCompiler) expr(e expr) operand {
+	switch e := e.(type) {
+	case *litExpr:
+		v := e.v
+		return operand{typ: e.typ, eval: func(*frame) value { return v }, konst: true}
+
+	case *identExpr:
+		return fc.ident(e)
+
+	case *unaryExpr:
+		return fc.unary(e)
+
+	case *postfixExpr:
+		return fc.incDec(e.pos, e.op, e.x, true)
+
+	case *binaryExpr:
+		return fc.binary(e)
+
+	case *assignExpr:
+		return fc.assign(e)
+
+	case *condExpr:
+		return fc.ternary(e)
+
+	case *callExpr:
+		return fc.call(e)
+
+	case *castExpr:
+		return fc.explicitConvert(fc.expr(e.x), fc.valueType(e.typ, false), e.pos)
+
+	case *indexExpr:
+		return fc.index(e)
+
+	case *memberExpr:
+		return fc.member(e)
+
+	case *initListExpr:
+		panic(errorf(e.pos, "unexpected initializer list"))
+	}
+
+	panic(errorf(e.exprPos(), "unsupported expression"))
+}
+
+func (fc *funcCompiler) ident(e *identExpr) operand {
+	sym := fc.scope.lookup(e.name)
+	if sym == nil {
+		panic(errorf(e.pos, "use of undeclared identifier '%s'", e.name))
+	}
+
+	slot := sym.slot
+	switch sym.kind {
+	case symConst:
+		v := sym.val
+		return operand{typ: sym.typ, eval: func(*frame) value { return v }, konst: true, array: sym.length}
+
+	case symArray:
+		return operand{typ: sym.typ, eval: func(fr *frame) value { return fr.slots[slot] }, array: sym.length}
+
+	case symRef:
+		elem := sym.typ.Elem()
+		return operand{
+			typ: elem,
+			eval: func(fr *frame) value {
+				p := fr.slots[slot]
+				return load(p.mem, p.off, elem)
+			},
+			lv: &lvalue{
+				readonly: sym.typ.Const,
+				inMemory: true,
+				space:    sym.typ.Space,
+				loc: func(fr *frame) location {
+					p := fr.slots[slot]
+					return location{mem: p.mem, off: p.off, typ: elem}
+				},
+			},
+		}
+	}
+
+	typ := sym.typ
+	return operand{
+		typ:  typ,
+		eval: func(fr *frame) value { return fr.slots[slot] },
+		lv: &lvalue{
+			readonly: sym.readonly,
+			loc: func(fr *frame) location {
+				return location{slot: &fr.slots[slot], typ: typ}
+			},
+		},
+	}
+}
+
+// rvalue returns the operand as a plain value, dropping its location.
+func rvalue(x operand) operand {
+	x.lv = nil
+	x.array = 0
+	return x
+}
+
+func (fc *funcCompiler) unary(e *unaryExpr) operand {
+	switch e.op {
+	case "++", "--":
+		return fc.incDec(e.pos, e.op, e.x, false)
+	case "&":
+		return fc.addressOf(fc.expr(e.x), e.pos)
+	case "*":
+		return fc.deref(fc.expr(e.x), e.pos)
+	}
+
+	x := fc.expr(e.x)
+	if !x.typ.isArith() {
+		panic(errorf(e.pos, "invalid operand of type %s to unary '%s'", x.typ, e.op))
+	}
+
+	switch e.op {
+	case "!":
+		if x.typ.IsVector() {
+			t := vectorType(Bool, x.typ.Width)
+			x = fc.explicitConvert(x, t, e.pos)
+			return operand{typ: t, eval: lanewise1(t.Width, x.eval, func(a uint64) uint64 { return a ^ 1 }), konst: x.konst}
+		}
+		x = fc.convert(x, boolType, e.pos)
+		eval := x.eval
+		return operand{typ: boolType, eval: func(fr *frame) value { return boolValue(!eval(fr).bool()) }, konst: x.konst}
+	}
+
+	t := promote(x.typ)
+	x = fc.convert(x, t, e.pos)
+	s := t.Scalar
+
+	switch e.op {
+	case "+":
+		return rvalue(x)
+	case "-":
+		var f func(uint64) uint64
+		if s.IsFloat() {
+			f = floatLane1(s, func(x float64) float64 { return -x })
+		} else {
+			f = func(a uint64) uint64 { return uint64(wrapInt(s, -int64(a))) }
+		}
+		return operand{typ: t, eval: lanewise1(t.Width, x.eval, f), konst: x.konst}
+	case "~":
+		if !s.IsInteger() {
+			panic(errorf(e.pos, "invalid operand of type %s to unary '~'", x.typ))
+		}
+		return operand{typ: t, eval: lanewise1(t.Width, x.eval, func(a uint64) uint64 { return uint64(wrapInt(s, ^int64(a))) }), konst: x.konst}
+	}
+
+	panic(errorf(e.pos, "unsupported operator '%s'", e.op))
+}
+
+// addressOf compiles &x, which requires x to be a location in memory.
+func (fc *funcCompiler) addressOf(x operand, pos Pos) operand {
+	if x.lv == nil || !x.lv.inMemory {
+		panic(errorf(pos, "cannot take the address of this expression; only locations in memory (buffers, arrays, and references to them) have addresses"))
+	}
+	loc := x.lv.loc
+	typ := Type{Scalar: x.typ.Scalar, Width: x.typ.Width, Pointer: true, Space: x.lv.space, Const: x.lv.readonly}
+	return operand{
+		typ: typ,
+		eval: func(fr *frame) value {
+			l := loc(fr)
+			if l.n > 0 {
+				l.off += int(l.lanes[0]) * l.typ.Scalar.Size()
+			}
+			return value{mem: l.mem, off: l.off}
+		},
+	}
+}
+
+// deref compiles *p.
+func (fc *funcCompiler) deref(p operand, pos Pos) operand {
+	if !p.typ.Pointer {
+		panic(errorf(pos, "indirection requires a pointer operand, not %s", p.typ))
+	}
+	elem := p.typ.Elem()
+	eval := p.eval
+	return operand{
+		typ: elem,
+		eval: func(fr *frame) value {
+			v := eval(fr)
+			return load(v.mem, v.off, elem)
+		},
+		lv: &lvalue{
+			readonly: p.typ.Const,
+			inMemory: true,
+			space:    p.typ.Space,
+			loc: func(fr *frame) location {
+				v := eval(fr)
+				return location{mem: v.mem, off: v.off, typ: elem}
+			},
+		},
+	}
+}
+
+// index compiles x[i] for a pointer, array, or vector x.
+func (fc *funcCompiler) index(e *indexExpr) operand {
+	x := fc.expr(e.x)
+	i := fc.expr(e.index)
+	if !i.typ.isArith() || i.typ.IsVector() || !(i.typ.Scalar.IsInteger() || i.typ.Scalar == Bool) {
+		panic(errorf(e.index.exprPos(), "array subscript must be an integer, not %s", i.typ))
+	}
+
+	if x.typ.Pointer {
+		return fc.deref(fc.pointerOffset(x, i, "+", e.pos), e.pos)
+	}
+
+	if !x.typ.IsVector() {
+		panic(errorf(e.pos, "subscripted value of type %s is not a pointer, array, or vector", x.typ))
+	}
+
+	width := x.typ.Width
+	elem := scalarType(x.typ.Scalar)
+	ieval := i.eval
+	xeval := x.eval
+	out := operand{
+		typ: elem,
+		eval: func(fr *frame) value {
+			v := xeval(fr)
+			n := int(ieval(fr).int(0))
+			if n < 0 || n >= width {
+				panic(fmt.Sprintf("vector index %d out of range for %d components", n, width))
+			}
+			return value{lanes: [4]uint64{v.lanes[n]}}
+		},
+		konst: x.konst && i.konst,
+	}
+	if x.lv != nil {
+		loc := x.lv.loc
+		lv := *x.lv
+		lv.loc = func(fr *frame) location {
+			return loc(fr).lane(int(ieval(fr).int(0)), width)
+		}
+		out.lv = &lv
+	}
+	return out
+}
+
+// swizzleLanes maps swizzle letters to lanes.
+var swizzleLanes = map[byte]int{'x': 0, 'y': 1, 'z': 2, 'w': 3, 'r': 0, 'g': 1, 'b': 2, 'a': 3}
+
+// member compiles a vector swizzle such as v.x or v.zyx.
+func (fc *funcCompiler) member(e *memberExpr) operand {
+	x := fc.expr(e.x)
+	if !x.typ.IsVector() {
+		panic(errorf(e.pos, "member reference base type %s is not a vector", x.typ))
+	}
+	if len(e.name) > 4 {
+		panic(errorf(e.pos, "invalid swizzle '%s'", e.name))
+	}
+
+	lanes := make([]int, len(e.name))
+	unique := true
+	rgba := strings.ContainsAny(e.name, "rgba")
+	for i := range e.name {
+		lane, ok := swizzleLanes[e.name[i]]
+		if !ok || lane >= x.typ.Width || rgba != strings.ContainsRune("rgba", rune(e.name[i])) {
+			panic(errorf(e.pos, "invalid swizzle '%s' for %s", e.name, x.typ))
+		}
+		for _, prev := range lanes[:i] {
+			if prev == lane {
+				unique = false
+			}
+		}
+		lanes[i] = lane
+	}
+
+	typ := vectorType(x.typ.Scalar, len(lanes))
+	xeval := x.eval
+	out := operand{
+		typ: typ,
+		eval: func(fr *frame) value {
+			v := xeval(fr)
+			var out value
+			for i, lane := range lanes {
+				out.lanes[i] = v.lanes[lane]
+			}
+			return out
+		},
+		konst: x.konst,
+	}
+	if x.lv != nil {
+		loc := x.lv.loc
+		lv := *x.lv
+		lv.readonly = lv.readonly || !unique
+		lv.inMemory = lv.inMemory && len(lanes) == 1
+		lv.loc = func(fr *frame) location {
+			return loc(fr).swizzle(lanes)
+		}
+		out.lv = &lv
+	}
+	return out
+}
+
+// pointerOffset compiles p+n or p-n for a pointer p and integer n.
+func (fc *funcCompiler) pointerOffset(p, n operand, op string, pos Pos) operand {
+	if n.typ.IsVector() || !(n.typ.Scalar.IsInteger() || n.typ.Scalar == Bool) || n.typ.Pointer {
+		panic(errorf(pos, "invalid operands to binary '%s' (%s and %s)", op, p.typ, n.typ))
+	}
+	size := int64(p.typ.Elem().Size())
+	if op == "-" {
+		size = -size
+	}
+	peval, neval := p.eval, n.eval
+	return operand{
+		typ: Type{Scalar: p.typ.Scalar, Width: p.typ.Width, Pointer: true, Space: p.typ.Space, Const: p.typ.Const},
+		eval: func(fr *frame) value {
+			v := peval(fr)
+			v.off += int(neval(fr).int(0) * size)
+			return v
+		},
+	}
+}
+
+func (fc *funcCompiler) binary(e *binaryExpr) operand {
+	switch e.op {
+	case ",":
+		x, y := fc.expr(e.x).eval, fc.expr(e.y)
+		yeval := y.eval
+		return operand{typ: y.typ, eval: func(fr *frame) value { x(fr); return yeval(fr) }}
+
+	case "&&", "||":
+		x := fc.convert(fc.expr(e.x), boolType, e.x.exprPos())
+		y := fc.convert(fc.expr(e.y), boolType, e.y.exprPos())
+		xeval, yeval := x.eval, y.eval
+		konst := x.konst && y.konst
+		if e.op == "&&" {
+			return operand{typ: boolType, eval: func(fr *frame) value { return boolValue(xeval(fr).bool() && yeval(fr).bool()) }, konst: konst}
+		}
+		return operand{typ: boolType, eval: func(fr *frame) value { return boolValue(xeval(fr).bool() || yeval(fr).bool()) }, konst: konst}
+	}
+
+	return fc.arith(e.op, fc.expr(e.x), fc.expr(e.y), e.pos)
+}
+
+// arith compiles the arithmetic, bitwise, shift, or comparison operator op.
+func (fc *funcCompiler) arith(op string, x, y operand, pos Pos) operand {
+	if x.typ.Pointer || y.typ.Pointer {
+		return fc.pointerArith(op, x, y, pos)
+	}
+	if !x.typ.isArith() || !y.typ.isArith() {
+		panic(errorf(pos, "invalid operands to binary '%s' (%s and %s)", op, x.typ, y.typ))
+	}
+
+	var t Type
+	if op == "<<" || op == ">>" {
+		// The type of a shift is the promoted type of its left operand.
+		t = promote(x.typ)
+		if y.typ.IsVector() && !t.IsVector() {
+			panic(errorf(pos, "invalid operands to binary '%s' (%s and %s)", op, x.typ, y.typ))
+		}
+	} else {
+		var ok bool
+		t, ok = commonType(x.typ, y.typ)
+		if !ok {
+			panic(errorf(pos, "invalid operands to binary '%s' (%s and %s)", op, x.typ, y.typ))
+		}
+	}
+
+	f := binaryLaneOp(op, t.Scalar)
+	if f == nil || ((op == "%" || op == "&" || op == "|" || op == "^" || op == "<<" || op == ">>") && t.Scalar.IsFloat()) {
+		panic(errorf(pos, "invalid operands to binary '%s' (%s and %s)", op, x.typ, y.typ))
+	}
+
+	x = fc.convert(x, t, pos)
+	y = fc.convert(y, t, pos)
+	rt := t
+	if isComparison(op) {
+		rt = vectorType(Bool, t.Width)
+	}
+	return operand{typ: rt, eval: lanewise2(t.Width, x.eval, y.eval, f), konst: x.konst && y.konst}
+}
+
+// pointerArith compiles the operators that apply to pointers: adding or subtracting an integer,
+// subtracting two pointers, and comparing two pointers.
+func (fc *funcCompiler) pointerArith(op string, x, y operand, pos Pos) operand {
+	switch {
+	case x.typ.Pointer && !y.typ.Pointer && (op == "+" || op == "-"):
+		return fc.pointerOffset(x, y, op, pos)
+
+	case !x.typ.Pointer && y.typ.Pointer && op == "+":
+		return fc.pointerOffset(y, x, op, pos)
+
+	case x.typ.Pointer && y.typ.Pointer && x.typ.Elem() == y.typ.Elem():
+		xeval, yeval := x.eval, y.eval
+		size := x.typ.Elem().Size()
+		if op == "-" {
+			return operand{typ: scalarType(Long), eval: func(fr *frame) value {
+				a, b := xeval(fr), yeval(fr)
+				if a.mem != b.mem {
+					panic("subtraction of pointers into different memory")
+				}
+				return intValue(Long, 1, int64((a.off-b.off)/size))
+			}}
+		}
+		if isComparison(op) {
+			f := binaryLaneOp(op, Long)
+			return operand{typ: boolType, eval: func(fr *frame) value {
+				a, b := xeval(fr), yeval(fr)
+				if op == "==" || op == "!=" {
+					same := a.mem == b.mem && a.off == b.off
+					return boolValue(same == (op == "=="))
+				}
+				return value{lanes: [4]uint64{f(uint64(a.off), uint64(b.off))}}
+			}}
+		}
+	}
+
+	panic(errorf(pos, "invalid operands to binary '%s' (%s and %s)", op, x.typ, y.typ))
+}
+
+// promote applies the integer promotions: scalars narrower than int (and bool) become int. Vectors
+// are not promoted.
+func promote(t Type) Type {
+	if t.IsVector() || t.Scalar.IsFloat() || t.Scalar.rank() >= 3 {
+		return t
+	}
+	return intType
+}
+
+// commonType returns the type that the usual arithmetic conversions give two operands of types x
+// and y. A scalar combined with a vector converts to the vector's type; two vectors must have the
+// same type.
+func commonType(x, y Type) (Type, bool) {
+	switch {
+	case x.IsVector() && y.IsVector():
+		return x, x.equal(y)
+	case x.IsVector():
+		return x.Elem(), true
+	case y.IsVector():
+		return y.Elem(), true
+	}
+	return scalarType(commonScalar(x.Scalar, y.Scalar)), true
+}
+
+// commonScalar applies the usual arithmetic conversions to two scalars.
+func commonScalar(x, y Scalar) Scalar {
+	switch {
+	case x == Float || y == Float:
+		return Float
+	case x == Half || y == Half:
+		return Half
+	}
+
+	x, y = promote(scalarType(x)).Scalar, promote(scalarType(y)).Scalar
+	switch {
+	case x == y:
+		return x
+	case x.IsSigned() == y.IsSigned():
+		if x.rank() >= y.rank() {
+			return x
+		}
+		return y
+	}
+
+	u, s := x, y
+	if x.IsSigned() {
+		u, s = y, x
+	}
+	if u.rank() >= s.rank() {
+		return u
+	}
+	return s
+}
+
+func (fc *funcCompiler) ternary(e *condExpr) operand {
+	c := fc.expr(e.cond)
+	x, y := fc.expr(e.x), fc.expr(e.y)
+
+	var t Type
+	switch {
+	case x.typ.Pointer || y.typ.Pointer:
+		if x.typ != y.typ {
+			panic(errorf(e.pos, "incompatible operand types (%s and %s)", x.typ, y.typ))
+		}
+		t = x.typ
+	case x.typ.isArith() && y.typ.isArith():
+		var ok bool
+		if t, ok = commonType(x.typ, y.typ); !ok {
+			panic(errorf(e.pos, "incompatible operand types (%s and %s)", x.typ, y.typ))
+		}
+	default:
+		panic(errorf(e.pos, "incompatible operand types (%s and %s)", x.typ, y.typ))
+	}
+	if t.Scalar == Bool && x.typ.Scalar == Bool && y.typ.Scalar == Bool {
+		t = vectorType(Bool, t.Width)
+	}
+
+	x, y = fc.convert(x, t, e.pos), fc.convert(y, t, e.pos)
+	xeval, yeval := x.eval, y.eval
+
+	if c.typ.IsVector() {
+		// A vector condition selects component-wise.
+		if c.typ.Width != t.Width {
+			panic(errorf(e.pos, "vector condition type %s does not match result type %s", c.typ, t))
+		}
+		c = fc.explicitConvert(c, vectorType(Bool, t.Width), e.pos)
+		ceval := c.eval
+		return operand{typ: t, eval: lanewise3(t.Width, ceval, xeval, yeval, func(a, b, c uint64) uint64 {
+			if a != 0 {
+				return b
+			}
+			return c
+		}), konst: c.konst && x.konst && y.konst}
+	}
+
+	ceval := fc.cond(e.cond)
+	return operand{typ: t, eval: func(fr *frame) value {
+		if ceval(fr).bool() {
+			return xeval(fr)
+		}
+		return yeval(fr)
+	}, konst: c.konst && x.konst && y.konst}
+}
+
+// assignable checks that x can be assigned to.
+func assignable(x operand, pos Pos) *lvalue {
+	if x.lv == nil {
+		panic(errorf(pos, "expression is not assignable"))
+	}
+	if x.lv.readonly {
+		panic(errorf(pos, "cannot assign to a read-only location of type %s", x.typ))
+	}
+	return x.lv
+}
+
+func (fc *funcCompiler) assign(e *assignExpr) operand {
+	x := fc.expr(e.x)
+	lv := assignable(x, e.pos)
+	loc := lv.loc
+	y := fc.expr(e.y)
+
+	if e.op == "=" {
+		y = fc.convert(y, x.typ, e.pos)
+		yeval := y.eval
+		return operand{typ: x.typ, eval: func(fr *frame) value {
+			v := yeval(fr)
+			loc(fr).store(v)
+			return v
+		}}
+	}
+
+	// A compound assignment loads the location once, into a slot of its own, applies the operator
+	// in the operands' common type, and converts back.
+	op := strings.TrimSuffix(e.op, "=")
+	tmp := fc.newSlot()
+	current := operand{typ: x.typ, eval: func(fr *frame) value { return fr.slots[tmp] }}
+	reval := fc.convert(fc.arith(op, current, y, e.pos), x.typ, e.pos).eval
+
+	return operand{typ: x.typ, eval: func(fr *frame) value {
+		l := loc(fr)
+		fr.slots[tmp] = l.load()
+		v := reval(fr)
+		l.store(v)
+		return v
+	}}
+}
+
+// incDec compiles ++ and --, as a prefix or (if postfix is set) a postfix operator.
+func (fc *funcCompiler) incDec(pos Pos, op string, e expr, postfix bool) operand {
+	x := fc.expr(e)
+	lv := assignable(x, pos)
+	loc := lv.loc
+
+	var step func(v value) value
+	switch {
+	case x.typ.Pointer:
+		size := x.typ.Elem().Size()
+		if op == "--" {
+			size = -size
+		}
+		step = func(v value) value {
+			v.off += size
+			return v
+		}
+	case x.typ.isArith() && x.typ.Scalar != Bool:
+		arithOp := "+"
+		if op == "--" {
+			arithOp = "-"
+		}
+		f := binaryLaneOp(arithOp, x.typ.Scalar)
+		one := convert(intValue(Int, 1, 1), intType, scalarType(x.typ.Scalar)).lanes[0]
+		width := x.typ.Width
+		step = func(v value) value {
+			for i := 0; i < width; i++ {
+				v.lanes[i] = f(v.lanes[i], one)
+			}
+			return v
+		}
+	default:
+		panic(errorf(pos, "cannot increment or decrement a value of type %s", x.typ))
+	}
+
+	return operand{typ: x.typ, eval: func(fr *frame) value {
+		l := loc(fr)
+		old := l.load()
+		v := step(old)
+		l.store(v)
+		if postfix {
+			return old
+		}
+		return v
+	}}
+}
+
+// ----------------------------------------------------------------------------
+// Conversions
+// ----------------------------------------------------------------------------
+
+// convert applies an implicit conversion of x to type to.
+func (fc *funcCompiler) convert(x operand, to Type, pos Pos) operand {
+	from := x.typ
+
+	switch {
+	case from.Pointer || to.Pointer:
+		if from.Pointer && to.Pointer && from.Elem() == to.Elem() && from.Space == to.Space && (to.Const || !from.Const) {
+			return rvalue(x)
+		}
+		panic(errorf(pos, "cannot convert %s to %s", from, to))
+
+	case !from.isArith() || !to.isArith():
+		panic(errorf(pos, "cannot convert %s to %s", from, to))
+
+	case from.IsVector() && (from.Width != to.Width || from.Scalar != to.Scalar):
+		panic(errorf(pos, "cannot implicitly convert %s to %s", from, to))
+	}
+
+	return fc.explicitConvert(x, to, pos)
+}
+
+// explicitConvert converts x to type to as a cast or static_cast does.
+func (fc *funcCompiler) explicitConvert(x operand, to Type, pos Pos) operand {
+	from := x.typ
+	if from.Pointer || to.Pointer {
+		return fc.convert(x, to, pos)
+	}
+	if !from.isArith() || !to.isArith() {
+		panic(errorf(pos, "cannot convert %s to %s", from, to))
+	}
+	if from.IsVector() && from.Width != to.Width {
+		panic(errorf(pos, "cannot convert %s to %s", from, to))
+	}
+	if from.Scalar == to.Scalar && from.Width == to.Width {
+		return rvalue(x)
+	}
+
+	eval := x.eval
+	return operand{typ: to, eval: func(fr *frame) value { return convert(eval(fr), from, to) }, konst: x.konst}
+}
+
+// construct compiles a vector or scalar constructor such as float4(v.xy, 0, 1) or int(f).
+func (fc *funcCompiler) construct(pos Pos, t Type, args []operand) operand {
+	if t.Pointer || t.Scalar == Void {
+		panic(errorf(pos, "cannot construct a value of type %s", t))
+	}
+
+	if len(args) == 1 && (!args[0].typ.IsVector() || args[0].typ.Width == t.Width) {
+		// A single scalar converts and, for a vector, broadcasts. A single vector of the same
+		// width converts component-wise.
+		return fc.explicitConvert(args[0], t, pos)
+	}
+
+	// Otherwise the components of the arguments fill the vector in order.
+	type part struct {
+		eval  evalFn
+		from  Type
+		lanes int
+	}
+	var parts []part
+	total := 0
+	konst := true
+	for _, arg := range args {
+		if !arg.typ.isArith() {
+			panic(errorf(pos, "cannot use a value of type %s to construct %s", arg.typ, t))
+		}
+		parts = append(parts, part{eval: arg.eval, from: arg.typ, lanes: arg.typ.Width})
+		total += arg.typ.Width
+		konst = konst && arg.konst
+	}
+	if !t.IsVector() || total != t.Width {
+		panic(errorf(pos, "wrong number of components (%d) to construct %s", total, t))
+	}
+
+	s := t.Scalar
+	return operand{typ: t, eval: func(fr *frame) value {
+		var out value
+		i := 0
+		for _, p := range parts {
+			v := p.eval(fr)
+			for lane := 0; lane < p.lanes; lane++ {
+				out.lanes[i] = convertLane(v.lanes[lane], p.from.Scalar, s)
+				i++
+			}
+		}
+		return out
+	}, konst: konst}
+}
+
+// ----------------------------------------------------------------------------
+// Calls
+// ----------------------------------------------------------------------------
+
+func (fc *funcCompiler) call(e *callExpr) operand {
+	if e.name == "is_function_constant_defined" && e.targ == nil {
+		return fc.isFunctionConstantDefined(e)
+	}
+
+	args := make([]operand, len(e.args))
+	for i, arg := range e.args {
+		args[i] = fc.expr(arg)
+	}
+
+	if e.targ != nil {
+		t := fc.valueType(*e.targ, false)
+		switch e.name {
+		case "static_cast":
+			return fc.explicitConvert(args[0], t, e.pos)
+		case "as_type":
+			return fc.asType(args[0], t, e.pos)
+		default:
+			panic(errorf(e.pos, "%s is not supported", e.name))
+		}
+	}
+
+	if fns, ok := fc.c.funcs[e.name]; ok && fc.scope.lookup(e.name) == nil {
+		return fc.callFunction(e, fns, args)
+	}
+
+	if t, ok := LookupType(e.name); ok {
+		return fc.construct(e.pos, t, args)
+	}
+
+	if b, ok := builtins[e.name]; ok {
+		return b(fc, e.pos, e.name, args)
+	}
+
+	panic(errorf(e.pos, "use of undeclared function '%s'", e.name))
+}
+
+// isFunctionConstantDefined compiles is_function_constant_defined(name), which reports whether the
+// program was specialized with a value for the function constant called name.
+func (fc *funcCompiler) isFunctionConstantDefined(e *callExpr) operand {
+	var sym *symbol
+	if len(e.args) == 1 {
+		if id, ok := e.args[0].(*identExpr); ok {
+			sym = fc.scope.lookup(id.name)
+		}
+	}
+	if sym == nil || !sym.function {
+		panic(errorf(e.pos, "is_function_constant_defined requires a function constant"))
+	}
+
+	v := boolValue(sym.defined)
+	return operand{typ: boolType, eval: func(*frame) value { return v }, konst: true}
+}
+
+// asType compiles as_type<T>(x), which reinterprets the bits of x as a value of type t of the same
+// size.
+func (fc *funcCompiler) asType(x operand, t Type, pos Pos) operand {
+	if !x.typ.isArith() || !t.isArith() || x.typ.Size() != t.Size() || x.typ.Scalar == Bool || t.Scalar == Bool {
+		panic(errorf(pos, "as_type cannot reinterpret %s as %s", x.typ, t))
+	}
+
+	from := x.typ
+	eval := x.eval
+	return operand{typ: t, eval: func(fr *frame) value {
+		var b [32]byte
+		m := &memory{bytes: b[:from.Size()]}
+		store(m, 0, from, eval(fr))
+		return load(m, 0, t)
+	}, konst: x.konst}
+}
+
+// callFunction compiles a call to a helper function, choosing among overloads by the number and
+// types of the arguments.
+func (fc *funcCompiler) callFunction(e *callExpr, fns []*function, args []operand) operand {
+	var fn *function
+	best := -1
+	for _, candidate := range fns {
+		if score := matchScore(candidate, args); score > best {
+			fn, best = candidate, score
+		}
+	}
+	if fn == nil {
+		panic(errorf(e.pos, "no matching function for call to '%s'", e.name))
+	}
+	if fn.decl.kernel {
+		panic(errorf(e.pos, "cannot call kernel function '%s'", e.name))
+	}
+
+	fc.c.compileFunction(fn)
+
+	evals := make([]evalFn, len(args))
+	for i, arg := range args {
+		if fn.refs[i] {
+			addr := fc.addressOf(arg, e.args[i].exprPos())
+			if !fn.params[i].Const && addr.typ.Const {
+				panic(errorf(e.args[i].exprPos(), "cannot bind a read-only location to a non-const reference"))
+			}
+			evals[i] = addr.eval
+			continue
+		}
+		evals[i] = fc.convert(arg, fn.params[i], e.args[i].exprPos()).eval
+	}
+
+	return operand{typ: fn.ret, eval: func(fr *frame) value {
+		callee := &frame{slots: make([]value, fn.nslots)}
+		for i, eval := range evals {
+			callee.slots[i] = eval(fr)
+		}
+		fn.body(callee)
+		return callee.ret
+	}}
+}
+
+// matchScore rates how well args match the parameters of fn: -1 if they cannot be passed at all,
+// and otherwise higher for closer matches.
+func matchScore(fn *function, args []operand) int {
+	if len(fn.params) != len(args) {
+		return -1
+	}
+	score := 1
+	for i, arg := range args {
+		param := fn.params[i]
+		switch {
+		case fn.refs[i]:
+			if arg.lv == nil || !arg.lv.inMemory || arg.typ != param.Elem() {
+				return -1
+			}
+			score += 2
+		case arg.typ.Pointer || param.Pointer:
+			if !arg.typ.Pointer || !param.Pointer || arg.typ.Elem() != param.Elem() || arg.typ.Space != param.Space || (arg.typ.Const && !param.Const) {
+				return -1
+			}
+			score += 2
+		case !arg.typ.isArith():
+			return -1
+		case arg.typ.equal(param):
+			score += 2
+		case arg.typ.IsVector() && (arg.typ.Width != param.Width || arg.typ.Scalar != param.Scalar):
+			return -1
+		default:
+			score++
+		}
+	}
+	return score
+}
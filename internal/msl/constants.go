@@ -0,0 +1,136 @@
+package msl
+
+// A FunctionConstant is the declaration of a function constant, a program-scope constant whose
+// value is given when a function is specialized, such as
+//
+//	constant uint TILE [[function_constant(0)]];
+type FunctionConstant struct {
+	// Name is the constant's name.
+	Name string
+	// TypeName is the constant's type as it is written, without its qualifiers, such as "uint".
+	TypeName string
+	// Type is the constant's type if TypeName names a scalar or vector type; otherwise its Scalar is
+	// Void.
+	Type Type
+	// Index is the index in the constant's function_constant attribute.
+	Index int
+	// Pos is the position of the constant's name.
+	Pos Pos
+}
+
+// ParseFunctionConstants returns the function constants declared in src, in source order.
+//
+// Like ParseSignatures, it reads only declarations and ignores preprocessor directives, so the
+// declarations it describes need not be ones the interpreter supports.
+func ParseFunctionConstants(src string) (consts []FunctionConstant, err error) {
+	tokens, err := scan(src, false)
+	if err != nil {
+		return nil, err
+	}
+	defer recoverError(&err)
+
+	p := &parser{tokens: tokens}
+	depth := 0
+	for p.peek().kind != tokenEOF {
+		switch {
+		case p.is("{"):
+			depth++
+			p.next()
+		case p.is("}"):
+			depth--
+			p.next()
+		case depth == 0 && p.is("constant"):
+			consts = append(consts, p.parseFunctionConstants()...)
+		default:
+			p.next()
+		}
+	}
+
+	return consts, nil
+}
+
+// parseFunctionConstants parses a program-scope declaration that starts with the constant keyword,
+// up to its semicolon, and returns the function constants that it declares.
+func (p *parser) parseFunctionConstants() []FunctionConstant {
+	// Gather the declarators, which are separated by commas outside any brackets, with the
+	// attributes that follow each one. Initializers are skipped, as a function constant has none.
+	type declarator struct {
+		tokens []token
+		attrs  []attribute
+	}
+	decls := []declarator{{}}
+	init := false
+	depth := 0
+	for !p.is(";") || depth > 0 {
+		t := p.peek()
+		d := &decls[len(decls)-1]
+		switch {
+		case t.kind == tokenEOF || (depth == 0 && !init && (p.is("{") || p.is("("))):
+			// This is not a variable declaration but, say, a function that returns a constant
+			// reference.
+			return nil
+		case depth == 0 && p.isAttrStart():
+			d.attrs = append(d.attrs, p.parseAttrs()...)
+			continue
+		case depth == 0 && p.is(","):
+			decls = append(decls, declarator{})
+			init = false
+			p.next()
+			continue
+		case depth == 0 && p.is("="):
+			init = true
+		case p.is("(") || p.is("[") || p.is("{"):
+			depth++
+		case p.is(")") || p.is("]") || p.is("}"):
+			depth--
+		}
+		if !init {
+			d.tokens = append(d.tokens, t)
+		}
+		p.next()
+	}
+	p.next()
+
+	// The first declarator holds the qualifiers and the type, which every declarator shares.
+	var typeTokens []token
+	var consts []FunctionConstant
+	for i, d := range decls {
+		tokens := d.tokens
+		for j, t := range tokens {
+			if t.text == "[" {
+				tokens = tokens[:j]
+				break
+			}
+		}
+		if len(tokens) == 0 || tokens[len(tokens)-1].kind != tokenIdent || isKeyword(tokens[len(tokens)-1].text) {
+			return consts
+		}
+		name := tokens[len(tokens)-1]
+		if i == 0 {
+			for j := 0; j < len(tokens)-1; j++ {
+				switch t := tokens[j]; {
+				case t.text == "constant" || t.text == "const" || t.text == "constexpr" || t.text == "static":
+				case (t.text == "metal" || t.text == "std") && tokens[j+1].text == "::":
+					j++
+				default:
+					typeTokens = append(typeTokens, t)
+				}
+			}
+		}
+
+		index, ok := functionConstantIndex(d.attrs)
+		if !ok {
+			continue
+		}
+		if index < 0 {
+			p.fail(name.pos, "invalid function constant index for '%s'", name.text)
+		}
+		c := FunctionConstant{Name: name.text, TypeName: joinTokens(typeTokens), Index: index, Pos: name.pos}
+		if typ, ok := LookupType(c.TypeName); ok {
+			c.Type = typ
+		}
+		consts = append(consts, c)
+	}
+
+	return consts
+}
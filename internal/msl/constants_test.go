@@ -0,0 +1,143 @@
+package msl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseFunctionConstants(t *testing.T) {
+	t.Run("declarations", func(t *testing.T) {
+		consts, err := ParseFunctionConstants(`
+#include <metal_stdlib>
+using namespace metal;
+
+constant uint TILE [[function_constant(0)]];
+constant bool FAST_PATH [[ function_constant(1) ]], SLOW_PATH = !FAST_PATH;
+constant metal::half SCALE [[function_constant(0x10)]];
+constant float4 BIAS [[function_constant(3)]];
+constant Params PARAMS [[function_constant(4)]];
+constant int LIMITS[2] = {1, 2};
+constant float ratio = 0.5;
+
+kernel void k(device float *a [[buffer(0)]]) {
+    constant int local [[function_constant(9)]];
+}
+`)
+		require.NoError(t, err)
+		require.Equal(t, []FunctionConstant{
+			{Name: "TILE", TypeName: "uint", Type: Type{Scalar: UInt, Width: 1}, Index: 0, Pos: Pos{Line: 5, Column: 15}},
+			{Name: "FAST_PATH", TypeName: "bool", Type: Type{Scalar: Bool, Width: 1}, Index: 1, Pos: Pos{Line: 6, Column: 15}},
+			{Name: "SCALE", TypeName: "half", Type: Type{Scalar: Half, Width: 1}, Index: 16, Pos: Pos{Line: 7, Column: 22}},
+			{Name: "BIAS", TypeName: "float4", Type: Type{Scalar: Float, Width: 4}, Index: 3, Pos: Pos{Line: 8, Column: 17}},
+			{Name: "PARAMS", TypeName: "Params", Index: 4, Pos: Pos{Line: 9, Column: 17}},
+		}, consts)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		consts, err := ParseFunctionConstants("constant float &ref(constant float &x) { return x; }\nkernel void k() {}")
+		require.NoError(t, err)
+		require.Empty(t, consts)
+	})
+
+	t.Run("invalid index", func(t *testing.T) {
+		for _, src := range []string{
+			"constant int n [[function_constant]];",
+			"constant int n [[function_constant(x)]];",
+			"constant int n [[function_constant(65536)]];",
+		} {
+			_, err := ParseFunctionConstants(src)
+			require.EqualError(t, err, "1:14: invalid function constant index for 'n'", src)
+		}
+	})
+}
+
+// Test_ParseSpecialized tests that function constants take the values that a program is
+// specialized with.
+func Test_ParseSpecialized(t *testing.T) {
+	src := `
+constant int SCALE [[function_constant(0)]];
+constant bool NEGATE [[function_constant(1)]];
+constant int OFFSET = is_function_constant_defined(NEGATE) ? 100 : 0;
+
+kernel void k(device int *out [[buffer(0)]], uint i [[thread_position_in_grid]]) {
+    int v = int(i) * SCALE + OFFSET;
+    if (is_function_constant_defined(NEGATE) && NEGATE) {
+        v = -v;
+    }
+    out[i] = v;
+}
+`
+
+	type subtest struct {
+		name      string
+		constants map[string][]byte
+		want      []int32
+		err       string
+	}
+
+	subtests := []subtest{
+		{
+			name:      "specialized",
+			constants: map[string][]byte{"SCALE": {3, 0, 0, 0}, "NEGATE": {1}},
+			want:      []int32{-100, -103, -106},
+		},
+		{
+			name:      "undefined",
+			constants: map[string][]byte{"SCALE": {2, 0, 0, 0}},
+			want:      []int32{0, 2, 4},
+		},
+		{
+			name: "unspecialized",
+			want: []int32{0, 0, 0},
+		},
+		{
+			name:      "wrong size",
+			constants: map[string][]byte{"SCALE": {2, 0}},
+			err:       "2:14: function constant 'SCALE' has type int, which is 4 bytes, not 2",
+		},
+		{
+			name:      "unknown",
+			constants: map[string][]byte{"OFFSET": {2, 0, 0, 0}},
+			err:       "no function constant named 'OFFSET'",
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			prog, err := ParseSpecialized(src, subtest.constants)
+			if subtest.err != "" {
+				require.EqualError(t, err, subtest.err)
+				return
+			}
+			require.NoError(t, err)
+
+			k, err := prog.Kernel("k")
+			require.NoError(t, err)
+			out := make([]byte, 12)
+			inv, err := k.Bind([][]byte{out})
+			require.NoError(t, err)
+			ta := ThreadAttributes{ThreadsPerGrid: [3]uint32{3, 1, 1}, ThreadsPerThreadgroup: [3]uint32{1, 1, 1}}
+			for i := range uint32(3) {
+				ta.PositionInGrid = [3]uint32{i, 0, 0}
+				inv.Run(&ta)
+			}
+			require.Equal(t, subtest.want, bytesInts(out))
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for src, msg := range map[string]string{
+			"constant int n [[function_constant(0)]] = 1;":                                       "1:14: function constant 'n' must be a scalar or vector without an initializer",
+			"constant int n [[function_constant(-1)]];":                                          "1:14: invalid function constant index for 'n'",
+			"kernel void k() { int n [[function_constant(0)]]; }":                                "1:23: function constant 'n' must be declared at program scope",
+			"constant int n = 1;\nkernel void k() { bool b = is_function_constant_defined(n); }": "2:28: is_function_constant_defined requires a function constant",
+		} {
+			prog, err := Parse(src)
+			if err == nil {
+				_, err = prog.Kernel("k")
+			}
+			require.EqualError(t, err, msg, src)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+/*
+Package msl is a pure-Go lexer, parser, and interpreter for the subset of the Metal Shading
+Language used by simple compute kernels. It lets the CPU backend of package metal run the same
+.metal source that the Metal compiler would, on machines without a GPU.
+
+# Supported language
+
+  - Scalar types bool, char, uchar, short, ushort, int, uint, long, ulong, half, and float (plus
+    the <stdint.h>-style aliases such as int32_t), and 2-, 3-, and 4-component vectors of them.
+  - Arithmetic, bitwise, comparison, logical, and assignment operators with C++ conversion rules,
+    swizzles (v.xy, v.zyx), and vector/scalar broadcasting.
+  - Kernel parameters that are device or constant pointers or references, bound by position or
+    by [[buffer(n)]], and the thread attributes [[thread_position_in_grid]],
+    [[threads_per_grid]], [[threadgroup_position_in_grid]], [[thread_position_in_threadgroup]],
+    [[threads_per_threadgroup]], [[thread_index_in_threadgroup]], and
+    [[threadgroups_per_grid]].
+  - Local variables and fixed-size local arrays, program-scope constant variables, helper
+    functions, if/else, for, while, do/while, break, continue, and return.
+  - Function constants declared with [[function_constant(n)]], whose values [ParseSpecialized]
+    supplies, and is_function_constant_defined.
+  - The common metal_math, metal_common, metal_integer, metal_geometric, and metal_relational
+    functions, with or without the metal::, precise::, or fast:: qualifiers, and static_cast and
+    as_type.
+
+Preprocessor directives other than #include (which is ignored; the standard headers are built
+in), #pragma, and #line (which sets the positions that errors report) are rejected, as are structs, templates, textures, atomics, and threadgroup
+memory. [Preprocess] expands macros and selects conditional groups the way the C preprocessor
+does, keeping every line in place, so running source through it first lets Parse accept
+#define, #if, and the rest. [ResolveIncludes] replaces quoted #include directives with the files
+they name in an fs.FS, marking each with #line directives.
+
+# Numerics
+
+Integer arithmetic wraps at the width of its type. float arithmetic is rounded to single
+precision after every operation and half arithmetic to half precision, so the basic operators
+are bit-compatible with the GPU. Math functions are evaluated in double precision and rounded
+once, which is within the error bounds that the Metal specification allows for them.
+*/
+package msl
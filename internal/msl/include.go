@@ -0,0 +1,298 @@
+package msl
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ResolveIncludes returns the source of the file called name in fsys with every quoted #include
+// replaced by the contents of the file it names, recursively. A quoted include is looked for
+// relative to the directory of the file that includes it, and then relative to the root of fsys.
+// Includes of system headers, such as #include <metal_stdlib>, are left in place.
+//
+// The result begins with a #line directive for name, and each included file is surrounded by #line
+// directives, so that the positions the Metal compiler and Parse report are in the original files.
+//
+// A file that contains #pragma once, or whose contents are all inside an include guard, is included
+// only once. Otherwise, a file that includes itself, directly or through other files, is an error.
+// An include that cannot be found inside a conditional group is left in place, as the group may be
+// skipped; anywhere else it is an error.
+func ResolveIncludes(fsys fs.FS, name string) (string, error) {
+	name = path.Clean(name)
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	src, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return "", err
+	}
+
+	inc := &includer{fsys: fsys, included: make(map[string]bool)}
+	fmt.Fprintf(&inc.out, "#line 1 %s\n", strconv.Quote(name))
+	if err := inc.include(name, string(src), 0); err != nil {
+		return "", err
+	}
+
+	return inc.out.String(), nil
+}
+
+// An includer holds the state of ResolveIncludes.
+type includer struct {
+	fsys fs.FS
+	// stack holds the files being included, outermost first.
+	stack []string
+	// included records the files that are included only once and have been included outside of
+	// any conditional group, and so can be skipped from then on.
+	included map[string]bool
+	out      strings.Builder
+}
+
+// include writes src, the contents of the file called name, with its includes resolved. depth is
+// the number of conditional groups that the file is included in.
+func (inc *includer) include(name, src string, depth int) error {
+	inc.stack = append(inc.stack, name)
+	defer func() { inc.stack = inc.stack[:len(inc.stack)-1] }()
+
+	lines := strings.SplitAfter(src, "\n")
+	inComment := false
+	// resync is set once a file is included in a conditional group. The compiler may skip the group,
+	// and with it the #line directive that follows the included file, so the position is given again
+	// after every later directive that can end a group.
+	resync := false
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimLeft(line, " \t")
+		if inComment || !strings.HasPrefix(trimmed, "#") {
+			inComment = commentState(line, inComment)
+			inc.out.WriteString(line)
+			continue
+		}
+
+		// A directive continues across escaped newlines and unterminated block comments.
+		start := i
+		directive := line
+		for i+1 < len(lines) && (strings.HasSuffix(strings.TrimRight(directive, "\r\n"), "\\") || commentState(directive, false)) {
+			i++
+			directive += lines[i]
+		}
+
+		pos := Pos{File: name, Line: start + 1, Column: len(line) - len(trimmed) + 1}
+		tokens := trimSpace(ppTokenize(strings.TrimLeft(directive, " \t")[1:], pos))
+		var kind string
+		if len(tokens) > 0 {
+			kind = tokens[0].text
+		}
+		args := trimSpace(tokens[min(1, len(tokens)):])
+
+		switch {
+		case kind == "if" || kind == "ifdef" || kind == "ifndef":
+			depth++
+		case kind == "elif" || kind == "else" || kind == "endif":
+			if kind == "endif" && depth > 0 {
+				depth--
+			}
+			if resync {
+				inc.out.WriteString(directive)
+				if !strings.HasSuffix(directive, "\n") {
+					inc.out.WriteString("\n")
+				}
+				fmt.Fprintf(&inc.out, "#line %d %s\n", i+2, strconv.Quote(name))
+				continue
+			}
+		case kind == "pragma" && len(args) == 1 && args[0].text == "once":
+			// Including the file only once is handled here, and the compiler warns about
+			// #pragma once in what it sees as the main file.
+			inc.out.WriteString(blankLines(directive))
+			continue
+		case kind == "include" && len(args) == 1 && args[0].kind == ppString && strings.HasPrefix(args[0].text, `"`):
+			done, err := inc.resolve(name, directive, args[0].text, pos, depth)
+			if err != nil {
+				return err
+			}
+			if done {
+				resync = resync || depth > 0
+				continue
+			}
+		}
+
+		inc.out.WriteString(directive)
+	}
+
+	return nil
+}
+
+// resolve writes the file named by quoted, the argument of the include directive at pos in the file
+// called name. It reports false if the file could not be found but the directive may be in a
+// skipped group, so it should be left in place.
+func (inc *includer) resolve(name, directive, quoted string, pos Pos, depth int) (bool, error) {
+	target := strings.TrimSuffix(quoted[1:], `"`)
+	file, src, err := inc.find(path.Dir(name), target)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && depth > 0:
+		return false, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return false, errorf(pos, "include file '%s' not found", target)
+	case err != nil:
+		return false, errorf(pos, "unable to read include file '%s': %s", target, err)
+	}
+
+	_, guarded := includeGuard(src)
+	once := guarded || pragmaOnce(src)
+
+	if once && inc.included[file] {
+		inc.out.WriteString(blankLines(directive))
+		return true, nil
+	}
+	if i := slices.Index(inc.stack, file); i >= 0 {
+		if once {
+			// The file is already being included, so its guard or #pragma once leaves it empty.
+			inc.out.WriteString(blankLines(directive))
+			return true, nil
+		}
+		cycle := append(slices.Clone(inc.stack[i:]), file)
+		return false, errorf(pos, "include cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	// A file with #pragma once is given an include guard of its own, so that the compiler includes
+	// it only once even if it is included in conditional groups that this cannot evaluate.
+	wrap := once && !guarded
+	if wrap {
+		h := fnv.New64a()
+		h.Write([]byte(file))
+		guard := fmt.Sprintf("__include_once_%016x", h.Sum64())
+		fmt.Fprintf(&inc.out, "#ifndef %s\n#define %s\n", guard, guard)
+	}
+
+	fmt.Fprintf(&inc.out, "#line 1 %s\n", strconv.Quote(file))
+	if err := inc.include(file, src, depth); err != nil {
+		return false, err
+	}
+	if !strings.HasSuffix(inc.out.String(), "\n") {
+		inc.out.WriteString("\n")
+	}
+	if wrap {
+		inc.out.WriteString("#endif\n")
+	}
+	next := pos.Line + strings.Count(directive, "\n")
+	fmt.Fprintf(&inc.out, "#line %d %s\n", next, strconv.Quote(name))
+
+	if once && depth == 0 {
+		inc.included[file] = true
+	}
+
+	return true, nil
+}
+
+// find reads the file named by an include in a file in dir. It returns the file's cleaned path and
+// its contents.
+func (inc *includer) find(dir, target string) (string, string, error) {
+	err := error(&fs.PathError{Op: "open", Path: target, Err: fs.ErrNotExist})
+	for _, file := range []string{path.Join(dir, target), path.Clean(target)} {
+		if !fs.ValidPath(file) {
+			continue
+		}
+		var src []byte
+		src, err = fs.ReadFile(inc.fsys, file)
+		if err == nil {
+			return file, string(src), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", "", err
+		}
+	}
+
+	return "", "", err
+}
+
+// includeGuard returns the macro of the include guard around the contents of src: an #ifndef, or
+// an #if !defined, followed by a #define of the same macro, whose #endif ends the file. It reports
+// false if src has no include guard.
+func includeGuard(src string) (string, bool) {
+	lines := significantLines(src)
+	if len(lines) < 3 {
+		return "", false
+	}
+
+	var guard string
+	switch first := lines[0]; {
+	case len(first) == 3 && directiveName(first) == "ifndef" && first[2].kind == ppIdent:
+		guard = first[2].text
+	case len(first) == 5 && directiveName(first) == "if" && first[2].text == "!" && first[3].text == "defined" && first[4].kind == ppIdent:
+		guard = first[4].text
+	case len(first) == 7 && directiveName(first) == "if" && first[2].text == "!" && first[3].text == "defined" && first[4].text == "(" && first[5].kind == ppIdent && first[6].text == ")":
+		guard = first[5].text
+	default:
+		return "", false
+	}
+	if define := lines[1]; len(define) < 3 || directiveName(define) != "define" || define[2].text != guard {
+		return "", false
+	}
+
+	depth := 0
+	for i, line := range lines {
+		switch directiveName(line) {
+		case "if", "ifdef", "ifndef":
+			depth++
+		case "elif", "else":
+			if depth == 1 {
+				return "", false
+			}
+		case "endif":
+			depth--
+			if depth == 0 {
+				return guard, i == len(lines)-1
+			}
+		}
+	}
+
+	return "", false
+}
+
+// pragmaOnce reports whether src contains #pragma once.
+func pragmaOnce(src string) bool {
+	for _, line := range significantLines(src) {
+		if len(line) == 3 && directiveName(line) == "pragma" && line[2].text == "once" {
+			return true
+		}
+	}
+	return false
+}
+
+// significantLines splits src into lines of preprocessing tokens, without whitespace and comments,
+// and drops the lines that are left empty.
+func significantLines(src string) [][]ppToken {
+	var lines [][]ppToken
+	var line []ppToken
+	for _, t := range ppTokenize(src, Pos{Line: 1, Column: 1}) {
+		switch t.kind {
+		case ppSpace:
+		case ppNewline:
+			if len(line) > 0 {
+				lines = append(lines, line)
+			}
+			line = nil
+		default:
+			line = append(line, t)
+		}
+	}
+	if len(line) > 0 {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// directiveName returns the name of the directive on line, or the empty string if line is not a
+// directive.
+func directiveName(line []ppToken) string {
+	if len(line) < 2 || line[0].text != "#" || line[1].kind != ppIdent {
+		return ""
+	}
+	return line[1].text
+}
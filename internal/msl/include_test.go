@@ -0,0 +1,194 @@
+package msl
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_ResolveIncludes tests that quoted includes are replaced by the files they name, with #line
+// directives around them.
+func Test_ResolveIncludes(t *testing.T) {
+	type subtest struct {
+		name  string
+		files map[string]string
+		want  string
+		err   string
+	}
+
+	subtests := []subtest{
+		{
+			name:  "no includes",
+			files: map[string]string{"main.metal": "#include <metal_stdlib>\nkernel void k() {}\n"},
+			want:  "#line 1 \"main.metal\"\n#include <metal_stdlib>\nkernel void k() {}\n",
+		},
+		{
+			name: "nested",
+			files: map[string]string{
+				"main.metal":        "#include \"lib/common.h\"\nkernel void k() {}",
+				"lib/common.h":      "#include \"complex.metal\"\n  #  include \"defs.h\"\nint c;",
+				"lib/complex.metal": "int z;\n",
+				"defs.h":            "int d;",
+			},
+			want: "#line 1 \"main.metal\"\n" +
+				"#line 1 \"lib/common.h\"\n" +
+				"#line 1 \"lib/complex.metal\"\nint z;\n#line 2 \"lib/common.h\"\n" +
+				"#line 1 \"defs.h\"\nint d;\n#line 3 \"lib/common.h\"\n" +
+				"int c;\n#line 2 \"main.metal\"\n" +
+				"kernel void k() {}",
+		},
+		{
+			name: "continued directive",
+			files: map[string]string{
+				"main.metal": "#include \\\n  \"a.h\" /* a\n b */\nint m;",
+				"a.h":        "int a;\n",
+			},
+			want: "#line 1 \"main.metal\"\n#line 1 \"a.h\"\nint a;\n#line 4 \"main.metal\"\nint m;",
+		},
+		{
+			name: "pragma once",
+			files: map[string]string{
+				"main.metal": "#include \"a.h\"\n#include \"b.h\"\n#include \"a.h\"\n",
+				"a.h":        "#pragma once\nint a;\n",
+				"b.h":        "#include \"a.h\"\nint b;\n",
+			},
+			want: "#line 1 \"main.metal\"\n" +
+				"#ifndef __include_once_e61da3190466632a\n#define __include_once_e61da3190466632a\n" +
+				"#line 1 \"a.h\"\n\nint a;\n#endif\n#line 2 \"main.metal\"\n" +
+				"#line 1 \"b.h\"\n\nint b;\n#line 3 \"main.metal\"\n" +
+				"\n",
+		},
+		{
+			name: "include guard",
+			files: map[string]string{
+				"main.metal": "#include \"a.h\"\n#include \"a.h\"\n",
+				"a.h":        "// a.h\n#if !defined(A_H)\n#define A_H\nint a;\n#endif /* A_H */\n",
+			},
+			want: "#line 1 \"main.metal\"\n" +
+				"#line 1 \"a.h\"\n// a.h\n#if !defined(A_H)\n#define A_H\nint a;\n#endif /* A_H */\n#line 2 \"main.metal\"\n" +
+				"\n",
+		},
+		{
+			name: "guarded cycle",
+			files: map[string]string{
+				"main.metal": "#include \"a.h\"\n",
+				"a.h":        "#ifndef A_H\n#define A_H\n#include \"b.h\"\n#endif",
+				"b.h":        "#include \"a.h\"\nint b;\n",
+			},
+			want: "#line 1 \"main.metal\"\n" +
+				"#line 1 \"a.h\"\n#ifndef A_H\n#define A_H\n" +
+				"#line 1 \"b.h\"\n\nint b;\n#line 4 \"a.h\"\n" +
+				"#endif\n#line 5 \"a.h\"\n#line 2 \"main.metal\"\n",
+		},
+		{
+			name: "conditional",
+			files: map[string]string{
+				"main.metal": "#ifdef USE_A\n#include \"a.h\"\n#else\n#include \"missing.h\"\n#endif\nint m;",
+				"a.h":        "int a;\n",
+			},
+			want: "#line 1 \"main.metal\"\n" +
+				"#ifdef USE_A\n#line 1 \"a.h\"\nint a;\n#line 3 \"main.metal\"\n" +
+				"#else\n#line 4 \"main.metal\"\n#include \"missing.h\"\n#endif\n#line 6 \"main.metal\"\nint m;",
+		},
+		{
+			name:  "missing file",
+			files: map[string]string{"other.metal": ""},
+			err:   "open main.metal: file does not exist",
+		},
+		{
+			name: "missing include",
+			files: map[string]string{
+				"main.metal": "#include \"a.h\"\n",
+				"a.h":        "\n #include \"../b.h\"\n",
+				"b.h":        "",
+			},
+			err: "a.h:2:2: include file '../b.h' not found",
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"main.metal": "#include \"a.h\"\n",
+				"a.h":        "#include \"b.h\"\n",
+				"b.h":        "int b;\n#include \"a.h\"\n",
+			},
+			err: "b.h:2:1: include cycle: a.h -> b.h -> a.h",
+		},
+		{
+			name:  "self include",
+			files: map[string]string{"main.metal": "#include \"./main.metal\""},
+			err:   "main.metal:1:1: include cycle: main.metal -> main.metal",
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for name, data := range subtest.files {
+				fsys[name] = &fstest.MapFile{Data: []byte(data)}
+			}
+
+			got, err := ResolveIncludes(fsys, "main.metal")
+			if subtest.err != "" {
+				require.EqualError(t, err, subtest.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, subtest.want, got)
+		})
+	}
+
+	t.Run("invalid path", func(t *testing.T) {
+		_, err := ResolveIncludes(fstest.MapFS{}, "../main.metal")
+		require.ErrorIs(t, err, fs.ErrInvalid)
+	})
+}
+
+// Test_ResolveIncludes_positions tests that the preprocessor and the lexer report positions in the
+// files that were included.
+func Test_ResolveIncludes_positions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.metal": {Data: []byte("#include \"common.h\"\n\nkernel void k(device float *a) {\n    a[0] = SCALE(a[0]);\n    a[1] = ;\n}\n")},
+		"common.h":   {Data: []byte("#pragma once\n\n#define SCALE(x) ((x) * 2)\n#define BAD(x) x\nBAD(\n")},
+	}
+
+	src, err := ResolveIncludes(fsys, "main.metal")
+	require.NoError(t, err)
+	_, err = Preprocess(src, nil)
+	require.EqualError(t, err, "common.h:5:1: unterminated invocation of macro 'BAD'")
+
+	fsys["common.h"].Data = []byte("#pragma once\n\n#define SCALE(x) ((x) * 2)\n")
+	src, err = ResolveIncludes(fsys, "main.metal")
+	require.NoError(t, err)
+	src, err = Preprocess(src, nil)
+	require.NoError(t, err)
+	_, err = Parse(src)
+	require.EqualError(t, err, "main.metal:5:12: unexpected ';'")
+}
+
+// Test_lex_line tests that #line directives set the positions of the lines after them.
+func Test_lex_line(t *testing.T) {
+	tokens, err := lex("a\n#line 10 \"x.h\"\nb\n  # line 3\nc\n#line 7 \"dir/y z.h\"\n\nd")
+	require.NoError(t, err)
+	require.Equal(t, []Pos{
+		{Line: 1, Column: 1},
+		{File: "x.h", Line: 10, Column: 1},
+		{File: "x.h", Line: 3, Column: 1},
+		{File: "dir/y z.h", Line: 8, Column: 1},
+		{File: "dir/y z.h", Line: 8, Column: 2},
+	}, []Pos{tokens[0].pos, tokens[1].pos, tokens[2].pos, tokens[3].pos, tokens[4].pos})
+
+	for _, src := range []string{"#line", "#line x", "#line 0", "#line 1 x.h", "#line 1 \"\"", "#line 1 \"a\" 2"} {
+		_, err := lex(src)
+		require.EqualError(t, err, "1:1: invalid #line directive", src)
+
+		_, err = Preprocess(src, nil)
+		require.EqualError(t, err, "1:1: invalid #line directive", src)
+	}
+
+	// Signatures are scanned leniently, so an invalid #line is ignored there.
+	sigs, err := ParseSignatures("#line x\nkernel void k() {}")
+	require.NoError(t, err)
+	require.Len(t, sigs, 1)
+}
@@ -0,0 +1,288 @@
+package msl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A tokenKind categorizes a token.
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenInt
+	tokenFloat
+	tokenPunct
+)
+
+// A Pos is a position in a source file. Line and Column are 1-based; Column counts bytes. File is
+// the name given by the last #line directive before the position, if any.
+type Pos struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	if p.File != "" {
+		return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// A token is one lexical element of the source.
+type token struct {
+	kind tokenKind
+	text string
+	pos  Pos
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of file"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// An Error is a problem found while lexing, parsing, or checking source, or while running a
+// kernel. Pos is the zero Pos if the error has no position.
+type Error struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *Error) Error() string {
+	if e.Pos == (Pos{}) {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// errorf returns an *Error at pos.
+func errorf(pos Pos, format string, args ...any) *Error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// puncts lists every punctuator, longest first so that the lexer matches greedily. "[[" and "]]"
+// are deliberately absent: "a[b[c]]" must lex as single brackets, so the parser recognizes
+// attributes as two consecutive '[' tokens instead.
+var puncts = []string{
+	"<<=", ">>=", "...",
+	"<<", ">>", "<=", ">=", "==", "!=", "&&", "||", "++", "--", "+=", "-=", "*=", "/=", "%=",
+	"&=", "|=", "^=", "->", "::",
+	"+", "-", "*", "/", "%", "<", ">", "=", "!", "~", "&", "|", "^", "?", ":", ";", ",", ".",
+	"(", ")", "{", "}", "[", "]",
+}
+
+// lex splits src into tokens. Comments are skipped. Preprocessor lines are handled here too, since
+// they are line-oriented: #include and #pragma lines are dropped, #line lines set the position of
+// the lines after them, and anything else is an error.
+func lex(src string) ([]token, error) {
+	return scan(src, true)
+}
+
+// scan is lex, except that if strict is false it drops every preprocessor line rather than
+// rejecting the ones it does not understand.
+func scan(src string, strict bool) ([]token, error) {
+	var tokens []token
+	file, line, lineStart := "", 1, 0
+	atLineStart := true
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		pos := Pos{File: file, Line: line, Column: i - lineStart + 1}
+
+		switch {
+		case c == '\n':
+			line++
+			lineStart = i + 1
+			atLineStart = true
+			i++
+			continue
+
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+			continue
+
+		case c == '\\' && i+1 < len(src) && src[i+1] == '\n':
+			// A line continuation outside a directive is just whitespace.
+			i++
+			continue
+
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, errorf(pos, "unterminated comment")
+			}
+			for _, ch := range src[i : i+2+end+2] {
+				if ch == '\n' {
+					line++
+				}
+			}
+			if nl := strings.LastIndexByte(src[i:i+2+end+2], '\n'); nl >= 0 {
+				lineStart = i + nl + 1
+			}
+			i += 2 + end + 2
+			continue
+
+		case c == '#' && atLineStart:
+			end := i
+			for end < len(src) && src[end] != '\n' {
+				if src[end] == '\\' && end+1 < len(src) && src[end+1] == '\n' {
+					line++
+					lineStart = end + 2
+					end += 2
+					continue
+				}
+				end++
+			}
+			text := strings.TrimPrefix(src[i:end], "#")
+			directive := strings.Fields(text)
+			if len(directive) > 0 && directive[0] == "line" {
+				next, name, ok := parseLine(strings.TrimPrefix(strings.TrimSpace(text), "line"))
+				switch {
+				case ok:
+					// The newline that ends the directive moves to the line it names.
+					line = next - 1
+					if name != "" {
+						file = name
+					}
+				case strict:
+					return nil, errorf(pos, "invalid #line directive")
+				}
+			} else if strict && len(directive) > 0 && directive[0] != "include" && directive[0] != "pragma" {
+				return nil, errorf(pos, "unsupported preprocessor directive '#%s'", directive[0])
+			}
+			i = end
+			continue
+		}
+
+		atLineStart = false
+
+		switch {
+		case isIdentStart(c):
+			start := i
+			for i < len(src) && isIdentPart(src[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[start:i], pos: pos})
+
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])):
+			start := i
+			kind, n := lexNumber(src[i:])
+			i += n
+			tokens = append(tokens, token{kind: kind, text: src[start:i], pos: pos})
+
+		default:
+			matched := ""
+			for _, p := range puncts {
+				if strings.HasPrefix(src[i:], p) {
+					matched = p
+					break
+				}
+			}
+			if matched == "" {
+				return nil, errorf(pos, "unexpected character %q", c)
+			}
+			i += len(matched)
+			tokens = append(tokens, token{kind: tokenPunct, text: matched, pos: pos})
+		}
+	}
+
+	tokens = append(tokens, token{kind: tokenEOF, pos: Pos{File: file, Line: line, Column: len(src) - lineStart + 1}})
+	return tokens, nil
+}
+
+// lexNumber returns the kind and length of the numeric literal at the start of s, including any
+// suffix. It accepts decimal and hexadecimal integers and decimal floats with an optional
+// exponent. Validation of the digits happens when the literal is parsed.
+func lexNumber(s string) (tokenKind, int) {
+	i := 0
+	kind := tokenInt
+
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		i = 2
+		for i < len(s) && isHexDigit(s[i]) {
+			i++
+		}
+	} else {
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		if i < len(s) && s[i] == '.' {
+			kind = tokenFloat
+			i++
+			for i < len(s) && isDigit(s[i]) {
+				i++
+			}
+		}
+		if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+			j := i + 1
+			if j < len(s) && (s[j] == '+' || s[j] == '-') {
+				j++
+			}
+			if j < len(s) && isDigit(s[j]) {
+				kind = tokenFloat
+				i = j
+				for i < len(s) && isDigit(s[i]) {
+					i++
+				}
+			}
+		}
+	}
+
+	// Suffixes (u, l, f, h, and combinations) are letters glued to the number.
+	for i < len(s) && isIdentPart(s[i]) {
+		i++
+	}
+
+	return kind, i
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// parseLine parses the arguments of a #line directive: the number of the line that follows it,
+// and optionally the name of its file as a string literal. It reports false if they are invalid.
+func parseLine(args string) (int, string, bool) {
+	args = strings.TrimSpace(args)
+	num, name := args, ""
+	if i := strings.IndexAny(args, " \t"); i >= 0 {
+		num, name = args[:i], strings.TrimSpace(args[i:])
+	}
+	line, err := strconv.Atoi(num)
+	if err != nil || line < 1 || strings.TrimLeft(num, "0123456789") != "" {
+		return 0, "", false
+	}
+
+	if name == "" {
+		return line, "", true
+	}
+	file, err := strconv.Unquote(name)
+	if err != nil || !strings.HasPrefix(name, `"`) || file == "" {
+		return 0, "", false
+	}
+
+	return line, file, true
+}
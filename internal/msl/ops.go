@@ -0,0 +1,282 @@
+package msl
+
+import (
+	"math"
+	"math/bits"
+)
+
+// A laneOp computes one lane of a binary operator from the lanes of its operands.
+type laneOp func(a, b uint64) uint64
+
+// binaryLaneOp returns the implementation of the arithmetic, bitwise, shift, or comparison operator
+// op on one lane of scalar s, or nil if op does not apply to s. Comparisons produce bool lanes; every
+// other operator produces a lane of s.
+func binaryLaneOp(op string, s Scalar) laneOp {
+	switch {
+	case s.IsFloat():
+		return floatLaneOp(op, s)
+	case s.IsSigned():
+		return signedLaneOp(op, s)
+	default:
+		return unsignedLaneOp(op, s)
+	}
+}
+
+func floatLaneOp(op string, s Scalar) laneOp {
+	arith := func(f func(x, y float64) float64) laneOp {
+		return func(a, b uint64) uint64 {
+			return math.Float64bits(roundFloat(s, f(math.Float64frombits(a), math.Float64frombits(b))))
+		}
+	}
+	compare := func(f func(x, y float64) bool) laneOp {
+		return func(a, b uint64) uint64 {
+			return boolLane(f(math.Float64frombits(a), math.Float64frombits(b)))
+		}
+	}
+
+	// Operating in double precision and rounding once gives the correctly rounded single- or
+	// half-precision result for each of these operators.
+	switch op {
+	case "+":
+		return arith(func(x, y float64) float64 { return x + y })
+	case "-":
+		return arith(func(x, y float64) float64 { return x - y })
+	case "*":
+		return arith(func(x, y float64) float64 { return x * y })
+	case "/":
+		return arith(func(x, y float64) float64 { return x / y })
+	case "==":
+		return compare(func(x, y float64) bool { return x == y })
+	case "!=":
+		return compare(func(x, y float64) bool { return x != y })
+	case "<":
+		return compare(func(x, y float64) bool { return x < y })
+	case "<=":
+		return compare(func(x, y float64) bool { return x <= y })
+	case ">":
+		return compare(func(x, y float64) bool { return x > y })
+	case ">=":
+		return compare(func(x, y float64) bool { return x >= y })
+	}
+	return nil
+}
+
+func signedLaneOp(op string, s Scalar) laneOp {
+	arith := func(f func(x, y int64) int64) laneOp {
+		return func(a, b uint64) uint64 {
+			return uint64(wrapInt(s, f(int64(a), int64(b))))
+		}
+	}
+	compare := func(f func(x, y int64) bool) laneOp {
+		return func(a, b uint64) uint64 {
+			return boolLane(f(int64(a), int64(b)))
+		}
+	}
+	shift := uint64(s.Size()*8 - 1)
+
+	switch op {
+	case "+":
+		return arith(func(x, y int64) int64 { return x + y })
+	case "-":
+		return arith(func(x, y int64) int64 { return x - y })
+	case "*":
+		return arith(func(x, y int64) int64 { return x * y })
+	case "/":
+		return arith(func(x, y int64) int64 { checkDivisor(y != 0); return x / y })
+	case "%":
+		return arith(func(x, y int64) int64 { checkDivisor(y != 0); return x % y })
+	case "&":
+		return arith(func(x, y int64) int64 { return x & y })
+	case "|":
+		return arith(func(x, y int64) int64 { return x | y })
+	case "^":
+		return arith(func(x, y int64) int64 { return x ^ y })
+	case "<<":
+		return arith(func(x, y int64) int64 { return x << (uint64(y) & shift) })
+	case ">>":
+		return arith(func(x, y int64) int64 { return x >> (uint64(y) & shift) })
+	case "==":
+		return compare(func(x, y int64) bool { return x == y })
+	case "!=":
+		return compare(func(x, y int64) bool { return x != y })
+	case "<":
+		return compare(func(x, y int64) bool { return x < y })
+	case "<=":
+		return compare(func(x, y int64) bool { return x <= y })
+	case ">":
+		return compare(func(x, y int64) bool { return x > y })
+	case ">=":
+		return compare(func(x, y int64) bool { return x >= y })
+	}
+	return nil
+}
+
+func unsignedLaneOp(op string, s Scalar) laneOp {
+	arith := func(f func(x, y uint64) uint64) laneOp {
+		return func(a, b uint64) uint64 {
+			return uint64(wrapInt(s, int64(f(a, b))))
+		}
+	}
+	compare := func(f func(x, y uint64) bool) laneOp {
+		return func(a, b uint64) uint64 {
+			return boolLane(f(a, b))
+		}
+	}
+	shift := uint64(s.Size()*8 - 1)
+
+	switch op {
+	case "+":
+		return arith(func(x, y uint64) uint64 { return x + y })
+	case "-":
+		return arith(func(x, y uint64) uint64 { return x - y })
+	case "*":
+		return arith(func(x, y uint64) uint64 { return x * y })
+	case "/":
+		return arith(func(x, y uint64) uint64 { checkDivisor(y != 0); return x / y })
+	case "%":
+		return arith(func(x, y uint64) uint64 { checkDivisor(y != 0); return x % y })
+	case "&":
+		return arith(func(x, y uint64) uint64 { return x & y })
+	case "|":
+		return arith(func(x, y uint64) uint64 { return x | y })
+	case "^":
+		return arith(func(x, y uint64) uint64 { return x ^ y })
+	case "<<":
+		return arith(func(x, y uint64) uint64 { return x << (y & shift) })
+	case ">>":
+		return arith(func(x, y uint64) uint64 { return x >> (y & shift) })
+	case "==":
+		return compare(func(x, y uint64) bool { return x == y })
+	case "!=":
+		return compare(func(x, y uint64) bool { return x != y })
+	case "<":
+		return compare(func(x, y uint64) bool { return x < y })
+	case "<=":
+		return compare(func(x, y uint64) bool { return x <= y })
+	case ">":
+		return compare(func(x, y uint64) bool { return x > y })
+	case ">=":
+		return compare(func(x, y uint64) bool { return x >= y })
+	}
+	return nil
+}
+
+// checkDivisor panics if an integer division or remainder has a zero divisor. The result would be
+// undefined on a GPU; on the CPU it is reported rather than guessed.
+func checkDivisor(ok bool) {
+	if !ok {
+		panic("integer division by zero")
+	}
+}
+
+func boolLane(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// isComparison reports whether op is a comparison operator.
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+// lanewise1 returns an evalFn that applies f to each of the first width lanes of x.
+func lanewise1(width int, x evalFn, f func(a uint64) uint64) evalFn {
+	return func(fr *frame) value {
+		v := x(fr)
+		var out value
+		for i := 0; i < width; i++ {
+			out.lanes[i] = f(v.lanes[i])
+		}
+		return out
+	}
+}
+
+// lanewise2 returns an evalFn that applies f to each pair of the first width lanes of x and y.
+func lanewise2(width int, x, y evalFn, f laneOp) evalFn {
+	if width == 1 {
+		return func(fr *frame) value {
+			a, b := x(fr), y(fr)
+			return value{lanes: [4]uint64{f(a.lanes[0], b.lanes[0])}}
+		}
+	}
+	return func(fr *frame) value {
+		a, b := x(fr), y(fr)
+		var out value
+		for i := 0; i < width; i++ {
+			out.lanes[i] = f(a.lanes[i], b.lanes[i])
+		}
+		return out
+	}
+}
+
+// lanewise3 returns an evalFn that applies f to each triple of the first width lanes of x, y, and z.
+func lanewise3(width int, x, y, z evalFn, f func(a, b, c uint64) uint64) evalFn {
+	return func(fr *frame) value {
+		a, b, c := x(fr), y(fr), z(fr)
+		var out value
+		for i := 0; i < width; i++ {
+			out.lanes[i] = f(a.lanes[i], b.lanes[i], c.lanes[i])
+		}
+		return out
+	}
+}
+
+// floatLane1 adapts a float64 function to a lane function for the floating-point scalar s.
+func floatLane1(s Scalar, f func(x float64) float64) func(a uint64) uint64 {
+	return func(a uint64) uint64 {
+		return math.Float64bits(roundFloat(s, f(math.Float64frombits(a))))
+	}
+}
+
+// floatLane2 is floatLane1 for binary functions.
+func floatLane2(s Scalar, f func(x, y float64) float64) laneOp {
+	return func(a, b uint64) uint64 {
+		return math.Float64bits(roundFloat(s, f(math.Float64frombits(a), math.Float64frombits(b))))
+	}
+}
+
+// floatLane3 is floatLane1 for ternary functions.
+func floatLane3(s Scalar, f func(x, y, z float64) float64) func(a, b, c uint64) uint64 {
+	return func(a, b, c uint64) uint64 {
+		return math.Float64bits(roundFloat(s, f(math.Float64frombits(a), math.Float64frombits(b), math.Float64frombits(c))))
+	}
+}
+
+// intLess returns the less-than comparison for lanes of the integer scalar s.
+func intLess(s Scalar) func(a, b uint64) bool {
+	if s.IsSigned() {
+		return func(a, b uint64) bool { return int64(a) < int64(b) }
+	}
+	return func(a, b uint64) bool { return a < b }
+}
+
+// countLeadingZeros returns the number of leading zero bits in the lane a of the integer scalar s.
+func countLeadingZeros(s Scalar, a uint64) uint64 {
+	n := s.Size() * 8
+	if n < 64 {
+		a &= 1<<n - 1
+	}
+	return uint64(bits.LeadingZeros64(a) - (64 - n))
+}
+
+// countTrailingZeros returns the number of trailing zero bits in the lane a of the integer scalar
+// s, which is the width of s if a is zero.
+func countTrailingZeros(s Scalar, a uint64) uint64 {
+	n := s.Size() * 8
+	return uint64(min(bits.TrailingZeros64(a), n))
+}
+
+// popCount returns the number of set bits in the lane a of the integer scalar s.
+func popCount(s Scalar, a uint64) uint64 {
+	n := s.Size() * 8
+	if n < 64 {
+		a &= 1<<n - 1
+	}
+	return uint64(bits.OnesCount64(a))
+}
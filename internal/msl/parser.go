@@ -0,0 +1,757 @@
+package msl
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A parser builds a syntax tree from tokens by recursive descent. It stops at the first error,
+// which it reports by panicking with an *Error that parse recovers.
+type parser struct {
+	tokens []token
+	i      int
+}
+
+// parse parses src into a file.
+func parse(src string) (f *file, err error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			f, err = nil, e
+		}
+	}()
+
+	return p.parseFile(), nil
+}
+
+// ----------------------------------------------------------------------------
+// Token helpers
+// ----------------------------------------------------------------------------
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) peekAt(n int) token {
+	if p.i+n >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.i+n]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+// is reports whether the next token is the punctuator or keyword text.
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == tokenPunct || t.kind == tokenIdent) && t.text == text
+}
+
+// accept consumes the next token if it is text.
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+// expect consumes the next token, which must be text.
+func (p *parser) expect(text string) token {
+	if !p.is(text) {
+		p.fail(p.peek().pos, "expected '%s', found %s", text, p.peek())
+	}
+	return p.next()
+}
+
+// ident consumes the next token, which must be an identifier.
+func (p *parser) ident() token {
+	t := p.peek()
+	if t.kind != tokenIdent || isKeyword(t.text) {
+		p.fail(t.pos, "expected identifier, found %s", t)
+	}
+	return p.next()
+}
+
+func (p *parser) fail(pos Pos, format string, args ...any) {
+	panic(errorf(pos, format, args...))
+}
+
+// isAttrStart reports whether the next tokens open an attribute ("[[").
+func (p *parser) isAttrStart() bool {
+	return p.is("[") && p.peekAt(1).kind == tokenPunct && p.peekAt(1).text == "["
+}
+
+var keywords = map[string]bool{
+	"break": true, "case": true, "const": true, "constant": true, "constexpr": true, "continue": true, "default": true,
+	"device": true, "do": true, "else": true, "false": true, "for": true, "if": true, "inline": true,
+	"kernel": true, "return": true, "static": true, "struct": true, "switch": true, "thread": true,
+	"threadgroup": true, "true": true, "typedef": true, "using": true, "void": true, "volatile": true,
+	"while": true,
+}
+
+func isKeyword(s string) bool {
+	return keywords[s]
+}
+
+// ----------------------------------------------------------------------------
+// Declarations
+// ----------------------------------------------------------------------------
+
+func (p *parser) parseFile() *file {
+	f := &file{}
+
+	for p.peek().kind != tokenEOF {
+		switch {
+		case p.accept(";"):
+			// Stray semicolons at file scope are harmless.
+
+		case p.is("using"):
+			// using namespace metal; is the only using-directive kernels need, and the builtins are
+			// always in scope.
+			for !p.accept(";") {
+				if p.peek().kind == tokenEOF {
+					p.fail(p.peek().pos, "expected ';', found %s", p.peek())
+				}
+				p.next()
+			}
+
+		case p.is("struct") || p.is("typedef") || p.is("template") || p.is("namespace") || p.is("enum") || p.is("class"):
+			p.fail(p.peek().pos, "unsupported declaration '%s'", p.peek().text)
+
+		default:
+			p.parseTopDecl(f)
+		}
+	}
+
+	return f
+}
+
+// parseTopDecl parses a function or a program-scope variable declaration.
+func (p *parser) parseTopDecl(f *file) {
+	start := p.peek().pos
+	attrs := p.parseAttrs()
+
+	kernel := false
+	for {
+		switch {
+		case p.accept("kernel"):
+			kernel = true
+			attrs = append(attrs, p.parseAttrs()...)
+			continue
+		case p.accept("static"), p.accept("inline"):
+			continue
+		}
+		break
+	}
+	for _, attr := range attrs {
+		if attr.name == "kernel" {
+			kernel = true
+		}
+	}
+
+	typ := p.parseType()
+
+	if p.peekAt(1).kind == tokenPunct && p.peekAt(1).text == "(" {
+		name := p.ident()
+		fn := &funcDecl{pos: start, kernel: kernel, attrs: attrs, ret: typ, name: name.text}
+		fn.params = p.parseParams()
+		if !p.accept(";") {
+			fn.body = p.parseBlock()
+		}
+		f.funcs = append(f.funcs, fn)
+		return
+	}
+
+	if kernel {
+		p.fail(start, "kernel must be a function")
+	}
+	f.globals = append(f.globals, p.parseDeclRest(start, typ))
+}
+
+// parseAttrs parses any number of attribute lists, such as [[kernel]] or [[buffer(0)]].
+func (p *parser) parseAttrs() []attribute {
+	var attrs []attribute
+	for p.isAttrStart() {
+		p.next()
+		p.next()
+		for {
+			// Attribute names may be keywords, as in [[kernel]].
+			t := p.peek()
+			if t.kind != tokenIdent {
+				p.fail(t.pos, "expected attribute, found %s", t)
+			}
+			p.next()
+			pos, name := t.pos, t.text
+			for p.accept("::") {
+				name = p.ident().text
+			}
+
+			attr := attribute{pos: pos, name: name}
+			if p.accept("(") {
+				var arg strings.Builder
+				depth := 0
+				for {
+					t := p.peek()
+					if t.kind == tokenEOF {
+						p.fail(t.pos, "unterminated attribute")
+					}
+					if t.kind == tokenPunct && (t.text == "," || t.text == ")") && depth == 0 {
+						attr.args = append(attr.args, strings.TrimSpace(arg.String()))
+						arg.Reset()
+						p.next()
+						if t.text == ")" {
+							break
+						}
+						continue
+					}
+					if t.text == "(" {
+						depth++
+					} else if t.text == ")" {
+						depth--
+					}
+					if arg.Len() > 0 {
+						arg.WriteByte(' ')
+					}
+					arg.WriteString(t.text)
+					p.next()
+				}
+			}
+			attrs = append(attrs, attr)
+
+			if !p.accept(",") {
+				break
+			}
+		}
+		p.expect("]")
+		p.expect("]")
+	}
+	return attrs
+}
+
+// isTypeStart reports whether the next token can begin a type.
+func (p *parser) isTypeStart() bool {
+	t := p.peek()
+	if t.kind != tokenIdent {
+		return false
+	}
+	switch t.text {
+	case "const", "constexpr", "device", "constant", "thread", "threadgroup", "volatile":
+		return true
+	}
+	if (t.text == "metal" || t.text == "std") && p.peekAt(1).text == "::" {
+		_, ok := LookupType(p.peekAt(2).text)
+		return ok
+	}
+	_, ok := LookupType(t.text)
+	return ok
+}
+
+// parseType parses qualifiers, a scalar or vector name, and an optional pointer or reference
+// declarator.
+func (p *parser) parseType() typeSpec {
+	ts := typeSpec{pos: p.peek().pos}
+
+	for {
+		switch {
+		case p.accept("const"), p.accept("constexpr"):
+			ts.isConst = true
+		case p.accept("volatile"):
+		case p.accept("device"):
+			ts.space, ts.spaced = Device, true
+		case p.accept("constant"):
+			ts.space, ts.spaced = Constant, true
+		case p.accept("thread"):
+			ts.space, ts.spaced = Thread, true
+		case p.accept("threadgroup"):
+			ts.space, ts.spaced = Threadgroup, true
+		default:
+			goto name
+		}
+	}
+
+name:
+	t := p.peek()
+	if t.kind != tokenIdent {
+		p.fail(t.pos, "expected type, found %s", t)
+	}
+	p.next()
+	if p.is("::") && (t.text == "metal" || t.text == "std") {
+		p.next()
+		t = p.ident()
+	}
+	typ, ok := LookupType(t.text)
+	if !ok {
+		p.fail(t.pos, "unknown type '%s'", t.text)
+	}
+	ts.name = t.text
+	ts.typ = typ
+
+	// Qualifiers may also follow the type name (float const *p).
+	for p.accept("const") || p.accept("volatile") {
+		ts.isConst = true
+	}
+
+	switch {
+	case p.accept("*"):
+		ts.pointer = true
+		// A pointer may itself be const (float *const p), which does not affect the pointee.
+		p.accept("const")
+		if p.is("*") {
+			p.fail(p.peek().pos, "pointers to pointers are not supported")
+		}
+	case p.accept("&"):
+		ts.ref = true
+	}
+
+	return ts
+}
+
+// parseParams parses a parenthesized parameter list.
+func (p *parser) parseParams() []paramDecl {
+	p.expect("(")
+	var params []paramDecl
+	if p.accept(")") {
+		return params
+	}
+	if p.is("void") && p.peekAt(1).text == ")" {
+		p.next()
+		p.next()
+		return params
+	}
+
+	for {
+		pos := p.peek().pos
+		typ := p.parseType()
+		name := p.ident()
+		if p.is("[") && !p.isAttrStart() {
+			p.fail(p.peek().pos, "array parameters are not supported")
+		}
+		attrs := p.parseAttrs()
+		params = append(params, paramDecl{pos: pos, typ: typ, name: name.text, attrs: attrs})
+
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect(")")
+	return params
+}
+
+// parseDeclRest parses the declarators of a declaration whose type has already been parsed, through
+// the closing semicolon.
+func (p *parser) parseDeclRest(pos Pos, typ typeSpec) *declStmt {
+	d := &declStmt{pos: pos, typ: typ}
+	for {
+		name := p.ident()
+		decl := declarator{pos: name.pos, name: name.text}
+		if !p.isAttrStart() && p.accept("[") {
+			decl.array = true
+			if !p.is("]") {
+				decl.arrayLen = p.parseExpr()
+			}
+			p.expect("]")
+		}
+		decl.attrs = p.parseAttrs()
+		if p.accept("=") {
+			if p.is("{") {
+				decl.init = p.parseInitList()
+			} else {
+				decl.init = p.parseAssign()
+			}
+		} else if p.is("{") {
+			decl.init = p.parseInitList()
+		}
+		d.decls = append(d.decls, decl)
+
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect(";")
+	return d
+}
+
+// parseInitList parses a braced initializer list.
+func (p *parser) parseInitList() *initListExpr {
+	l := &initListExpr{pos: p.expect("{").pos}
+	for !p.is("}") {
+		if p.is("{") {
+			l.elems = append(l.elems, p.parseInitList())
+		} else {
+			l.elems = append(l.elems, p.parseAssign())
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect("}")
+	return l
+}
+
+// ----------------------------------------------------------------------------
+// Statements
+// ----------------------------------------------------------------------------
+
+func (p *parser) parseBlock() *blockStmt {
+	b := &blockStmt{pos: p.expect("{").pos}
+	for !p.is("}") {
+		if p.peek().kind == tokenEOF {
+			p.fail(p.peek().pos, "expected '}', found %s", p.peek())
+		}
+		b.stmts = append(b.stmts, p.parseStmt())
+	}
+	p.next()
+	return b
+}
+
+func (p *parser) parseStmt() stmt {
+	t := p.peek()
+
+	switch {
+	case p.is("{"):
+		return p.parseBlock()
+
+	case p.accept(";"):
+		return &emptyStmt{pos: t.pos}
+
+	case p.accept("if"):
+		s := &ifStmt{pos: t.pos}
+		p.expect("(")
+		s.cond = p.parseExpr()
+		p.expect(")")
+		s.then = p.parseStmt()
+		if p.accept("else") {
+			s.els = p.parseStmt()
+		}
+		return s
+
+	case p.accept("for"):
+		s := &forStmt{pos: t.pos}
+		p.expect("(")
+		if !p.is(";") {
+			s.init = p.parseSimpleStmt()
+		} else {
+			p.next()
+		}
+		if !p.is(";") {
+			s.cond = p.parseExpr()
+		}
+		p.expect(";")
+		if !p.is(")") {
+			s.post = p.parseExpr()
+		}
+		p.expect(")")
+		s.body = p.parseStmt()
+		return s
+
+	case p.accept("while"):
+		s := &whileStmt{pos: t.pos}
+		p.expect("(")
+		s.cond = p.parseExpr()
+		p.expect(")")
+		s.body = p.parseStmt()
+		return s
+
+	case p.accept("do"):
+		s := &doStmt{pos: t.pos}
+		s.body = p.parseStmt()
+		p.expect("while")
+		p.expect("(")
+		s.cond = p.parseExpr()
+		p.expect(")")
+		p.expect(";")
+		return s
+
+	case p.accept("return"):
+		s := &returnStmt{pos: t.pos}
+		if !p.is(";") {
+			s.x = p.parseExpr()
+		}
+		p.expect(";")
+		return s
+
+	case p.accept("break"), p.accept("continue"):
+		p.expect(";")
+		return &branchStmt{pos: t.pos, tok: t.text}
+
+	case p.is("switch"), p.is("goto"):
+		p.fail(t.pos, "unsupported statement '%s'", t.text)
+	}
+
+	return p.parseSimpleStmt()
+}
+
+// parseSimpleStmt parses a declaration or an expression statement, including its semicolon.
+func (p *parser) parseSimpleStmt() stmt {
+	pos := p.peek().pos
+	if p.isDeclStart() {
+		return p.parseDeclRest(pos, p.parseType())
+	}
+
+	x := p.parseExpr()
+	p.expect(";")
+	return &exprStmt{pos: pos, x: x}
+}
+
+// isDeclStart reports whether the next tokens begin a declaration rather than an expression. A type
+// name followed by '(' is a constructor call, not a declaration.
+func (p *parser) isDeclStart() bool {
+	if !p.isTypeStart() {
+		return false
+	}
+	t := p.peek()
+	if _, ok := LookupType(t.text); ok {
+		next := p.peekAt(1)
+		return !(next.kind == tokenPunct && next.text == "(")
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------------
+// Expressions
+// ----------------------------------------------------------------------------
+
+// binaryPrec gives the precedence of each binary operator; higher binds tighter.
+var binaryPrec = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6,
+	"<": 7, ">": 7, "<=": 7, ">=": 7,
+	"<<": 8, ">>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+var assignOps = map[string]bool{
+	"=": true, "+=": true, "-=": true, "*=": true, "/=": true, "%=": true,
+	"&=": true, "|=": true, "^=": true, "<<=": true, ">>=": true,
+}
+
+// parseExpr parses a full expression, including the comma operator.
+func (p *parser) parseExpr() expr {
+	x := p.parseAssign()
+	for p.is(",") {
+		t := p.next()
+		x = &binaryExpr{pos: t.pos, op: ",", x: x, y: p.parseAssign()}
+	}
+	return x
+}
+
+// parseAssign parses an assignment or conditional expression.
+func (p *parser) parseAssign() expr {
+	x := p.parseCond()
+	if t := p.peek(); t.kind == tokenPunct && assignOps[t.text] {
+		p.next()
+		return &assignExpr{pos: t.pos, op: t.text, x: x, y: p.parseAssign()}
+	}
+	return x
+}
+
+func (p *parser) parseCond() expr {
+	x := p.parseBinary(1)
+	if t := p.peek(); p.accept("?") {
+		y := p.parseExpr()
+		p.expect(":")
+		return &condExpr{pos: t.pos, cond: x, x: y, y: p.parseCond()}
+	}
+	return x
+}
+
+func (p *parser) parseBinary(minPrec int) expr {
+	x := p.parseUnary()
+	for {
+		t := p.peek()
+		prec, ok := binaryPrec[t.text]
+		if t.kind != tokenPunct || !ok || prec < minPrec {
+			return x
+		}
+		p.next()
+		x = &binaryExpr{pos: t.pos, op: t.text, x: x, y: p.parseBinary(prec + 1)}
+	}
+}
+
+func (p *parser) parseUnary() expr {
+	t := p.peek()
+	if t.kind == tokenPunct {
+		switch t.text {
+		case "+", "-", "!", "~", "*", "&", "++", "--":
+			p.next()
+			return &unaryExpr{pos: t.pos, op: t.text, x: p.parseUnary()}
+		case "(":
+			// A parenthesized type is a C-style cast.
+			save := p.i
+			p.next()
+			if p.isTypeStart() {
+				ts := p.parseType()
+				if p.accept(")") {
+					return &castExpr{pos: t.pos, typ: ts, x: p.parseUnary()}
+				}
+			}
+			p.i = save
+		}
+	}
+	return p.parsePostfix(p.parsePrimary())
+}
+
+func (p *parser) parsePostfix(x expr) expr {
+	for {
+		t := p.peek()
+		switch {
+		case p.is("[") && !p.isAttrStart():
+			p.next()
+			index := p.parseExpr()
+			p.expect("]")
+			x = &indexExpr{pos: t.pos, x: x, index: index}
+		case p.accept("."):
+			x = &memberExpr{pos: t.pos, x: x, name: p.ident().text}
+		case p.is("->"):
+			p.fail(t.pos, "unsupported operator '->'")
+		case p.accept("++"), p.accept("--"):
+			x = &postfixExpr{pos: t.pos, op: t.text, x: x}
+		default:
+			return x
+		}
+	}
+}
+
+func (p *parser) parsePrimary() expr {
+	t := p.peek()
+
+	switch t.kind {
+	case tokenInt:
+		p.next()
+		return p.intLiteral(t)
+
+	case tokenFloat:
+		p.next()
+		return p.floatLiteral(t)
+
+	case tokenIdent:
+		switch t.text {
+		case "true", "false":
+			p.next()
+			return &litExpr{pos: t.pos, typ: boolType, v: boolValue(t.text == "true")}
+		}
+
+		p.next()
+		name := t.text
+		// Namespace qualifiers (metal::, precise::, fast::) select among implementations that this
+		// interpreter does not distinguish, so only the last component matters.
+		for p.accept("::") {
+			name = p.ident().text
+		}
+
+		if p.is("<") && (name == "static_cast" || name == "as_type" || name == "reinterpret_cast") {
+			p.next()
+			ts := p.parseType()
+			p.expect(">")
+			p.expect("(")
+			x := p.parseExpr()
+			p.expect(")")
+			return &callExpr{pos: t.pos, name: name, targ: &ts, args: []expr{x}}
+		}
+
+		if p.accept("(") {
+			call := &callExpr{pos: t.pos, name: name}
+			if !p.accept(")") {
+				for {
+					call.args = append(call.args, p.parseAssign())
+					if !p.accept(",") {
+						break
+					}
+				}
+				p.expect(")")
+			}
+			return call
+		}
+
+		if isKeyword(name) {
+			p.fail(t.pos, "unexpected %s", t)
+		}
+		return &identExpr{pos: t.pos, name: name}
+
+	case tokenPunct:
+		if p.accept("(") {
+			x := p.parseExpr()
+			p.expect(")")
+			return x
+		}
+	}
+
+	p.fail(t.pos, "unexpected %s", t)
+	return nil
+}
+
+// intLiteral parses an integer literal with an optional u/U (unsigned), l/L (long), or h/H (half)
+// suffix. As in C++, an unsuffixed literal too large for int takes the next type that fits it.
+func (p *parser) intLiteral(t token) expr {
+	text := strings.ToLower(t.text)
+	digits := strings.TrimRight(text, "ul")
+	suffix := text[len(digits):]
+	if strings.HasSuffix(digits, "h") || strings.HasSuffix(digits, "f") && !strings.HasPrefix(digits, "0x") {
+		// 1h and 1f are not valid MSL, but the intent is unambiguous.
+		return p.floatLiteral(t)
+	}
+
+	n, err := strconv.ParseUint(digits, 0, 64)
+	if err != nil {
+		p.fail(t.pos, "invalid integer literal '%s'", t.text)
+	}
+
+	unsigned := strings.Contains(suffix, "u")
+	long := strings.Contains(suffix, "l")
+	var s Scalar
+	switch {
+	case !long && !unsigned && n <= math.MaxInt32:
+		s = Int
+	case !long && (unsigned || strings.HasPrefix(digits, "0x")) && n <= math.MaxUint32:
+		s = UInt
+	case !unsigned && n <= math.MaxInt64:
+		s = Long
+	default:
+		s = ULong
+	}
+
+	return &litExpr{pos: t.pos, typ: scalarType(s), v: intValue(s, 1, int64(n))}
+}
+
+// floatLiteral parses a floating-point literal with an optional f/F (float) or h/H (half) suffix.
+// Unsuffixed literals are float, since MSL has no double.
+func (p *parser) floatLiteral(t token) expr {
+	text := strings.ToLower(t.text)
+	s := Float
+	switch {
+	case strings.HasSuffix(text, "h"):
+		s = Half
+		text = text[:len(text)-1]
+	case strings.HasSuffix(text, "f"):
+		text = text[:len(text)-1]
+	}
+
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		p.fail(t.pos, "invalid floating-point literal '%s'", t.text)
+	}
+
+	return &litExpr{pos: t.pos, typ: scalarType(s), v: floatValue(s, 1, f)}
+}
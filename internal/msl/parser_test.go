@@ -0,0 +1,72 @@
+package msl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_lex(t *testing.T) {
+	tokens, err := lex("#include <metal_stdlib>\n/* block\ncomment */ a[[b]] >>= 1.5e3f; // line\n0x1Fu")
+	require.NoError(t, err)
+
+	var got []string
+	for _, tok := range tokens {
+		got = append(got, tok.pos.String()+" "+tok.text)
+	}
+	require.Equal(t, []string{
+		"3:12 a", "3:13 [", "3:14 [", "3:15 b", "3:16 ]", "3:17 ]", "3:19 >>=", "3:23 1.5e3f", "3:29 ;",
+		"4:1 0x1Fu", "4:6 ",
+	}, got)
+}
+
+func Test_parse(t *testing.T) {
+	f, err := parse(`
+using namespace metal;
+
+constant float SCALE = 2.0f;
+
+float scale(float x);
+
+[[kernel]] void k(device float *out [[buffer(1)]], uint2 pos [[thread_position_in_grid]]) {
+    out[pos.x] = scale((float)pos.y) + static_cast<float>(-1);
+}
+
+float scale(float x) { return x * SCALE; }
+`)
+	require.NoError(t, err)
+	require.Len(t, f.globals, 1)
+	require.Len(t, f.funcs, 3)
+
+	k := f.funcs[1]
+	require.True(t, k.kernel)
+	require.Equal(t, "k", k.name)
+	require.Len(t, k.params, 2)
+	require.Equal(t, []attribute{{pos: Pos{Line: 8, Column: 39}, name: "buffer", args: []string{"1"}}}, k.params[0].attrs)
+	require.Equal(t, "thread_position_in_grid", k.params[1].attrs[0].name)
+	require.Nil(t, f.funcs[0].body)
+	require.NotNil(t, f.funcs[2].body)
+
+	t.Run("errors", func(t *testing.T) {
+		type subtest struct {
+			name string
+			src  string
+			err  string
+		}
+
+		subtests := []subtest{
+			{name: "struct", src: "struct S { float x; };", err: "1:1: unsupported declaration 'struct'"},
+			{name: "unknown type", src: "kernel void k(device vec3 *v) {}", err: "1:22: unknown type 'vec3'"},
+			{name: "missing brace", src: "kernel void k() {", err: "1:18: expected '}', found end of file"},
+			{name: "unterminated comment", src: "/* ...", err: "1:1: unterminated comment"},
+			{name: "switch", src: "void f() { switch (1) {} }", err: "1:12: unsupported statement 'switch'"},
+		}
+
+		for _, subtest := range subtests {
+			t.Run(subtest.name, func(t *testing.T) {
+				_, err := parse(subtest.src)
+				require.EqualError(t, err, subtest.err)
+			})
+		}
+	})
+}
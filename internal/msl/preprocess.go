@@ -0,0 +1,989 @@
+package msl
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Preprocess runs the C preprocessor over src, with macros defined as if by #define name value
+// before the first line, as the Metal compiler does before compiling it.
+//
+// It supports object-like and function-like macros, including variadic ones and the # and ##
+// operators, #undef, conditional compilation with #if, #ifdef, #ifndef, #elif, #else, and #endif,
+// and #error. Other directives, such as #include, #pragma, and #line, are left in place for the
+// lexer. Each line of src becomes one line of the result, so positions in the result are positions
+// in src. Positions in errors follow #line directives, as the lexer's do.
+func Preprocess(src string, macros map[string]string) (string, error) {
+	pp := &preprocessor{macros: make(map[string]*macro)}
+
+	names := make([]string, 0, len(macros))
+	for name := range macros {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if !isIdentifier(name) {
+			return "", errorf(Pos{}, "invalid macro name '%s'", name)
+		}
+		tokens := ppTokenize(macros[name], Pos{})
+		m, err := pp.parseMacro(name, false, nil, false, tokens, Pos{})
+		if err != nil {
+			return "", err
+		}
+		pp.macros[name] = m
+	}
+
+	return pp.run(src)
+}
+
+// isIdentifier reports whether s is a valid identifier.
+func isIdentifier(s string) bool {
+	if s == "" || !isIdentStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isIdentPart(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// A macro is a #define: its replacement list and, for a function-like macro, its parameters.
+type macro struct {
+	name     string
+	function bool
+	params   []string
+	variadic bool
+	body     []ppToken
+}
+
+// A preprocessor holds the macros defined so far and the state of conditional compilation.
+type preprocessor struct {
+	macros map[string]*macro
+	conds  []condition
+	out    strings.Builder
+
+	// file and offset map lines of the source to the positions that #line directives give them: the
+	// nth line is reported as line n+offset of file.
+	file   string
+	offset int
+}
+
+// A condition is one level of #if nesting.
+type condition struct {
+	// active reports whether the lines of the current group are kept.
+	active bool
+	// taken reports whether any group of the conditional has been kept, so later ones are not.
+	taken bool
+	// parent reports whether the enclosing group is kept. If not, no group of this one is.
+	parent bool
+	// sawElse reports whether #else has been seen.
+	sawElse bool
+	pos     Pos
+}
+
+// active reports whether lines at the current nesting are kept.
+func (pp *preprocessor) active() bool {
+	return len(pp.conds) == 0 || pp.conds[len(pp.conds)-1].active
+}
+
+// run preprocesses src line by line. Text lines are collected into runs, so that a function-like
+// macro can be invoked across lines, and each run is expanded when a directive or the end of the
+// source is reached.
+func (pp *preprocessor) run(src string) (string, error) {
+	lines := strings.SplitAfter(src, "\n")
+	inComment := false
+	var text strings.Builder
+	textStart := 1
+
+	flush := func() error {
+		if text.Len() == 0 {
+			return nil
+		}
+		expanded, err := pp.expandText(text.String(), pp.pos(textStart, 1))
+		if err != nil {
+			return err
+		}
+		pp.out.WriteString(expanded)
+		text.Reset()
+		return nil
+	}
+
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimLeft(line, " \t")
+		if inComment || !strings.HasPrefix(trimmed, "#") {
+			inComment = commentState(line, inComment)
+			if pp.active() {
+				if text.Len() == 0 {
+					textStart = i + 1
+				}
+				text.WriteString(line)
+			} else {
+				pp.out.WriteString(blankLines(line))
+			}
+			i++
+			continue
+		}
+
+		// A directive continues across escaped newlines and unterminated block comments.
+		start := i
+		directive := line
+		i++
+		for i < len(lines) && (strings.HasSuffix(strings.TrimRight(directive, "\r\n"), "\\") || commentState(directive, false)) {
+			directive += lines[i]
+			i++
+		}
+
+		if err := flush(); err != nil {
+			return "", err
+		}
+		pos := pp.pos(start+1, len(line)-len(trimmed)+1)
+		keep, err := pp.directive(directive, pos)
+		if err != nil {
+			return "", err
+		}
+		if keep {
+			pp.out.WriteString(directive)
+		} else {
+			pp.out.WriteString(blankLines(directive))
+		}
+	}
+	if err := flush(); err != nil {
+		return "", err
+	}
+
+	if len(pp.conds) > 0 {
+		return "", errorf(pp.conds[len(pp.conds)-1].pos, "unterminated conditional directive")
+	}
+
+	return pp.out.String(), nil
+}
+
+// pos returns the position of the given column of the nth line of the source.
+func (pp *preprocessor) pos(n, column int) Pos {
+	return Pos{File: pp.file, Line: n + pp.offset, Column: column}
+}
+
+// blankLines returns the newlines in s, to stand in for lines that are dropped.
+func blankLines(s string) string {
+	return strings.Repeat("\n", strings.Count(s, "\n"))
+}
+
+// commentState reports whether a block comment is open at the end of line, given whether one was
+// open at its start.
+func commentState(line string, inComment bool) bool {
+	for i := 0; i < len(line); i++ {
+		switch {
+		case inComment:
+			if strings.HasPrefix(line[i:], "*/") {
+				inComment = false
+				i++
+			}
+		case strings.HasPrefix(line[i:], "//"):
+			return false
+		case strings.HasPrefix(line[i:], "/*"):
+			inComment = true
+			i++
+		case line[i] == '"' || line[i] == '\'':
+			i += quotedLength(line[i:]) - 1
+		}
+	}
+	return inComment
+}
+
+// quotedLength returns the length of the string or character literal at the start of s, up to the
+// end of the line if it is unterminated.
+func quotedLength(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		case '\n':
+			return i
+		}
+	}
+	return len(s)
+}
+
+// directive handles the directive in text, which starts at pos. It reports whether the directive
+// is left in the output for the lexer.
+func (pp *preprocessor) directive(text string, pos Pos) (bool, error) {
+	tokens := trimSpace(ppTokenize(strings.TrimLeft(text, " \t")[1:], pos))
+	if len(tokens) == 0 {
+		// The null directive.
+		return false, nil
+	}
+	name, args := tokens[0].text, trimSpace(tokens[1:])
+
+	switch name {
+	case "if", "ifdef", "ifndef":
+		c := condition{parent: pp.active(), pos: pos}
+		if c.parent {
+			var err error
+			switch name {
+			case "if":
+				c.active, err = pp.evaluate(args, pos)
+			case "ifdef":
+				c.active, err = pp.defined(name, args, pos)
+			case "ifndef":
+				c.active, err = pp.defined(name, args, pos)
+				c.active = !c.active
+			}
+			if err != nil {
+				return false, err
+			}
+			c.taken = c.active
+		}
+		pp.conds = append(pp.conds, c)
+		return false, nil
+
+	case "elif", "else":
+		if len(pp.conds) == 0 {
+			return false, errorf(pos, "#%s without #if", name)
+		}
+		c := &pp.conds[len(pp.conds)-1]
+		if c.sawElse {
+			return false, errorf(pos, "#%s after #else", name)
+		}
+		c.active = false
+		if c.parent && !c.taken {
+			if name == "else" {
+				c.active = true
+			} else {
+				active, err := pp.evaluate(args, pos)
+				if err != nil {
+					return false, err
+				}
+				c.active = active
+			}
+			c.taken = c.active
+		}
+		c.sawElse = name == "else"
+		return false, nil
+
+	case "endif":
+		if len(pp.conds) == 0 {
+			return false, errorf(pos, "#endif without #if")
+		}
+		pp.conds = pp.conds[:len(pp.conds)-1]
+		return false, nil
+	}
+
+	if !pp.active() {
+		return false, nil
+	}
+
+	switch name {
+	case "define":
+		return false, pp.define(args, pos)
+	case "undef":
+		if len(args) == 0 || args[0].kind != ppIdent {
+			return false, errorf(pos, "macro name missing in #undef")
+		}
+		delete(pp.macros, args[0].text)
+		return false, nil
+	case "error":
+		return false, errorf(pos, "#error %s", joinPP(args))
+	case "line":
+		next, file, ok := parseLine(joinPP(args))
+		if !ok {
+			return false, errorf(pos, "invalid #line directive")
+		}
+		// The line after the directive, which may span several, becomes line next.
+		n := pos.Line - pp.offset + strings.Count(text, "\n")
+		pp.offset = next - n
+		if file != "" {
+			pp.file = file
+		}
+		return true, nil
+	default:
+		return true, nil
+	}
+}
+
+// defined reports whether the macro named by the arguments of #ifdef or #ifndef is defined.
+func (pp *preprocessor) defined(directive string, args []ppToken, pos Pos) (bool, error) {
+	if len(args) == 0 || args[0].kind != ppIdent {
+		return false, errorf(pos, "macro name missing in #%s", directive)
+	}
+	_, ok := pp.macros[args[0].text]
+	return ok, nil
+}
+
+// define handles the arguments of #define.
+func (pp *preprocessor) define(args []ppToken, pos Pos) error {
+	if len(args) == 0 || args[0].kind != ppIdent {
+		return errorf(pos, "macro name missing in #define")
+	}
+	name := args[0].text
+	rest := args[1:]
+
+	// A macro is function-like only if the parenthesis immediately follows its name.
+	if len(rest) == 0 || rest[0].text != "(" {
+		m, err := pp.parseMacro(name, false, nil, false, rest, pos)
+		if err != nil {
+			return err
+		}
+		pp.macros[name] = m
+		return nil
+	}
+
+	var params []string
+	variadic := false
+	i := 1
+	for {
+		for i < len(rest) && rest[i].kind == ppSpace {
+			i++
+		}
+		if i == len(rest) {
+			return errorf(pos, "missing ')' in parameters of macro '%s'", name)
+		}
+		switch t := rest[i]; {
+		case t.text == ")" && len(params) == 0 && !variadic:
+		case t.text == "...":
+			variadic = true
+			i++
+		case t.kind == ppIdent && !slices.Contains(params, t.text):
+			params = append(params, t.text)
+			i++
+		default:
+			return errorf(pos, "invalid parameter %s of macro '%s'", t, name)
+		}
+		for i < len(rest) && rest[i].kind == ppSpace {
+			i++
+		}
+		if i == len(rest) {
+			return errorf(pos, "missing ')' in parameters of macro '%s'", name)
+		}
+		if rest[i].text == ")" {
+			i++
+			break
+		}
+		if rest[i].text != "," || variadic {
+			return errorf(pos, "invalid parameter %s of macro '%s'", rest[i], name)
+		}
+		i++
+	}
+
+	m, err := pp.parseMacro(name, true, params, variadic, rest[i:], pos)
+	if err != nil {
+		return err
+	}
+	pp.macros[name] = m
+	return nil
+}
+
+// parseMacro builds the macro called name from its replacement list, collapsing whitespace and
+// checking the uses of # and ##.
+func (pp *preprocessor) parseMacro(name string, function bool, params []string, variadic bool, body []ppToken, pos Pos) (*macro, error) {
+	m := &macro{name: name, function: function, params: params, variadic: variadic}
+	if variadic {
+		m.params = append(slices.Clone(params), "__VA_ARGS__")
+	}
+
+	body = trimSpace(body)
+	for i, t := range body {
+		switch {
+		case t.kind == ppSpace || t.kind == ppNewline:
+			// Whitespace around ## is not part of the result, and other runs of it are one space.
+			if body[i-1].text == "##" || body[i+1].text == "##" || m.body[len(m.body)-1].kind == ppSpace {
+				continue
+			}
+			t = ppToken{kind: ppSpace, text: " ", pos: t.pos}
+		case t.text == "##" && (i == 0 || i == len(body)-1):
+			return nil, errorf(pos, "'##' cannot appear at either end of macro '%s'", name)
+		}
+		m.body = append(m.body, t)
+	}
+
+	if function {
+		for i, t := range m.body {
+			if t.text == "#" && (i+1 == len(m.body) || !slices.Contains(m.params, m.body[i+1].text)) {
+				return nil, errorf(pos, "'#' is not followed by a macro parameter in macro '%s'", name)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// ----------------------------------------------------------------------------
+// Macro expansion
+// ----------------------------------------------------------------------------
+
+// expandText expands the macros in a run of text lines that starts at pos.
+func (pp *preprocessor) expandText(text string, pos Pos) (string, error) {
+	tokens, err := pp.expand(ppTokenize(text, pos))
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, t := range tokens {
+		b.WriteString(t.text)
+	}
+	return b.String(), nil
+}
+
+// expand replaces every invocation of a macro in tokens with its expansion, rescanning the result
+// for more. A token is not expanded by a macro in its hide set, which holds the macros whose
+// expansion produced it, so that a macro that refers to itself is not expanded forever.
+func (pp *preprocessor) expand(tokens []ppToken) ([]ppToken, error) {
+	var out []ppToken
+	for len(tokens) > 0 {
+		t := tokens[0]
+		m := pp.macros[t.text]
+		if t.kind != ppIdent || m == nil || slices.Contains(t.hide, t.text) {
+			out = append(out, t)
+			tokens = tokens[1:]
+			continue
+		}
+
+		hide := append(slices.Clone(t.hide), m.name)
+		if !m.function {
+			tokens = slices.Concat(pp.substitute(m, nil, hide, t.pos), tokens[1:])
+			continue
+		}
+
+		// A function-like macro name that is not followed by arguments is not an invocation.
+		open := 1
+		for open < len(tokens) && (tokens[open].kind == ppSpace || tokens[open].kind == ppNewline) {
+			open++
+		}
+		if open == len(tokens) || tokens[open].text != "(" {
+			out = append(out, t)
+			tokens = tokens[1:]
+			continue
+		}
+
+		args, end, err := collectArgs(m, tokens, open, t.pos)
+		if err != nil {
+			return nil, err
+		}
+
+		// The newlines inside the invocation are put back after its expansion, so that the lines
+		// that follow keep their numbers.
+		var newlines []ppToken
+		for _, arg := range tokens[:end] {
+			if arg.kind == ppNewline {
+				newlines = append(newlines, arg)
+			}
+		}
+
+		expanded := make([][]ppToken, len(args))
+		for i, arg := range args {
+			if expanded[i], err = pp.expand(arg); err != nil {
+				return nil, err
+			}
+		}
+		replacement := pp.substitute(m, &macroArgs{raw: args, expanded: expanded}, hide, t.pos)
+		tokens = slices.Concat(replacement, newlines, tokens[end:])
+	}
+
+	return out, nil
+}
+
+// macroArgs are the arguments of a function-like macro invocation, as written and fully expanded.
+type macroArgs struct {
+	raw      [][]ppToken
+	expanded [][]ppToken
+}
+
+// collectArgs splits the arguments of the invocation of m whose opening parenthesis is
+// tokens[open]. It returns them, without surrounding whitespace, and the index after the closing
+// parenthesis.
+func collectArgs(m *macro, tokens []ppToken, open int, pos Pos) ([][]ppToken, int, error) {
+	var args [][]ppToken
+	var arg []ppToken
+	depth := 0
+	for i := open + 1; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind == ppNewline {
+			t = ppToken{kind: ppSpace, text: " ", pos: t.pos}
+		}
+		switch {
+		case t.text == "(":
+			depth++
+		case t.text == ")" && depth > 0:
+			depth--
+		case t.text == ")":
+			args = append(args, trimSpace(arg))
+			if len(args) == 1 && len(args[0]) == 0 && len(m.params) == 0 {
+				args = nil
+			}
+			if len(args) != len(m.params) {
+				// A variadic macro may be invoked without any variadic arguments.
+				if !m.variadic || len(args) != len(m.params)-1 {
+					return nil, 0, errorf(pos, "macro '%s' takes %d arguments, but %d were given", m.name, len(m.params), len(args))
+				}
+				args = append(args, nil)
+			}
+			return args, i + 1, nil
+		case t.text == "," && depth == 0 && !(m.variadic && len(args) == len(m.params)-1):
+			args = append(args, trimSpace(arg))
+			arg = nil
+			continue
+		}
+		arg = append(arg, t)
+	}
+
+	return nil, 0, errorf(pos, "unterminated invocation of macro '%s'", m.name)
+}
+
+// substitute returns the replacement list of m with the arguments of an invocation, if any,
+// substituted for its parameters, and with hide added to the hide set of every token. pos is the
+// position of the invocation, which every token of the result takes.
+func (pp *preprocessor) substitute(m *macro, args *macroArgs, hide []string, pos Pos) []ppToken {
+	param := func(t ppToken) int {
+		if args == nil || t.kind != ppIdent {
+			return -1
+		}
+		return slices.Index(m.params, t.text)
+	}
+
+	var out []ppToken
+	for i := 0; i < len(m.body); i++ {
+		t := m.body[i]
+		pasted := i+1 < len(m.body) && m.body[i+1].text == "##" || i > 0 && m.body[i-1].text == "##"
+		switch {
+		case t.text == "#" && args != nil:
+			i++
+			out = append(out, ppToken{kind: ppString, text: stringize(args.raw[param(m.body[i])])})
+		case t.text == "##":
+			// The operands are pasted below, once both are in out.
+			out = append(out, t)
+		case param(t) >= 0 && pasted:
+			arg := args.raw[param(t)]
+			if len(arg) == 0 {
+				// An empty argument still takes part in the paste, as a placemarker.
+				arg = []ppToken{{kind: ppSpace}}
+			}
+			out = append(out, arg...)
+		case param(t) >= 0:
+			out = append(out, args.expanded[param(t)]...)
+		default:
+			out = append(out, t)
+		}
+	}
+
+	// Paste the tokens on either side of each ##.
+	for i := 0; i < len(out); i++ {
+		if out[i].text != "##" || out[i].kind != ppPunct {
+			continue
+		}
+		left, right := out[i-1], out[i+1]
+		pasted := ppTokenize(left.text+right.text, pos)
+		out = slices.Concat(out[:i-1], pasted, out[i+2:])
+		i += len(pasted) - 2
+	}
+
+	for i := range out {
+		out[i].pos = pos
+		out[i].hide = slices.Concat(out[i].hide, hide)
+	}
+	return out
+}
+
+// stringize returns the string literal that the # operator makes of arg.
+func stringize(arg []ppToken) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, t := range arg {
+		text := t.text
+		if t.kind == ppSpace {
+			text = " "
+		}
+		if t.kind == ppString {
+			text = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text)
+		}
+		b.WriteString(text)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// ----------------------------------------------------------------------------
+// Conditional expressions
+// ----------------------------------------------------------------------------
+
+// evaluate reports whether the controlling expression of #if or #elif is true.
+func (pp *preprocessor) evaluate(tokens []ppToken, pos Pos) (bool, error) {
+	// defined is evaluated before macros are expanded, so that its operand is not expanded.
+	var resolved []ppToken
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].text != "defined" {
+			resolved = append(resolved, tokens[i])
+			continue
+		}
+
+		j := skipSpace(tokens, i+1)
+		parens := j < len(tokens) && tokens[j].text == "("
+		if parens {
+			j = skipSpace(tokens, j+1)
+		}
+		if j == len(tokens) || tokens[j].kind != ppIdent {
+			return false, errorf(pos, "macro name missing after 'defined'")
+		}
+		value := "0"
+		if _, ok := pp.macros[tokens[j].text]; ok {
+			value = "1"
+		}
+		if parens {
+			j = skipSpace(tokens, j+1)
+			if j == len(tokens) || tokens[j].text != ")" {
+				return false, errorf(pos, "missing ')' after 'defined'")
+			}
+		}
+		resolved = append(resolved, ppToken{kind: ppNumber, text: value})
+		i = j
+	}
+
+	expanded, err := pp.expand(resolved)
+	if err != nil {
+		return false, err
+	}
+
+	e := &ifExpr{pos: pos}
+	for _, t := range expanded {
+		if t.kind != ppSpace && t.kind != ppNewline {
+			e.tokens = append(e.tokens, t)
+		}
+	}
+	if len(e.tokens) == 0 {
+		return false, errorf(pos, "missing expression in conditional directive")
+	}
+
+	value, err := e.parse(0)
+	if err != nil {
+		return false, err
+	}
+	if len(e.tokens) > 0 {
+		return false, errorf(pos, "unexpected %s in conditional directive", e.tokens[0])
+	}
+
+	return value != 0, nil
+}
+
+// skipSpace returns the index of the first token at or after i that is not whitespace.
+func skipSpace(tokens []ppToken, i int) int {
+	for i < len(tokens) && tokens[i].kind == ppSpace {
+		i++
+	}
+	return i
+}
+
+// An ifExpr is the controlling expression of a conditional directive, which is evaluated as it is
+// parsed.
+type ifExpr struct {
+	tokens []ppToken
+	pos    Pos
+}
+
+// condPrecedence gives the precedence of each binary operator, higher binding tighter.
+var condPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6,
+	"<": 7, "<=": 7, ">": 7, ">=": 7,
+	"<<": 8, ">>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+// parse evaluates a conditional expression whose binary operators bind tighter than minPrec.
+func (e *ifExpr) parse(minPrec int) (int64, error) {
+	left, err := e.unary()
+	if err != nil {
+		return 0, err
+	}
+
+	for len(e.tokens) > 0 {
+		op := e.tokens[0].text
+		if op == "?" && minPrec == 0 {
+			e.tokens = e.tokens[1:]
+			then, err := e.parse(0)
+			if err != nil {
+				return 0, err
+			}
+			if len(e.tokens) == 0 || e.tokens[0].text != ":" {
+				return 0, errorf(e.pos, "missing ':' in conditional directive")
+			}
+			e.tokens = e.tokens[1:]
+			otherwise, err := e.parse(0)
+			if err != nil {
+				return 0, err
+			}
+			if left != 0 {
+				return then, nil
+			}
+			return otherwise, nil
+		}
+
+		prec, ok := condPrecedence[op]
+		if !ok || prec <= minPrec {
+			break
+		}
+		e.tokens = e.tokens[1:]
+		right, err := e.parse(prec)
+		if err != nil {
+			return 0, err
+		}
+		if left, err = e.binary(op, left, right); err != nil {
+			return 0, err
+		}
+	}
+
+	return left, nil
+}
+
+// binary applies a binary operator.
+func (e *ifExpr) binary(op string, l, r int64) (int64, error) {
+	b := func(v bool) int64 {
+		if v {
+			return 1
+		}
+		return 0
+	}
+
+	switch op {
+	case "||":
+		return b(l != 0 || r != 0), nil
+	case "&&":
+		return b(l != 0 && r != 0), nil
+	case "|":
+		return l | r, nil
+	case "^":
+		return l ^ r, nil
+	case "&":
+		return l & r, nil
+	case "==":
+		return b(l == r), nil
+	case "!=":
+		return b(l != r), nil
+	case "<":
+		return b(l < r), nil
+	case "<=":
+		return b(l <= r), nil
+	case ">":
+		return b(l > r), nil
+	case ">=":
+		return b(l >= r), nil
+	case "<<":
+		return l << (r & 63), nil
+	case ">>":
+		return l >> (r & 63), nil
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	default:
+		if r == 0 {
+			return 0, errorf(e.pos, "division by zero in conditional directive")
+		}
+		if op == "/" {
+			return l / r, nil
+		}
+		return l % r, nil
+	}
+}
+
+// unary evaluates a unary expression: an operand with any prefix operators.
+func (e *ifExpr) unary() (int64, error) {
+	if len(e.tokens) == 0 {
+		return 0, errorf(e.pos, "missing operand in conditional directive")
+	}
+	t := e.tokens[0]
+	e.tokens = e.tokens[1:]
+
+	switch {
+	case t.text == "(":
+		v, err := e.parse(0)
+		if err != nil {
+			return 0, err
+		}
+		if len(e.tokens) == 0 || e.tokens[0].text != ")" {
+			return 0, errorf(e.pos, "missing ')' in conditional directive")
+		}
+		e.tokens = e.tokens[1:]
+		return v, nil
+	case t.text == "!" || t.text == "~" || t.text == "-" || t.text == "+":
+		v, err := e.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch t.text {
+		case "!":
+			if v == 0 {
+				return 1, nil
+			}
+			return 0, nil
+		case "~":
+			return ^v, nil
+		case "-":
+			return -v, nil
+		}
+		return v, nil
+	case t.kind == ppNumber:
+		v, err := strconv.ParseInt(strings.TrimRight(t.text, "uUlL"), 0, 64)
+		if err != nil {
+			return 0, errorf(e.pos, "invalid integer %s in conditional directive", t)
+		}
+		return v, nil
+	case t.text == "true":
+		return 1, nil
+	case t.kind == ppIdent:
+		// An identifier that is not a macro evaluates to 0.
+		return 0, nil
+	default:
+		return 0, errorf(e.pos, "unexpected %s in conditional directive", t)
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Preprocessing tokens
+// ----------------------------------------------------------------------------
+
+// A ppKind categorizes a preprocessing token.
+type ppKind int
+
+const (
+	ppIdent ppKind = iota
+	ppNumber
+	ppString
+	ppPunct
+	// ppSpace is whitespace or a comment, which is kept as it was written so that the output is
+	// the source wherever no macro is expanded.
+	ppSpace
+	ppNewline
+)
+
+// A ppToken is one preprocessing token. Unlike the lexer's tokens, whitespace and comments are
+// tokens too.
+type ppToken struct {
+	kind ppKind
+	text string
+	pos  Pos
+	// hide is the hide set: the macros whose expansion produced the token.
+	hide []string
+}
+
+func (t ppToken) String() string {
+	return "'" + t.text + "'"
+}
+
+// ppTokenize splits src, which starts at pos, into preprocessing tokens. It never fails: a
+// character that starts no other token is a punctuator of its own, left for the lexer to reject.
+func ppTokenize(src string, pos Pos) []ppToken {
+	var tokens []ppToken
+	line, lineStart := pos.Line, -pos.Column+1
+
+	for i := 0; i < len(src); {
+		start := i
+		p := Pos{File: pos.File, Line: line, Column: i - lineStart + 1}
+		kind := ppPunct
+
+		switch c := src[i]; {
+		case c == '\n':
+			kind = ppNewline
+			i++
+			line++
+			lineStart = i
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			kind = ppSpace
+			for i < len(src) && strings.IndexByte(" \t\r\f\v", src[i]) >= 0 {
+				i++
+			}
+		case c == '\\' && i+1 < len(src) && src[i+1] == '\n':
+			kind = ppSpace
+			i += 2
+			line++
+			lineStart = i
+		case strings.HasPrefix(src[i:], "//"):
+			kind = ppSpace
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			kind = ppSpace
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += 2 + end + 2
+			}
+			if nl := strings.LastIndexByte(src[start:i], '\n'); nl >= 0 {
+				line += strings.Count(src[start:i], "\n")
+				lineStart = start + nl + 1
+			}
+		case c == '"' || c == '\'':
+			kind = ppString
+			i += quotedLength(src[i:])
+		case isIdentStart(c):
+			kind = ppIdent
+			for i < len(src) && isIdentPart(src[i]) {
+				i++
+			}
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])):
+			kind = ppNumber
+			for i < len(src) {
+				if (src[i] == '+' || src[i] == '-') && strings.IndexByte("eEpP", src[i-1]) >= 0 {
+					i++
+				} else if isIdentPart(src[i]) || src[i] == '.' {
+					i++
+				} else {
+					break
+				}
+			}
+		default:
+			n := 1
+			for _, punct := range append([]string{"##", "#"}, puncts...) {
+				if strings.HasPrefix(src[i:], punct) {
+					n = len(punct)
+					break
+				}
+			}
+			i += n
+		}
+
+		tokens = append(tokens, ppToken{kind: kind, text: src[start:i], pos: p})
+	}
+
+	return tokens
+}
+
+// trimSpace returns tokens without leading or trailing whitespace.
+func trimSpace(tokens []ppToken) []ppToken {
+	for len(tokens) > 0 && (tokens[0].kind == ppSpace || tokens[0].kind == ppNewline) {
+		tokens = tokens[1:]
+	}
+	for len(tokens) > 0 && (tokens[len(tokens)-1].kind == ppSpace || tokens[len(tokens)-1].kind == ppNewline) {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+// joinPP returns the text of tokens, with each run of whitespace collapsed to one space.
+func joinPP(tokens []ppToken) string {
+	var b strings.Builder
+	for i, t := range tokens {
+		if t.kind == ppSpace || t.kind == ppNewline {
+			if i > 0 && tokens[i-1].kind != ppSpace && tokens[i-1].kind != ppNewline {
+				b.WriteByte(' ')
+			}
+			continue
+		}
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
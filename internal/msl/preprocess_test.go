@@ -0,0 +1,233 @@
+package msl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_Preprocess tests that macros are expanded and conditional groups selected as the C
+// preprocessor does, keeping every line in place.
+func Test_Preprocess(t *testing.T) {
+	type subtest struct {
+		name   string
+		src    string
+		macros map[string]string
+		want   string
+		err    string
+	}
+
+	subtests := []subtest{
+		{
+			name: "no directives",
+			src:  "kernel void k(device float *a) {\n    a[0] = 1; // N\n}",
+			want: "kernel void k(device float *a) {\n    a[0] = 1; // N\n}",
+		},
+		{
+			name:   "predefined",
+			src:    "float x = SCALE * N;",
+			macros: map[string]string{"SCALE": "2.5f", "N": "(4 + 1)"},
+			want:   "float x = 2.5f * (4 + 1);",
+		},
+		{
+			name: "object-like",
+			src:  "#define TILE 16\n#define AREA (TILE * TILE)\nint a = AREA;\n#undef TILE\nint b = TILE;",
+			want: "\n\nint a = (16 * 16);\n\nint b = TILE;",
+		},
+		{
+			name: "function-like",
+			src:  "#define MAX(a, b) ((a) > (b) ? (a) : (b))\nint m = MAX(x + 1, f(y, z));",
+			want: "\nint m = ((x + 1) > (f(y, z)) ? (x + 1) : (f(y, z)));",
+		},
+		{
+			name: "function-like without arguments",
+			src:  "#define F(x) x\nint F = 1;",
+			want: "\nint F = 1;",
+		},
+		{
+			name: "invocation across lines",
+			src:  "#define ADD(a, b) a + b\nint s = ADD(1,\n    2);\nint t;",
+			want: "\nint s = 1 + 2\n;\nint t;",
+		},
+		{
+			name: "nested",
+			src:  "#define SQ(x) ((x) * (x))\n#define CUBE(x) (SQ(x) * (x))\nCUBE(SQ(2))",
+			want: "\n\n(((((2) * (2))) * (((2) * (2)))) * (((2) * (2))))",
+		},
+		{
+			name: "self-referential",
+			src:  "#define foo foo + 1\n#define a b\n#define b a\nfoo; a; b;",
+			want: "\n\n\nfoo + 1; a; b;",
+		},
+		{
+			name: "stringize and paste",
+			src:  "#define STR(x) #x\n#define CAT(a, b) a ## b\n#define NAME(n) CAT(kernel_, n)\nSTR(a  +  \"b\"); CAT(x, 1); NAME(scale)",
+			want: "\n\n\n\"a + \\\"b\\\"\"; x1; kernel_scale",
+		},
+		{
+			name: "empty paste",
+			src:  "#define CAT(a, b) a ## b\nCAT(, y) CAT(x, )",
+			want: "\ny x",
+		},
+		{
+			name: "variadic",
+			src:  "#define CALL(f, ...) f(__VA_ARGS__)\nCALL(g, 1, 2); CALL(h)",
+			want: "\ng(1, 2); h()",
+		},
+		{
+			name: "comments",
+			src:  "#define N 4 /* four\n   lines */\n/* N\n#define N 5 */ int a = N; // N\nchar *s = \"N\";",
+			want: "\n\n/* N\n#define N 5 */ int a = 4; // N\nchar *s = \"N\";",
+		},
+		{
+			name: "continuation",
+			src:  "#define SUM(a, b) \\\n    ((a) + \\\n     (b))\nSUM(1, 2)",
+			want: "\n\n\n((1) + (2))",
+		},
+		{
+			name: "ifdef",
+			src:  "#ifdef FAST\nfast\n#else\nslow\n#endif\n#ifndef FAST\nnotfast\n#endif",
+			want: "\n\n\nslow\n\n\nnotfast\n",
+		},
+		{
+			name:   "if elif else",
+			src:    "#if MODE == 1\none\n#elif MODE == 2 && defined(FAST)\ntwo\n#elif defined FAST\nfast\n#else\nother\n#endif",
+			macros: map[string]string{"MODE": "3", "FAST": ""},
+			want:   "\n\n\n\n\nfast\n\n\n",
+		},
+		{
+			name: "nested conditionals",
+			src:  "#if 0\n#if 1\na\n#else\nb\n#endif\n#elif (1 << 4) / 2 == 8 ? 1 : 0\nc\n#endif",
+			want: "\n\n\n\n\n\n\nc\n",
+		},
+		{
+			name: "directives in a skipped group",
+			src:  "#if 0\n#error unreachable\n#define X 1\n#endif\nX",
+			want: "\n\n\n\nX",
+		},
+		{
+			name: "include guard",
+			src:  "#ifndef COMMON_H\n#define COMMON_H\nint a;\n#endif",
+			want: "\n\nint a;\n",
+		},
+		{
+			name: "kept directives",
+			src:  "#include <metal_stdlib>\n#pragma once\n  # pragma clang loop unroll(full)\n#",
+			want: "#include <metal_stdlib>\n#pragma once\n  # pragma clang loop unroll(full)\n",
+		},
+		{
+			name:   "invalid macro name",
+			macros: map[string]string{"1N": "1"},
+			err:    "invalid macro name '1N'",
+		},
+		{
+			name: "error",
+			src:  "\n#if !defined(N)\n  #error N  must be  defined\n#endif",
+			err:  "3:3: #error N must be defined",
+		},
+		{
+			name: "wrong argument count",
+			src:  "#define F(a, b) a\nint x =\n  F(1);",
+			err:  "3:3: macro 'F' takes 2 arguments, but 1 were given",
+		},
+		{
+			name: "unterminated invocation",
+			src:  "#define F(a) a\nF(1",
+			err:  "2:1: unterminated invocation of macro 'F'",
+		},
+		{
+			name: "invalid parameter",
+			src:  "#define F(a, 1) a",
+			err:  "1:1: invalid parameter '1' of macro 'F'",
+		},
+		{
+			name: "stringize without parameter",
+			src:  "#define F(a) #b",
+			err:  "1:1: '#' is not followed by a macro parameter in macro 'F'",
+		},
+		{
+			name: "paste at end",
+			src:  "#define F a ##",
+			err:  "1:1: '##' cannot appear at either end of macro 'F'",
+		},
+		{
+			name: "missing define name",
+			src:  "#define 1",
+			err:  "1:1: macro name missing in #define",
+		},
+		{
+			name: "else without if",
+			src:  "#else",
+			err:  "1:1: #else without #if",
+		},
+		{
+			name: "elif after else",
+			src:  "#if 1\n#else\n#elif 1\n#endif",
+			err:  "3:1: #elif after #else",
+		},
+		{
+			name: "unterminated conditional",
+			src:  "#if 1\n#ifdef X\n#endif",
+			err:  "1:1: unterminated conditional directive",
+		},
+		{
+			name: "division by zero",
+			src:  "#if 1 / 0\n#endif",
+			err:  "1:1: division by zero in conditional directive",
+		},
+		{
+			name: "missing expression",
+			src:  "#if\n#endif",
+			err:  "1:1: missing expression in conditional directive",
+		},
+		{
+			name: "bad expression",
+			src:  "#if 1 +\n#endif",
+			err:  "1:1: missing operand in conditional directive",
+		},
+		{
+			name: "trailing tokens",
+			src:  "#if 1 2\n#endif",
+			err:  "1:1: unexpected '2' in conditional directive",
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			got, err := Preprocess(subtest.src, subtest.macros)
+			if subtest.err != "" {
+				require.EqualError(t, err, subtest.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, subtest.want, got)
+		})
+	}
+}
+
+// Test_Preprocess_Parse tests that preprocessed source is accepted by the strict lexer and runs.
+func Test_Preprocess_Parse(t *testing.T) {
+	src := `#include <metal_stdlib>
+using namespace metal;
+
+#define SCALE(x) ((x) * FACTOR)
+#if defined(DOUBLE)
+#define FACTOR 2.0f
+#else
+#define FACTOR 3.0f
+#endif
+
+kernel void scale(device float *data [[buffer(0)]], uint pos [[thread_position_in_grid]]) {
+    data[pos] = SCALE(data[pos]);
+}`
+
+	_, err := Parse(src)
+	require.EqualError(t, err, "4:1: unsupported preprocessor directive '#define'")
+
+	out, err := Preprocess(src, map[string]string{"DOUBLE": "1"})
+	require.NoError(t, err)
+
+	data := floatBytes(1.5, -4)
+	run(t, out, "scale", [3]uint32{2, 1, 1}, data)
+	require.Equal(t, []float32{3, -8}, bytesFloats(data))
+}
@@ -0,0 +1,264 @@
+package msl
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// A Program is a parsed MSL source file. It is safe for concurrent use.
+type Program struct {
+	file *file
+
+	mu sync.Mutex // guards c, whose functions are compiled on demand
+	c  *compiler
+}
+
+// Parse parses and checks the program-scope declarations of src. Function bodies are compiled when
+// a kernel that uses them is requested with Kernel.
+func Parse(src string) (*Program, error) {
+	return ParseSpecialized(src, nil)
+}
+
+// ParseSpecialized parses src as Parse does, giving the function constants it declares, such as
+// constant int n [[function_constant(0)]], the values in constants. Each value is keyed by the
+// constant's name and encoded as a buffer holds it: the bytes of its type in little-endian order,
+// with one byte for a bool. A function constant without a value is zero, and
+// is_function_constant_defined reports false for it.
+func ParseSpecialized(src string, constants map[string][]byte) (*Program, error) {
+	f, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newCompiler(f, constants)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Program{file: f, c: c}, nil
+}
+
+// Kernels returns the names of the kernel functions defined in the program, in source order.
+func (p *Program) Kernels() []string {
+	var names []string
+	for _, decl := range p.file.funcs {
+		if decl.kernel && decl.body != nil {
+			names = append(names, decl.name)
+		}
+	}
+	return names
+}
+
+// A Param describes one parameter of a kernel.
+type Param struct {
+	// Name is the parameter's name.
+	Name string
+	// Type is the parameter's type. A reference parameter has the pointer type of its referent, with
+	// Ref set.
+	Type Type
+	// Ref reports whether the parameter is a reference.
+	Ref bool
+	// Buffer is the buffer index that the parameter is bound to, or -1 if it is not a buffer.
+	Buffer int
+	// Attribute is the name of the parameter's thread attribute, such as "thread_position_in_grid",
+	// or "" if it has none.
+	Attribute string
+}
+
+// threadAttributes lists the supported thread attributes and the maximum width of each.
+var threadAttributes = map[string]int{
+	"thread_position_in_grid":        3,
+	"threads_per_grid":               3,
+	"threadgroup_position_in_grid":   3,
+	"thread_position_in_threadgroup": 3,
+	"threads_per_threadgroup":        3,
+	"threadgroups_per_grid":          3,
+	"thread_index_in_threadgroup":    1,
+}
+
+// A Kernel is a compiled kernel function.
+type Kernel struct {
+	name   string
+	fn     *function
+	params []Param
+}
+
+// Kernel compiles the kernel function called name, along with every function it calls.
+func (p *Program) Kernel(name string) (k *Kernel, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer recoverError(&err)
+
+	var fn *function
+	for _, candidate := range p.c.funcs[name] {
+		if candidate.decl.kernel && candidate.decl.body != nil {
+			fn = candidate
+		}
+	}
+	if fn == nil {
+		return nil, &Error{Msg: fmt.Sprintf("no kernel function named '%s'", name)}
+	}
+	if fn.ret.Scalar != Void || fn.ret.Pointer {
+		panic(errorf(fn.decl.pos, "kernel function '%s' must return void", name))
+	}
+
+	k = &Kernel{name: name, fn: fn}
+	nextBuffer := 0
+	used := make(map[int]string)
+	for i, decl := range fn.decl.params {
+		param := kernelParam(decl, fn.params[i], &nextBuffer)
+		if param.Buffer >= 0 {
+			if other, ok := used[param.Buffer]; ok {
+				panic(errorf(decl.pos, "parameters '%s' and '%s' are both bound to buffer %d", other, param.Name, param.Buffer))
+			}
+			used[param.Buffer] = param.Name
+		}
+		k.params = append(k.params, param)
+	}
+
+	p.c.compileFunction(fn)
+
+	return k, nil
+}
+
+// kernelParam checks one kernel parameter and describes how it is bound. A buffer without an
+// explicit [[buffer(n)]] index takes the index after the previous buffer's, as in Metal.
+func kernelParam(decl paramDecl, typ Type, nextBuffer *int) Param {
+	param := Param{Name: decl.name, Type: typ, Ref: decl.typ.ref, Buffer: -1}
+
+	buffer := -1
+	for _, attr := range decl.attrs {
+		switch {
+		case attr.name == "buffer":
+			if len(attr.args) != 1 {
+				panic(errorf(attr.pos, "[[buffer]] requires one index"))
+			}
+			n, err := strconv.ParseUint(attr.args[0], 0, 31)
+			if err != nil {
+				panic(errorf(attr.pos, "invalid buffer index '%s'", attr.args[0]))
+			}
+			buffer = int(n)
+		case threadAttributes[attr.name] > 0:
+			if param.Attribute != "" {
+				panic(errorf(attr.pos, "parameter '%s' has more than one thread attribute", decl.name))
+			}
+			param.Attribute = attr.name
+		default:
+			panic(errorf(attr.pos, "unsupported attribute [[%s]] on parameter '%s'", attr.name, decl.name))
+		}
+	}
+
+	if param.Attribute != "" {
+		width := threadAttributes[param.Attribute]
+		if typ.Pointer || buffer >= 0 || (typ.Scalar != UInt && typ.Scalar != UShort) || typ.Width > width {
+			panic(errorf(decl.pos, "parameter '%s' with [[%s]] must have type uint or ushort, or a vector of up to %d of them", decl.name, param.Attribute, width))
+		}
+		return param
+	}
+
+	if !typ.Pointer || (typ.Space != Device && typ.Space != Constant) {
+		if typ.Pointer && typ.Space == Threadgroup {
+			panic(errorf(decl.pos, "parameter '%s': threadgroup memory is not supported", decl.name))
+		}
+		panic(errorf(decl.pos, "parameter '%s' must be a device or constant pointer or reference, or have a thread attribute", decl.name))
+	}
+
+	if buffer < 0 {
+		buffer = *nextBuffer
+	}
+	param.Buffer = buffer
+	*nextBuffer = buffer + 1
+
+	return param
+}
+
+// Name returns the kernel's name.
+func (k *Kernel) Name() string {
+	return k.name
+}
+
+// Params returns the kernel's parameters, in declaration order.
+func (k *Kernel) Params() []Param {
+	return append([]Param(nil), k.params...)
+}
+
+// ThreadAttributes holds the values of the thread attributes for one thread of a dispatch. Unused
+// dimensions should be 0 for positions and 1 for sizes.
+type ThreadAttributes struct {
+	PositionInGrid            [3]uint32
+	ThreadsPerGrid            [3]uint32
+	ThreadgroupPositionInGrid [3]uint32
+	PositionInThreadgroup     [3]uint32
+	ThreadsPerThreadgroup     [3]uint32
+	ThreadgroupsPerGrid       [3]uint32
+}
+
+// attribute returns the value of the named thread attribute.
+func (t *ThreadAttributes) attribute(name string) [3]uint32 {
+	switch name {
+	case "thread_position_in_grid":
+		return t.PositionInGrid
+	case "threads_per_grid":
+		return t.ThreadsPerGrid
+	case "threadgroup_position_in_grid":
+		return t.ThreadgroupPositionInGrid
+	case "thread_position_in_threadgroup":
+		return t.PositionInThreadgroup
+	case "threads_per_threadgroup":
+		return t.ThreadsPerThreadgroup
+	case "threadgroups_per_grid":
+		return t.ThreadgroupsPerGrid
+	case "thread_index_in_threadgroup":
+		p, s := t.PositionInThreadgroup, t.ThreadsPerThreadgroup
+		return [3]uint32{p[0] + s[0]*(p[1]+s[1]*p[2])}
+	}
+	return [3]uint32{}
+}
+
+// An Invocation is a kernel with its buffers bound, ready to run on any number of threads.
+type Invocation struct {
+	k     *Kernel
+	slots []value
+	attrs []int
+}
+
+// Bind binds the kernel's buffer parameters to memory. buffers is indexed by buffer index, and
+// every buffer the kernel uses must be present (non-nil). The kernel reads and writes the bytes in
+// place, in little-endian order. Bind does not copy buffers, so writes by one thread are visible to
+// the others, as on a GPU.
+func (k *Kernel) Bind(buffers [][]byte) (*Invocation, error) {
+	inv := &Invocation{k: k, slots: make([]value, len(k.params))}
+	for i, param := range k.params {
+		if param.Attribute != "" {
+			inv.attrs = append(inv.attrs, i)
+			continue
+		}
+		if param.Buffer >= len(buffers) || buffers[param.Buffer] == nil {
+			return nil, &Error{Msg: fmt.Sprintf("missing buffer for parameter '%s' at index %d", param.Name, param.Buffer)}
+		}
+		inv.slots[i] = value{mem: &memory{name: param.Name, bytes: buffers[param.Buffer], space: param.Type.Space}}
+	}
+	return inv, nil
+}
+
+// Run runs the kernel for one thread. It is safe to call Run concurrently for different threads.
+//
+// A problem detected while running, such as an out-of-bounds access or an integer division by
+// zero, panics with a string describing it.
+func (inv *Invocation) Run(t *ThreadAttributes) {
+	fr := frame{slots: make([]value, inv.k.fn.nslots)}
+	copy(fr.slots, inv.slots)
+
+	for _, i := range inv.attrs {
+		param := inv.k.params[i]
+		pos := t.attribute(param.Attribute)
+		var v value
+		for lane := 0; lane < param.Type.Width; lane++ {
+			v.lanes[lane] = uint64(wrapInt(param.Type.Scalar, int64(pos[lane])))
+		}
+		fr.slots[i] = v
+	}
+
+	inv.k.fn.body(&fr)
+}
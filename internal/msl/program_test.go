@@ -0,0 +1,375 @@
+package msl
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// run interprets the kernel called name from src once for every thread in grid, with buffers bound
+// at indexes 0, 1, 2, and so on.
+func run(t *testing.T, src, name string, grid [3]uint32, buffers ...[]byte) {
+	t.Helper()
+
+	require.NoError(t, runErr(src, name, grid, buffers...))
+}
+
+// runErr is run, returning the first error instead of failing the test. A panic while running the
+// kernel is returned as an error.
+func runErr(src, name string, grid [3]uint32, buffers ...[]byte) (err error) {
+	prog, err := Parse(src)
+	if err != nil {
+		return err
+	}
+	k, err := prog.Kernel(name)
+	if err != nil {
+		return err
+	}
+	inv, err := k.Bind(buffers)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = &Error{Msg: r.(string)}
+		}
+	}()
+
+	ta := ThreadAttributes{ThreadsPerGrid: grid, ThreadsPerThreadgroup: [3]uint32{1, 1, 1}, ThreadgroupsPerGrid: grid}
+	for z := uint32(0); z < grid[2]; z++ {
+		for y := uint32(0); y < grid[1]; y++ {
+			for x := uint32(0); x < grid[0]; x++ {
+				ta.PositionInGrid = [3]uint32{x, y, z}
+				ta.ThreadgroupPositionInGrid = ta.PositionInGrid
+				inv.Run(&ta)
+			}
+		}
+	}
+	return nil
+}
+
+func floatBytes(fs ...float32) []byte {
+	b := make([]byte, 4*len(fs))
+	for i, f := range fs {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(f))
+	}
+	return b
+}
+
+func bytesFloats(b []byte) []float32 {
+	fs := make([]float32, len(b)/4)
+	for i := range fs {
+		fs[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return fs
+}
+
+func bytesInts(b []byte) []int32 {
+	ns := make([]int32, len(b)/4)
+	for i := range ns {
+		ns[i] = int32(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return ns
+}
+
+// ulps returns the distance between a and b in units in the last place.
+func ulps(a, b float32) int64 {
+	ia, ib := int64(math.Float32bits(a)), int64(math.Float32bits(b))
+	if ia < 0x80000000 != (ib < 0x80000000) {
+		return int64(math.MaxInt32)
+	}
+	if ia > ib {
+		return ia - ib
+	}
+	return ib - ia
+}
+
+func Test_Program_shaders(t *testing.T) {
+	t.Run("sine", func(t *testing.T) {
+		src := `#include <metal_stdlib>
+#include <metal_math>
+
+using namespace metal;
+
+kernel void sine(constant float *mult, constant float *input, device float *result, uint pos [[thread_position_in_grid]]) {
+    result[pos] = sin(input[pos]) * *mult * *mult;
+}`
+		input := make([]float32, 1000)
+		for i := range input {
+			input[i] = float32(i)/10 - 50
+		}
+		result := make([]byte, 4*len(input))
+		run(t, src, "sine", [3]uint32{uint32(len(input)), 1, 1}, floatBytes(3), floatBytes(input...), result)
+
+		for i, got := range bytesFloats(result) {
+			want := float32(math.Sin(float64(input[i]))) * 3 * 3
+			require.LessOrEqual(t, ulps(got, want), int64(4), "index %d: %v != %v", i, got, want)
+		}
+	})
+
+	t.Run("transfer2D", func(t *testing.T) {
+		src := `kernel void transfer2D(constant float *add, constant float *input, device float *result, uint2 pos [[thread_position_in_grid]], uint2 grid_size [[threads_per_grid]]) {
+    int index = (pos.x * grid_size.y) + pos.y;
+    result[index] = input[index] + *add;
+}`
+		input := make([]float32, 6*7)
+		for i := range input {
+			input[i] = float32(i) * 1.1
+		}
+		result := make([]byte, 4*len(input))
+		run(t, src, "transfer2D", [3]uint32{6, 7, 1}, floatBytes(0.3), floatBytes(input...), result)
+
+		for i, got := range bytesFloats(result) {
+			require.Equal(t, input[i]+0.3, got, "index %d", i)
+		}
+	})
+
+	t.Run("transfer3D", func(t *testing.T) {
+		src := `kernel void transfer3D(constant float *input, device float *result, uint3 pos [[thread_position_in_grid]], uint3 grid_size [[threads_per_grid]]) {
+    int index = (pos.x * grid_size.y * grid_size.z) + (pos.y * grid_size.z) + pos.z;
+    result[index] = input[index];
+}`
+		input := make([]float32, 3*4*5)
+		for i := range input {
+			input[i] = float32(i) / 3
+		}
+		result := make([]byte, 4*len(input))
+		run(t, src, "transfer3D", [3]uint32{3, 4, 5}, floatBytes(input...), result)
+		require.Equal(t, input, bytesFloats(result))
+	})
+
+	t.Run("transferType", func(t *testing.T) {
+		src := `kernel void transferType(constant short *input, device float *result, uint pos [[thread_position_in_grid]]) {
+    int index = pos;
+    result[index] = input[index];
+}`
+		input := []byte{0x01, 0x00, 0xff, 0xff, 0x00, 0x80}
+		result := make([]byte, 12)
+		run(t, src, "transferType", [3]uint32{3, 1, 1}, input, result)
+		require.Equal(t, []float32{1, -1, -32768}, bytesFloats(result))
+	})
+}
+
+func Test_Program_language(t *testing.T) {
+	type subtest struct {
+		name string
+		body string
+		want []int32
+	}
+
+	subtests := []subtest{
+		{
+			name: "integer arithmetic wraps",
+			body: `int a = 2147483647; out[0] = a + 1; uint b = 0; out[1] = b - 1; short s = 32767; s++; out[2] = s;`,
+			want: []int32{math.MinInt32, -1, -32768},
+		},
+		{
+			name: "division and remainder truncate",
+			body: `out[0] = -7 / 2; out[1] = -7 % 2; out[2] = 7u / 2u;`,
+			want: []int32{-3, -1, 3},
+		},
+		{
+			name: "usual arithmetic conversions",
+			body: `uint u = 1; int i = -2; out[0] = (u + i) > 0u; out[1] = int(3.9f); out[2] = int(-3.9f);`,
+			want: []int32{1, 3, -3},
+		},
+		{
+			name: "shifts and bitwise operators",
+			body: `out[0] = 1 << 4 | 3; out[1] = -16 >> 2; out[2] = ~0u >> 28 ^ 1;`,
+			want: []int32{19, -4, 14},
+		},
+		{
+			name: "control flow",
+			body: `int sum = 0;
+for (int i = 0; i < 10; i++) {
+    if (i == 2) continue;
+    if (i == 6) break;
+    sum += i;
+}
+int n = 0;
+while (n < 5) n += 2;
+int d = 0;
+do { d++; } while (d < 3);
+out[0] = sum; out[1] = n; out[2] = d;`,
+			want: []int32{13, 6, 3},
+		},
+		{
+			name: "ternary and logical operators",
+			body: `int x = 3; out[0] = x > 2 && x < 4 ? 10 : 20; out[1] = !(x == 3) || false; out[2] = (x, 7);`,
+			want: []int32{10, 0, 7},
+		},
+		{
+			name: "vectors and swizzles",
+			body: `int3 v = int3(1, 2, 3); v.xz = v.zx; v *= 2; int2 w = v.yz + int2(1); out[0] = v.x; out[1] = w.y; out[2] = dot(float2(1, 2), float2(3, 4));`,
+			want: []int32{6, 3, 11},
+		},
+		{
+			name: "local arrays and pointers",
+			body: `int a[4] = {1, 2, 3}; thread int *p = a + 1; *p += 10; p[2] = 5; out[0] = a[1]; out[1] = a[3]; out[2] = a[2] + (int)(p - a);`,
+			want: []int32{12, 5, 4},
+		},
+		{
+			name: "helper functions and constants",
+			body: `out[0] = square(K); out[1] = square(-3); out[2] = clamp(TABLE[2] * 10, 0, 25);`,
+			want: []int32{49, 9, 25},
+		},
+		{
+			name: "builtins",
+			body: `out[0] = int(floor(-1.5f)); out[1] = max(3, 9) + min(-2, 4); out[2] = popcount(0xffu) + clz(1u) + abs(-4);`,
+			want: []int32{-2, 7, 43},
+		},
+		{
+			name: "as_type and half",
+			body: `out[0] = as_type<int>(1.0f); half h = 65504.0h; h *= 2; out[1] = isinf(h); out[2] = int(half(0.1f) * 1000.0f);`,
+			want: []int32{0x3f800000, 1, 99},
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			src := `
+constant int K = 7;
+constant int TABLE[] = {1, 2, 3};
+
+int square(int x) {
+    return x * x;
+}
+
+kernel void test(device int *out [[buffer(0)]]) {
+` + subtest.body + `
+}`
+			out := make([]byte, 4*len(subtest.want))
+			run(t, src, "test", [3]uint32{1, 1, 1}, out)
+			require.Equal(t, subtest.want, bytesInts(out))
+		})
+	}
+}
+
+func Test_Program_float(t *testing.T) {
+	src := `kernel void test(constant float *in, device float *out, uint i [[thread_position_in_grid]]) {
+    float x = in[i];
+    out[4 * i + 0] = x * 3.0f + 0.1f;
+    out[4 * i + 1] = x / 7;
+    out[4 * i + 2] = sqrt(fabs(x));
+    out[4 * i + 3] = fma(x, x, -1.0f);
+}`
+	input := []float32{0.1, 1.5, -2.25, 3e10, 1e-30, 123.456}
+	out := make([]byte, 16*len(input))
+	run(t, src, "test", [3]uint32{uint32(len(input)), 1, 1}, floatBytes(input...), out)
+
+	got := bytesFloats(out)
+	for i, x := range input {
+		// The basic operators and sqrt are correctly rounded, so they match Go's float32 exactly.
+		require.Equal(t, x*3+0.1, got[4*i+0], "x = %v", x)
+		require.Equal(t, x/7, got[4*i+1], "x = %v", x)
+		require.Equal(t, float32(math.Sqrt(math.Abs(float64(x)))), got[4*i+2], "x = %v", x)
+		require.Equal(t, float32(math.FMA(float64(x), float64(x), -1)), got[4*i+3], "x = %v", x)
+	}
+}
+
+func Test_Program_errors(t *testing.T) {
+	type subtest struct {
+		name string
+		src  string
+		err  string
+	}
+
+	subtests := []subtest{
+		{
+			name: "syntax error",
+			src:  `kernel void test(device int *out) { out[0] = ; }`,
+			err:  "1:46: unexpected ';'",
+		},
+		{
+			name: "undeclared identifier",
+			src:  `kernel void test(device int *out) { out[0] = y; }`,
+			err:  "1:46: use of undeclared identifier 'y'",
+		},
+		{
+			name: "write to constant memory",
+			src:  `kernel void test(constant int *in) { in[0] = 1; }`,
+			err:  "1:44: cannot assign to a read-only location of type int",
+		},
+		{
+			name: "implicit vector conversion",
+			src:  `kernel void test(device int *out) { float2 v = int2(1); }`,
+			err:  "1:48: cannot implicitly convert int2 to float2",
+		},
+		{
+			name: "unsupported parameter",
+			src:  `kernel void test(float x) { }`,
+			err:  "1:18: parameter 'x' must be a device or constant pointer or reference, or have a thread attribute",
+		},
+		{
+			name: "recursion",
+			src:  `int f(int x) { return f(x); } kernel void test(device int *out) { out[0] = f(1); }`,
+			err:  "1:1: recursive call to function 'f'",
+		},
+		{
+			name: "unsupported directive",
+			src:  "#define N 4\nkernel void test(device int *out) { }",
+			err:  "1:1: unsupported preprocessor directive '#define'",
+		},
+		{
+			name: "missing kernel",
+			src:  `kernel void other(device int *out) { }`,
+			err:  "no kernel function named 'test'",
+		},
+		{
+			name: "missing buffer",
+			src:  `kernel void test(device int *out [[buffer(3)]]) { }`,
+			err:  "missing buffer for parameter 'out' at index 3",
+		},
+		{
+			name: "out-of-bounds access",
+			src:  `kernel void test(device int *out) { out[1] = 1; }`,
+			err:  "out-of-bounds access to 'out': int at byte offset 4 of 4",
+		},
+		{
+			name: "division by zero",
+			src:  `kernel void test(device int *out) { out[0] = 1 / out[0]; }`,
+			err:  "integer division by zero",
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			err := runErr(subtest.src, "test", [3]uint32{1, 1, 1}, make([]byte, 4))
+			require.EqualError(t, err, subtest.err)
+		})
+	}
+}
+
+func Test_Program_Kernels(t *testing.T) {
+	prog, err := Parse(`
+void helper();
+kernel void first(device float *a) {}
+[[kernel]] void second(device float *a) {}
+void helper() {}
+`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"first", "second"}, prog.Kernels())
+}
+
+func Test_Kernel_Params(t *testing.T) {
+	prog, err := Parse(`kernel void k(
+    constant float &scale [[buffer(2)]],
+    device const int4 *input,
+    device half *output,
+    uint2 pos [[thread_position_in_grid]])
+{
+}`)
+	require.NoError(t, err)
+	k, err := prog.Kernel("k")
+	require.NoError(t, err)
+
+	require.Equal(t, []Param{
+		{Name: "scale", Type: Type{Scalar: Float, Width: 1, Pointer: true, Space: Constant, Const: true}, Ref: true, Buffer: 2},
+		{Name: "input", Type: Type{Scalar: Int, Width: 4, Pointer: true, Space: Device, Const: true}, Buffer: 3},
+		{Name: "output", Type: Type{Scalar: Half, Width: 1, Pointer: true, Space: Device}, Buffer: 4},
+		{Name: "pos", Type: Type{Scalar: UInt, Width: 2}, Buffer: -1, Attribute: "thread_position_in_grid"},
+	}, k.Params())
+}
@@ -0,0 +1,291 @@
+package msl
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A Signature is the declaration of a kernel function: its name and its parameters.
+type Signature struct {
+	Name   string
+	Params []SignatureParam
+}
+
+// A SignatureParam describes one parameter of a kernel function as it is declared.
+type SignatureParam struct {
+	// Name is the parameter's name.
+	Name string
+	// TypeName is the parameter's type without its qualifiers, address space, or pointer or reference
+	// declarator, such as "float4" or "texture2d<float, access::read>".
+	TypeName string
+	// Type is the parameter's type if TypeName names a scalar or vector type; otherwise its Scalar is
+	// Void. Its Pointer, Space, and Const fields are set either way. A reference parameter has the
+	// pointer type of its referent, with Ref set.
+	Type Type
+	// Ref reports whether the parameter is a reference.
+	Ref bool
+	// Index is the parameter's index in the argument table it is bound from, or -1 if it is not
+	// bound from one. Device and constant pointers and references are bound from the buffer table,
+	// threadgroup pointers from the threadgroup memory table, and textures and samplers from their
+	// own tables. A parameter without an explicit index takes the index after the previous one in its
+	// table.
+	Index int
+	// Attributes lists the parameter's attributes, such as buffer(1) or thread_position_in_grid.
+	Attributes []Attribute
+}
+
+// An Attribute is one attribute of a declaration, such as buffer(1) in [[buffer(1)]].
+type Attribute struct {
+	Name string
+	Args []string
+}
+
+// String returns the attribute as it is written between the brackets.
+func (a Attribute) String() string {
+	if len(a.Args) == 0 {
+		return a.Name
+	}
+	return a.Name + "(" + strings.Join(a.Args, ", ") + ")"
+}
+
+// indexAttributes maps the attributes that give a parameter an explicit index to the argument
+// table they index.
+var indexAttributes = map[string]string{
+	"buffer":      "buffer",
+	"threadgroup": "threadgroup",
+	"texture":     "texture",
+	"sampler":     "sampler",
+}
+
+// ParseSignatures returns the signatures of the kernel functions defined in src, in source order.
+//
+// Unlike Parse, it reads only declarations: function bodies are skipped, parameter types need not
+// be ones the interpreter supports, and preprocessor directives are ignored rather than rejected
+// (so no macros are expanded). It therefore describes kernels that Parse cannot.
+func ParseSignatures(src string) (sigs []Signature, err error) {
+	tokens, err := scan(src, false)
+	if err != nil {
+		return nil, err
+	}
+	defer recoverError(&err)
+
+	p := &parser{tokens: tokens}
+	depth := 0
+	for p.peek().kind != tokenEOF {
+		switch {
+		case p.is("{"):
+			depth++
+			p.next()
+		case p.is("}"):
+			depth--
+			p.next()
+		case depth == 0 && (p.is("kernel") || p.isAttrStart()):
+			if sig, ok := p.parseSignature(); ok {
+				sigs = append(sigs, sig)
+			}
+		default:
+			p.next()
+		}
+	}
+
+	return sigs, nil
+}
+
+// parseSignature parses a declaration that starts with the kernel keyword or an attribute list. It
+// consumes the declaration up to its body, if any, and returns its signature if it is a kernel
+// function definition.
+func (p *parser) parseSignature() (Signature, bool) {
+	kernel := false
+	for {
+		if p.accept("kernel") {
+			kernel = true
+			continue
+		}
+		if !p.isAttrStart() {
+			break
+		}
+		for _, attr := range p.parseAttrs() {
+			if attr.name == "kernel" {
+				kernel = true
+			}
+		}
+	}
+	if !kernel {
+		return Signature{}, false
+	}
+
+	// The return type (always void for a kernel) is skipped up to the function name.
+	for p.peek().kind != tokenIdent || p.peekAt(1).kind != tokenPunct || p.peekAt(1).text != "(" {
+		if t := p.peek(); t.kind == tokenEOF || p.is(";") || p.is("{") {
+			p.fail(t.pos, "expected kernel function name, found %s", t)
+		}
+		p.next()
+	}
+	sig := Signature{Name: p.next().text}
+
+	p.expect("(")
+	if p.is("void") && p.peekAt(1).text == ")" {
+		p.next()
+	}
+	next := make(map[string]int)
+	for !p.accept(")") {
+		if len(sig.Params) > 0 {
+			p.expect(",")
+		}
+		sig.Params = append(sig.Params, p.parseSignatureParam(next))
+	}
+
+	// A prototype has no body, and is described by its definition instead.
+	return sig, p.is("{")
+}
+
+// parseSignatureParam parses one parameter of a kernel signature. next holds the next implicit
+// index of each argument table, and is updated for the parameter's table.
+func (p *parser) parseSignatureParam(next map[string]int) SignatureParam {
+	start := p.peek()
+
+	// Gather the parameter's tokens, which run to the next comma or closing parenthesis outside any
+	// brackets. Template arguments, as in texture2d<float, access::read>, count as brackets too.
+	var tokens []token
+	var attrs []attribute
+	depth := 0
+loop:
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokenEOF:
+			p.fail(t.pos, "expected ')', found %s", t)
+		case depth == 0 && p.isAttrStart():
+			attrs = append(attrs, p.parseAttrs()...)
+			continue
+		case depth == 0 && (p.is(",") || p.is(")")):
+			break loop
+		case p.is("(") || p.is("[") || p.is("<"):
+			depth++
+		case p.is(")") || p.is("]") || p.is(">"):
+			depth--
+		case p.is(">>"):
+			depth -= 2
+		}
+		tokens = append(tokens, p.next())
+	}
+
+	// Drop any array declarator, leaving the name as the last token.
+	for len(tokens) > 0 && tokens[len(tokens)-1].text == "]" {
+		open := len(tokens) - 1
+		for open > 0 && tokens[open].text != "[" {
+			open--
+		}
+		tokens = tokens[:open]
+	}
+	if len(tokens) < 2 || tokens[len(tokens)-1].kind != tokenIdent || isKeyword(tokens[len(tokens)-1].text) {
+		p.fail(start.pos, "expected parameter declaration")
+	}
+	param := SignatureParam{Name: tokens[len(tokens)-1].text, Index: -1}
+
+	// Sort the remaining tokens into qualifiers, declarators, and the type name.
+	var typ Type
+	var name []token
+	declarator := false
+	depth = 0
+	for i := 0; i < len(tokens)-1; i++ {
+		t := tokens[i]
+		if depth > 0 {
+			switch t.text {
+			case "<":
+				depth++
+			case ">":
+				depth--
+			case ">>":
+				depth -= 2
+			}
+			name = append(name, t)
+			continue
+		}
+
+		switch {
+		case t.text == "const" || t.text == "constexpr":
+			// A const after the declarator (float *const p) applies to the pointer, not the pointee.
+			if !declarator {
+				typ.Const = true
+			}
+		case t.text == "volatile":
+		case t.text == "device":
+			typ.Space = Device
+		case t.text == "constant":
+			typ.Space = Constant
+		case t.text == "thread":
+			typ.Space = Thread
+		case t.text == "threadgroup":
+			typ.Space = Threadgroup
+		case t.text == "*" || t.text == "&":
+			typ.Pointer = true
+			param.Ref = t.text == "&"
+			declarator = true
+		case (t.text == "metal" || t.text == "std") && i+1 < len(tokens)-1 && tokens[i+1].text == "::":
+			i++
+		default:
+			if t.text == "<" {
+				depth++
+			}
+			name = append(name, t)
+		}
+	}
+	if len(name) == 0 {
+		p.fail(start.pos, "expected type for parameter '%s'", param.Name)
+	}
+	param.TypeName = joinTokens(name)
+	if t, ok := LookupType(param.TypeName); ok {
+		typ.Scalar, typ.Width = t.Scalar, t.Width
+	}
+	param.Type = typ
+
+	table := ""
+	for _, attr := range attrs {
+		param.Attributes = append(param.Attributes, Attribute{Name: attr.name, Args: attr.args})
+		if t, ok := indexAttributes[attr.name]; ok {
+			if len(attr.args) != 1 {
+				p.fail(attr.pos, "[[%s]] requires one index", attr.name)
+			}
+			n, err := strconv.ParseUint(attr.args[0], 0, 31)
+			if err != nil {
+				p.fail(attr.pos, "invalid %s index '%s'", attr.name, attr.args[0])
+			}
+			table, param.Index = t, int(n)
+		}
+	}
+	if table == "" {
+		switch {
+		case typ.Pointer && (typ.Space == Device || typ.Space == Constant):
+			table = "buffer"
+		case typ.Pointer && typ.Space == Threadgroup:
+			table = "threadgroup"
+		case strings.HasPrefix(param.TypeName, "texture") || strings.HasPrefix(param.TypeName, "depth"):
+			table = "texture"
+		case param.TypeName == "sampler":
+			table = "sampler"
+		default:
+			return param
+		}
+		param.Index = next[table]
+	}
+	next[table] = param.Index + 1
+
+	return param
+}
+
+// joinTokens writes tokens back out as source text, with a space only where one is needed to keep
+// two words apart and after each comma.
+func joinTokens(tokens []token) string {
+	var b strings.Builder
+	for i, t := range tokens {
+		if i > 0 {
+			prev := tokens[i-1]
+			if prev.text == "," || (prev.kind != tokenPunct && t.kind != tokenPunct) {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
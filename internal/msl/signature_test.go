@@ -0,0 +1,90 @@
+package msl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseSignatures(t *testing.T) {
+	t.Run("kernels", func(t *testing.T) {
+		sigs, err := ParseSignatures(`
+#include <metal_stdlib>
+#define SIZE 16
+using namespace metal;
+
+struct Params { float scale; };
+
+kernel void prototype(device float *a);
+
+void helper(device float *a) {
+    switch (0) { default: break; }
+}
+
+[[kernel]] void first(
+    constant Params &params [[buffer(2)]],
+    device const float4 *input,
+    metal::texture2d<float, access::read> tex [[texture(1)]],
+    threadgroup float *scratch [[threadgroup(0)]],
+    device half * const output,
+    uint2 pos [[thread_position_in_grid]])
+{
+    if (true) { helper(nullptr); }
+}
+
+kernel void second(void) {}
+`)
+		require.NoError(t, err)
+		require.Equal(t, []Signature{
+			{Name: "first", Params: []SignatureParam{
+				{
+					Name: "params", TypeName: "Params", Type: Type{Pointer: true, Space: Constant}, Ref: true, Index: 2,
+					Attributes: []Attribute{{Name: "buffer", Args: []string{"2"}}},
+				},
+				{Name: "input", TypeName: "float4", Type: Type{Scalar: Float, Width: 4, Pointer: true, Space: Device, Const: true}, Index: 3},
+				{
+					Name: "tex", TypeName: "texture2d<float, access::read>", Index: 1,
+					Attributes: []Attribute{{Name: "texture", Args: []string{"1"}}},
+				},
+				{
+					Name: "scratch", TypeName: "float", Type: Type{Scalar: Float, Width: 1, Pointer: true, Space: Threadgroup}, Index: 0,
+					Attributes: []Attribute{{Name: "threadgroup", Args: []string{"0"}}},
+				},
+				{Name: "output", TypeName: "half", Type: Type{Scalar: Half, Width: 1, Pointer: true, Space: Device}, Index: 4},
+				{
+					Name: "pos", TypeName: "uint2", Type: Type{Scalar: UInt, Width: 2}, Index: -1,
+					Attributes: []Attribute{{Name: "thread_position_in_grid"}},
+				},
+			}},
+			{Name: "second"},
+		}, sigs)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		type subtest struct {
+			name string
+			src  string
+			err  string
+		}
+
+		subtests := []subtest{
+			{name: "lexer", src: "kernel void k() {} /*", err: "1:20: unterminated comment"},
+			{name: "missing name", src: "kernel void;", err: "1:12: expected kernel function name, found ';'"},
+			{name: "missing type", src: "kernel void k(a) {}", err: "1:15: expected parameter declaration"},
+			{name: "unterminated", src: "kernel void k(device float *a", err: "1:30: expected ')', found end of file"},
+			{name: "bad index", src: "kernel void k(device float *a [[buffer(x)]]) {}", err: "1:33: invalid buffer index 'x'"},
+		}
+
+		for _, subtest := range subtests {
+			t.Run(subtest.name, func(t *testing.T) {
+				_, err := ParseSignatures(subtest.src)
+				require.EqualError(t, err, subtest.err)
+			})
+		}
+	})
+}
+
+func Test_Attribute_String(t *testing.T) {
+	require.Equal(t, "kernel", Attribute{Name: "kernel"}.String())
+	require.Equal(t, "buffer(1)", Attribute{Name: "buffer", Args: []string{"1"}}.String())
+}
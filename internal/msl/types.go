@@ -0,0 +1,653 @@
+package msl
+
+import (
+	"fmt"
+	"math"
+)
+
+// A Scalar is the element type of a scalar or vector.
+type Scalar int
+
+const (
+	Void Scalar = iota
+	Bool
+	Char
+	UChar
+	Short
+	UShort
+	Int
+	UInt
+	Long
+	ULong
+	Half
+	Float
+)
+
+var scalarNames = [...]string{
+	Void:   "void",
+	Bool:   "bool",
+	Char:   "char",
+	UChar:  "uchar",
+	Short:  "short",
+	UShort: "ushort",
+	Int:    "int",
+	UInt:   "uint",
+	Long:   "long",
+	ULong:  "ulong",
+	Half:   "half",
+	Float:  "float",
+}
+
+func (s Scalar) String() string {
+	if s >= 0 && int(s) < len(scalarNames) {
+		return scalarNames[s]
+	}
+	return fmt.Sprintf("Scalar(%d)", int(s))
+}
+
+// Size returns the size of the scalar in bytes.
+func (s Scalar) Size() int {
+	switch s {
+	case Bool, Char, UChar:
+		return 1
+	case Short, UShort, Half:
+		return 2
+	case Int, UInt, Float:
+		return 4
+	case Long, ULong:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// IsFloat reports whether s is a floating-point scalar.
+func (s Scalar) IsFloat() bool {
+	return s == Half || s == Float
+}
+
+// IsInteger reports whether s is an integer scalar (not including bool).
+func (s Scalar) IsInteger() bool {
+	return s >= Char && s <= ULong
+}
+
+// IsSigned reports whether s is a signed integer or floating-point scalar.
+func (s Scalar) IsSigned() bool {
+	switch s {
+	case Char, Short, Int, Long, Half, Float:
+		return true
+	default:
+		return false
+	}
+}
+
+// rank orders the integer scalars for the usual arithmetic conversions.
+func (s Scalar) rank() int {
+	switch s {
+	case Bool:
+		return 0
+	case Char, UChar:
+		return 1
+	case Short, UShort:
+		return 2
+	case Int, UInt:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// An AddressSpace is the address space of a pointer or reference.
+type AddressSpace int
+
+const (
+	// Thread is the address space of local variables. It is also used for values that are not
+	// pointers at all.
+	Thread AddressSpace = iota
+	Device
+	Constant
+	Threadgroup
+)
+
+var addressSpaceNames = [...]string{
+	Thread:      "thread",
+	Device:      "device",
+	Constant:    "constant",
+	Threadgroup: "threadgroup",
+}
+
+func (a AddressSpace) String() string {
+	if a >= 0 && int(a) < len(addressSpaceNames) {
+		return addressSpaceNames[a]
+	}
+	return fmt.Sprintf("AddressSpace(%d)", int(a))
+}
+
+// A Type is the type of a value: a scalar, a vector, or a pointer to one of those.
+type Type struct {
+	// Scalar is the element type. For a pointer it is the element type of the pointee.
+	Scalar Scalar
+	// Width is the number of vector components: 1 for a scalar, or 2 to 4 for a vector.
+	Width int
+	// Pointer reports whether this is a pointer to Scalar/Width.
+	Pointer bool
+	// Space is the address space of the pointee. It is Thread for non-pointers.
+	Space AddressSpace
+	// Const reports whether the pointee (for a pointer) or the value (otherwise) is read-only.
+	Const bool
+}
+
+// scalarType returns the scalar type s.
+func scalarType(s Scalar) Type {
+	return Type{Scalar: s, Width: 1}
+}
+
+// vectorType returns the vector type of width components of s (or the scalar type if width is 1).
+func vectorType(s Scalar, width int) Type {
+	return Type{Scalar: s, Width: width}
+}
+
+var (
+	voidType  = Type{Scalar: Void, Width: 1}
+	boolType  = scalarType(Bool)
+	intType   = scalarType(Int)
+	uintType  = scalarType(UInt)
+	floatType = scalarType(Float)
+)
+
+// Elem returns the pointee type of a pointer, or t itself for a non-pointer.
+func (t Type) Elem() Type {
+	return Type{Scalar: t.Scalar, Width: t.Width}
+}
+
+// IsVector reports whether t is a vector (not a pointer).
+func (t Type) IsVector() bool {
+	return !t.Pointer && t.Width > 1
+}
+
+// isArith reports whether t is a scalar or vector of an arithmetic or bool type.
+func (t Type) isArith() bool {
+	return !t.Pointer && t.Scalar != Void
+}
+
+// Size returns the size in bytes of a value of type t in memory. As in Metal, 3-component vectors
+// are padded to the size of 4-component ones. Pointers are 8 bytes.
+func (t Type) Size() int {
+	if t.Pointer {
+		return 8
+	}
+	if t.Width == 3 {
+		return 4 * t.Scalar.Size()
+	}
+	return t.Width * t.Scalar.Size()
+}
+
+// Align returns the alignment in bytes of a value of type t in memory.
+func (t Type) Align() int {
+	if t.Pointer {
+		return 8
+	}
+	return t.Size()
+}
+
+// equal reports whether t and u are the same type, ignoring constness of non-pointers.
+func (t Type) equal(u Type) bool {
+	if !t.Pointer && !u.Pointer {
+		return t.Scalar == u.Scalar && t.Width == u.Width
+	}
+	return t == u
+}
+
+func (t Type) String() string {
+	name := t.Scalar.String()
+	if t.Width > 1 {
+		name = fmt.Sprintf("%s%d", name, t.Width)
+	}
+	if !t.Pointer {
+		return name
+	}
+	if t.Const {
+		name = "const " + name
+	}
+	return fmt.Sprintf("%s %s*", t.Space, name)
+}
+
+// scalarsByName maps every scalar type name, including aliases, to its scalar.
+var scalarsByName = map[string]Scalar{
+	"void":     Void,
+	"bool":     Bool,
+	"char":     Char,
+	"int8_t":   Char,
+	"uchar":    UChar,
+	"uint8_t":  UChar,
+	"short":    Short,
+	"int16_t":  Short,
+	"ushort":   UShort,
+	"uint16_t": UShort,
+	"int":      Int,
+	"int32_t":  Int,
+	"uint":     UInt,
+	"uint32_t": UInt,
+	"long":     Long,
+	"int64_t":  Long,
+	"ulong":    ULong,
+	"uint64_t": ULong,
+	"size_t":   ULong,
+	"half":     Half,
+	"float":    Float,
+}
+
+// LookupType returns the scalar or vector type with the given name, such as "float" or "uint3".
+func LookupType(name string) (Type, bool) {
+	if s, ok := scalarsByName[name]; ok {
+		return scalarType(s), true
+	}
+
+	// Vector names are a base scalar name followed by a width of 2, 3, or 4. Only the canonical
+	// names (not the <stdint.h> aliases) have vector forms.
+	if len(name) < 2 {
+		return Type{}, false
+	}
+	width := int(name[len(name)-1] - '0')
+	if width < 2 || width > 4 {
+		return Type{}, false
+	}
+	s, ok := scalarsByName[name[:len(name)-1]]
+	if !ok || s == Void || scalarNames[s] != name[:len(name)-1] {
+		return Type{}, false
+	}
+
+	return vectorType(s, width), true
+}
+
+// ----------------------------------------------------------------------------
+// Values
+// ----------------------------------------------------------------------------
+
+// A value is the runtime representation of every type. Each vector lane holds either the float64
+// bits of a floating-point component (already rounded to the precision of its type) or the int64
+// bits of an integer or bool component (already wrapped and sign- or zero-extended to the width of
+// its type). A pointer refers to an offset in a block of memory.
+type value struct {
+	lanes [4]uint64
+	mem   *memory
+	off   int
+}
+
+// A memory is a block of bytes that pointers refer into: a bound buffer, a local array, or a
+// program-scope array.
+type memory struct {
+	name  string
+	bytes []byte
+	space AddressSpace
+}
+
+func (v value) float(lane int) float64 {
+	return math.Float64frombits(v.lanes[lane])
+}
+
+func (v value) int(lane int) int64 {
+	return int64(v.lanes[lane])
+}
+
+func (v value) bool() bool {
+	return v.lanes[0] != 0
+}
+
+// floatValue returns a value with every lane of width set to f, rounded to s.
+func floatValue(s Scalar, width int, f float64) value {
+	var v value
+	bits := math.Float64bits(roundFloat(s, f))
+	for i := 0; i < width; i++ {
+		v.lanes[i] = bits
+	}
+	return v
+}
+
+// intValue returns a value with every lane of width set to n, wrapped to s.
+func intValue(s Scalar, width int, n int64) value {
+	var v value
+	bits := uint64(wrapInt(s, n))
+	for i := 0; i < width; i++ {
+		v.lanes[i] = bits
+	}
+	return v
+}
+
+// boolValue returns a bool value.
+func boolValue(b bool) value {
+	var v value
+	if b {
+		v.lanes[0] = 1
+	}
+	return v
+}
+
+// roundFloat rounds f to the precision of the floating-point scalar s.
+func roundFloat(s Scalar, f float64) float64 {
+	switch s {
+	case Float:
+		return float64(float32(f))
+	case Half:
+		return float64(Float32FromHalf(HalfFromFloat32(float32(f))))
+	default:
+		return f
+	}
+}
+
+// wrapInt wraps n to the width of the integer or bool scalar s, sign- or zero-extending it back to
+// 64 bits.
+func wrapInt(s Scalar, n int64) int64 {
+	switch s {
+	case Bool:
+		if n != 0 {
+			return 1
+		}
+		return 0
+	case Char:
+		return int64(int8(n))
+	case UChar:
+		return int64(uint8(n))
+	case Short:
+		return int64(int16(n))
+	case UShort:
+		return int64(uint16(n))
+	case Int:
+		return int64(int32(n))
+	case UInt:
+		return int64(uint32(n))
+	default:
+		return n
+	}
+}
+
+// convertLane converts one lane from scalar from to scalar to, following C++ conversion rules:
+// float to integer truncates toward zero (saturating, as Metal does), integer to float rounds, and
+// anything to bool compares against zero.
+func convertLane(bits uint64, from, to Scalar) uint64 {
+	if from == to {
+		return bits
+	}
+
+	if from.IsFloat() {
+		f := math.Float64frombits(bits)
+		switch {
+		case to.IsFloat():
+			return math.Float64bits(roundFloat(to, f))
+		case to == Bool:
+			if f != 0 {
+				return 1
+			}
+			return 0
+		default:
+			return uint64(floatToInt(to, f))
+		}
+	}
+
+	n := int64(bits)
+	if to.IsFloat() {
+		if from == ULong {
+			return math.Float64bits(roundFloat(to, float64(uint64(n))))
+		}
+		return math.Float64bits(roundFloat(to, float64(n)))
+	}
+	return uint64(wrapInt(to, n))
+}
+
+// floatToInt converts f to the integer scalar s, truncating toward zero and saturating at the
+// limits of s. NaN converts to zero.
+func floatToInt(s Scalar, f float64) int64 {
+	if math.IsNaN(f) {
+		return 0
+	}
+	f = math.Trunc(f)
+
+	var lo, hi float64
+	switch s {
+	case Char:
+		lo, hi = math.MinInt8, math.MaxInt8
+	case UChar:
+		lo, hi = 0, math.MaxUint8
+	case Short:
+		lo, hi = math.MinInt16, math.MaxInt16
+	case UShort:
+		lo, hi = 0, math.MaxUint16
+	case Int:
+		lo, hi = math.MinInt32, math.MaxInt32
+	case UInt:
+		lo, hi = 0, math.MaxUint32
+	case Long:
+		if f <= math.MinInt64 {
+			return math.MinInt64
+		}
+		if f >= math.MaxInt64 {
+			return math.MaxInt64
+		}
+		return int64(f)
+	case ULong:
+		if f <= 0 {
+			return 0
+		}
+		if f >= math.MaxUint64 {
+			return -1
+		}
+		return int64(uint64(f))
+	}
+
+	return int64(math.Max(lo, math.Min(hi, f)))
+}
+
+// convert converts v from type from to type to. Both must be arithmetic; a scalar converts to a
+// vector by broadcasting.
+func convert(v value, from, to Type) value {
+	if from.Scalar == to.Scalar && from.Width == to.Width {
+		return v
+	}
+
+	var out value
+	for i := 0; i < to.Width; i++ {
+		lane := i
+		if from.Width == 1 {
+			lane = 0
+		}
+		out.lanes[i] = convertLane(v.lanes[lane], from.Scalar, to.Scalar)
+	}
+	return out
+}
+
+// ----------------------------------------------------------------------------
+// Memory access
+// ----------------------------------------------------------------------------
+
+// load reads a value of type t from mem at byte offset off. It panics with a descriptive message if
+// the access is out of bounds; the CPU backend reports such panics as errors.
+func load(mem *memory, off int, t Type) value {
+	size := t.Scalar.Size()
+	n := t.Width
+	checkAccess(mem, off, t)
+
+	var v value
+	for i := 0; i < n; i++ {
+		v.lanes[i] = loadScalar(mem.bytes[off+i*size:], t.Scalar)
+	}
+	return v
+}
+
+// store writes v, of type t, to mem at byte offset off. It panics like load on an out-of-bounds
+// access.
+func store(mem *memory, off int, t Type, v value) {
+	size := t.Scalar.Size()
+	n := t.Width
+	checkAccess(mem, off, t)
+
+	for i := 0; i < n; i++ {
+		storeScalar(mem.bytes[off+i*size:], t.Scalar, v.lanes[i])
+	}
+}
+
+// checkAccess panics if a value of type t at byte offset off does not lie entirely within mem.
+func checkAccess(mem *memory, off int, t Type) {
+	if mem == nil {
+		panic("null pointer dereference")
+	}
+	end := off + t.Scalar.Size()*t.Width
+	if off < 0 || end > len(mem.bytes) {
+		panic(fmt.Sprintf("out-of-bounds access to '%s': %s at byte offset %d of %d", mem.name, t.Elem(), off, len(mem.bytes)))
+	}
+}
+
+// loadScalar reads one little-endian scalar of type s from b.
+func loadScalar(b []byte, s Scalar) uint64 {
+	switch s {
+	case Bool:
+		if b[0] != 0 {
+			return 1
+		}
+		return 0
+	case Char:
+		return uint64(int64(int8(b[0])))
+	case UChar:
+		return uint64(b[0])
+	case Short:
+		return uint64(int64(int16(le16(b))))
+	case UShort:
+		return uint64(le16(b))
+	case Half:
+		return math.Float64bits(float64(Float32FromHalf(le16(b))))
+	case Int:
+		return uint64(int64(int32(le32(b))))
+	case UInt:
+		return uint64(le32(b))
+	case Float:
+		return math.Float64bits(float64(math.Float32frombits(le32(b))))
+	case Long, ULong:
+		return le64(b)
+	default:
+		panic(fmt.Sprintf("cannot load %s", s))
+	}
+}
+
+// storeScalar writes one little-endian scalar of type s to b.
+func storeScalar(b []byte, s Scalar, bits uint64) {
+	switch s {
+	case Bool, Char, UChar:
+		b[0] = byte(bits)
+	case Short, UShort:
+		put16(b, uint16(bits))
+	case Half:
+		put16(b, HalfFromFloat32(float32(math.Float64frombits(bits))))
+	case Int, UInt:
+		put32(b, uint32(bits))
+	case Float:
+		put32(b, math.Float32bits(float32(math.Float64frombits(bits))))
+	case Long, ULong:
+		put64(b, bits)
+	default:
+		panic(fmt.Sprintf("cannot store %s", s))
+	}
+}
+
+func le16(b []byte) uint16 {
+	return uint16(b[0]) | uint16(b[1])<<8
+}
+
+func le32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+func le64(b []byte) uint64 {
+	return uint64(le32(b)) | uint64(le32(b[4:]))<<32
+}
+
+func put16(b []byte, v uint16) {
+	b[0], b[1] = byte(v), byte(v>>8)
+}
+
+func put32(b []byte, v uint32) {
+	b[0], b[1], b[2], b[3] = byte(v), byte(v>>8), byte(v>>16), byte(v>>24)
+}
+
+func put64(b []byte, v uint64) {
+	put32(b, uint32(v))
+	put32(b[4:], uint32(v>>32))
+}
+
+// ----------------------------------------------------------------------------
+// Half precision
+// ----------------------------------------------------------------------------
+
+// HalfFromFloat32 converts f to the bits of the nearest IEEE 754 half-precision value, rounding
+// ties to even. Values too large for a half become infinity, and NaNs stay NaNs.
+func HalfFromFloat32(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23) & 0xff
+	mant := bits & 0x7fffff
+
+	switch {
+	case exp == 0xff:
+		// Infinity or NaN. Keep NaNs quiet and non-zero.
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+
+	case exp-127 > 15:
+		return sign | 0x7c00
+	}
+
+	e := exp - 127 + 15
+	if e <= 0 {
+		// Subnormal half (or zero). Shift the mantissa, including its implicit leading one, into
+		// place and round to nearest even.
+		if e < -10 {
+			return sign
+		}
+		m := mant | 0x800000
+		shift := uint(14 - e)
+		half := uint32(1) << (shift - 1)
+		rounded := m >> shift
+		rem := m & (1<<shift - 1)
+		if rem > half || (rem == half && rounded&1 == 1) {
+			rounded++
+		}
+		return sign | uint16(rounded)
+	}
+
+	// Normal half. Round the 23-bit mantissa to 10 bits; a carry out of the mantissa correctly
+	// bumps the exponent (and overflows to infinity at the top).
+	rounded := uint32(e)<<10 | mant>>13
+	rem := mant & 0x1fff
+	if rem > 0x1000 || (rem == 0x1000 && rounded&1 == 1) {
+		rounded++
+	}
+	if rounded >= 0x7c00 {
+		return sign | 0x7c00
+	}
+	return sign | uint16(rounded)
+}
+
+// Float32FromHalf converts the bits of an IEEE 754 half-precision value to a float32, exactly.
+func Float32FromHalf(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch {
+	case exp == 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case exp == 0:
+		if mant == 0 {
+			return math.Float32frombits(sign)
+		}
+		// Subnormal: normalize the mantissa.
+		e := uint32(127 - 15 + 1)
+		for mant&0x400 == 0 {
+			mant <<= 1
+			e--
+		}
+		return math.Float32frombits(sign | e<<23 | (mant&0x3ff)<<13)
+	default:
+		return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+	}
+}
@@ -0,0 +1,81 @@
+package msl
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LookupType(t *testing.T) {
+	type subtest struct {
+		name string
+		typ  Type
+		ok   bool
+	}
+
+	subtests := []subtest{
+		{name: "float", typ: Type{Scalar: Float, Width: 1}, ok: true},
+		{name: "uint3", typ: Type{Scalar: UInt, Width: 3}, ok: true},
+		{name: "half4", typ: Type{Scalar: Half, Width: 4}, ok: true},
+		{name: "int32_t", typ: Type{Scalar: Int, Width: 1}, ok: true},
+		{name: "int32_t2"},
+		{name: "float5"},
+		{name: "void2"},
+		{name: "double"},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			typ, ok := LookupType(subtest.name)
+			require.Equal(t, subtest.ok, ok)
+			require.Equal(t, subtest.typ, typ)
+		})
+	}
+}
+
+func Test_Type_Size(t *testing.T) {
+	require.Equal(t, 4, floatType.Size())
+	require.Equal(t, 8, vectorType(Float, 2).Size())
+	require.Equal(t, 16, vectorType(Float, 3).Size())
+	require.Equal(t, 8, vectorType(Half, 3).Size())
+	require.Equal(t, 8, Type{Scalar: Char, Width: 1, Pointer: true}.Size())
+}
+
+func Test_HalfFromFloat32(t *testing.T) {
+	type subtest struct {
+		name string
+		f    float32
+		half uint16
+	}
+
+	subtests := []subtest{
+		{name: "zero", f: 0, half: 0x0000},
+		{name: "negative zero", f: float32(math.Copysign(0, -1)), half: 0x8000},
+		{name: "one", f: 1, half: 0x3c00},
+		{name: "max", f: 65504, half: 0x7bff},
+		{name: "overflow", f: 65520, half: 0x7c00},
+		{name: "round to even", f: 1 + 1.0/2048, half: 0x3c00},
+		{name: "round up", f: 1 + 3.0/2048, half: 0x3c02},
+		{name: "smallest subnormal", f: 0x1p-24, half: 0x0001},
+		{name: "underflow", f: 0x1p-26, half: 0x0000},
+		{name: "infinity", f: float32(math.Inf(-1)), half: 0xfc00},
+		{name: "nan", f: float32(math.NaN()), half: 0x7e00},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			require.Equal(t, subtest.half, HalfFromFloat32(subtest.f))
+		})
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		for h := 0; h < 0x10000; h++ {
+			f := Float32FromHalf(uint16(h))
+			if f != f {
+				continue
+			}
+			require.Equal(t, uint16(h), HalfFromFloat32(f), "half %#04x", h)
+		}
+	})
+}
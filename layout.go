@@ -0,0 +1,302 @@
+package metal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/green-aloe/metal/internal/msl"
+)
+
+// ----------------------------------------------------------------------------
+// Struct layout
+// ----------------------------------------------------------------------------
+
+// maxInputBytes is the largest input that setBytes accepts. Larger data belongs in a buffer.
+const maxInputBytes = 4096
+
+// A typeLayout is the layout in Metal memory of a Go type used in a struct input: a scalar, a
+// vector, an array, or a struct.
+type typeLayout struct {
+	// name is the Metal type, such as "float", "packed_float3", or "float4[2]", or the Go type for a
+	// struct.
+	name  string
+	size  int
+	align int
+
+	// scalar and width are the element type and number of components of a scalar or vector.
+	scalar msl.Scalar
+	width  int
+
+	// elem and count are the element layout and length of an array.
+	elem  *typeLayout
+	count int
+
+	// fields are the fields of a struct, in order.
+	fields []fieldLayout
+}
+
+// A fieldLayout is one field of a struct input.
+type fieldLayout struct {
+	name   string
+	index  int
+	offset int
+	layout *typeLayout
+}
+
+// structLayouts caches the layout of every struct type that has been packed, keyed by its
+// reflect.Type.
+var structLayouts sync.Map
+
+// packStruct returns the bytes of v, a struct or a pointer to one, laid out as Metal lays out the
+// matching struct in constant memory.
+func packStruct(v any) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("%T is nil", v)
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%T is not a struct", v)
+	}
+
+	l, err := structLayoutOf(rv.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, l.size)
+	l.encode(b, rv)
+
+	return b, nil
+}
+
+// structLayoutOf returns the layout of the struct type t, computing it on first use.
+func structLayoutOf(t reflect.Type) (*typeLayout, error) {
+	if l, ok := structLayouts.Load(t); ok {
+		return l.(*typeLayout), nil
+	}
+
+	l, err := layoutStruct(t)
+	if err != nil {
+		return nil, err
+	}
+	structLayouts.Store(t, l)
+
+	return l, nil
+}
+
+// layoutType returns the layout of a field of Go type t whose metal struct tag is tag. Without a
+// tag, a Go scalar maps to the Metal scalar of the same width, an array of 2 to 4 scalars to a
+// vector, any other array to an array, and a struct to a struct. A tag names the Metal type
+// explicitly, for a half, a packed vector, or an array of vectors.
+func layoutType(t reflect.Type, tag string) (*typeLayout, error) {
+	if tag != "" {
+		return layoutTagged(t, tag)
+	}
+
+	switch t.Kind() {
+	case reflect.Array:
+		if s := kindScalar(t.Elem().Kind()); s != msl.Void && t.Len() >= 2 && t.Len() <= 4 {
+			return layoutVector(s, t.Len(), false), nil
+		}
+		elem, err := layoutType(t.Elem(), "")
+		if err != nil {
+			return nil, err
+		}
+		return layoutArray(elem, t.Len()), nil
+
+	case reflect.Struct:
+		return layoutStruct(t)
+
+	default:
+		if s := kindScalar(t.Kind()); s != msl.Void {
+			return layoutVector(s, 1, false), nil
+		}
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+}
+
+// layoutTagged returns the layout of a field of Go type t tagged with the Metal scalar or vector
+// type tag. t must hold that type, or be an array (of arrays) of it.
+func layoutTagged(t reflect.Type, tag string) (*typeLayout, error) {
+	name, packed := strings.CutPrefix(tag, "packed_")
+	typ, ok := msl.LookupType(name)
+	if !ok || typ.Scalar == msl.Void || (packed && typ.Width == 1) {
+		return nil, fmt.Errorf("unknown metal type '%s'", tag)
+	}
+
+	var layout func(t reflect.Type) *typeLayout
+	layout = func(t reflect.Type) *typeLayout {
+		if holds(t, typ) {
+			return layoutVector(typ.Scalar, typ.Width, packed)
+		}
+		if t.Kind() != reflect.Array {
+			return nil
+		}
+		elem := layout(t.Elem())
+		if elem == nil {
+			return nil
+		}
+		return layoutArray(elem, t.Len())
+	}
+
+	l := layout(t)
+	if l == nil {
+		return nil, fmt.Errorf("%s cannot hold a %s", t, tag)
+	}
+
+	return l, nil
+}
+
+// holds reports whether a value of Go type t has the shape of the Metal scalar or vector typ: a
+// scalar of the same width, or an array of one per component.
+func holds(t reflect.Type, typ msl.Type) bool {
+	if typ.Width == 1 {
+		return compatibleElement(typ.Scalar, kindScalar(t.Kind()))
+	}
+	return t.Kind() == reflect.Array && t.Len() == typ.Width && compatibleElement(typ.Scalar, kindScalar(t.Elem().Kind()))
+}
+
+// layoutVector returns the layout of a scalar (width 1) or vector. As in Metal, a vector is aligned
+// to its size, and a 3-component vector is padded to the size of a 4-component one; a packed vector
+// has no padding and is aligned like its scalar.
+func layoutVector(s msl.Scalar, width int, packed bool) *typeLayout {
+	l := &typeLayout{name: s.String(), scalar: s, width: width}
+	switch {
+	case width == 1:
+		l.size, l.align = s.Size(), s.Size()
+	case packed:
+		l.name = fmt.Sprintf("packed_%s%d", s, width)
+		l.size, l.align = width*s.Size(), s.Size()
+	default:
+		typ, _ := msl.LookupType(fmt.Sprintf("%s%d", s, width))
+		l.name = typ.String()
+		l.size, l.align = typ.Size(), typ.Align()
+	}
+
+	return l
+}
+
+// layoutArray returns the layout of an array of count elements. Each element's size is already a
+// multiple of its alignment, so the elements are contiguous.
+func layoutArray(elem *typeLayout, count int) *typeLayout {
+	return &typeLayout{
+		name:  fmt.Sprintf("%s[%d]", elem.name, count),
+		size:  count * elem.size,
+		align: elem.align,
+		elem:  elem,
+		count: count,
+	}
+}
+
+// layoutStruct returns the layout of the struct type t. Each field is placed at the next offset
+// that is a multiple of its alignment, and the struct's size is rounded up to a multiple of its
+// largest field alignment, as in C. A field tagged metal:"-" is skipped. Blank fields are laid out
+// like any other and packed as zeros, so explicit padding works as it does in MSL.
+func layoutStruct(t reflect.Type) (*typeLayout, error) {
+	l := &typeLayout{name: t.String(), align: 1}
+
+	offset := 0
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("metal")
+		if tag == "-" {
+			continue
+		}
+
+		fl, err := layoutType(f.Type, tag)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %w", f.Name, err)
+		}
+
+		offset = alignUp(offset, fl.align)
+		l.fields = append(l.fields, fieldLayout{name: f.Name, index: i, offset: offset, layout: fl})
+		offset += fl.size
+		l.align = max(l.align, fl.align)
+	}
+	if len(l.fields) == 0 {
+		return nil, fmt.Errorf("%s has no fields", t)
+	}
+	l.size = alignUp(offset, l.align)
+
+	return l, nil
+}
+
+// alignUp rounds n up to a multiple of align.
+func alignUp(n, align int) int {
+	return (n + align - 1) / align * align
+}
+
+// kindScalar returns the Metal scalar that has the width and encoding of a Go value of kind k, or
+// msl.Void if there is none. Half values are held in uint16s, so they need a tag.
+func kindScalar(k reflect.Kind) msl.Scalar {
+	switch k {
+	case reflect.Bool:
+		return msl.Bool
+	case reflect.Int8:
+		return msl.Char
+	case reflect.Uint8:
+		return msl.UChar
+	case reflect.Int16:
+		return msl.Short
+	case reflect.Uint16:
+		return msl.UShort
+	case reflect.Int32:
+		return msl.Int
+	case reflect.Uint32:
+		return msl.UInt
+	case reflect.Float32:
+		return msl.Float
+	default:
+		return msl.Void
+	}
+}
+
+// encode writes v, whose type was laid out as l, into b. Padding is left as it is.
+func (l *typeLayout) encode(b []byte, v reflect.Value) {
+	switch {
+	case l.fields != nil:
+		for _, f := range l.fields {
+			f.layout.encode(b[f.offset:], v.Field(f.index))
+		}
+	case l.elem != nil:
+		for i := 0; i < l.count; i++ {
+			l.elem.encode(b[i*l.elem.size:], v.Index(i))
+		}
+	case l.width == 1:
+		encodeScalar(b, v)
+	default:
+		for i := 0; i < l.width; i++ {
+			encodeScalar(b[i*l.scalar.Size():], v.Index(i))
+		}
+	}
+}
+
+// encodeScalar writes the Go scalar v into b in little-endian order.
+func encodeScalar(b []byte, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			b[0] = 1
+		}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		putInt(b, uint64(v.Int()), int(v.Type().Size()))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		putInt(b, v.Uint(), int(v.Type().Size()))
+	case reflect.Float32:
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(v.Float())))
+	}
+}
+
+// putInt writes the low size bytes of n into b in little-endian order.
+func putInt(b []byte, n uint64, size int) {
+	for i := 0; i < size; i++ {
+		b[i] = byte(n >> (8 * i))
+	}
+}
@@ -0,0 +1,242 @@
+package metal
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_layoutStruct tests that Go structs are laid out with Metal's sizes and alignments.
+func Test_layoutStruct(t *testing.T) {
+	type inner struct {
+		A [2]float32
+		B float32
+	}
+
+	type subtest struct {
+		name   string
+		value  any
+		size   int
+		align  int
+		fields []string
+		err    string
+	}
+
+	subtests := []subtest{
+		{
+			name: "scalars",
+			value: struct {
+				A int8
+				B int16
+				C uint8
+				D float32
+				E bool
+			}{},
+			size:   16,
+			align:  4,
+			fields: []string{"A char @0", "B short @2", "C uchar @4", "D float @8", "E bool @12"},
+		},
+		{
+			name: "float4",
+			value: struct {
+				Count uint32
+				Scale [4]float32
+			}{},
+			size:   32,
+			align:  16,
+			fields: []string{"Count uint @0", "Scale float4 @16"},
+		},
+		{
+			name: "float2",
+			value: struct {
+				Count int32
+				Scale [2]float32
+				Tail  int32
+			}{},
+			size:   24,
+			align:  8,
+			fields: []string{"Count int @0", "Scale float2 @8", "Tail int @16"},
+		},
+		{
+			name: "float3",
+			value: struct {
+				Position [3]float32
+				Mass     float32
+			}{},
+			size:   32,
+			align:  16,
+			fields: []string{"Position float3 @0", "Mass float @16"},
+		},
+		{
+			name: "packed_float3",
+			value: struct {
+				Position [3]float32 `metal:"packed_float3"`
+				Mass     float32
+			}{},
+			size:   16,
+			align:  4,
+			fields: []string{"Position packed_float3 @0", "Mass float @12"},
+		},
+		{
+			name: "half",
+			value: struct {
+				Gain   uint16    `metal:"half"`
+				Bias   [4]uint16 `metal:"half4"`
+				Offset uint16
+			}{},
+			size:   24,
+			align:  8,
+			fields: []string{"Gain half @0", "Bias half4 @8", "Offset ushort @16"},
+		},
+		{
+			name: "arrays",
+			value: struct {
+				Weights [5]float32
+				Points  [3][2]float32
+				Matrix  [2][4]float32 `metal:"float4"`
+				Packed  [2][3]float32 `metal:"packed_float3"`
+			}{},
+			size:   112,
+			align:  16,
+			fields: []string{"Weights float[5] @0", "Points float2[3] @24", "Matrix float4[2] @48", "Packed packed_float3[2] @80"},
+		},
+		{
+			name: "nested",
+			value: struct {
+				Flag  bool
+				Inner inner
+				Items [2]inner
+			}{},
+			size:   56,
+			align:  8,
+			fields: []string{"Flag bool @0", "Inner metal.inner @8", "Items metal.inner[2] @24"},
+		},
+		{
+			name: "padding",
+			value: struct {
+				A float32
+				_ [12]byte
+				B [4]float32
+			}{},
+			size:   32,
+			align:  16,
+			fields: []string{"A float @0", "_ uchar[12] @4", "B float4 @16"},
+		},
+		{
+			name: "skipped",
+			value: struct {
+				A    float32
+				Note string `metal:"-"`
+			}{},
+			size:   4,
+			align:  4,
+			fields: []string{"A float @0"},
+		},
+		{
+			name:  "unsupported type",
+			value: struct{ N int }{},
+			err:   "field 'N': unsupported type int",
+		},
+		{
+			name:  "unsupported nested type",
+			value: struct{ Inner struct{ X float64 } }{},
+			err:   "field 'Inner': field 'X': unsupported type float64",
+		},
+		{
+			name: "unknown tag",
+			value: struct {
+				A float32 `metal:"float5"`
+			}{},
+			err: "field 'A': unknown metal type 'float5'",
+		},
+		{
+			name: "packed scalar",
+			value: struct {
+				A float32 `metal:"packed_float"`
+			}{},
+			err: "field 'A': unknown metal type 'packed_float'",
+		},
+		{
+			name: "mismatched tag",
+			value: struct {
+				A [3]float32 `metal:"float4"`
+			}{},
+			err: "field 'A': [3]float32 cannot hold a float4",
+		},
+		{
+			name: "mismatched half",
+			value: struct {
+				A float32 `metal:"half"`
+			}{},
+			err: "field 'A': float32 cannot hold a half",
+		},
+		{
+			name:  "empty",
+			value: struct{}{},
+			err:   "struct {} has no fields",
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			l, err := layoutStruct(reflect.TypeOf(subtest.value))
+			if subtest.err != "" {
+				require.EqualError(t, err, subtest.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, subtest.size, l.size)
+			require.Equal(t, subtest.align, l.align)
+
+			fields := make([]string, len(l.fields))
+			for i, f := range l.fields {
+				fields[i] = fmt.Sprintf("%s %s @%d", f.name, f.layout.name, f.offset)
+			}
+			require.Equal(t, subtest.fields, fields)
+		})
+	}
+}
+
+// Test_packStruct tests that struct values are encoded at their Metal offsets.
+func Test_packStruct(t *testing.T) {
+	type params struct {
+		Count  uint32
+		Scale  [2]float32
+		Offset int16
+		Gain   uint16 `metal:"half"`
+		Origin [3]float32
+		Enable bool
+	}
+
+	value := params{Count: 7, Scale: [2]float32{1, -2}, Offset: -3, Gain: 0x3c00, Origin: [3]float32{0.5, 0, 2}, Enable: true}
+	want := []byte{
+		7, 0, 0, 0, // Count
+		0, 0, 0, 0, // padding
+		0x00, 0x00, 0x80, 0x3f, 0x00, 0x00, 0x00, 0xc0, // Scale
+		0xfd, 0xff, // Offset
+		0x00, 0x3c, // Gain
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // padding
+		0x00, 0x00, 0x00, 0x3f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0, 0, 0, 0, // Origin
+		1,                                           // Enable
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // padding
+	}
+
+	b, err := packStruct(value)
+	require.NoError(t, err)
+	require.Equal(t, want, b)
+
+	b, err = packStruct(&value)
+	require.NoError(t, err)
+	require.Equal(t, want, b)
+
+	_, err = packStruct((*params)(nil))
+	require.EqualError(t, err, "*metal.params is nil")
+
+	_, err = packStruct(3)
+	require.EqualError(t, err, "int is not a struct")
+
+	_, err = packStruct(nil)
+	require.EqualError(t, err, "<nil> is not a struct")
+}
@@ -0,0 +1,207 @@
+package metal
+
+import (
+	"errors"
+	"os"
+	"slices"
+)
+
+// ----------------------------------------------------------------------------
+// Library type and lifecycle
+// ----------------------------------------------------------------------------
+
+var ErrInvalidLibrary = errors.New("invalid library")
+
+// A Library is a set of compiled metal functions that Functions can be created from without
+// compiling anything again.
+//
+// Functions created from a Library do not depend on it: they stay valid after the Library is
+// closed.
+type Library struct {
+	id    int32
+	b     backend
+	names []string
+
+	// source and opts are kept to describe the arguments of the library's functions. source is empty
+	// and opts nil for a library loaded from a metallib.
+	source string
+	opts   *CompileOptions
+
+	// diagnostics are the warnings and notes from compiling the library, which its functions share.
+	diagnostics []Diagnostic
+}
+
+// NewLibrary compiles every function in the provided metal code at once, so that any number of
+// Functions can then be created from it with Library.Function without compiling the source again.
+// This is much faster than calling NewFunction for each kernel of a source with many kernels.
+//
+// If Metal could not be initialized, or if CPUOptions.Force is set, the library is instead built on
+// the CPU backend, whose Functions run the kernels registered with RegisterCPUKernel or else
+// interpret the source, as NewFunction's do. The options are checked as NewFunctionWithOptions
+// checks them.
+func NewLibrary(metalSource string, opts CompileOptions) (*Library, error) {
+	if err := opts.validate(); err != nil {
+		return nil, newError(err.Error(), "unable to create metal library", errCodeNone)
+	}
+	o := opts.clone()
+	if err := o.specialize(metalSource); err != nil {
+		return nil, newError(err.Error(), "unable to create metal library", errCodeNone)
+	}
+
+	b := functionBackend()
+	if err := b.available(); err != nil {
+		return nil, err
+	}
+
+	id, names, diagnostics, err := b.newLibrary(metalSource, o)
+	if err != nil {
+		return nil, err
+	}
+
+	library := newLibrary(id, b, names, metalSource)
+	library.opts = o
+	library.diagnostics = diagnostics
+
+	return library, nil
+}
+
+// LoadLibrary loads the compiled metallib file in data, such as one built ahead of time with
+// `xcrun metal`, so that its functions can be run without compiling their source at run time.
+//
+// On the CPU backend, which cannot run compiled code, a function from the library can be created
+// only if a kernel was registered for it with RegisterCPUKernel.
+func LoadLibrary(data []byte) (*Library, error) {
+	b := functionBackend()
+	if err := b.available(); err != nil {
+		return nil, err
+	}
+
+	id, names, err := b.loadLibrary(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLibrary(id, b, names, ""), nil
+}
+
+// newLibrary returns the handle of the library with the given id on b. names are the library's
+// kernels, which are sorted and deduplicated in place.
+func newLibrary(id int32, b backend, names []string, source string) *Library {
+	slices.Sort(names)
+
+	return &Library{id: id, b: b, names: slices.Compact(names), source: source}
+}
+
+// LoadLibraryFile loads the compiled metallib file at path, as LoadLibrary does.
+func LoadLibraryFile(path string) (*Library, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadLibrary(data)
+}
+
+// NewFunctionFromLibrary sets up a new function from the compiled metallib file in data. It is a
+// shortcut for loading the library, creating one Function from it, and closing the library; load
+// the library with LoadLibrary instead to create several Functions from it.
+func NewFunctionFromLibrary(data []byte, funcName string) (*Function, error) {
+	library, err := LoadLibrary(data)
+	if err != nil {
+		return nil, err
+	}
+	defer library.Close()
+
+	return library.Function(funcName)
+}
+
+// NewFunctionFromLibraryFile sets up a new function from the compiled metallib file at path, as
+// NewFunctionFromLibrary does.
+func NewFunctionFromLibraryFile(path, funcName string) (*Function, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFunctionFromLibrary(data, funcName)
+}
+
+// Valid checks whether or not the library is valid and can be used to create functions.
+func (l *Library) Valid() bool {
+	return l != nil && l.id > 0
+}
+
+// Functions returns the names of the kernel functions in the library, in sorted order. It returns
+// nil if the library is not valid. On the CPU backend, the kernels of a library built from source are
+// found by scanning the source for their declarations.
+func (l *Library) Functions() []string {
+	if !l.Valid() {
+		return nil
+	}
+
+	return slices.Clone(l.names)
+}
+
+// Function sets up the function called funcName in the library. It is the equivalent of
+// NewFunction for a function that has already been compiled, and the result behaves the same way.
+// Functions set up from the same library share its compiled code.
+//
+// A function created from a compiled metallib has no source to describe its arguments from, so on
+// the GPU its Arguments are those reflected from the pipeline, and on the CPU backend they cannot
+// be described.
+func (l *Library) Function(funcName string) (*Function, error) {
+	if !l.Valid() {
+		return nil, ErrInvalidLibrary
+	}
+
+	b := l.backend()
+	id, err := b.libraryFunction(l.id, funcName, l.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Function{
+		id:          id,
+		b:           b,
+		source:      l.source,
+		name:        funcName,
+		opts:        l.opts,
+		args:        &argumentCache{},
+		diagnostics: &l.diagnostics,
+	}, nil
+}
+
+// Diagnostics returns the warnings and notes that the compiler reported for the library's source,
+// as Function.Diagnostics does. Every Function created from the library reports the same ones. It
+// returns nil for a library loaded from a metallib, or if the library is not valid.
+func (l *Library) Diagnostics() []Diagnostic {
+	if !l.Valid() {
+		return nil
+	}
+
+	return slices.Clone(l.diagnostics)
+}
+
+// Close releases the library. Functions that were created from it are not affected.
+func (l *Library) Close() error {
+	if !l.Valid() {
+		return ErrInvalidLibrary
+	}
+
+	if err := l.backend().closeLibrary(l.id); err != nil {
+		return err
+	}
+	l.id = 0
+
+	return nil
+}
+
+// backend returns the backend that loaded the library. A zero Library has no backend of its own, so
+// it uses the one LoadLibrary would choose; its invalid id is then reported the same way as any
+// other.
+func (l *Library) backend() backend {
+	if l.b != nil {
+		return l.b
+	}
+	return functionBackend()
+}
@@ -0,0 +1,162 @@
+//go:build darwin && cgo
+
+package metal
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// compileMetallib compiles the metal source files into one metallib file with the command-line
+// tools, skipping the test if they are not installed, and returns the file's contents.
+func compileMetallib(t *testing.T, sources ...string) []byte {
+	t.Helper()
+
+	if _, err := exec.LookPath("xcrun"); err != nil {
+		t.Skip("xcrun is not installed")
+	}
+
+	dir := t.TempDir()
+	var airs []string
+	for _, source := range sources {
+		air := filepath.Join(dir, filepath.Base(source)+".air")
+		if out, err := exec.Command("xcrun", "-sdk", "macosx", "metal", "-c", source, "-o", air).CombinedOutput(); err != nil {
+			t.Skipf("the metal compiler is not available: %s", out)
+		}
+		airs = append(airs, air)
+	}
+
+	path := filepath.Join(dir, "library.metallib")
+	args := append([]string{"-sdk", "macosx", "metallib", "-o", path}, airs...)
+	out, err := exec.Command("xcrun", args...).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	return data
+}
+
+// Test_NewLibrary tests that functions set up from a library built from source share it and outlive
+// it.
+func Test_NewLibrary(t *testing.T) {
+	t.Run("invalid source", func(t *testing.T) {
+		library, err := NewLibrary("", CompileOptions{})
+		require.EqualError(t, err, "unable to create metal library: missing metal code")
+		require.Nil(t, library)
+
+		_, err = NewLibrary("kernel void broken(", CompileOptions{})
+		require.ErrorContains(t, err, "unable to create metal library: failed to create library: ")
+	})
+
+	t.Run("valid source", func(t *testing.T) {
+		library, err := NewLibrary(sourceTransfer1D+"\n"+sourceNoop, CompileOptions{})
+		require.NoError(t, err)
+		require.True(t, library.Valid())
+		require.Equal(t, []string{"noop", "transfer1D"}, library.Functions())
+
+		transfer, err := library.Function("transfer1D")
+		require.NoError(t, err)
+		require.True(t, validFunctionId(transfer.id))
+		noop, err := library.Function("noop")
+		require.NoError(t, err)
+		require.True(t, validFunctionId(noop.id))
+
+		args, err := transfer.Arguments()
+		require.NoError(t, err)
+		require.Len(t, args, 3)
+
+		_, err = library.Function("transfer2D")
+		require.EqualError(t, err, "unable to set up metal function: failed to find function 'transfer2D'")
+
+		require.NoError(t, library.Close())
+		require.Nil(t, library.Functions())
+
+		inputId, _, err := NewBufferWith([]float32{1, 2, 3})
+		require.NoError(t, err)
+		require.True(t, validBufferId(inputId))
+		outputId, output, err := NewBuffer[float32](3)
+		require.NoError(t, err)
+		require.True(t, validBufferId(outputId))
+
+		require.NoError(t, transfer.Run(RunParameters{Grid: Grid{X: 3}, BufferIds: []BufferId{inputId, outputId}}))
+		require.Equal(t, []float32{1, 2, 3}, output)
+		require.NoError(t, noop.Run(RunParameters{Grid: Grid{X: 3}}))
+
+		require.NoError(t, transfer.Close())
+		require.NoError(t, noop.Close())
+		require.NoError(t, inputId.Close())
+		require.NoError(t, outputId.Close())
+	})
+}
+
+// Test_Library tests that functions are set up from a compiled metallib and outlive their library.
+func Test_Library(t *testing.T) {
+	t.Run("invalid data", func(t *testing.T) {
+		library, err := LoadLibrary([]byte("not a library"))
+		require.ErrorContains(t, err, "unable to load metal library: failed to create library")
+		require.Nil(t, library)
+
+		_, err = LoadLibrary(nil)
+		require.EqualError(t, err, "unable to load metal library: missing library data")
+	})
+
+	t.Run("invalid library", func(t *testing.T) {
+		var nilPtr *Library
+		require.ErrorIs(t, nilPtr.Close(), ErrInvalidLibrary)
+		_, err := nilPtr.Function("noop")
+		require.ErrorIs(t, err, ErrInvalidLibrary)
+
+		library := Library{id: 99999}
+		require.EqualError(t, library.Close(), "unable to close metal library: invalid library id: 99999")
+		require.ErrorIs(t, library.Close(), ErrInvalidLibrary)
+	})
+
+	t.Run("valid library", func(t *testing.T) {
+		data := compileMetallib(t, "test/transfer1D.metal", "test/noop.metal")
+
+		info, err := ReadLibraryInfo(data)
+		require.NoError(t, err)
+		require.Equal(t, "macOS", info.Platform)
+		require.ElementsMatch(t, []string{"noop", "transfer1D"}, info.kernels())
+
+		library, err := LoadLibrary(data)
+		require.NoError(t, err)
+		require.Equal(t, []string{"noop", "transfer1D"}, library.Functions())
+
+		function, err := library.Function("transfer1D")
+		require.NoError(t, err)
+		require.True(t, validFunctionId(function.id))
+		require.Equal(t, "transfer1D", function.String())
+
+		_, err = library.Function("transfer2D")
+		require.EqualError(t, err, "unable to set up metal function: failed to find function 'transfer2D'")
+
+		require.NoError(t, library.Close())
+		require.False(t, library.Valid())
+
+		// The function stays valid after its library is closed.
+		inputId, _, err := NewBufferWith([]float32{1, 2, 3})
+		require.NoError(t, err)
+		require.True(t, validBufferId(inputId))
+		outputId, output, err := NewBuffer[float32](3)
+		require.NoError(t, err)
+		require.True(t, validBufferId(outputId))
+
+		require.NoError(t, function.Run(RunParameters{Grid: Grid{X: 3}, BufferIds: []BufferId{inputId, outputId}}))
+		require.Equal(t, []float32{1, 2, 3}, output)
+
+		require.NoError(t, function.Close())
+		require.NoError(t, inputId.Close())
+		require.NoError(t, outputId.Close())
+
+		function, err = NewFunctionFromLibrary(data, "noop")
+		require.NoError(t, err)
+		require.True(t, validFunctionId(function.id))
+		require.NoError(t, function.Close())
+	})
+}
@@ -0,0 +1,261 @@
+package metal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ----------------------------------------------------------------------------
+// Metallib container
+// ----------------------------------------------------------------------------
+
+// A metallib file is a container for the compiled functions of a library. Apple does not document
+// its layout; the parser below reads only the parts that have been stable across Xcode releases.
+// All integers are little-endian.
+//
+// The file starts with an 88-byte header:
+//
+//	offset  size  field
+//	0       4     magic, "MTLB"
+//	4       2     target platform flags
+//	6       2     container version, major
+//	8       2     container version, minor
+//	10      1     library type
+//	11      1     target operating system
+//	12      2     target operating system version, major
+//	14      2     target operating system version, minor
+//	16      8     file size
+//	24      8     function list offset
+//	32      8     function list size
+//	40      48    offsets and sizes of the metadata and bitcode sections
+//
+// The function list is a uint32 count followed by one entry per function. Each entry is a uint32
+// size, which counts the size field itself, and a sequence of tags. A tag is a four-character name,
+// a uint16 length, and that many bytes of data, and the sequence ends with a bare "ENDT".
+const (
+	metallibMagic      = "MTLB"
+	metallibHeaderSize = 88
+)
+
+// A Version is a major and minor version number, such as the version of the Metal Shading Language
+// that a function was compiled for.
+type Version struct {
+	Major int
+	Minor int
+}
+
+// String returns the version as major.minor.
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// A FunctionType is the kind of a function in a compiled library.
+type FunctionType int
+
+const (
+	FunctionTypeVertex FunctionType = iota
+	FunctionTypeFragment
+	// FunctionTypeKernel is a compute kernel, the only type of function that this package can run.
+	FunctionTypeKernel
+	FunctionTypeUnqualified
+	FunctionTypeVisible
+	FunctionTypeExtern
+	FunctionTypeIntersection
+)
+
+// String returns the name of the function type.
+func (t FunctionType) String() string {
+	switch t {
+	case FunctionTypeVertex:
+		return "vertex"
+	case FunctionTypeFragment:
+		return "fragment"
+	case FunctionTypeKernel:
+		return "kernel"
+	case FunctionTypeUnqualified:
+		return "unqualified"
+	case FunctionTypeVisible:
+		return "visible"
+	case FunctionTypeExtern:
+		return "extern"
+	case FunctionTypeIntersection:
+		return "intersection"
+	default:
+		return fmt.Sprintf("FunctionType(%d)", int(t))
+	}
+}
+
+// LibraryInfo describes a compiled metallib file, as read from its container header.
+type LibraryInfo struct {
+	// FileVersion is the version of the container format.
+	FileVersion Version
+	// Platform is the operating system the library was compiled for, such as "macOS" or "iOS", or
+	// the empty string if the file does not say.
+	Platform string
+	// PlatformVersion is the minimum version of Platform that the library targets.
+	PlatformVersion Version
+	// Functions are the functions in the library, in the order they are stored.
+	Functions []LibraryFunction
+}
+
+// LibraryFunction describes one function in a compiled metallib file.
+type LibraryFunction struct {
+	// Name is the function's name.
+	Name string
+	// Type is the kind of function.
+	Type FunctionType
+	// LanguageVersion is the version of the Metal Shading Language that the function was compiled
+	// for. It is zero if the file does not say.
+	LanguageVersion Version
+	// AIRVersion is the version of the intermediate representation that the function is stored in.
+	// It is zero if the file does not say.
+	AIRVersion Version
+}
+
+// kernels returns the names of the kernel functions in the library.
+func (info LibraryInfo) kernels() []string {
+	var names []string
+	for _, f := range info.Functions {
+		if f.Type == FunctionTypeKernel {
+			names = append(names, f.Name)
+		}
+	}
+
+	return names
+}
+
+// metallibPlatforms names the target operating systems, indexed by the low seven bits of the header
+// field.
+var metallibPlatforms = []string{
+	1: "macOS",
+	2: "iOS",
+	3: "tvOS",
+	4: "watchOS",
+	5: "bridgeOS",
+	6: "macCatalyst",
+	7: "iOS Simulator",
+	8: "tvOS Simulator",
+	9: "watchOS Simulator",
+}
+
+// ReadLibraryInfo reads the container header of the compiled metallib file in data and describes
+// the library in it. It reads only the header and the function list, not the compiled code, so it
+// works on every platform, including those without Metal.
+func ReadLibraryInfo(data []byte) (LibraryInfo, error) {
+	if len(data) < metallibHeaderSize {
+		return LibraryInfo{}, fmt.Errorf("%d bytes is too short for a metallib header", len(data))
+	}
+	if string(data[:4]) != metallibMagic {
+		return LibraryInfo{}, errors.New("not a metallib file")
+	}
+
+	le := binary.LittleEndian
+	info := LibraryInfo{
+		FileVersion:     Version{Major: int(le.Uint16(data[6:])), Minor: int(le.Uint16(data[8:]))},
+		PlatformVersion: Version{Major: int(le.Uint16(data[12:])), Minor: int(le.Uint16(data[14:]))},
+	}
+	if platform := int(data[11] & 0x7f); platform < len(metallibPlatforms) {
+		info.Platform = metallibPlatforms[platform]
+	}
+
+	if size := le.Uint64(data[16:]); size != uint64(len(data)) {
+		return LibraryInfo{}, fmt.Errorf("header gives a file size of %d bytes, not %d", size, len(data))
+	}
+	list, err := metallibSection(data, le.Uint64(data[24:]), le.Uint64(data[32:]))
+	if err != nil {
+		return LibraryInfo{}, fmt.Errorf("function list: %w", err)
+	}
+
+	if len(list) < 4 {
+		return LibraryInfo{}, errors.New("function list: missing function count")
+	}
+	count := le.Uint32(list)
+	list = list[4:]
+	for i := range count {
+		if len(list) < 4 {
+			return LibraryInfo{}, fmt.Errorf("function %d: missing entry", i)
+		}
+		size := le.Uint32(list)
+		if size < 4 || uint64(size) > uint64(len(list)) {
+			return LibraryInfo{}, fmt.Errorf("function %d: entry size %d is out of range", i, size)
+		}
+
+		function, err := readMetallibFunction(list[4:size])
+		if err != nil {
+			return LibraryInfo{}, fmt.Errorf("function %d: %w", i, err)
+		}
+		info.Functions = append(info.Functions, function)
+		list = list[size:]
+	}
+
+	return info, nil
+}
+
+// metallibSection returns the size bytes of data at offset, or an error if they are not all in
+// data.
+func metallibSection(data []byte, offset, size uint64) ([]byte, error) {
+	if offset > uint64(len(data)) || size > uint64(len(data))-offset {
+		return nil, fmt.Errorf("%d bytes at offset %d is outside the file's %d bytes", size, offset, len(data))
+	}
+
+	return data[offset : offset+size], nil
+}
+
+// readMetallibFunction reads the tags of one function list entry.
+func readMetallibFunction(entry []byte) (LibraryFunction, error) {
+	le := binary.LittleEndian
+
+	var function LibraryFunction
+	var hasName, hasType bool
+	for {
+		if len(entry) < 4 {
+			return LibraryFunction{}, errors.New("missing ENDT tag")
+		}
+		tag := string(entry[:4])
+		if tag == "ENDT" {
+			break
+		}
+		if len(entry) < 6 {
+			return LibraryFunction{}, fmt.Errorf("tag '%s': missing length", tag)
+		}
+		length := int(le.Uint16(entry[4:]))
+		if len(entry)-6 < length {
+			return LibraryFunction{}, fmt.Errorf("tag '%s': %d bytes is past the end of the entry", tag, length)
+		}
+		value := entry[6 : 6+length]
+		entry = entry[6+length:]
+
+		switch tag {
+		case "NAME":
+			name, _, ok := bytes.Cut(value, []byte{0})
+			if !ok || len(name) == 0 {
+				return LibraryFunction{}, errors.New("tag 'NAME': invalid name")
+			}
+			function.Name = string(name)
+			hasName = true
+		case "TYPE":
+			if length != 1 {
+				return LibraryFunction{}, fmt.Errorf("tag 'TYPE': %d bytes is not 1", length)
+			}
+			function.Type = FunctionType(value[0])
+			hasType = true
+		case "VERS":
+			if length != 8 {
+				return LibraryFunction{}, fmt.Errorf("tag 'VERS': %d bytes is not 8", length)
+			}
+			function.AIRVersion = Version{Major: int(le.Uint16(value)), Minor: int(le.Uint16(value[2:]))}
+			function.LanguageVersion = Version{Major: int(le.Uint16(value[4:])), Minor: int(le.Uint16(value[6:]))}
+		}
+	}
+
+	switch {
+	case !hasName:
+		return LibraryFunction{}, errors.New("missing NAME tag")
+	case !hasType:
+		return LibraryFunction{}, fmt.Errorf("'%s': missing TYPE tag", function.Name)
+	}
+
+	return function, nil
+}
@@ -0,0 +1,212 @@
+package metal
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// metallibTag is one tag of a function list entry.
+type metallibTag struct {
+	name  string
+	value []byte
+}
+
+// buildMetallib returns a metallib file for macOS 14.0 with one function list entry for each set of
+// tags. The file has no metadata or bitcode, which ReadLibraryInfo does not read.
+func buildMetallib(entries ...[]metallibTag) []byte {
+	le := binary.LittleEndian
+
+	list := le.AppendUint32(nil, uint32(len(entries)))
+	for _, tags := range entries {
+		var entry []byte
+		for _, tag := range tags {
+			entry = append(entry, tag.name...)
+			entry = le.AppendUint16(entry, uint16(len(tag.value)))
+			entry = append(entry, tag.value...)
+		}
+		entry = append(entry, "ENDT"...)
+		list = le.AppendUint32(list, uint32(4+len(entry)))
+		list = append(list, entry...)
+	}
+
+	data := make([]byte, metallibHeaderSize, metallibHeaderSize+len(list))
+	copy(data, metallibMagic)
+	le.PutUint16(data[4:], 0x8001)
+	le.PutUint16(data[6:], 1)
+	le.PutUint16(data[8:], 2)
+	data[11] = 0x81
+	le.PutUint16(data[12:], 14)
+	le.PutUint64(data[16:], uint64(metallibHeaderSize+len(list)))
+	le.PutUint64(data[24:], metallibHeaderSize)
+	le.PutUint64(data[32:], uint64(len(list)))
+
+	return append(data, list...)
+}
+
+// metallibKernel returns the tags of a kernel function compiled for MSL 3.1.
+func metallibKernel(name string) []metallibTag {
+	return []metallibTag{
+		{"NAME", append([]byte(name), 0)},
+		{"TYPE", []byte{byte(FunctionTypeKernel)}},
+		{"HASH", make([]byte, 32)},
+		{"VERS", []byte{2, 0, 6, 0, 3, 0, 1, 0}},
+	}
+}
+
+// Test_ReadLibraryInfo tests that metallib container headers are read on every platform.
+func Test_ReadLibraryInfo(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		vertex := []metallibTag{
+			{"NAME", []byte("draw\x00")},
+			{"TYPE", []byte{byte(FunctionTypeVertex)}},
+		}
+		data := buildMetallib(metallibKernel("square"), vertex, metallibKernel("add"))
+
+		info, err := ReadLibraryInfo(data)
+		require.NoError(t, err)
+		require.Equal(t, LibraryInfo{
+			FileVersion:     Version{Major: 1, Minor: 2},
+			Platform:        "macOS",
+			PlatformVersion: Version{Major: 14, Minor: 0},
+			Functions: []LibraryFunction{
+				{Name: "square", Type: FunctionTypeKernel, LanguageVersion: Version{3, 1}, AIRVersion: Version{2, 6}},
+				{Name: "draw", Type: FunctionTypeVertex},
+				{Name: "add", Type: FunctionTypeKernel, LanguageVersion: Version{3, 1}, AIRVersion: Version{2, 6}},
+			},
+		}, info)
+		require.Equal(t, []string{"square", "add"}, info.kernels())
+		require.Equal(t, "3.1", info.Functions[0].LanguageVersion.String())
+		require.Equal(t, "vertex", info.Functions[1].Type.String())
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		info, err := ReadLibraryInfo(buildMetallib())
+		require.NoError(t, err)
+		require.Empty(t, info.Functions)
+		require.Nil(t, info.kernels())
+	})
+
+	t.Run("unknown platform", func(t *testing.T) {
+		data := buildMetallib()
+		data[11] = 0xff
+		info, err := ReadLibraryInfo(data)
+		require.NoError(t, err)
+		require.Equal(t, "", info.Platform)
+	})
+
+	type subtest struct {
+		name   string
+		data   func() []byte
+		errMsg string
+	}
+
+	subtests := []subtest{
+		{
+			name:   "short",
+			data:   func() []byte { return []byte("MTLB") },
+			errMsg: "4 bytes is too short for a metallib header",
+		},
+		{
+			name: "bad magic",
+			data: func() []byte {
+				data := buildMetallib()
+				copy(data, "BLTM")
+				return data
+			},
+			errMsg: "not a metallib file",
+		},
+		{
+			name:   "truncated",
+			data:   func() []byte { return buildMetallib(metallibKernel("square"))[:100] },
+			errMsg: "header gives a file size of 172 bytes, not 100",
+		},
+		{
+			name: "function list out of range",
+			data: func() []byte {
+				data := buildMetallib()
+				binary.LittleEndian.PutUint64(data[24:], 90)
+				return data
+			},
+			errMsg: "function list: 4 bytes at offset 90 is outside the file's 92 bytes",
+		},
+		{
+			name: "missing count",
+			data: func() []byte {
+				data := buildMetallib()
+				binary.LittleEndian.PutUint64(data[32:], 2)
+				return data
+			},
+			errMsg: "function list: missing function count",
+		},
+		{
+			name: "missing entry",
+			data: func() []byte {
+				data := buildMetallib()
+				binary.LittleEndian.PutUint32(data[metallibHeaderSize:], 1)
+				return data
+			},
+			errMsg: "function 0: missing entry",
+		},
+		{
+			name: "entry too large",
+			data: func() []byte {
+				data := buildMetallib(metallibKernel("square"))
+				binary.LittleEndian.PutUint32(data[metallibHeaderSize+4:], 1000)
+				return data
+			},
+			errMsg: "function 0: entry size 1000 is out of range",
+		},
+		{
+			name: "tag past entry",
+			data: func() []byte {
+				data := buildMetallib(metallibKernel("square"))
+				binary.LittleEndian.PutUint16(data[metallibHeaderSize+12:], 500)
+				return data
+			},
+			errMsg: "function 0: tag 'NAME': 500 bytes is past the end of the entry",
+		},
+		{
+			name:   "missing type",
+			data:   func() []byte { return buildMetallib([]metallibTag{{"NAME", []byte("square\x00")}}) },
+			errMsg: "function 0: 'square': missing TYPE tag",
+		},
+		{
+			name:   "missing name",
+			data:   func() []byte { return buildMetallib([]metallibTag{{"TYPE", []byte{2}}}) },
+			errMsg: "function 0: missing NAME tag",
+		},
+		{
+			name:   "empty name",
+			data:   func() []byte { return buildMetallib([]metallibTag{{"NAME", []byte{0}}}) },
+			errMsg: "function 0: tag 'NAME': invalid name",
+		},
+		{
+			name:   "bad type",
+			data:   func() []byte { return buildMetallib([]metallibTag{{"TYPE", []byte{2, 0}}}) },
+			errMsg: "function 0: tag 'TYPE': 2 bytes is not 1",
+		},
+		{
+			name:   "bad version",
+			data:   func() []byte { return buildMetallib([]metallibTag{{"VERS", []byte{2, 0}}}) },
+			errMsg: "function 0: tag 'VERS': 2 bytes is not 8",
+		},
+		{
+			name: "missing end",
+			data: func() []byte {
+				data := buildMetallib(metallibKernel("square"))
+				copy(data[len(data)-4:], "ENDX")
+				return data
+			},
+			errMsg: "function 0: tag 'ENDX': missing length",
+		},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			_, err := ReadLibraryInfo(subtest.data())
+			require.EqualError(t, err, subtest.errMsg)
+		})
+	}
+}
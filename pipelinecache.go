@@ -0,0 +1,381 @@
+package metal
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Pipeline cache
+// ----------------------------------------------------------------------------
+
+// PipelineCacheOptions configure the on-disk cache of compiled pipelines that SetPipelineCache
+// enables.
+type PipelineCacheOptions struct {
+	// Dir is the directory that the cache is kept in, which is created if it does not exist.
+	// Processes that use the same directory share its pipelines. DefaultPipelineCacheDir returns a
+	// directory in the user's cache directory. An empty Dir disables the cache.
+	Dir string
+	// MaxBytes is the most disk space that the cached pipelines may take up. When a new pipeline
+	// takes the cache past it, the least recently used pipelines are removed until it fits again. A
+	// value of 0 or less uses 256 MiB.
+	MaxBytes int64
+}
+
+// defaultPipelineCacheBytes is the size of the pipeline cache when PipelineCacheOptions.MaxBytes
+// is not set.
+const defaultPipelineCacheBytes = 256 << 20
+
+// pipelineCacheVersion is part of every key, so that a change to how pipelines are cached does not
+// read the entries that an older version wrote.
+const pipelineCacheVersion = "1"
+
+// DefaultPipelineCacheDir returns the directory that the pipeline cache is conventionally kept in:
+// green-aloe-metal in the directory that os.UserCacheDir returns.
+func DefaultPipelineCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "green-aloe-metal"), nil
+}
+
+// SetPipelineCache enables a cache of compiled pipelines on disk, so that NewFunction and
+// NewFunctionWithOptions do not compile the same pipeline again in a later run. Pipelines are
+// cached as Metal binary archives, keyed by a hash of the source, the function name, the compile
+// options, and the GPU and system that compiled them. A cached pipeline that cannot be used, such
+// as one that is corrupt or was compiled by an older system, is compiled again instead, and cached
+// afresh the next time that it is needed.
+//
+// The cache is off until SetPipelineCache is called, and calling it with an empty Dir turns it off
+// again. Problems with the cache never keep a function from being set up: it is compiled without
+// the cache instead. The cache has no effect on the CPU backend, or before macOS 11, which has no
+// binary archives. Functions set up from a Library are not cached. It is safe for concurrent use,
+// and a function being set up keeps the cache it started with.
+func SetPipelineCache(opts PipelineCacheOptions) error {
+	if opts.Dir == "" {
+		activePipelineCache.Store(nil)
+		return nil
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return fmt.Errorf("unable to set up pipeline cache: %w", err)
+	}
+	activePipelineCache.Store(newPipelineCache(opts))
+
+	return nil
+}
+
+// activePipelineCache holds the cache set by SetPipelineCache, or nil if there is none.
+var activePipelineCache atomic.Pointer[pipelineCache]
+
+// pipelineKey returns the key that the pipeline for funcName in source, compiled with opts on the
+// device described by device, is cached under: the hex-encoded SHA-256 hash of each of them. Each
+// field is prefixed with its length, so that no two sets of fields hash the same bytes.
+func pipelineKey(source, funcName string, opts *CompileOptions, device string) string {
+	h := sha256.New()
+	for _, field := range []string{pipelineCacheVersion, source, funcName, opts.key(), device} {
+		h.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(field))))
+		h.Write([]byte(field))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// An archiveStatus reports what the C layer did with the binary archives that it was given for a
+// new pipeline. These must stay in sync with enum PipelineArchiveStatus in Metal.h.
+type archiveStatus int
+
+const (
+	// archiveNone means that no archive was used: the pipeline was compiled, and could not be
+	// stored.
+	archiveNone archiveStatus = 0
+	// archiveLoaded means that the pipeline was loaded from the cached archive.
+	archiveLoaded archiveStatus = 1
+	// archiveStored means that the pipeline was compiled and stored in a new archive.
+	archiveStored archiveStatus = 2
+)
+
+// A pipelineCache is a directory of binary archives, each holding one compiled pipeline, with an
+// index of their sizes and when they were last used. The index is shared with other processes, so
+// it is read and written only while its lock file is held.
+type pipelineCache struct {
+	dir      string
+	maxBytes int64
+	lock     fileLock
+	// now returns the current time. Tests replace it to order entries.
+	now func() time.Time
+	// mu keeps the goroutines of this process from waiting on each other through the lock file.
+	mu sync.Mutex
+}
+
+// A pipelineIndex is the contents of a pipeline cache's index file.
+type pipelineIndex struct {
+	Entries map[string]pipelineEntry `json:"entries"`
+}
+
+// A pipelineEntry describes one cached pipeline.
+type pipelineEntry struct {
+	// Size is the size of the pipeline's archive, in bytes.
+	Size int64 `json:"size"`
+	// LastUsed is when the pipeline was last stored or loaded, in nanoseconds since the Unix epoch.
+	LastUsed int64 `json:"lastUsed"`
+}
+
+const (
+	pipelineIndexFile  = "index.json"
+	pipelineLockFile   = "index.lock"
+	pipelineArchiveExt = ".metalarchive"
+	pipelineTempExt    = ".tmp"
+)
+
+// pipelineTempAge is how old a temporary file in the cache's directory must be before sweep takes it
+// to have been left behind. A temporary file is only written while a pipeline is being stored, which
+// takes far less time than this.
+const pipelineTempAge = 10 * time.Minute
+
+// newPipelineCache returns the cache described by opts, whose Dir must exist.
+func newPipelineCache(opts PipelineCacheOptions) *pipelineCache {
+	maxBytes := opts.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultPipelineCacheBytes
+	}
+
+	return &pipelineCache{
+		dir:      opts.Dir,
+		maxBytes: maxBytes,
+		lock:     fileLock{path: filepath.Join(opts.Dir, pipelineLockFile), timeout: 5 * time.Second, stale: 30 * time.Second},
+		now:      time.Now,
+	}
+}
+
+// path returns the path of the archive for key.
+func (c *pipelineCache) path(key string) string {
+	return filepath.Join(c.dir, key+pipelineArchiveExt)
+}
+
+// begin prepares to set up the pipeline cached under key. It returns the path of the cached archive
+// to load the pipeline from, or if there is none, a new path that the pipeline can be stored at once
+// it is compiled. The file at that path is not created until the pipeline is stored, so that sweep
+// does not take a slow compile's file for one that was left behind. A cached archive that turns out
+// to be unusable is removed by finish, so the pipeline is stored again the next time it is set up.
+// The result must be passed to finish.
+func (c *pipelineCache) begin(key string) (archiveIn, archiveOut string) {
+	if archiveIn, ok := c.lookup(key); ok {
+		return archiveIn, ""
+	}
+
+	return "", filepath.Join(c.dir, key+"-"+rand.Text()+pipelineTempExt)
+}
+
+// finish records what became of the archives that begin returned for key.
+func (c *pipelineCache) finish(key, archiveIn, archiveOut string, status archiveStatus) {
+	switch {
+	case status == archiveStored && archiveOut != "":
+		if c.store(key, archiveOut) == nil {
+			return
+		}
+	case status == archiveNone && archiveIn != "":
+		// The cached archive could not be used, and nothing replaced it.
+		c.remove(key)
+	}
+
+	if archiveOut != "" {
+		os.Remove(archiveOut)
+	}
+}
+
+// lookup returns the path of the archive cached under key, and marks it as used. It reports false
+// if there is no such archive, or if its file is missing or is not the size that was recorded.
+func (c *pipelineCache) lookup(key string) (string, bool) {
+	var path string
+	err := c.update(func(idx *pipelineIndex) {
+		entry, ok := idx.Entries[key]
+		if !ok {
+			return
+		}
+		info, err := os.Stat(c.path(key))
+		if err != nil || info.Size() != entry.Size {
+			delete(idx.Entries, key)
+			os.Remove(c.path(key))
+			return
+		}
+
+		entry.LastUsed = c.now().UnixNano()
+		idx.Entries[key] = entry
+		path = c.path(key)
+	})
+
+	return path, err == nil && path != ""
+}
+
+// store moves the archive at tmp into the cache under key and then removes the least recently used
+// archives until the cache fits in its size limit again.
+func (c *pipelineCache) store(key, tmp string) error {
+	return c.update(func(idx *pipelineIndex) {
+		info, err := os.Stat(tmp)
+		if err != nil || os.Rename(tmp, c.path(key)) != nil {
+			return
+		}
+		now := c.now()
+		idx.Entries[key] = pipelineEntry{Size: info.Size(), LastUsed: now.UnixNano()}
+		c.evict(idx, now)
+	})
+}
+
+// remove removes the archive cached under key.
+func (c *pipelineCache) remove(key string) {
+	c.update(func(idx *pipelineIndex) {
+		delete(idx.Entries, key)
+		os.Remove(c.path(key))
+	})
+}
+
+// evict removes the least recently used archives in idx until their total size is at most the
+// cache's limit, and sweeps away temporary files that are stale at now.
+func (c *pipelineCache) evict(idx *pipelineIndex, now time.Time) {
+	c.sweep(now)
+
+	var total int64
+	keys := make([]string, 0, len(idx.Entries))
+	for key, entry := range idx.Entries {
+		total += entry.Size
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(cmp.Compare(idx.Entries[a].LastUsed, idx.Entries[b].LastUsed), strings.Compare(a, b))
+	})
+
+	for _, key := range keys {
+		if total <= c.maxBytes {
+			break
+		}
+		total -= idx.Entries[key].Size
+		delete(idx.Entries, key)
+		os.Remove(c.path(key))
+	}
+}
+
+// sweep removes the temporary files in the cache's directory that are older than pipelineTempAge
+// at now. They were left behind by a process that exited, or failed, before it could move its
+// pipeline into the cache; a process that is still storing one wrote its file more recently.
+func (c *pipelineCache) sweep(now time.Time) {
+	entries, _ := os.ReadDir(c.dir)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), pipelineTempExt) || !e.Type().IsRegular() {
+			continue
+		}
+		if info, err := e.Info(); err == nil && now.Sub(info.ModTime()) > pipelineTempAge {
+			os.Remove(filepath.Join(c.dir, e.Name()))
+		}
+	}
+}
+
+// update calls f with the cache's index while holding its lock, and then writes the index back.
+func (c *pipelineCache) update(f func(idx *pipelineIndex)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	unlock, err := c.lock.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	idx := c.readIndex()
+	f(idx)
+	return c.writeIndex(idx)
+}
+
+// readIndex reads the cache's index. If the index is missing or cannot be decoded, it is rebuilt
+// from the archives in the directory, each of which is treated as last used when its file was last
+// modified.
+func (c *pipelineCache) readIndex() *pipelineIndex {
+	idx := &pipelineIndex{}
+	data, err := os.ReadFile(filepath.Join(c.dir, pipelineIndexFile))
+	if err == nil && json.Unmarshal(data, idx) == nil && idx.Entries != nil {
+		return idx
+	}
+
+	idx.Entries = make(map[string]pipelineEntry)
+	entries, _ := os.ReadDir(c.dir)
+	for _, e := range entries {
+		key, ok := strings.CutSuffix(e.Name(), pipelineArchiveExt)
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			idx.Entries[key] = pipelineEntry{Size: info.Size(), LastUsed: info.ModTime().UnixNano()}
+		}
+	}
+	return idx
+}
+
+// writeIndex replaces the cache's index with idx. The index is written to a temporary file that is
+// then renamed over it, so that a reader never sees part of it.
+func (c *pipelineCache) writeIndex(idx *pipelineIndex) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(c.dir, pipelineIndexFile+pipelineTempExt)
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(c.dir, pipelineIndexFile))
+}
+
+// errLockTimeout is returned when a fileLock cannot be acquired in time.
+var errLockTimeout = errors.New("timed out waiting for lock")
+
+// A fileLock is a lock shared between processes: it is held by whichever process creates its file,
+// until that process removes the file again.
+type fileLock struct {
+	path string
+	// timeout is how long lock waits for the lock before giving up.
+	timeout time.Duration
+	// stale is how old a lock file must be before it is taken to have been left behind by a process
+	// that exited while holding it, and is removed.
+	stale time.Duration
+}
+
+// lockRetryInterval is how often a waiting fileLock tries to acquire the lock again.
+const lockRetryInterval = 10 * time.Millisecond
+
+// lock acquires the lock, waiting for up to l.timeout, and returns a function that releases it.
+func (l fileLock) lock() (func(), error) {
+	deadline := time.Now().Add(l.timeout)
+	for {
+		f, err := os.OpenFile(l.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(l.path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(l.path); err == nil && time.Since(info.ModTime()) > l.stale {
+			os.Remove(l.path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errLockTimeout
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
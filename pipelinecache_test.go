@@ -0,0 +1,307 @@
+package metal
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_pipelineKey tests that a pipeline's key changes with everything that changes the pipeline.
+func Test_pipelineKey(t *testing.T) {
+	opts := &CompileOptions{PreprocessorMacros: map[string]string{"N": "1"}}
+	key := pipelineKey("source", "k", opts, "GPU; macOS 15")
+	require.Len(t, key, 64)
+	require.Equal(t, key, pipelineKey("source", "k", opts.clone(), "GPU; macOS 15"))
+
+	// A nil and a zero set of options compile the same pipeline.
+	require.Equal(t, pipelineKey("source", "k", nil, "GPU"), pipelineKey("source", "k", &CompileOptions{}, "GPU"))
+
+	keys := map[string]bool{key: true}
+	for _, other := range []string{
+		pipelineKey("source ", "k", opts, "GPU; macOS 15"),
+		pipelineKey("source", "k2", opts, "GPU; macOS 15"),
+		pipelineKey("source", "k", &CompileOptions{PreprocessorMacros: map[string]string{"N": "2"}}, "GPU; macOS 15"),
+		pipelineKey("source", "k", opts, "GPU; macOS 15.1"),
+		// The fields are delimited, so moving bytes between them changes the key.
+		pipelineKey("sourcek", "", opts, "GPU; macOS 15"),
+	} {
+		require.False(t, keys[other])
+		keys[other] = true
+	}
+}
+
+// newTestPipelineCache returns a cache in a new directory whose clock advances by a second every
+// time it is read.
+func newTestPipelineCache(t *testing.T, maxBytes int64) *pipelineCache {
+	t.Helper()
+
+	c := newPipelineCache(PipelineCacheOptions{Dir: t.TempDir(), MaxBytes: maxBytes})
+	clock := time.Unix(1_700_000_000, 0)
+	c.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	return c
+}
+
+// storeArchive stores an archive of size bytes under key, as the C layer would after compiling a
+// pipeline.
+func storeArchive(t *testing.T, c *pipelineCache, key string, size int) {
+	t.Helper()
+
+	in, out := c.begin(key)
+	require.Empty(t, in)
+	require.NotEmpty(t, out)
+	require.NoFileExists(t, out)
+	require.NoError(t, os.WriteFile(out, make([]byte, size), 0o644))
+	c.finish(key, in, out, archiveStored)
+}
+
+// tempFiles returns the paths of the temporary files in the cache's directory.
+func tempFiles(t *testing.T, c *pipelineCache) []string {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*"+pipelineTempExt))
+	require.NoError(t, err)
+	return paths
+}
+
+// cachedKeys returns the keys in the cache's index.
+func cachedKeys(c *pipelineCache) []string {
+	var keys []string
+	for key := range c.readIndex().Entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Test_pipelineCache tests that archives are stored, found again, and replaced when they cannot be
+// used.
+func Test_pipelineCache(t *testing.T) {
+	c := newTestPipelineCache(t, 1000)
+
+	storeArchive(t, c, "a", 10)
+	require.FileExists(t, c.path("a"))
+	require.Equal(t, map[string]pipelineEntry{"a": {Size: 10, LastUsed: time.Unix(1_700_000_001, 0).UnixNano()}}, c.readIndex().Entries)
+
+	t.Run("loaded", func(t *testing.T) {
+		in, out := c.begin("a")
+		require.Equal(t, c.path("a"), in)
+		require.Empty(t, out)
+		require.Empty(t, tempFiles(t, c))
+		c.finish("a", in, out, archiveLoaded)
+		require.FileExists(t, c.path("a"))
+		require.Equal(t, time.Unix(1_700_000_002, 0).UnixNano(), c.readIndex().Entries["a"].LastUsed)
+	})
+
+	t.Run("replaced", func(t *testing.T) {
+		// The cached archive was stale, so the pipeline was compiled and the archive removed. The
+		// next time, the pipeline is compiled and stored again.
+		in, out := c.begin("a")
+		require.NotEmpty(t, in)
+		c.finish("a", in, out, archiveNone)
+		require.Empty(t, cachedKeys(c))
+
+		in, out = c.begin("a")
+		require.Empty(t, in)
+		require.NoError(t, os.WriteFile(out, make([]byte, 20), 0o644))
+		c.finish("a", in, out, archiveStored)
+		require.NoFileExists(t, out)
+		require.Equal(t, int64(20), c.readIndex().Entries["a"].Size)
+	})
+
+	t.Run("unusable", func(t *testing.T) {
+		// The cached archive could not be used and no new one was stored.
+		in, out := c.begin("a")
+		require.NotEmpty(t, in)
+		c.finish("a", in, out, archiveNone)
+		require.NoFileExists(t, c.path("a"))
+		require.Empty(t, cachedKeys(c))
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		storeArchive(t, c, "b", 10)
+		require.NoError(t, os.WriteFile(c.path("b"), make([]byte, 5), 0o644))
+		in, out := c.begin("b")
+		require.Empty(t, in)
+		c.finish("b", in, out, archiveNone)
+		require.NoFileExists(t, c.path("b"))
+		require.Empty(t, cachedKeys(c))
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		storeArchive(t, c, "c", 10)
+		require.NoError(t, os.Remove(c.path("c")))
+		_, ok := c.lookup("c")
+		require.False(t, ok)
+		require.Empty(t, cachedKeys(c))
+	})
+}
+
+// Test_pipelineCache_evict tests that the least recently used archives are removed to keep the
+// cache within its size limit.
+func Test_pipelineCache_evict(t *testing.T) {
+	c := newTestPipelineCache(t, 100)
+
+	storeArchive(t, c, "a", 40)
+	storeArchive(t, c, "b", 40)
+	_, ok := c.lookup("a")
+	require.True(t, ok)
+
+	// b is now the least recently used, so it makes room for c.
+	storeArchive(t, c, "c", 40)
+	require.ElementsMatch(t, []string{"a", "c"}, cachedKeys(c))
+	require.NoFileExists(t, c.path("b"))
+
+	// An archive larger than the whole cache is not kept.
+	storeArchive(t, c, "d", 101)
+	require.Empty(t, cachedKeys(c))
+	require.NoFileExists(t, c.path("d"))
+
+	storeArchive(t, c, "e", 100)
+	require.Equal(t, []string{"e"}, cachedKeys(c))
+
+	require.Equal(t, int64(defaultPipelineCacheBytes), newPipelineCache(PipelineCacheOptions{Dir: t.TempDir()}).maxBytes)
+}
+
+// Test_pipelineCache_sweep tests that temporary files left behind by a process that did not store
+// its pipeline are removed once they are older than pipelineTempAge, by the cache's clock, and that
+// newer ones are kept even once they are older than a stale lock.
+func Test_pipelineCache_sweep(t *testing.T) {
+	c := newTestPipelineCache(t, 1000)
+
+	stale := filepath.Join(c.dir, "a-1"+pipelineTempExt)
+	fresh := filepath.Join(c.dir, "b-2"+pipelineTempExt)
+	require.NoError(t, os.WriteFile(stale, nil, 0o644))
+	require.NoError(t, os.WriteFile(fresh, nil, 0o644))
+	now := c.now()
+	staleTime, freshTime := now.Add(-2*pipelineTempAge), now.Add(-2*c.lock.stale)
+	require.NoError(t, os.Chtimes(stale, staleTime, staleTime))
+	require.NoError(t, os.Chtimes(fresh, freshTime, freshTime))
+
+	storeArchive(t, c, "c", 10)
+	require.NoFileExists(t, stale)
+	require.FileExists(t, fresh)
+	require.Equal(t, []string{fresh}, tempFiles(t, c))
+}
+
+// Test_pipelineCache_readIndex tests that a corrupt index is rebuilt from the archives in the
+// directory.
+func Test_pipelineCache_readIndex(t *testing.T) {
+	c := newTestPipelineCache(t, 1000)
+	storeArchive(t, c, "a", 10)
+	storeArchive(t, c, "b", 20)
+
+	modTime := time.Unix(1_600_000_000, 0)
+	require.NoError(t, os.Chtimes(c.path("b"), modTime, modTime))
+	require.NoError(t, os.WriteFile(filepath.Join(c.dir, pipelineIndexFile), []byte("{not json"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(c.dir, "a-123.tmp"), nil, 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(c.dir, "dir"+pipelineArchiveExt), 0o755))
+
+	idx := c.readIndex()
+	require.Len(t, idx.Entries, 2)
+	require.Equal(t, int64(10), idx.Entries["a"].Size)
+	require.Equal(t, pipelineEntry{Size: 20, LastUsed: modTime.UnixNano()}, idx.Entries["b"])
+
+	in, out := c.begin("b")
+	require.Equal(t, c.path("b"), in)
+	c.finish("b", in, out, archiveLoaded)
+
+	// The rebuilt index was written back.
+	data, err := os.ReadFile(filepath.Join(c.dir, pipelineIndexFile))
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"entries"`)
+}
+
+// Test_fileLock tests that a file lock is held by one holder at a time, times out, and is taken
+// over once it is stale.
+func Test_fileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+	l := fileLock{path: path, timeout: time.Second, stale: time.Minute}
+
+	unlock, err := l.lock()
+	require.NoError(t, err)
+	require.FileExists(t, path)
+
+	short := l
+	short.timeout = 30 * time.Millisecond
+	_, err = short.lock()
+	require.ErrorIs(t, err, errLockTimeout)
+
+	unlock()
+	require.NoFileExists(t, path)
+
+	// A lock file left behind by a holder that exited long ago is removed.
+	require.NoError(t, os.WriteFile(path, nil, 0o644))
+	old := time.Now().Add(-2 * time.Minute)
+	require.NoError(t, os.Chtimes(path, old, old))
+	unlock, err = short.lock()
+	require.NoError(t, err)
+	unlock()
+
+	// Holders exclude each other.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	held, maxHeld := 0, 0
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := l.lock()
+			mu.Lock()
+			if err != nil {
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			held++
+			maxHeld = max(maxHeld, held)
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			held--
+			mu.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+	require.Empty(t, errs)
+	require.Equal(t, 1, maxHeld)
+
+	_, err = fileLock{path: filepath.Join(path, "missing", "x.lock"), timeout: time.Second}.lock()
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errLockTimeout)
+}
+
+// Test_SetPipelineCache tests that the pipeline cache is enabled and disabled.
+func Test_SetPipelineCache(t *testing.T) {
+	t.Cleanup(func() { activePipelineCache.Store(nil) })
+
+	dir := filepath.Join(t.TempDir(), "nested", "cache")
+	require.NoError(t, SetPipelineCache(PipelineCacheOptions{Dir: dir, MaxBytes: 1 << 20}))
+	require.DirExists(t, dir)
+	c := activePipelineCache.Load()
+	require.NotNil(t, c)
+	require.Equal(t, dir, c.dir)
+	require.Equal(t, int64(1<<20), c.maxBytes)
+
+	require.NoError(t, SetPipelineCache(PipelineCacheOptions{}))
+	require.Nil(t, activePipelineCache.Load())
+
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o644))
+	err := SetPipelineCache(PipelineCacheOptions{Dir: filepath.Join(file, "cache")})
+	require.ErrorContains(t, err, "unable to set up pipeline cache")
+	require.Nil(t, activePipelineCache.Load())
+
+	if dir, err := DefaultPipelineCacheDir(); err == nil {
+		require.Equal(t, "green-aloe-metal", filepath.Base(dir))
+	}
+}
@@ -0,0 +1,276 @@
+package metal
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"sync"
+	"unsafe"
+)
+
+// ----------------------------------------------------------------------------
+// Buffer pool
+// ----------------------------------------------------------------------------
+
+const (
+	// minPoolClass is the smallest size class, in bytes. Smaller requests share it.
+	minPoolClass = 64
+	// maxPoolClass is the largest size class, in bytes. The next power of two is past the limit on
+	// a single buffer, so larger requests are allocated exactly and never pooled.
+	maxPoolClass = 1 << 30
+)
+
+// PoolOptions set the high-water marks of a BufferPool: how much memory it may keep in reserve. A
+// buffer that is closed while its pool is at a mark is freed instead of being kept. A value of 0 or
+// less means no limit.
+type PoolOptions struct {
+	// MaxBytes is the most memory, in bytes, that the pool keeps in idle buffers.
+	MaxBytes int
+	// MaxBuffersPerClass is the most idle buffers that the pool keeps in each size class.
+	MaxBuffersPerClass int
+}
+
+// PoolStats report the activity of a BufferPool.
+type PoolStats struct {
+	// Hits is the number of buffers that were handed out from the pool's reserve.
+	Hits int
+	// Misses is the number of buffers that had to be allocated because the reserve held none of the
+	// right size.
+	Misses int
+	// Releases is the number of buffers that were freed instead of being kept, because the pool was
+	// at a high-water mark or trimmed, or because they were too large to pool.
+	Releases int
+	// BytesRetained is the memory, in bytes, currently held in idle buffers.
+	BytesRetained int
+	// BuffersRetained is the number of idle buffers currently held.
+	BuffersRetained int
+}
+
+// A BufferPool reuses buffers to avoid the cost of allocating and freeing them one at a time. It
+// keeps closed buffers in power-of-two size classes and hands them out again from Get, so code that
+// creates and closes many short-lived buffers allocates only as many as are open at once.
+//
+// A BufferPool is safe for concurrent use.
+type BufferPool struct {
+	mu     sync.Mutex
+	policy poolPolicy
+	closed bool
+}
+
+// NewBufferPool returns an empty pool with the given high-water marks.
+func NewBufferPool(opts PoolOptions) *BufferPool {
+	return &BufferPool{policy: newPoolPolicy(opts)}
+}
+
+// Get returns a buffer of length elements from pool. It reuses an idle buffer of the right size
+// class if there is one and allocates a new one otherwise. Like one from NewBuffer, the buffer
+// holds zeros.
+//
+// Closing the buffer returns it to the pool rather than freeing it. Its Id and slice then become
+// invalid as for any closed Buffer, and the next Get of the same size class may hand out the same
+// memory under the same Id. Close the Buffer rather than its Id: closing the Id returns
+// ErrInvalidBufferId, since the memory belongs to the pool.
+//
+// The buffer holds length elements even though its memory is a whole size class, so ranges of it
+// and the CPU backend are checked against the length that was asked for, as for NewBuffer.
+func Get[T BufferType](pool *BufferPool, length int) (*Buffer[T], error) {
+	if pool == nil {
+		return nil, errors.New("nil buffer pool")
+	}
+	if length < 1 {
+		return nil, errors.New("invalid width")
+	}
+	if length > math.MaxInt32/sizeof[T]() {
+		return nil, errors.New("exceeded maximum number of bytes")
+	}
+	numBytes := length * sizeof[T]()
+
+	raw, err := pool.get(numBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	slice := unsafe.Slice((*T)(raw.contents), length)
+	clear(slice)
+	registerBuffer(BufferId(raw.id), slice, raw.contents, numBytes, true)
+
+	return &Buffer[T]{id: BufferId(raw.id), slice: slice, pool: pool, raw: raw}, nil
+}
+
+// get returns an idle buffer that can hold numBytes, or allocates one.
+func (p *BufferPool) get(numBytes int) (pooledBuffer, error) {
+	b := bufferBackend()
+	if err := b.available(); err != nil {
+		return pooledBuffer{}, err
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return pooledBuffer{}, errors.New("buffer pool is closed")
+	}
+	raw, ok := p.policy.get(numBytes)
+	p.mu.Unlock()
+	if ok {
+		return raw, nil
+	}
+
+	size := numBytes
+	if class, ok := sizeClass(numBytes); ok {
+		size = class
+	}
+	id, contents, err := b.newBuffer(size)
+	if err != nil {
+		return pooledBuffer{}, err
+	}
+
+	return pooledBuffer{id: id, contents: contents, numBytes: size}, nil
+}
+
+// put takes back a buffer that was handed out by get, keeping it for reuse or freeing it.
+func (p *BufferPool) put(raw pooledBuffer) error {
+	p.mu.Lock()
+	var released []pooledBuffer
+	if p.closed {
+		released = []pooledBuffer{raw}
+	} else {
+		released = p.policy.put(raw)
+	}
+	p.mu.Unlock()
+
+	return freePooled(released)
+}
+
+// Trim frees every idle buffer that the pool holds. Buffers that are open are not affected, and
+// return to the pool as usual when they are closed.
+func (p *BufferPool) Trim() error {
+	p.mu.Lock()
+	released := p.policy.trim()
+	p.mu.Unlock()
+
+	return freePooled(released)
+}
+
+// Stats returns the pool's activity so far.
+func (p *BufferPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.policy.stats
+}
+
+// Close frees every idle buffer, like Trim, and stops the pool from keeping or handing out buffers.
+// Buffers that are still open are freed when they are closed.
+func (p *BufferPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	released := p.policy.trim()
+	p.mu.Unlock()
+
+	return freePooled(released)
+}
+
+// freePooled frees buffers that the pool has let go of, returning the first error.
+func freePooled(released []pooledBuffer) error {
+	var firstErr error
+	for _, raw := range released {
+		if err := bufferBackend().closeBuffer(raw.id); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// ----------------------------------------------------------------------------
+// Pool policy
+// ----------------------------------------------------------------------------
+
+// A pooledBuffer is a backend buffer owned by a pool: its id and memory, and its size, which is a
+// size class unless the buffer is too large to pool.
+type pooledBuffer struct {
+	id       int32
+	contents unsafe.Pointer
+	numBytes int
+}
+
+// A poolPolicy decides which buffers a pool keeps and which one it hands out. It holds the idle
+// buffers but never allocates or frees one itself: get and put report what the caller must do, so
+// the policy can be tested without a backend. It is not safe for concurrent use.
+type poolPolicy struct {
+	opts  PoolOptions
+	free  map[int][]pooledBuffer
+	stats PoolStats
+}
+
+// newPoolPolicy returns a policy with no idle buffers.
+func newPoolPolicy(opts PoolOptions) poolPolicy {
+	return poolPolicy{opts: opts, free: make(map[int][]pooledBuffer)}
+}
+
+// get hands out the most recently kept idle buffer of the size class for numBytes, or reports a
+// miss, in which case the caller allocates a new buffer.
+func (p *poolPolicy) get(numBytes int) (pooledBuffer, bool) {
+	class, ok := sizeClass(numBytes)
+	if !ok || len(p.free[class]) == 0 {
+		p.stats.Misses++
+		return pooledBuffer{}, false
+	}
+
+	n := len(p.free[class])
+	raw := p.free[class][n-1]
+	p.free[class] = p.free[class][:n-1]
+
+	p.stats.Hits++
+	p.stats.BytesRetained -= raw.numBytes
+	p.stats.BuffersRetained--
+
+	return raw, true
+}
+
+// put keeps raw for reuse unless that would take the pool past a high-water mark, or raw is too
+// large to pool. It returns the buffers that the caller must free.
+func (p *poolPolicy) put(raw pooledBuffer) []pooledBuffer {
+	class, ok := sizeClass(raw.numBytes)
+	switch {
+	case !ok || class != raw.numBytes,
+		p.opts.MaxBuffersPerClass > 0 && len(p.free[class]) >= p.opts.MaxBuffersPerClass,
+		p.opts.MaxBytes > 0 && p.stats.BytesRetained+raw.numBytes > p.opts.MaxBytes:
+		p.stats.Releases++
+		return []pooledBuffer{raw}
+	}
+
+	p.free[class] = append(p.free[class], raw)
+	p.stats.BytesRetained += raw.numBytes
+	p.stats.BuffersRetained++
+
+	return nil
+}
+
+// trim gives up every idle buffer and returns them for the caller to free.
+func (p *poolPolicy) trim() []pooledBuffer {
+	var released []pooledBuffer
+	for class, free := range p.free {
+		released = append(released, free...)
+		delete(p.free, class)
+	}
+
+	p.stats.Releases += len(released)
+	p.stats.BytesRetained = 0
+	p.stats.BuffersRetained = 0
+
+	return released
+}
+
+// sizeClass returns the size class for a buffer of numBytes: the smallest power of two that is at
+// least numBytes and minPoolClass. It reports false if numBytes is too large to pool.
+func sizeClass(numBytes int) (int, bool) {
+	if numBytes > maxPoolClass {
+		return 0, false
+	}
+	if numBytes <= minPoolClass {
+		return minPoolClass, true
+	}
+
+	return 1 << bits.Len(uint(numBytes-1)), true
+}
@@ -0,0 +1,108 @@
+package metal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sizeClass(t *testing.T) {
+	type subtest struct {
+		numBytes int
+		class    int
+		ok       bool
+	}
+
+	subtests := []subtest{
+		{numBytes: 1, class: 64, ok: true},
+		{numBytes: 64, class: 64, ok: true},
+		{numBytes: 65, class: 128, ok: true},
+		{numBytes: 4000, class: 4096, ok: true},
+		{numBytes: 4096, class: 4096, ok: true},
+		{numBytes: 1 << 30, class: 1 << 30, ok: true},
+		{numBytes: 1<<30 + 1, ok: false},
+	}
+
+	for _, subtest := range subtests {
+		class, ok := sizeClass(subtest.numBytes)
+		require.Equal(t, subtest.ok, ok, subtest.numBytes)
+		require.Equal(t, subtest.class, class, subtest.numBytes)
+	}
+}
+
+// Test_poolPolicy tests which buffers a pool keeps and hands out, without a backend.
+func Test_poolPolicy(t *testing.T) {
+	raw := func(id int32, numBytes int) pooledBuffer {
+		return pooledBuffer{id: id, numBytes: numBytes}
+	}
+
+	t.Run("reuse", func(t *testing.T) {
+		p := newPoolPolicy(PoolOptions{})
+
+		_, ok := p.get(100)
+		require.False(t, ok)
+
+		require.Empty(t, p.put(raw(1, 128)))
+		require.Empty(t, p.put(raw(2, 128)))
+		require.Empty(t, p.put(raw(3, 64)))
+		require.Equal(t, PoolStats{Misses: 1, BytesRetained: 320, BuffersRetained: 3}, p.stats)
+
+		// The most recently kept buffer of the class is handed out first.
+		b, ok := p.get(65)
+		require.True(t, ok)
+		require.Equal(t, raw(2, 128), b)
+		b, ok = p.get(128)
+		require.True(t, ok)
+		require.Equal(t, raw(1, 128), b)
+		_, ok = p.get(100)
+		require.False(t, ok)
+		b, ok = p.get(8)
+		require.True(t, ok)
+		require.Equal(t, raw(3, 64), b)
+
+		require.Equal(t, PoolStats{Hits: 3, Misses: 2}, p.stats)
+	})
+
+	t.Run("max bytes", func(t *testing.T) {
+		p := newPoolPolicy(PoolOptions{MaxBytes: 256})
+
+		require.Empty(t, p.put(raw(1, 128)))
+		require.Empty(t, p.put(raw(2, 64)))
+		require.Equal(t, []pooledBuffer{raw(3, 128)}, p.put(raw(3, 128)))
+		require.Empty(t, p.put(raw(4, 64)))
+		require.Equal(t, PoolStats{Releases: 1, BytesRetained: 256, BuffersRetained: 3}, p.stats)
+	})
+
+	t.Run("max buffers per class", func(t *testing.T) {
+		p := newPoolPolicy(PoolOptions{MaxBuffersPerClass: 2})
+
+		require.Empty(t, p.put(raw(1, 64)))
+		require.Empty(t, p.put(raw(2, 64)))
+		require.Equal(t, []pooledBuffer{raw(3, 64)}, p.put(raw(3, 64)))
+		require.Empty(t, p.put(raw(4, 128)))
+		require.Equal(t, PoolStats{Releases: 1, BytesRetained: 256, BuffersRetained: 3}, p.stats)
+	})
+
+	t.Run("unpooled size", func(t *testing.T) {
+		p := newPoolPolicy(PoolOptions{})
+
+		_, ok := p.get(1<<30 + 1)
+		require.False(t, ok)
+		require.Equal(t, []pooledBuffer{raw(1, 1<<30+1)}, p.put(raw(1, 1<<30+1)))
+		require.Equal(t, PoolStats{Misses: 1, Releases: 1}, p.stats)
+	})
+
+	t.Run("trim", func(t *testing.T) {
+		p := newPoolPolicy(PoolOptions{})
+
+		require.Empty(t, p.put(raw(1, 64)))
+		require.Empty(t, p.put(raw(2, 128)))
+		require.Empty(t, p.put(raw(3, 128)))
+		require.ElementsMatch(t, []pooledBuffer{raw(1, 64), raw(2, 128), raw(3, 128)}, p.trim())
+		require.Equal(t, PoolStats{Releases: 3}, p.stats)
+
+		_, ok := p.get(64)
+		require.False(t, ok)
+		require.Empty(t, p.trim())
+	})
+}
@@ -0,0 +1,116 @@
+package metal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/green-aloe/metal/internal/msl"
+)
+
+// ----------------------------------------------------------------------------
+// Typed scalar inputs
+// ----------------------------------------------------------------------------
+
+// A Scalar is a typed static input for a metal function, for use in RunParameters.Scalars. Create
+// one with Int32, Uint32, Float32, Int16, Uint16, or Half. The kernel receives it with the byte
+// width and encoding of its Metal type, so an integer parameter reads the integer itself rather than
+// the bits of a float32.
+//
+// The zero Scalar is not valid.
+type Scalar struct {
+	typ  msl.Scalar
+	bits uint32
+}
+
+// Int32 returns a Scalar for a Metal int.
+func Int32(v int32) Scalar {
+	return Scalar{typ: msl.Int, bits: uint32(v)}
+}
+
+// Uint32 returns a Scalar for a Metal uint.
+func Uint32(v uint32) Scalar {
+	return Scalar{typ: msl.UInt, bits: v}
+}
+
+// Float32 returns a Scalar for a Metal float.
+func Float32(v float32) Scalar {
+	return Scalar{typ: msl.Float, bits: math.Float32bits(v)}
+}
+
+// Int16 returns a Scalar for a Metal short.
+func Int16(v int16) Scalar {
+	return Scalar{typ: msl.Short, bits: uint32(uint16(v))}
+}
+
+// Uint16 returns a Scalar for a Metal ushort.
+func Uint16(v uint16) Scalar {
+	return Scalar{typ: msl.UShort, bits: uint32(v)}
+}
+
+// Half returns a Scalar for a Metal half. Go has no 16-bit float, so v is rounded to the nearest
+// half, with ties to even; values too large for a half become infinities.
+func Half(v float32) Scalar {
+	return Scalar{typ: msl.Half, bits: uint32(msl.HalfFromFloat32(v))}
+}
+
+// Type returns the name of the scalar's Metal type, such as "int" or "half".
+func (s Scalar) Type() string {
+	return s.typ.String()
+}
+
+// Size returns the number of bytes the scalar occupies in the kernel's argument.
+func (s Scalar) Size() int {
+	return s.typ.Size()
+}
+
+// String returns the scalar's value and Metal type, such as "5 (uint)".
+func (s Scalar) String() string {
+	switch s.typ {
+	case msl.Bool:
+		return fmt.Sprintf("%t (%s)", s.bits != 0, s.typ)
+	case msl.Float, msl.Half:
+		return fmt.Sprintf("%v (%s)", s.float32(), s.typ)
+	case msl.Int, msl.Short:
+		return fmt.Sprintf("%d (%s)", s.int64(), s.typ)
+	default:
+		return fmt.Sprintf("%d (%s)", s.bits, s.typ)
+	}
+}
+
+// valid reports whether s was made by one of the constructors.
+func (s Scalar) valid() bool {
+	return s.typ != msl.Void
+}
+
+// bytes returns the scalar's encoding in the kernel's argument: its Size bytes in little-endian
+// order.
+func (s Scalar) bytes() []byte {
+	b := binary.LittleEndian.AppendUint32(nil, s.bits)
+	return b[:s.Size()]
+}
+
+// int64 returns the value of an integer scalar, sign-extended if its type is signed.
+func (s Scalar) int64() int64 {
+	switch s.typ {
+	case msl.Int:
+		return int64(int32(s.bits))
+	case msl.Short:
+		return int64(int16(s.bits))
+	default:
+		return int64(s.bits)
+	}
+}
+
+// float32 returns the value of the scalar as a float32, which is how CPU kernels written in Go
+// receive it. Integers with a magnitude above 2^24 are rounded.
+func (s Scalar) float32() float32 {
+	switch s.typ {
+	case msl.Float:
+		return math.Float32frombits(s.bits)
+	case msl.Half:
+		return msl.Float32FromHalf(uint16(s.bits))
+	default:
+		return float32(s.int64())
+	}
+}
@@ -0,0 +1,45 @@
+package metal
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test_Scalar tests that each scalar constructor encodes its value with the width and encoding of
+// its Metal type.
+func Test_Scalar(t *testing.T) {
+	type subtest struct {
+		name   string
+		scalar Scalar
+		typ    string
+		bytes  []byte
+		str    string
+		value  float32
+	}
+
+	subtests := []subtest{
+		{name: "int32", scalar: Int32(-2), typ: "int", bytes: []byte{0xfe, 0xff, 0xff, 0xff}, str: "-2 (int)", value: -2},
+		{name: "uint32", scalar: Uint32(5), typ: "uint", bytes: []byte{5, 0, 0, 0}, str: "5 (uint)", value: 5},
+		{name: "float32", scalar: Float32(1), typ: "float", bytes: []byte{0, 0, 0x80, 0x3f}, str: "1 (float)", value: 1},
+		{name: "int16", scalar: Int16(-2), typ: "short", bytes: []byte{0xfe, 0xff}, str: "-2 (short)", value: -2},
+		{name: "uint16", scalar: Uint16(0xabcd), typ: "ushort", bytes: []byte{0xcd, 0xab}, str: "43981 (ushort)", value: 0xabcd},
+		{name: "half", scalar: Half(-1.5), typ: "half", bytes: []byte{0x00, 0xbe}, str: "-1.5 (half)", value: -1.5},
+		{name: "half rounded", scalar: Half(0.1), typ: "half", bytes: []byte{0x66, 0x2e}, str: "0.099975586 (half)", value: 0.099975586},
+		{name: "half overflow", scalar: Half(1e6), typ: "half", bytes: []byte{0x00, 0x7c}, str: "+Inf (half)", value: float32(math.Inf(1))},
+	}
+
+	for _, subtest := range subtests {
+		t.Run(subtest.name, func(t *testing.T) {
+			require.True(t, subtest.scalar.valid())
+			require.Equal(t, subtest.typ, subtest.scalar.Type())
+			require.Equal(t, len(subtest.bytes), subtest.scalar.Size())
+			require.Equal(t, subtest.bytes, subtest.scalar.bytes())
+			require.Equal(t, subtest.str, subtest.scalar.String())
+			require.Equal(t, subtest.value, subtest.scalar.float32())
+		})
+	}
+
+	require.False(t, Scalar{}.valid())
+}
@@ -0,0 +1,22 @@
+package metal
+
+import (
+	_ "embed"
+)
+
+// The test shaders are shared by the tests for every backend, so they are embedded in a file with
+// no build constraint.
+var (
+	//go:embed test/noop.metal
+	sourceNoop string
+	//go:embed test/transfer1D.metal
+	sourceTransfer1D string
+	//go:embed test/transfer2D.metal
+	sourceTransfer2D string
+	//go:embed test/transfer3D.metal
+	sourceTransfer3D string
+	//go:embed test/sine.metal
+	sourceSine string
+	//go:embed test/transferType.metal
+	sourceTransferType string
+)